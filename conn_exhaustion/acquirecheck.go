@@ -0,0 +1,175 @@
+// Acquire-time connection validation and a scenario comparing its cost and benefit.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// acquireChecks are the validations run when database/sql hands out an idle
+// connection again (on top of pgx's own ping after a second idle):
+//   - none: no extra check
+//   - ping: pgx Ping, an empty "-- ping" statement
+//   - select1: SELECT 1
+//   - txprobe: reject connections inside a transaction, then BEGIN; SELECT 1; ROLLBACK
+var acquireChecks = []string{"none", "ping", "select1", "txprobe"}
+
+// acquireCheck applies to pools opened with openDB
+var acquireCheck = "none"
+
+// validateOnAcquire is the stdlib ResetSession hook. Returning ErrBadConn makes
+// database/sql discard the connection and check out another one; closing a
+// poisoned connection also rolls its transaction back on the server. The
+// session reset runs after a successful check.
+func validateOnAcquire(ctx context.Context, conn *pgx.Conn) error {
+	var err error
+	switch acquireCheck {
+	case "ping":
+		err = conn.Ping(ctx)
+	case "select1":
+		_, err = conn.Exec(ctx, "SELECT 1")
+	case "txprobe":
+		if conn.PgConn().TxStatus() != 'I' {
+			return driver.ErrBadConn
+		}
+		err = conn.PgConn().Exec(ctx, "BEGIN; SELECT 1; ROLLBACK").Close()
+	}
+	if err != nil {
+		return driver.ErrBadConn
+	}
+	return resetSession(ctx, conn)
+}
+
+type acquireResult struct {
+	p50, p95   time.Duration
+	deadErrors int // statement errors after the idle sessions were terminated
+	inherited  int // statements which ran inside the poisoned transaction
+}
+
+const acquireProbes = 10
+
+func init() {
+	registerScenario("acquirecompare", scenario{
+		standalone: func(o *options) bool { return runAcquireCompare(o.connStr, o.acquireIterations) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 10 + 1 },
+	})
+}
+
+// runAcquireCompare measures, for each strategy, the checkout+SELECT 1 latency
+// on a warm pool and how many of the following statements hit a fault:
+//   - dead: every idle pooled session is terminated on the server
+//   - poisoned: one connection goes back to the pool inside a transaction
+func runAcquireCompare(connStr string, iterations int) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_acquire")
+	setup.Exec("CREATE TABLE test_acquire (id INT PRIMARY KEY, val INT)")
+	setup.Exec("INSERT INTO test_acquire VALUES (1, 0)")
+
+	saved := acquireCheck
+	defer func() { acquireCheck = saved }()
+
+	results := map[string]acquireResult{}
+	for _, strategy := range acquireChecks {
+		acquireCheck = strategy
+		fmt.Fprintf(os.Stderr, "[%s] ACQUIRE_COMPARE: %s\n", time.Now().Format("04:05"), strategy)
+		r, err := acquireOnce(connStr, setup, strategy, iterations)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", strategy, err)
+			return false
+		}
+		results[strategy] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> ACQUIRE CHECK REPORT")
+	fmt.Printf("%-8s %10s %10s %10s %12s %14s\n", "Check", "p50", "p95", "Tax(p50)", "DeadErrors", "RanInPoisonTx")
+	base := results["none"].p50
+	for _, strategy := range acquireChecks {
+		r := results[strategy]
+		fmt.Printf("%-8s %10s %10s %10s %9d/%d %11d/%d\n", strategy, ms(r.p50), ms(r.p95), ms(r.p50-base),
+			r.deadErrors, acquireProbes, r.inherited, acquireProbes)
+	}
+	return true
+}
+
+func acquireOnce(connStr string, setup *sql.DB, strategy string, iterations int) (acquireResult, error) {
+	var r acquireResult
+	appName := "pg-idle-test-acquire-" + strategy
+	db, err := openDB(connStr, appName)
+	if err != nil {
+		return r, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+	ctx := context.Background()
+
+	// Latency tax: sequential checkouts of a warm connection
+	var one int
+	latencies := make([]time.Duration, 0, iterations)
+	for i := 0; i < iterations; i++ {
+		start := time.Now()
+		if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+			return r, err
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.p50, r.p95 = percentile(latencies, 0.5), percentile(latencies, 0.95)
+
+	// Dead connections: fill the pool, terminate every session while idle and
+	// probe again before pgx's own one-second idle ping would kick in
+	fillPool(ctx, db, acquireProbes)
+	setup.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE application_name = $1", appName)
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < acquireProbes; i++ {
+		if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+			r.deadErrors++
+		}
+	}
+
+	// Poisoned connection: one idle connection holds an open transaction
+	fillPool(ctx, db, acquireProbes)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return r, err
+	}
+	conn.ExecContext(ctx, "BEGIN")
+	conn.ExecContext(ctx, "UPDATE test_acquire SET val = val + 1 WHERE id = 1")
+	conn.Close()
+	for i := 0; i < acquireProbes; i++ {
+		// now() is the transaction start, so it only differs from the
+		// statement start inside a transaction begun earlier
+		var inTx bool
+		if err := db.QueryRowContext(ctx, "SELECT now() <> statement_timestamp()").Scan(&inTx); err == nil && inTx {
+			r.inherited++
+		}
+	}
+	return r, nil
+}
+
+// fillPool opens n connections and returns them to the pool idle
+func fillPool(ctx context.Context, db *sql.DB, n int) {
+	var conns []*sql.Conn
+	for i := 0; i < n; i++ {
+		if conn, err := db.Conn(ctx); err == nil {
+			conn.PingContext(ctx)
+			conns = append(conns, conn)
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
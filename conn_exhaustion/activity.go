@@ -0,0 +1,133 @@
+// Sampling of pg_stat_activity once a second, to set the server's view of
+// the sessions next to the client's POOL_STATS.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// activitySample is one poll of the client backends of the current database,
+// every client's and not only this process's
+type activitySample struct {
+	active, idle, idleInTx, idleInTxAborted int
+	oldestXact                              time.Duration // longest open transaction
+	longestLockWait                         time.Duration // longest statement waiting for a lock
+}
+
+// activityPeak is the worst of the samples taken during one phase
+type activityPeak struct {
+	phase   string
+	samples int
+	max     activitySample
+}
+
+type activitySampler struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	peaks []*activityPeak
+}
+
+// activity is nil unless -activity-stats was given
+var activity *activitySampler
+
+// newActivitySampler opens the sampler's own connection, so it keeps
+// sampling while the worker pool is exhausted
+func newActivitySampler(connStr string) (*activitySampler, error) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &activitySampler{db: db}, nil
+}
+
+// run samples every second, or every monitorTick with -low-overhead, until
+// the process exits
+func (a *activitySampler) run() {
+	ticker := time.NewTicker(monitorTick())
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		s, err := a.sample()
+		selfOverhead.since("activity sampler", start, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: pg_stat_activity sample failed: %v\n", err)
+			continue
+		}
+		if jsonOutput() {
+			emitJSON("activity_stats", map[string]any{
+				"active": s.active, "idle": s.idle, "idle_in_transaction": s.idleInTx, "idle_in_transaction_aborted": s.idleInTxAborted,
+				"oldest_xact_s": s.oldestXact.Seconds(), "longest_lock_wait_s": s.longestLockWait.Seconds(),
+			})
+		} else {
+			fmt.Fprintf(os.Stderr, "[%s] ACTIVITY: Active=%d Idle=%d IdleInTx=%d IdleInTxAborted=%d OldestXact=%.1fs LongestLockWait=%.1fs\n",
+				time.Now().Format("04:05"), s.active, s.idle, s.idleInTx, s.idleInTxAborted, s.oldestXact.Seconds(), s.longestLockWait.Seconds())
+		}
+		a.observe(s)
+	}
+}
+
+func (a *activitySampler) sample() (activitySample, error) {
+	var s activitySample
+	var oldestXact, lockWait float64
+	err := a.db.QueryRow(`
+		SELECT count(*) FILTER (WHERE state = 'active'),
+		       count(*) FILTER (WHERE state = 'idle'),
+		       count(*) FILTER (WHERE state = 'idle in transaction'),
+		       count(*) FILTER (WHERE state = 'idle in transaction (aborted)'),
+		       coalesce(extract(epoch FROM max(now() - xact_start)), 0),
+		       coalesce(extract(epoch FROM max(now() - state_change) FILTER (WHERE state = 'active' AND wait_event_type = 'Lock')), 0)
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND backend_type = 'client backend' AND pid <> pg_backend_pid()
+		  AND application_name <> $1`, controlAppName).
+		Scan(&s.active, &s.idle, &s.idleInTx, &s.idleInTxAborted, &oldestXact, &lockWait)
+	s.oldestXact = time.Duration(oldestXact * float64(time.Second))
+	s.longestLockWait = time.Duration(lockWait * float64(time.Second))
+	return s, err
+}
+
+// observe folds a sample into the peak of the current phase
+func (a *activitySampler) observe(s activitySample) {
+	p := currentPhase.Load()
+	if p == nil || p.name == "" {
+		return // before the warmup or after the phase report
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.peaks) == 0 || a.peaks[len(a.peaks)-1].phase != p.name {
+		a.peaks = append(a.peaks, &activityPeak{phase: p.name})
+	}
+	peak := a.peaks[len(a.peaks)-1]
+	peak.samples++
+	peak.max.active = max(peak.max.active, s.active)
+	peak.max.idle = max(peak.max.idle, s.idle)
+	peak.max.idleInTx = max(peak.max.idleInTx, s.idleInTx)
+	peak.max.idleInTxAborted = max(peak.max.idleInTxAborted, s.idleInTxAborted)
+	peak.max.oldestXact = max(peak.max.oldestXact, s.oldestXact)
+	peak.max.longestLockWait = max(peak.max.longestLockWait, s.longestLockWait)
+}
+
+// print reports the peaks per phase, to read against the phase report
+func (a *activitySampler) print() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Println()
+	fmt.Println(">>> SERVER ACTIVITY (peak per phase, all client backends of the database)")
+	fmt.Printf("%-24s %7s %7s %7s %9s %13s %11s %10s\n", "Phase", "Samples", "Active", "Idle", "IdleInTx", "TxAborted", "OldestXact", "LockWait")
+	for _, p := range a.peaks {
+		fmt.Printf("%-24s %7d %7d %7d %9d %13d %10.1fs %9.1fs\n", p.phase, p.samples, p.max.active, p.max.idle,
+			p.max.idleInTx, p.max.idleInTxAborted, p.max.oldestXact.Seconds(), p.max.longestLockWait.Seconds())
+	}
+}
@@ -0,0 +1,243 @@
+// Adaptive query timeouts derived from observed latency and a scenario
+// comparing them with a fixed deadline.
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	adaptiveWindow     = 1000 // committed iterations the percentile is taken over
+	adaptiveMinSamples = 100  // below this the fixed deadline applies
+	adaptiveRecompute  = 50   // observations between percentile updates
+	adaptiveMultiplier = 3
+	adaptiveFloor      = 50 * time.Millisecond
+	adaptiveCeiling    = 30 * time.Second
+)
+
+// adaptiveTimeout derives deadlines from the rolling p99 of committed
+// iterations times adaptiveMultiplier. Only successes are observed, so a
+// stall cannot raise the deadline it is measured against.
+type adaptiveTimeout struct {
+	mu      sync.Mutex
+	window  []time.Duration
+	next    int
+	pending int
+	current time.Duration
+}
+
+// queryDeadlines is the controller of the worker pool, nil without
+// -adaptive-timeout
+var queryDeadlines *adaptiveTimeout
+
+func newAdaptiveTimeout(fixed time.Duration) *adaptiveTimeout {
+	return &adaptiveTimeout{current: fixed}
+}
+
+// timeout returns the deadline for the next iteration. A nil controller
+// returns the fixed deadline.
+func (a *adaptiveTimeout) timeout(fixed time.Duration) time.Duration {
+	if a == nil {
+		return fixed
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current
+}
+
+// observe records the latency of a committed iteration
+func (a *adaptiveTimeout) observe(d time.Duration, err error) {
+	if a == nil || err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.window) < adaptiveWindow {
+		a.window = append(a.window, d)
+	} else {
+		a.window[a.next] = d
+		a.next = (a.next + 1) % adaptiveWindow
+	}
+	if a.pending++; a.pending < adaptiveRecompute || len(a.window) < adaptiveMinSamples {
+		return
+	}
+	a.pending = 0
+	sorted := append([]time.Duration(nil), a.window...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	a.current = min(max(percentile(sorted, 0.99)*adaptiveMultiplier, adaptiveFloor), adaptiveCeiling)
+}
+
+// timeoutPhases are the load the comparison offers, in order:
+//   - normal: mostly 20-60ms, 1% up to 450ms, all inside the 500ms default
+//   - degraded: the same queries three times slower, as on a busy but healthy
+//     server, so 1% legitimately take up to 1.35s
+//   - hung: normal latency, but 5% of the queries never finish on their own
+var timeoutPhases = []string{"normal", "degraded", "hung"}
+
+const (
+	timeoutPhaseLength = 10 * time.Second
+	timeoutHung        = 30 * time.Second // planned duration of a hung query
+)
+
+// plannedLatency draws how long a query of the phase would take uncanceled
+func plannedLatency(phase string) time.Duration {
+	var d time.Duration
+	switch r := rand.Float64(); {
+	case r < 0.90:
+		d = time.Duration(20+rand.Intn(40)) * time.Millisecond
+	case r < 0.99:
+		d = time.Duration(100+rand.Intn(200)) * time.Millisecond
+	default:
+		d = time.Duration(300+rand.Intn(150)) * time.Millisecond
+	}
+	switch {
+	case phase == "degraded":
+		d *= 3
+	case phase == "hung" && rand.Float64() < 0.05:
+		d = timeoutHung
+	}
+	return d
+}
+
+type timeoutPhaseResult struct {
+	ok             int64
+	falsePositives int64         // canceled queries which would have finished
+	truePositives  int64         // canceled hung queries
+	wasted         time.Duration // server time spent on false positives before the cancel
+	hungHeld       time.Duration // total time hung queries held a connection
+	deadline       time.Duration // at the end of the phase
+}
+
+func init() {
+	registerScenario("timeoutcompare", scenario{
+		standalone: func(o *options) bool { return runTimeoutCompare(o.connStr, o.maxOpen, o.queryTimeout) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = o.maxOpen + 1 },
+	})
+}
+
+// runTimeoutCompare offers the same load to workers using the fixed
+// -query-timeout and to workers using the adaptive controller. It passes if
+// the adaptive deadline canceled no more queries which would have finished.
+func runTimeoutCompare(connStr string, workers int, fixed time.Duration) bool {
+	policies := []string{"fixed", "adaptive"}
+	results := map[string][]timeoutPhaseResult{}
+	for _, policy := range policies {
+		fmt.Printf(">>> TIMEOUT COMPARE: %s, %d workers\n", policy, workers)
+		var controller *adaptiveTimeout
+		if policy == "adaptive" {
+			controller = newAdaptiveTimeout(fixed)
+		}
+		r, err := timeoutCompareOnce(connStr, policy, workers, fixed, controller)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", policy, err)
+			return false
+		}
+		results[policy] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> TIMEOUT COMPARISON (fixed %v, adaptive p99 x %d)\n", fixed, adaptiveMultiplier)
+	fmt.Printf("%-9s %-9s %8s %9s %9s %9s %10s %10s\n", "Policy", "Phase", "OK", "FalsePos", "TruePos", "Wasted", "HungHeld", "Deadline")
+	var falsePositives = map[string]int64{}
+	for _, policy := range policies {
+		for i, phase := range timeoutPhases {
+			r := results[policy][i]
+			falsePositives[policy] += r.falsePositives
+			held := "-"
+			if r.truePositives > 0 {
+				held = ms(r.hungHeld / time.Duration(r.truePositives))
+			}
+			fmt.Printf("%-9s %-9s %8d %9d %9d %8.1fs %10s %10s\n", policy, phase, r.ok, r.falsePositives, r.truePositives,
+				r.wasted.Seconds(), held, ms(r.deadline))
+		}
+	}
+	fmt.Println()
+	fmt.Println("FalsePos are cancellations of queries which would have finished, Wasted the server time they had used;")
+	fmt.Println("HungHeld is how long a hung query held its connection on average before the deadline caught it.")
+	if falsePositives["adaptive"] > falsePositives["fixed"] {
+		fmt.Println("FAIL: the adaptive deadline canceled more queries which would have finished")
+		return false
+	}
+	fmt.Println("PASS: the adaptive deadline canceled no more queries which would have finished")
+	return true
+}
+
+func timeoutCompareOnce(connStr, policy string, workers int, fixed time.Duration, controller *adaptiveTimeout) ([]timeoutPhaseResult, error) {
+	db, err := openDB(connStr, "pg-idle-test-timeout-"+policy)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(workers)
+	db.SetMaxIdleConns(workers)
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	results := make([]timeoutPhaseResult, len(timeoutPhases))
+	var phaseIndex atomic.Int32
+	var mu sync.Mutex
+	var stopping atomic.Bool
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopping.Load() {
+				idx := phaseIndex.Load()
+				planned := plannedLatency(timeoutPhases[idx])
+				ctx, cancel := context.WithTimeout(context.Background(), controller.timeout(fixed))
+				start := time.Now()
+				_, err := db.ExecContext(ctx, "SELECT pg_sleep($1)", planned.Seconds())
+				elapsed := time.Since(start)
+				cancel()
+				controller.observe(elapsed, err)
+				mu.Lock()
+				r := &results[idx]
+				switch {
+				case err == nil:
+					r.ok++
+				case planned == timeoutHung:
+					r.truePositives++
+					r.hungHeld += elapsed
+				case errorsIsTimeout(err):
+					r.falsePositives++
+					r.wasted += elapsed
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i, phase := range timeoutPhases {
+		phaseIndex.Store(int32(i))
+		for start := time.Now(); time.Since(start) < timeoutPhaseLength; {
+			time.Sleep(1 * time.Second)
+			mu.Lock()
+			r := results[i]
+			mu.Unlock()
+			fmt.Fprintf(os.Stderr, "[%s] TIMEOUT_COMPARE: %s %s deadline=%s ok=%d false_pos=%d true_pos=%d\n",
+				time.Now().Format("04:05"), policy, phase, ms(controller.timeout(fixed)), r.ok, r.falsePositives, r.truePositives)
+		}
+		mu.Lock()
+		results[i].deadline = controller.timeout(fixed)
+		mu.Unlock()
+	}
+	stopping.Store(true)
+	wg.Wait()
+	return results, nil
+}
+
+// errorsIsTimeout reports whether err is the deadline rather than a failure
+// of the query itself
+func errorsIsTimeout(err error) bool {
+	class := classifyError(err)
+	return class == "cancel" || class == "pool_wait_timeout"
+}
@@ -0,0 +1,149 @@
+// Admission control: a weighted semaphore bounding concurrent workload
+// iterations above the database/sql pool.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// errAdmissionTimeout is returned when an iteration's context expires while
+// it waits at the admission semaphore, before it reached the pool
+var errAdmissionTimeout = errors.New("admission: context expired waiting for the semaphore")
+
+// admissionGate admits work by weight. Unlike database/sql, which hands a
+// returned connection to an arbitrary waiter, the semaphore admits waiters
+// in arrival order.
+type admissionGate struct {
+	limit int64
+	sem   *semaphore.Weighted
+}
+
+// admission is the gate in front of the worker pool, nil without -admission
+var admission *admissionGate
+
+func newAdmissionGate(limit int64) *admissionGate {
+	return &admissionGate{limit: limit, sem: semaphore.NewWeighted(limit)}
+}
+
+// admissionPhase is what the gate saw during one phase
+type admissionPhase struct {
+	waits     []time.Duration // of admitted iterations
+	timeouts  int
+	perWorker map[int]int // committed iterations
+}
+
+var (
+	admissionMu     sync.Mutex
+	admissionPhases = map[*phaseMetrics]*admissionPhase{}
+)
+
+func currentAdmissionPhase() *admissionPhase {
+	p := currentPhase.Load()
+	if p == nil {
+		return nil
+	}
+	a := admissionPhases[p]
+	if a == nil {
+		a = &admissionPhase{perWorker: map[int]int{}}
+		admissionPhases[p] = a
+	}
+	return a
+}
+
+// acquire waits until weight units are free and returns the function
+// releasing them. A nil gate admits everything at once.
+func (g *admissionGate) acquire(ctx context.Context, weight int64) (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	if err := g.sem.Acquire(ctx, weight); err != nil {
+		admissionMu.Lock()
+		if a := currentAdmissionPhase(); a != nil {
+			a.timeouts++
+		}
+		admissionMu.Unlock()
+		return nil, fmt.Errorf("%w after %v", errAdmissionTimeout, time.Since(start).Round(time.Millisecond))
+	}
+	admissionMu.Lock()
+	if a := currentAdmissionPhase(); a != nil {
+		a.waits = append(a.waits, time.Since(start))
+	}
+	admissionMu.Unlock()
+	return func() { g.sem.Release(weight) }, nil
+}
+
+// recordWorkerIteration counts a worker's committed iterations for the
+// fairness columns, with or without a gate
+func recordWorkerIteration(worker int, err error) {
+	if err != nil {
+		return
+	}
+	admissionMu.Lock()
+	defer admissionMu.Unlock()
+	if a := currentAdmissionPhase(); a != nil {
+		a.perWorker[worker]++
+	}
+}
+
+// jainIndex is Jain's fairness index of the workers' shares: 1 when every
+// worker got the same, 1/n when one worker got everything
+func jainIndex(counts map[int]int, workers int) float64 {
+	var sum, squares float64
+	for _, n := range counts {
+		sum += float64(n)
+		squares += float64(n) * float64(n)
+	}
+	if squares == 0 {
+		return 0
+	}
+	return sum * sum / (float64(workers) * squares)
+}
+
+// printAdmissionReport prints admission waits and fairness per phase; the
+// phases must have been closed by printPhaseReport
+func printAdmissionReport(workers, poolSize int) {
+	admissionMu.Lock()
+	defer admissionMu.Unlock()
+	fmt.Println()
+	if admission == nil {
+		fmt.Println(">>> ADMISSION REPORT (no -admission, the pool alone bounds concurrency)")
+	} else {
+		fmt.Printf(">>> ADMISSION REPORT (-admission=%d above a pool of %d)\n", admission.limit, poolSize)
+	}
+	fmt.Printf("%-40s %9s %10s %10s %10s %10s %8s %8s %8s\n", "Phase", "Timeouts", "Wait p50", "Wait p95", "Wait p99", "Wait max", "Starved", "Jain", "Max/Min")
+	for _, p := range phaseHistory[:len(phaseHistory)-1] {
+		a := admissionPhases[p]
+		if a == nil {
+			a = &admissionPhase{perWorker: map[int]int{}}
+		}
+		sorted := append([]time.Duration(nil), a.waits...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		minShare, maxShare := -1, 0
+		for w := 0; w < workers; w++ {
+			n := a.perWorker[w]
+			maxShare = max(maxShare, n)
+			if minShare < 0 || n < minShare {
+				minShare = n
+			}
+		}
+		ratio := "-"
+		if minShare > 0 {
+			ratio = fmt.Sprintf("%.1f", float64(maxShare)/float64(minShare))
+		}
+		waits := []string{"-", "-", "-", "-"}
+		if len(sorted) > 0 {
+			waits = []string{ms(percentile(sorted, 0.5)), ms(percentile(sorted, 0.95)), ms(percentile(sorted, 0.99)), ms(percentile(sorted, 1))}
+		}
+		fmt.Printf("%-40s %9d %10s %10s %10s %10s %8d %8.2f %8s\n", p.name, a.timeouts, waits[0], waits[1], waits[2], waits[3],
+			workers-len(a.perWorker), jainIndex(a.perWorker, workers), ratio)
+	}
+	fmt.Println("Starved workers committed nothing in the phase; Jain is 1.00 when every worker committed equally.")
+}
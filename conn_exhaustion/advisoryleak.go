@@ -0,0 +1,62 @@
+// Scenario: a session-level advisory lock taken on a pooled connection and
+// never released, the poisoning which needs no open transaction.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// advisoryLeakKey is the advisory lock the scenario leaks
+const advisoryLeakKey = 4243
+
+func init() {
+	registerScenario("advisoryleak", scenario{
+		inject: runAdvisoryLeak,
+		validate: func(o *options) error {
+			if o.poisonAudit == 0 {
+				o.poisonAudit = 2 * time.Second
+			}
+			return nil
+		},
+	})
+}
+
+// runAdvisoryLeak takes the lock with pg_advisory_lock on a pooled
+// connection and puts the connection back, then checks from outside the pool
+// at the end of the hold whether the key is still taken
+func runAdvisoryLeak(h *harness) bool {
+	ctx := context.Background()
+	fmt.Println()
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to check out a connection: %v\n", err)
+		return false
+	}
+	var pid int
+	conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", advisoryLeakKey); err != nil {
+		conn.Close()
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to take advisory lock %d: %v\n", advisoryLeakKey, err)
+		return false
+	}
+	conn.Close()
+	fmt.Printf(">>> ADVISORY LEAK: PID %d took session advisory lock %d, connection returned to the pool without unlocking\n", pid, advisoryLeakKey)
+	recordEvent("session advisory lock %d taken by PID %d, connection returned to the pool", advisoryLeakKey, pid)
+	startPhase("advisory leak")
+	phaseCtl.await("stop", h.o.hold)
+
+	var holder *int
+	err = statsDB.QueryRow("SELECT (SELECT pid FROM pg_locks WHERE locktype = 'advisory' AND granted AND objsubid = 1 AND objid = $1 LIMIT 1)", advisoryLeakKey).Scan(&holder)
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to look up advisory lock %d: %v\n", advisoryLeakKey, err)
+	case holder != nil:
+		fmt.Printf(">>> ADVISORY LEAK: lock %d still held by PID %d after %v, on a connection the pool hands out\n", advisoryLeakKey, *holder, h.o.hold)
+	default:
+		fmt.Printf(">>> ADVISORY LEAK: lock %d released within %v (session reset %s)\n", advisoryLeakKey, h.o.hold, sessionReset)
+	}
+	return true
+}
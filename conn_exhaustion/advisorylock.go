@@ -0,0 +1,257 @@
+// Scenario: workers serialized by a session-level advisory lock instead of a
+// row lock, while a pooled connection holds the lock, taken with
+// pg_try_advisory_lock polling and with a blocking pg_advisory_lock.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	advisoryLockKey      = 4244
+	advisoryLockBaseline = 5 * time.Second  // before the poison and after its session is terminated
+	advisoryLockBlock    = 20 * time.Second // the poisoned connection holds the lock this long
+)
+
+// errAdvisoryBusy ends a pg_try_advisory_lock loop which never got the lock
+var errAdvisoryBusy = errors.New("advisory lock still taken at the deadline")
+
+type advisoryLockResult struct {
+	acquired, failed int64
+	classes          map[string]int64
+	tries            int64 // pg_try_advisory_lock calls which returned false
+	reentrant        int64 // acquisitions on the poisoned session while it held the lock
+	unlockFailed     int64 // acquisitions whose pg_advisory_unlock failed
+	connects         int64 // connections opened after the warm-up
+	recovery         time.Duration
+	leaked           []int32 // pooled sessions holding the key once the workers stopped
+}
+
+func init() {
+	registerScenario("advisorylock", scenario{
+		standalone: func(o *options) bool { return runAdvisoryLock(o.connStr, o.workers, o.maxOpen, o.queryTimeout) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = o.maxOpen + 1 }, // pool and setup
+	})
+}
+
+// runAdvisoryLock runs workers which take advisory lock 4244 around a short
+// critical section twice, once polling pg_try_advisory_lock and once waiting
+// in pg_advisory_lock, each bounded by a context deadline of timeout. In
+// both runs a pooled connection takes the lock after the baseline and goes
+// back to the pool holding it until its session is terminated. It passes if
+// both runs recovered and no pooled session still held the key at the end.
+func runAdvisoryLock(connStr string, workers, maxOpen int, timeout time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+
+	configs := []string{"try", "blocking"}
+	results := map[string]advisoryLockResult{}
+	for _, config := range configs {
+		fmt.Printf(">>> ADVISORY LOCK: %s, %d workers on %d connections, %v (session reset %s)\n", config, workers, maxOpen, timeout, sessionReset)
+		r, err := advisoryLockOnce(connStr, setup, config == "try", workers, maxOpen, timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", config, err)
+			return false
+		}
+		results[config] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> ADVISORY LOCK COMPARISON (lock %d held for %v by a pooled connection)\n", advisoryLockKey, advisoryLockBlock)
+	fmt.Printf("%-9s %9s %8s %10s %10s %14s %9s %10s %7s   %s\n", "Lock", "Acquired", "Failed", "Busy tries", "Reentrant", "Unlock failed", "Connects", "Recovery", "Leaked", "Errors")
+	pass := true
+	for _, config := range configs {
+		r := results[config]
+		var classes []string
+		for class, n := range r.classes {
+			classes = append(classes, fmt.Sprintf("%s=%d", class, n))
+		}
+		sort.Strings(classes)
+		recovery := "never"
+		if r.recovery > 0 {
+			recovery = ms(r.recovery)
+		} else {
+			pass = false
+		}
+		if len(r.leaked) > 0 {
+			pass = false
+		}
+		fmt.Printf("%-9s %9d %8d %10d %10d %14d %9d %10s %7d   %s\n", config, r.acquired, r.failed, r.tries, r.reentrant, r.unlockFailed,
+			r.connects, recovery, len(r.leaked), strings.Join(classes, " "))
+	}
+	fmt.Println()
+	fmt.Println("Advisory locks are reentrant per session: a worker handed the poisoned connection gets the lock at once")
+	fmt.Println("(Reentrant) and its unlock only drops one level, so the lock stays with the connection. A deadline which")
+	fmt.Println("cancels pg_advisory_lock makes pgx close the connection, while one which expires between the lock and the")
+	fmt.Println("unlock fails the unlock before it is sent and puts the connection back in the pool still holding the lock")
+	fmt.Println("(Unlock failed, Leaked). Recovery is from the poisoned session's termination to the next acquisition.")
+	for _, config := range configs {
+		for _, pid := range results[config].leaked {
+			fmt.Printf("  %s: pooled connection pid=%d still held lock %d after the workers stopped\n", config, pid, advisoryLockKey)
+		}
+	}
+	if !pass {
+		fmt.Println(">>> ADVISORY LOCK: FAIL the lock outlived the poisoned session")
+		return false
+	}
+	fmt.Println(">>> ADVISORY LOCK: PASS every run recovered once the poisoned session was terminated")
+	return true
+}
+
+func advisoryLockOnce(connStr string, setup *sql.DB, try bool, workers, maxOpen int, timeout time.Duration) (advisoryLockResult, error) {
+	r := advisoryLockResult{classes: map[string]int64{}}
+	appName := "pg-idle-test-advisorylock-blocking"
+	if try {
+		appName = "pg-idle-test-advisorylock-try"
+	}
+	db, err := openDB(connStr, appName)
+	if err != nil {
+		return r, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxOpen)
+	if err := db.Ping(); err != nil {
+		return r, err
+	}
+
+	var measuring, stopping atomic.Bool
+	var poisonPID atomic.Int32
+	var released atomic.Int64 // UnixNano of the poisoned session's termination
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopping.Load() {
+				pid, busy, locked, err := advisoryLockIteration(db, try, timeout)
+				if measuring.Load() {
+					mu.Lock()
+					r.tries += int64(busy)
+					switch {
+					case err == nil:
+						r.acquired++
+						if pid == poisonPID.Load() {
+							r.reentrant++
+						}
+						if at := released.Load(); at != 0 && r.recovery == 0 {
+							r.recovery = time.Since(time.Unix(0, at))
+						}
+					case locked:
+						r.unlockFailed++
+						r.failed++
+						r.classes["unlock_"+classifyError(err)]++
+					case errors.Is(err, errAdvisoryBusy):
+						r.failed++
+						r.classes["busy"]++
+					default:
+						r.failed++
+						r.classes[classifyError(err)]++
+					}
+					mu.Unlock()
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+	}
+
+	time.Sleep(advisoryLockBaseline) // warm-up: the pool opens its connections
+	connectsBefore := connectsTotal.Load()
+	measuring.Store(true)
+	time.Sleep(advisoryLockBaseline)
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		stopping.Store(true)
+		wg.Wait()
+		return r, err
+	}
+	var pid int32
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid() FROM (SELECT pg_advisory_lock($1)) l", advisoryLockKey).Scan(&pid); err != nil {
+		conn.Close()
+		stopping.Store(true)
+		wg.Wait()
+		return r, err
+	}
+	poisonPID.Store(pid)
+	conn.Close()
+	fmt.Fprintf(os.Stderr, "[%s] ADVISORY_LOCK: PID %d took lock %d and went back to the pool for %v\n", time.Now().Format("04:05"), pid, advisoryLockKey, advisoryLockBlock)
+	time.Sleep(advisoryLockBlock)
+	if _, err := setup.Exec("SELECT pg_terminate_backend($1)", pid); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Unable to terminate PID %d: %v\n", pid, err)
+	}
+	released.Store(time.Now().UnixNano())
+	time.Sleep(advisoryLockBaseline)
+
+	stopping.Store(true)
+	wg.Wait()
+	r.connects = connectsTotal.Load() - connectsBefore
+
+	rows, err := setup.Query(`
+		SELECT l.pid FROM pg_locks l JOIN pg_stat_activity a USING (pid)
+		WHERE l.locktype = 'advisory' AND l.granted AND l.objsubid = 1 AND l.objid = $1 AND a.application_name = $2`, advisoryLockKey, appName)
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pid int32
+		if rows.Scan(&pid) == nil {
+			r.leaked = append(r.leaked, pid)
+		}
+	}
+	return r, rows.Err()
+}
+
+// advisoryLockIteration takes the lock on one checked-out connection, holds
+// it 5ms and unlocks it with the same deadline, as application code would.
+// It returns the session's PID, the pg_try_advisory_lock calls which found
+// the lock taken, and whether the error came after the lock was granted.
+func advisoryLockIteration(db *sql.DB, try bool, timeout time.Duration) (pid int32, busy int, locked bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer conn.Close()
+	if try {
+		for {
+			var got bool
+			if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1), pg_backend_pid()", advisoryLockKey).Scan(&got, &pid); err != nil {
+				return pid, busy, false, err
+			}
+			if got {
+				break
+			}
+			busy++
+			select {
+			case <-ctx.Done():
+				return pid, busy, false, errAdvisoryBusy
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	} else if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid() FROM (SELECT pg_advisory_lock($1)) l", advisoryLockKey).Scan(&pid); err != nil {
+		return pid, 0, false, err
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", advisoryLockKey); err != nil {
+		return pid, busy, true, err
+	}
+	return pid, busy, false, nil
+}
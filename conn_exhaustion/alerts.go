@@ -0,0 +1,178 @@
+// Alerting rules generated from a run: for each failure mode the run
+// observed, a Prometheus rule and the same check as a pg_stat_activity query,
+// with a threshold between the healthy warmup and what the fault produced.
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// alertRule is one generated rule; checkSQL is the query a SQL-based monitor
+// would run for the same condition, returning rows when it fires
+type alertRule struct {
+	name, expr, forDuration string
+	summary, observed       string
+	checkSQL                string
+}
+
+// alertThreshold picks a threshold above twice the healthy value and floor,
+// and below the worst value seen under the fault so the rule would have fired
+func alertThreshold(healthy, worst, floor float64) float64 {
+	t := max(2*healthy, floor)
+	if t >= worst {
+		t = worst / 2
+	}
+	if t >= 1 {
+		return math.Floor(t)
+	}
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(t, 'g', 2, 64), 64)
+	return v
+}
+
+// isWarmup tells the healthy phases before the fault from the rest
+func isWarmup(phase string) bool { return strings.HasPrefix(phase, "warmup") }
+
+// alertRules derives the rules from the phase report, the activity sampler,
+// the poison audit and the orphan detector. It must be called after
+// printPhaseReport.
+func alertRules(o *options) []alertRule {
+	var rules []alertRule
+
+	// Idle in transaction: the longest a pooled connection sat in an open
+	// transaction against the oldest transaction of the warmup
+	var healthyXact, worstIdle time.Duration
+	if activity != nil {
+		activity.mu.Lock()
+		for _, p := range activity.peaks {
+			if isWarmup(p.phase) {
+				healthyXact = max(healthyXact, p.max.oldestXact)
+			} else if p.max.idleInTx > 0 {
+				worstIdle = max(worstIdle, p.max.oldestXact)
+			}
+		}
+		activity.mu.Unlock()
+	}
+	if poisonAudit != nil {
+		poisonAudit.mu.Lock()
+		for _, p := range poisonAudit.poisoned {
+			if p.class == poisonOpenTx {
+				worstIdle = max(worstIdle, p.lastSeen.Sub(p.firstSeen)+poisonIdleAfter)
+			}
+		}
+		poisonAudit.mu.Unlock()
+	}
+	if worstIdle > 0 {
+		t := alertThreshold(healthyXact.Seconds(), worstIdle.Seconds(), 5)
+		rules = append(rules, alertRule{
+			name:     "PostgresIdleInTransaction",
+			expr:     fmt.Sprintf(`max by (datname) (pg_stat_activity_max_tx_duration{state="idle in transaction"}) > %g`, t),
+			summary:  fmt.Sprintf("A session has been idle inside an open transaction for more than %gs, holding its locks and snapshot", t),
+			observed: fmt.Sprintf("a pooled connection idle in transaction for %.1fs; oldest transaction during the warmup %.1fs", worstIdle.Seconds(), healthyXact.Seconds()),
+			checkSQL: fmt.Sprintf(`SELECT pid, usename, application_name, now() - state_change AS idle_for, left(query, 80) AS last_statement
+FROM pg_stat_activity
+WHERE state LIKE 'idle in transaction%%' AND now() - state_change > interval '%g seconds'`, t),
+		})
+	}
+
+	// Pool wait: seconds spent waiting for a connection per second of the
+	// phase, summed over the workers
+	var healthyWait, worstWait float64
+	worstPhase := ""
+	for _, row := range phaseRows() {
+		if row.secs <= 0 {
+			continue
+		}
+		rate := row.waited.Seconds() / row.secs
+		if isWarmup(row.name) {
+			healthyWait = max(healthyWait, rate)
+		} else if rate > worstWait {
+			worstWait, worstPhase = rate, row.name
+		}
+	}
+	if worstWait >= 0.1 && worstWait > 2*healthyWait {
+		t := alertThreshold(healthyWait, worstWait, 0.05)
+		rules = append(rules, alertRule{
+			name:        "ConnectionPoolWaitGrowing",
+			expr:        fmt.Sprintf("rate(pg_idle_test_pool_wait_duration_seconds_total[1m]) > %g", t),
+			forDuration: "1m",
+			summary:     fmt.Sprintf("Checkouts spend more than %gs per second waiting for a pooled connection; map the metric to the application's own pool", t),
+			observed:    fmt.Sprintf("%.2fs waited per second in phase %s; %.3fs during the warmup", worstWait, worstPhase, healthyWait),
+			checkSQL: fmt.Sprintf(`SELECT application_name, usename, count(*) AS sessions,
+       count(*) FILTER (WHERE state <> 'idle') AS busy
+FROM pg_stat_activity
+WHERE backend_type = 'client backend'
+GROUP BY application_name, usename
+HAVING count(*) FILTER (WHERE state <> 'idle') >= %d`, o.maxOpen),
+		})
+	}
+
+	// Orphaned queries: statements the client gave up on at its query timeout
+	// and which the server kept running
+	if n, _ := orphans.totals(); n > 0 {
+		t := o.queryTimeout.Seconds()
+		rules = append(rules, alertRule{
+			name:     "PostgresStatementOutlivedClient",
+			expr:     fmt.Sprintf(`max by (datname) (pg_stat_activity_max_tx_duration{state="active"}) > %g`, t),
+			summary:  fmt.Sprintf("A statement has been running for more than %gs, the client's query timeout, so its client has likely gone; consider client_connection_check_interval", t),
+			observed: fmt.Sprintf("%d backends ran statements for up to %.1fs after the client closed their connection", n, orphans.longest().Seconds()),
+			checkSQL: fmt.Sprintf(`SELECT pid, usename, application_name, now() - query_start AS running_for, left(query, 80) AS statement
+FROM pg_stat_activity
+WHERE state = 'active' AND backend_type = 'client backend' AND now() - query_start > interval '%g seconds'`, t),
+		})
+	}
+	return rules
+}
+
+// writeAlertRules writes the rules as a Prometheus rule file to path, or to
+// stdout for "-", with each rule's SQL check as an annotation
+func writeAlertRules(path, mode string, o *options) error {
+	rules := alertRules(o)
+	w := &strings.Builder{}
+	fmt.Fprintf(w, "# Alerting rules generated by pg-idle-test from a %s run at %s.\n", mode, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "# Server metrics are postgres_exporter's, pool metrics the tool's own /metrics;\n")
+	fmt.Fprintf(w, "# check_sql is the same condition as a query on pg_stat_activity.\n")
+	fmt.Fprintf(w, "groups:\n  - name: pg-idle-test-%s\n", mode)
+	if len(rules) == 0 {
+		fmt.Fprintf(w, "    # no failure mode observed: no idle in transaction, pool wait or orphaned query\n    rules: []\n")
+	} else {
+		fmt.Fprintf(w, "    rules:\n")
+	}
+	for _, r := range rules {
+		fmt.Fprintf(w, "      - alert: %s\n        expr: %s\n", r.name, r.expr)
+		if r.forDuration != "" {
+			fmt.Fprintf(w, "        for: %s\n", r.forDuration)
+		}
+		fmt.Fprintf(w, "        labels:\n          severity: warning\n        annotations:\n")
+		fmt.Fprintf(w, "          summary: %q\n          observed: %q\n          check_sql: |\n", r.summary, r.observed)
+		for _, line := range strings.Split(r.checkSQL, "\n") {
+			fmt.Fprintf(w, "            %s\n", line)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	fmt.Println()
+	names := make([]string, 0, len(rules))
+	for _, r := range rules {
+		names = append(names, r.name)
+	}
+	if len(names) == 0 {
+		names = append(names, "none, no failure mode observed")
+	}
+	fmt.Printf(">>> ALERT RULES: %s\n", strings.Join(names, ", "))
+	_, err := io.WriteString(out, w.String())
+	return err
+}
@@ -0,0 +1,222 @@
+// Scenario: the same request load served by a goroutine per request and by a
+// fixed worker pool with a bounded queue, while the connection pool is
+// exhausted behind a lock.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backpressureArchs are the client architectures compared:
+//   - unbounded: every request gets its own goroutine, as net/http does
+//   - fixed: as many workers as pooled connections take requests from a
+//     bounded queue, and requests arriving at a full queue are rejected
+var backpressureArchs = []string{"unbounded", "fixed"}
+
+const (
+	backpressurePool    = 10
+	backpressurePayload = 64 << 10         // bytes each request holds, standing in for its body
+	backpressureTimeout = 10 * time.Second // per request, a typical HTTP server timeout
+)
+
+type backpressureResult struct {
+	peakGoroutines int
+	peakHeap       uint64 // HeapInuse bytes
+	peakInFlight   int64  // accepted, not yet finished
+	ok             int64
+	failed         int64
+	rejected       int64
+	p99            time.Duration // of committed requests
+	recovery       time.Duration // from lock release until the backlog drained, -1 if it did not
+}
+
+func init() {
+	registerScenario("backpressure", scenario{
+		standalone: func(o *options) bool {
+			return runBackpressure(o.connStr, o.backpressureRate, o.backpressureQueue)
+		},
+		validate: func(o *options) error {
+			if o.backpressureRate <= 0 || o.backpressureQueue < 0 {
+				return fmt.Errorf("Invalid -backpressure-rate %d or -backpressure-queue %d", o.backpressureRate, o.backpressureQueue)
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = backpressurePool + 2 }, // setup and lock holder
+	})
+}
+
+// runBackpressure offers rate requests per second to each architecture for
+// 5s, then holds a lock on every row the requests update for 10s and lets the
+// client recover for 15s. It passes if the fixed pool drained its backlog.
+func runBackpressure(connStr string, rate, queue int) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_backpressure")
+	setup.Exec("CREATE TABLE test_backpressure (id INT PRIMARY KEY, val BIGINT)")
+	setup.Exec("INSERT INTO test_backpressure SELECT g, 0 FROM generate_series(1, 10) g")
+
+	results := map[string]backpressureResult{}
+	for _, arch := range backpressureArchs {
+		fmt.Printf(">>> BACKPRESSURE: %s, %d requests/s\n", arch, rate)
+		r, err := backpressureOnce(connStr, setup, arch, rate, queue)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", arch, err)
+			return false
+		}
+		results[arch] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> BACKPRESSURE REPORT")
+	fmt.Printf("%-10s %11s %9s %9s %8s %8s %9s %9s %9s\n", "Arch", "Goroutines", "HeapMB", "InFlight", "OK", "Failed", "Rejected", "P99", "Recovery")
+	for _, arch := range backpressureArchs {
+		r := results[arch]
+		recovery := "never"
+		if r.recovery >= 0 {
+			recovery = fmt.Sprintf("%.0fs", r.recovery.Seconds())
+		}
+		fmt.Printf("%-10s %11d %9.1f %9d %8d %8d %9d %8.0fms %9s\n", arch, r.peakGoroutines, float64(r.peakHeap)/(1<<20),
+			r.peakInFlight, r.ok, r.failed, r.rejected, float64(r.p99.Microseconds())/1000, recovery)
+	}
+	fmt.Println()
+	fmt.Println("Goroutines, HeapMB and InFlight are peaks; Recovery is from the lock release until no more requests were")
+	fmt.Println("in flight than before the lock. Unbounded concurrency turns a stalled pool into a backlog which holds memory")
+	fmt.Println("while it waits and then hits the database all at once; the fixed pool sheds the excess and recovers with the lock.")
+	return results["fixed"].recovery >= 0
+}
+
+func backpressureOnce(connStr string, setup *sql.DB, arch string, rate, queue int) (backpressureResult, error) {
+	r := backpressureResult{recovery: -1}
+	db, err := openDB(connStr, "pg-idle-test-backpressure")
+	if err != nil {
+		return r, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(backpressurePool)
+	db.SetMaxIdleConns(backpressurePool)
+	runtime.GC()
+
+	var inFlight, ok, failed, rejected atomic.Int64
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var requests sync.WaitGroup
+	handle := func(payload []byte) {
+		defer requests.Done()
+		defer inFlight.Add(-1)
+		ctx, cancel := context.WithTimeout(context.Background(), backpressureTimeout)
+		defer cancel()
+		start := time.Now()
+		_, err := db.ExecContext(ctx, "UPDATE test_backpressure SET val = val + 1 WHERE id = $1", 1+rand.Intn(10))
+		if err != nil {
+			failed.Add(1)
+		} else {
+			ok.Add(1)
+			mu.Lock()
+			latencies = append(latencies, time.Since(start))
+			mu.Unlock()
+		}
+		runtime.KeepAlive(payload)
+	}
+
+	jobs := make(chan []byte, queue)
+	if arch == "fixed" {
+		for i := 0; i < backpressurePool; i++ {
+			go func() {
+				for payload := range jobs {
+					handle(payload)
+				}
+			}()
+		}
+	}
+	stop := make(chan struct{})
+	generated := make(chan struct{})
+	go func() {
+		defer close(generated)
+		tick := time.NewTicker(time.Second / time.Duration(rate))
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+			payload := make([]byte, backpressurePayload)
+			payload[0] = 1
+			inFlight.Add(1)
+			requests.Add(1)
+			if arch == "unbounded" {
+				go handle(payload)
+				continue
+			}
+			select {
+			case jobs <- payload:
+			default:
+				inFlight.Add(-1)
+				requests.Done()
+				rejected.Add(1)
+			}
+		}
+	}()
+
+	// sample records the peaks every second for d and returns the highest
+	// in-flight count seen, stopping early once it is at most target
+	sample := func(phase string, d time.Duration, target int64) (int64, bool) {
+		var peak int64
+		var mem runtime.MemStats
+		for start := time.Now(); time.Since(start) < d; {
+			time.Sleep(1 * time.Second)
+			runtime.ReadMemStats(&mem)
+			n := inFlight.Load()
+			peak = max(peak, n)
+			r.peakGoroutines = max(r.peakGoroutines, runtime.NumGoroutine())
+			r.peakHeap = max(r.peakHeap, mem.HeapInuse)
+			r.peakInFlight = max(r.peakInFlight, n)
+			fmt.Fprintf(os.Stderr, "[%s] BACKPRESSURE: %s %s goroutines=%d heap=%.1fMB in_flight=%d ok=%d failed=%d rejected=%d\n",
+				time.Now().Format("04:05"), arch, phase, runtime.NumGoroutine(), float64(mem.HeapInuse)/(1<<20), n, ok.Load(), failed.Load(), rejected.Load())
+			if target >= 0 && n <= target {
+				return peak, true
+			}
+		}
+		return peak, false
+	}
+
+	steady, _ := sample("steady", 5*time.Second, -1)
+	holder, err := setup.Conn(context.Background())
+	if err != nil {
+		close(stop)
+		return r, err
+	}
+	holder.ExecContext(context.Background(), "BEGIN")
+	holder.ExecContext(context.Background(), "SELECT * FROM test_backpressure FOR UPDATE")
+	sample("locked", 10*time.Second, -1)
+	holder.ExecContext(context.Background(), "ROLLBACK")
+	holder.Close()
+	released := time.Now()
+	if _, drained := sample("recovering", 15*time.Second, max(steady, 1)); drained {
+		r.recovery = time.Since(released)
+	}
+	close(stop)
+	<-generated
+	close(jobs)
+	requests.Wait()
+
+	r.ok, r.failed, r.rejected = ok.Load(), failed.Load(), rejected.Load()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if len(latencies) > 0 {
+		r.p99 = latencies[len(latencies)*99/100]
+	}
+	return r, nil
+}
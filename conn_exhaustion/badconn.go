@@ -0,0 +1,97 @@
+// Counting of database/sql's silent retries after driver.ErrBadConn.
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// driverOps are the driver calls counted on connections of openDB pools.
+// database/sql retries the whole operation on another connection whenever one
+// of them returns driver.ErrBadConn (up to three attempts), so each ErrBadConn
+// before the last attempt is load the application never sees.
+var driverOps = []string{"exec", "query", "begin", "prepare", "ping", "reset"}
+
+type opCounter struct {
+	attempts, badConn atomic.Int64
+}
+
+var driverOpCounts = func() map[string]*opCounter {
+	counts := map[string]*opCounter{}
+	for _, op := range driverOps {
+		counts[op] = &opCounter{}
+	}
+	return counts
+}()
+
+func countOp(op string, err error) {
+	c := driverOpCounts[op]
+	c.attempts.Add(1)
+	if errors.Is(err, driver.ErrBadConn) {
+		c.badConn.Add(1)
+	}
+}
+
+// The statement methods also prefix queryTag, since every statement of an
+// openDB pool passes through them
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.stdlibConn.ExecContext(ctx, queryTag+query, args)
+	countOp("exec", err)
+	return res, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.stdlibConn.QueryContext(ctx, queryTag+query, args)
+	countOp("query", err)
+	return rows, err
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	tx, err := c.stdlibConn.BeginTx(ctx, opts)
+	countOp("begin", err)
+	return tx, err
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.stdlibConn.PrepareContext(ctx, queryTag+query)
+	countOp("prepare", err)
+	return stmt, err
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	err := c.stdlibConn.Ping(ctx)
+	countOp("ping", err)
+	return err
+}
+
+// badConnTotal is the number of ErrBadConn returns so far, for per-config deltas
+func badConnTotal() int64 {
+	var total int64
+	for _, c := range driverOpCounts {
+		total += c.badConn.Load()
+	}
+	return total
+}
+
+// printBadConnReport shows how many driver calls returned ErrBadConn and the
+// resulting amplification: driver attempts per call that did not need a retry
+func printBadConnReport() {
+	fmt.Println()
+	fmt.Println(">>> BAD CONN RETRIES")
+	fmt.Printf("%-8s %10s %10s %14s\n", "Op", "Attempts", "ErrBadConn", "Amplification")
+	for _, op := range driverOps {
+		c := driverOpCounts[op]
+		attempts, bad := c.attempts.Load(), c.badConn.Load()
+		if attempts == 0 {
+			continue
+		}
+		amplification := "-"
+		if attempts > bad {
+			amplification = fmt.Sprintf("%.2fx", float64(attempts)/float64(attempts-bad))
+		}
+		fmt.Printf("%-8s %10d %10d %14s\n", op, attempts, bad, amplification)
+	}
+}
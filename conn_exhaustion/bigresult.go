@@ -0,0 +1,155 @@
+// Scenario: a query returning millions of rows abandoned mid-fetch, by
+// canceling its context or by closing the rows early, and what each costs
+// before the connection is back in the pool or gone.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	bigResultRows  = 5_000_000
+	bigResultAfter = 100_000 // rows read before the fetch is abandoned
+)
+
+type bigResultResult struct {
+	read     int
+	err      error         // the error rows reported
+	released time.Duration // from abandoning the fetch to rows.Close's return
+	stopped  time.Duration // from abandoning the fetch until the backend left the query, -1 if it never did
+	reused   bool          // the pool's next statement ran on the same backend
+	connects int64         // connections the pool opened for its next statement
+	nextErr  error
+}
+
+func init() {
+	registerScenario("bigresult", scenario{
+		standalone: func(o *options) bool { return runBigResult(o.connStr) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 2 }, // pool of one and poller
+	})
+}
+
+// runBigResult reads bigResultAfter rows of a bigResultRows row query on a
+// pool of one connection, then abandons it by canceling the context, and
+// again by calling rows.Close with the context still live. It passes if the
+// server stopped the query within 5s both times and the pool's next
+// statement succeeded.
+func runBigResult(connStr string) bool {
+	poller, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer poller.Close()
+	poller.SetMaxOpenConns(1)
+
+	db, err := openDB(connStr, "pg-idle-test-bigresult")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	configs := []string{"cancel", "close"}
+	results := map[string]bigResultResult{}
+	for _, config := range configs {
+		fmt.Printf(">>> BIG RESULT: %s after %d of %d rows\n", config, bigResultAfter, bigResultRows)
+		r, err := bigResultOnce(db, poller, config == "cancel")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", config, err)
+			return false
+		}
+		results[config] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> BIG RESULT REPORT (%d rows, abandoned after %d)\n", bigResultRows, bigResultAfter)
+	fmt.Printf("%-8s %10s %-10s %10s %10s %-24s\n", "Abandon", "Rows read", "Error", "Released", "Stopped", "Pool")
+	pass := true
+	for _, config := range configs {
+		r := results[config]
+		class, stopped, pool := "none", "never", "connection reused"
+		if r.err != nil {
+			class = classifyError(r.err)
+		}
+		if r.stopped >= 0 {
+			stopped = ms(r.stopped)
+		}
+		switch {
+		case r.nextErr != nil:
+			pool = "failed: " + classifyError(r.nextErr)
+		case !r.reused:
+			pool = fmt.Sprintf("closed, %d new connection", r.connects)
+		}
+		fmt.Printf("%-8s %10d %-10s %10s %10s %-24s\n", config, r.read, class, ms(r.released), stopped, pool)
+		pass = pass && r.stopped >= 0 && r.nextErr == nil
+	}
+	fmt.Println()
+	fmt.Println("Released is how long rows.Close took to return the connection after the fetch was abandoned, Stopped")
+	fmt.Println("until the backend was gone or no longer running the query. A canceled context makes pgx interrupt the")
+	fmt.Println("socket and close the connection at once: the pool dials a new one and the server stops when it next")
+	fmt.Println("writes to the closed socket. rows.Close with a live context reads the rest of the result and throws it")
+	fmt.Println("away, so the connection stays in the pool but the server sends every row first; cancel the context")
+	fmt.Println("before closing rows of a result too big to drain.")
+	if !pass {
+		fmt.Println(">>> BIG RESULT: FAIL an abandoned query kept running on the server or broke the pool")
+		return false
+	}
+	fmt.Println(">>> BIG RESULT: PASS both abandoned queries stopped on the server and the pool kept working")
+	return true
+}
+
+func bigResultOnce(db, poller *sql.DB, cancelFetch bool) (bigResultResult, error) {
+	r := bigResultResult{stopped: -1}
+	var pid int32
+	if err := db.QueryRow("SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		return r, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT g, repeat('x', 100) FROM generate_series(1, $1) g", bigResultRows)
+	if err != nil {
+		return r, err
+	}
+	for r.read < bigResultAfter && rows.Next() {
+		var id int
+		var payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return r, err
+		}
+		r.read++
+	}
+	abandoned := time.Now()
+	if cancelFetch {
+		cancel()
+		for rows.Next() {
+			r.read++
+		}
+	}
+	rows.Close()
+	r.released = time.Since(abandoned)
+	r.err = rows.Err()
+
+	for time.Since(abandoned) < 5*time.Second {
+		var running bool
+		if poller.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE pid = $1 AND state = 'active')", pid).Scan(&running) == nil && !running {
+			r.stopped = time.Since(abandoned)
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	connectsBefore := connectsTotal.Load()
+	var next int32
+	r.nextErr = db.QueryRow("SELECT pg_backend_pid()").Scan(&next)
+	r.reused = r.nextErr == nil && next == pid
+	r.connects = connectsTotal.Load() - connectsBefore
+	return r, nil
+}
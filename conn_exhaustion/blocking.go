@@ -0,0 +1,261 @@
+// Blocking chains from pg_blocking_pids: which backend waits on which, down
+// to the session at the root and what it last ran.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blockedSession is one backend of the database as the reporter saw it
+type blockedSession struct {
+	pid       int32
+	blockers  []int32
+	state     string
+	app       string
+	xactAge   time.Duration
+	stateAge  time.Duration // how long it has been in state, e.g. waiting
+	waitEvent string
+	query     string
+}
+
+// blockingRoot is a session seen blocking others without waiting itself,
+// kept for the report at the end of the run
+type blockingRoot struct {
+	pid                 int32
+	firstSeen, lastSeen time.Time
+	maxBlocked          int
+	state, query        string
+}
+
+type blockingReporter struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	last  string // edges of the last tree printed
+	roots map[int32]*blockingRoot
+}
+
+// blocking is nil if -blocking-interval is 0
+var blocking *blockingReporter
+
+// newBlockingReporter opens the reporter's own connection, so it can look
+// while the worker pool is exhausted
+func newBlockingReporter(connStr string) (*blockingReporter, error) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &blockingReporter{db: db, roots: map[int32]*blockingRoot{}}, nil
+}
+
+// run prints the blocking tree every interval while it differs from the
+// last one printed
+func (b *blockingReporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		sessions, err := b.sessions()
+		selfOverhead.since("blocking reporter", start, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Blocking chain query failed: %v\n", err)
+			continue
+		}
+		b.report(sessions)
+	}
+}
+
+func (b *blockingReporter) sessions() (map[int32]*blockedSession, error) {
+	rows, err := b.db.Query(`
+		SELECT pid, array_to_string(pg_blocking_pids(pid), ','), coalesce(state, ''), coalesce(application_name, ''),
+		       coalesce(extract(epoch FROM now() - xact_start), 0), coalesce(extract(epoch FROM now() - state_change), 0),
+		       coalesce(wait_event_type || ':' || wait_event, ''), coalesce(query, '')
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND pid <> pg_backend_pid()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := map[int32]*blockedSession{}
+	for rows.Next() {
+		s := &blockedSession{}
+		var blockers string
+		var xactAge, stateAge float64
+		if err := rows.Scan(&s.pid, &blockers, &s.state, &s.app, &xactAge, &stateAge, &s.waitEvent, &s.query); err != nil {
+			return nil, err
+		}
+		for _, f := range strings.Split(blockers, ",") {
+			if pid, err := strconv.ParseInt(f, 10, 32); err == nil {
+				s.blockers = append(s.blockers, int32(pid))
+			}
+		}
+		s.xactAge = time.Duration(xactAge * float64(time.Second))
+		s.stateAge = time.Duration(stateAge * float64(time.Second))
+		sessions[s.pid] = s
+	}
+	return sessions, rows.Err()
+}
+
+// report prints the tree below every root: a backend which blocks others
+// and waits on nobody. Backends in a cycle (a deadlock the server has not
+// broken yet) have no root and are listed on their own.
+func (b *blockingReporter) report(sessions map[int32]*blockedSession) {
+	blockedBy := map[int32][]int32{}
+	var edges []string
+	for _, s := range sessions {
+		for _, blocker := range s.blockers {
+			blockedBy[blocker] = append(blockedBy[blocker], s.pid)
+			edges = append(edges, fmt.Sprintf("%d>%d", blocker, s.pid))
+		}
+	}
+	sort.Strings(edges)
+	key := strings.Join(edges, " ")
+
+	var roots []int32
+	for pid := range blockedBy {
+		if s := sessions[pid]; s == nil || len(s.blockers) == 0 {
+			roots = append(roots, pid)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i] < roots[j] })
+	for _, waiters := range blockedBy {
+		sort.Slice(waiters, func(i, j int) bool { return waiters[i] < waiters[j] })
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	changed := key != b.last
+	b.last = key
+	for _, pid := range roots {
+		r := b.roots[pid]
+		if r == nil {
+			r = &blockingRoot{pid: pid, firstSeen: now}
+			b.roots[pid] = r
+		}
+		r.lastSeen = now
+		r.maxBlocked = max(r.maxBlocked, countBlocked(pid, blockedBy, map[int32]bool{}))
+		if s := sessions[pid]; s != nil {
+			r.state, r.query = s.state, s.query
+		}
+	}
+	b.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if jsonOutput() {
+		emitJSON("blocking_tree", map[string]any{"roots": roots, "edges": edges})
+		return
+	}
+	timestamp := now.Format("04:05")
+	if len(edges) == 0 {
+		fmt.Fprintf(os.Stderr, "[%s] BLOCKING: no backend is waiting on another\n", timestamp)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[%s] BLOCKING: %d backends waiting, %d roots\n", timestamp, countWaiting(sessions), len(roots))
+	printed := map[int32]bool{}
+	for _, pid := range roots {
+		printBlockingTree(pid, sessions, blockedBy, printed, "  ")
+	}
+	for _, s := range sessions {
+		if len(s.blockers) > 0 && !printed[s.pid] {
+			fmt.Fprintf(os.Stderr, "  (cycle) %s\n", describeBlocked(s.pid, sessions))
+		}
+	}
+}
+
+func countWaiting(sessions map[int32]*blockedSession) int {
+	n := 0
+	for _, s := range sessions {
+		if len(s.blockers) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// countBlocked is the number of backends waiting on pid, directly or further
+// down the chain
+func countBlocked(pid int32, blockedBy map[int32][]int32, seen map[int32]bool) int {
+	n := 0
+	for _, waiter := range blockedBy[pid] {
+		if !seen[waiter] {
+			seen[waiter] = true
+			n += 1 + countBlocked(waiter, blockedBy, seen)
+		}
+	}
+	return n
+}
+
+func printBlockingTree(pid int32, sessions map[int32]*blockedSession, blockedBy map[int32][]int32, printed map[int32]bool, indent string) {
+	if printed[pid] {
+		fmt.Fprintf(os.Stderr, "%sPID %d (see above)\n", indent, pid)
+		return
+	}
+	printed[pid] = true
+	fmt.Fprintf(os.Stderr, "%s%s\n", indent, describeBlocked(pid, sessions))
+	for _, waiter := range blockedBy[pid] {
+		printBlockingTree(waiter, sessions, blockedBy, printed, indent+"  ")
+	}
+}
+
+// describeBlocked is one line of the tree: the state, how long, and the
+// statement the backend runs or, for an idle blocker, last ran
+func describeBlocked(pid int32, sessions map[int32]*blockedSession) string {
+	s := sessions[pid]
+	if s == nil {
+		return fmt.Sprintf("PID %d (not in this database)", pid)
+	}
+	var what string
+	switch {
+	case len(s.blockers) > 0:
+		what = fmt.Sprintf("waiting %.1fs on %s", s.stateAge.Seconds(), s.waitEvent)
+	case s.xactAge > 0:
+		what = fmt.Sprintf("%s %.1fs, transaction open %.1fs", s.state, s.stateAge.Seconds(), s.xactAge.Seconds())
+	default:
+		what = s.state
+	}
+	return fmt.Sprintf("PID %d [%s] %s: %s", pid, s.app, what, shortQuery(s.query))
+}
+
+// shortQuery strips this process's query tag and keeps the start of the text
+func shortQuery(query string) string {
+	query = oneLine(strings.TrimPrefix(query, queryTag))
+	if len(query) > 120 {
+		query = query[:117] + "..."
+	}
+	return query
+}
+
+// print lists every root seen during the run with the most backends it
+// blocked at once
+func (b *blockingReporter) print() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Println()
+	fmt.Printf(">>> BLOCKING ROOTS: %d sessions blocked others\n", len(b.roots))
+	roots := make([]*blockingRoot, 0, len(b.roots))
+	for _, r := range b.roots {
+		roots = append(roots, r)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].firstSeen.Before(roots[j].firstSeen) })
+	for _, r := range roots {
+		fmt.Printf("    PID %d: blocked up to %d backends for %.0fs, %s: %s\n", r.pid, r.maxBlocked,
+			r.lastSeen.Sub(r.firstSeen).Seconds(), r.state, shortQuery(r.query))
+	}
+}
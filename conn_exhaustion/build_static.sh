@@ -0,0 +1,14 @@
+#!/bin/bash
+# Build one statically linked binary with every scenario and the built-in
+# configs, to copy onto a host without Go, config files or internet access.
+# GOOS and GOARCH pass through for cross builds, e.g.
+#   GOOS=linux GOARCH=arm64 ./build_static.sh
+
+cd "$(dirname "$0")"
+OUT="${1:-pg-idle-test-$(go env GOOS)-$(go env GOARCH)}"
+
+# CGO_ENABLED=0 uses the pure Go resolver and leaves no libc dependency
+CGO_ENABLED=0 go build -trimpath -ldflags='-s -w' -o "$OUT" . || exit 1
+echo "Built $OUT"
+[ "$(go env GOOS)" = linux ] && command -v file >/dev/null && file "$OUT"
+exit 0
@@ -0,0 +1,52 @@
+// Cold and warm cache preparation before the workers start.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// testRelations selects the workload tables, their indexes and TOAST tables
+const testRelations = `
+	WITH tables AS (
+		SELECT c.oid, c.reltoastrelid FROM pg_class c
+		WHERE c.relnamespace = current_schema()::regnamespace AND c.relname LIKE 'test\_%' AND c.relkind IN ('r', 'i')
+	), rels AS (
+		SELECT oid FROM tables UNION SELECT reltoastrelid FROM tables WHERE reltoastrelid <> 0
+	)`
+
+// cacheModes are the values of -cache
+var cacheModes = []string{"asis", "cold", "warm"}
+
+// prepareCache evicts the workload relations from shared buffers (cold, needs
+// pg_buffercache from Postgres 17 and superuser) or loads them (warm, needs
+// pg_prewarm). The OS page cache is untouched; restart the instance and drop
+// OS caches for a fully cold start (see COLD_CACHE in the test script).
+func prepareCache(db *sql.DB, mode string) error {
+	var stmt string
+	switch mode {
+	case "asis":
+		return nil
+	case "cold":
+		db.Exec("CREATE EXTENSION IF NOT EXISTS pg_buffercache")
+		db.Exec("CHECKPOINT") // evicting dirty buffers would write them out one by one
+		stmt = testRelations + `
+			SELECT pg_buffercache_evict(b.bufferid) FROM pg_buffercache b
+			WHERE b.reldatabase = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND b.relfilenode IN (SELECT pg_relation_filenode(oid) FROM rels)`
+	case "warm":
+		db.Exec("CREATE EXTENSION IF NOT EXISTS pg_prewarm")
+		stmt = testRelations + `
+			SELECT pg_prewarm(oid) FROM rels`
+	default:
+		return fmt.Errorf("unknown cache mode %q", mode)
+	}
+
+	res, err := db.Exec(stmt)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	fmt.Printf(">>> CACHE: %s, %d relations/buffers processed\n", mode, n)
+	return nil
+}
@@ -0,0 +1,160 @@
+// Calibration of the harness's own cost: the counter workload's statements
+// against the in-process mock server, through the bare driver and through
+// the harness's instrumented path.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// calibrationPath is one way of running the statements and what it cost
+type calibrationPath struct {
+	name       string
+	iterations int64
+	errors     int64
+	latency    latencyHistogram
+	cpu        time.Duration // process CPU per iteration
+}
+
+type calibrationResult struct {
+	workers  int
+	duration time.Duration
+	bare     calibrationPath
+	harness  calibrationPath
+}
+
+// calibrated is set by -calibrate for the harness overhead report
+var calibrated *calibrationResult
+
+func init() {
+	registerScenario("calibrate", scenario{
+		standalone: func(o *options) bool {
+			r, err := runCalibration(o, 5*time.Second)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Calibration failed: %v\n", err)
+				return false
+			}
+			r.print()
+			return true
+		},
+		offline: true,
+	})
+}
+
+// runCalibration runs each path for d with as many workers as the pool has
+// connections, so no checkout waits, and no pause between iterations
+func runCalibration(o *options, d time.Duration) (*calibrationResult, error) {
+	mock, err := startMockPostgres(mockBehavior{})
+	if err != nil {
+		return nil, err
+	}
+	defer mock.close()
+	r := &calibrationResult{workers: min(o.workers, o.maxOpen), duration: d, bare: calibrationPath{name: "bare driver"}, harness: calibrationPath{name: "harness"}}
+
+	bare, err := sql.Open("pgx", mock.connStr())
+	if err != nil {
+		return nil, err
+	}
+	defer bare.Close()
+	harness, err := openDB(mock.connStr(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer harness.Close()
+	for _, db := range []*sql.DB{bare, harness} {
+		db.SetMaxOpenConns(r.workers)
+		db.SetMaxIdleConns(r.workers)
+	}
+
+	rows := max(o.wl.schema.rows, 1)
+	r.bare.measure(r.workers, d, func(ctx context.Context, iteration int) error {
+		if _, err := bare.ExecContext(ctx, "UPDATE test_row SET val = val + 1 WHERE id = $1", 1+rand.Intn(rows)); err != nil {
+			return err
+		}
+		_, err := bare.ExecContext(ctx, "SELECT pg_sleep(0.01)")
+		return err
+	})
+	r.harness.measure(r.workers, d, func(ctx context.Context, iteration int) error {
+		ctx, tag := withWorker(ctx, 0)
+		tag.untracked = !instrumented(iteration)
+		if _, err := execContext(ctx, harness, "UPDATE test_row SET val = val + 1 WHERE id = $1", 1+rand.Intn(rows)); err != nil {
+			return err
+		}
+		_, err := execContext(ctx, harness, "SELECT pg_sleep(0.01)")
+		return err
+	})
+
+	// The harness path fed the reports of the run; start them afresh
+	queryLatencies = &statementLatencies{interval: map[string]*latencyHistogram{}, run: map[string]*latencyHistogram{}}
+	checkoutMu.Lock()
+	checkoutSamples = nil
+	checkoutMu.Unlock()
+	return r, nil
+}
+
+// measure runs iteration on workers goroutines for d
+func (p *calibrationPath) measure(workers int, d time.Duration, iteration func(ctx context.Context, iteration int) error) {
+	var mu sync.Mutex
+	var n, failed atomic.Int64
+	stop := time.Now().Add(d)
+	startCPU := readCPUTimes()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var h latencyHistogram
+			for i := 0; time.Now().Before(stop); i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				start := time.Now()
+				err := iteration(ctx, i)
+				h.record(time.Since(start), err != nil)
+				cancel()
+				n.Add(1)
+				if err != nil {
+					failed.Add(1)
+				}
+			}
+			mu.Lock()
+			p.latency.merge(&h)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	cpu := readCPUTimes()
+	p.iterations, p.errors = n.Load(), failed.Load()
+	if p.iterations > 0 {
+		p.cpu = time.Duration((cpu.user + cpu.gc - startCPU.user - startCPU.gc) / float64(p.iterations) * float64(time.Second))
+	}
+}
+
+// mean is the path's average iteration time, free of the histogram's bucket widths
+func (r *calibrationResult) mean(p calibrationPath) time.Duration {
+	return time.Duration(int64(r.workers) * int64(r.duration) / max(p.iterations, 1))
+}
+
+// overhead is what the harness path adds to an iteration on average and in CPU
+func (r *calibrationResult) overhead() (latency, cpu time.Duration) {
+	return r.mean(r.harness) - r.mean(r.bare), r.harness.cpu - r.bare.cpu
+}
+
+func (r *calibrationResult) print() {
+	fmt.Println()
+	fmt.Printf(">>> CALIBRATION: counter workload against an in-process mock server, %d workers, %v per path\n", r.workers, r.duration)
+	fmt.Printf("%-12s %11s %8s %10s %10s %10s %12s\n", "Path", "Iterations", "Errors", "Iter/s", "p50", "p99", "CPU/iter")
+	for _, p := range []calibrationPath{r.bare, r.harness} {
+		fmt.Printf("%-12s %11d %8d %10.0f %10s %10s %10.1fµs\n", p.name, p.iterations, p.errors, float64(p.iterations)/r.duration.Seconds(),
+			ms(p.latency.quantile(0.5)), ms(p.latency.quantile(0.99)), float64(p.cpu.Nanoseconds())/1000)
+	}
+	latency, cpu := r.overhead()
+	fmt.Printf("Harness overhead per iteration: %+.1fµs on average, %+.1fµs CPU\n", float64(latency.Nanoseconds())/1000, float64(cpu.Nanoseconds())/1000)
+	fmt.Println("The mock answers every statement at once over loopback, so both paths measure the client alone; the difference is")
+	fmt.Println("the instrumentation (tracking, attribution, histograms, PID tracing) each real iteration carries on top of the driver.")
+}
@@ -0,0 +1,224 @@
+// Scenario: the driver's cancel request when a context deadline expires on a
+// statement blocked behind a row lock, as in test_client_cancel_driver.go.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func init() {
+	registerScenario("canceldriver", scenario{
+		standalone: func(o *options) bool { return runCancelDriver(o.connStr, 5*time.Second) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 3 }, // holder, victim and poller
+	})
+	registerScenario("cancelcompare", scenario{
+		standalone: func(o *options) bool { return runCancelCompare(o.connStr, 5*time.Second) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 3 },
+	})
+}
+
+// setupCancelTable recreates test_cancel and takes its row lock in an open
+// transaction on holder, which the caller closes
+func setupCancelTable(db *sql.DB) (*sql.Conn, error) {
+	db.Exec("DROP TABLE IF EXISTS test_cancel")
+	db.Exec("CREATE TABLE test_cancel (id INT PRIMARY KEY, value TEXT)")
+	db.Exec("INSERT INTO test_cancel VALUES (1, 'unlocked')")
+	holder, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	holder.ExecContext(context.Background(), "BEGIN")
+	if _, err := holder.ExecContext(context.Background(), "UPDATE test_cancel SET value = 'locked by A' WHERE id = 1"); err != nil {
+		holder.Close()
+		return nil, fmt.Errorf("unable to take the row lock: %w", err)
+	}
+	return holder, nil
+}
+
+// runCancelDriver holds the row lock of test_cancel in an open transaction and
+// runs an UPDATE of the same row under a timeout. PASS if the UPDATE fails at
+// the deadline and its backend stopped waiting, i.e. the driver's cancel request
+// reached the server rather than only the client giving up.
+func runCancelDriver(connStr string, timeout time.Duration) bool {
+	db, err := openDriverDB(connStr, "pg-idle-test-canceldriver")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+	holder, err := setupCancelTable(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return false
+	}
+	defer holder.Close()
+	defer holder.ExecContext(context.Background(), "ROLLBACK")
+	fmt.Printf(">>> CANCEL_DRIVER: row lock held, running a blocked UPDATE through %s with a %v timeout\n", sqlDriver, timeout)
+
+	tag := fmt.Sprintf("pg-idle-test canceldriver %d", time.Now().UnixNano())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	start := time.Now()
+	_, err = db.ExecContext(ctx, fmt.Sprintf("/* %s */ UPDATE test_cancel SET value = 'locked by B' WHERE id = 1", tag))
+	elapsed := time.Since(start)
+	cancel()
+	if err == nil {
+		fmt.Println(">>> CANCEL_DRIVER: FAIL the blocked UPDATE completed while the lock was held")
+		return false
+	}
+	fmt.Printf(">>> CANCEL_DRIVER: UPDATE failed after %v [%s]: %v\n", elapsed.Round(time.Millisecond), classifyError(err), err)
+
+	// Give the cancel request time to arrive before looking for the statement
+	time.Sleep(1 * time.Second)
+	var waiting bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE state = 'active' AND query LIKE '%' || $1 || '%' AND pid <> pg_backend_pid())", tag).Scan(&waiting); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return false
+	}
+	fmt.Println()
+	if waiting {
+		fmt.Println(">>> CANCEL_DRIVER: FAIL the UPDATE was still waiting on the server 1s after its deadline")
+		return false
+	}
+	fmt.Println(">>> CANCEL_DRIVER: PASS the UPDATE stopped on the server at its deadline")
+	return true
+}
+
+// cancelMechanism is one way of ending the blocked UPDATE and what came of it
+type cancelMechanism struct {
+	name     string
+	client   time.Duration // until the client's error
+	released time.Duration // until the backend stopped waiting for the lock
+	err      error
+	reused   bool // the connection ran the next statement on the same backend
+}
+
+// runCancelCompare runs the blocked UPDATE of canceldriver twice, ended once
+// by the context deadline, which makes pgx send a CancelRequest, and once by
+// the server's statement_timeout, and compares how soon the backend let go
+// of the lock queue and what each surfaced
+func runCancelCompare(connStr string, timeout time.Duration) bool {
+	db, err := openDriverDB(connStr, "pg-idle-test-cancelcompare")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+	holder, err := setupCancelTable(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return false
+	}
+	defer holder.Close()
+	defer holder.ExecContext(context.Background(), "ROLLBACK")
+	fmt.Printf(">>> CANCEL_COMPARE: row lock held, ending a blocked UPDATE after %v by context deadline and by statement_timeout\n", timeout)
+
+	var results []cancelMechanism
+	for _, serverSide := range []bool{false, true} {
+		r, err := blockedUpdate(db, timeout, serverSide)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", r.name, err)
+			return false
+		}
+		results = append(results, r)
+	}
+
+	fmt.Println()
+	fmt.Printf("%-20s %12s %14s %-10s %-13s %-11s %s\n", "Mechanism", "Client error", "Lock released", "SQLSTATE", "Class", "Connection", "Error")
+	passed := true
+	for _, r := range results {
+		state := "none"
+		var pgErr *pgconn.PgError
+		if errors.As(r.err, &pgErr) {
+			state = pgErr.Code
+		}
+		conn := "closed"
+		if r.reused {
+			conn = "reused"
+		}
+		released := "still waiting"
+		if r.released > 0 {
+			released = ms(r.released)
+		} else {
+			passed = false
+		}
+		fmt.Printf("%-20s %12s %14s %-10s %-13s %-11s %s\n", r.name, ms(r.client), released, state, classifyError(r.err), conn, oneLine(fmt.Sprint(r.err)))
+	}
+	fmt.Println()
+	if passed {
+		faster := results[0]
+		if results[1].released < faster.released {
+			faster = results[1]
+		}
+		fmt.Printf(">>> CANCEL_COMPARE: %s released the lock queue first, %s after the UPDATE started\n", faster.name, ms(faster.released))
+	} else {
+		fmt.Println(">>> CANCEL_COMPARE: FAIL a blocked UPDATE was still waiting on the server 5s after its deadline")
+	}
+	fmt.Println("Lock released is when the UPDATE's backend stopped waiting, seen from pg_stat_activity. The context deadline")
+	fmt.Println("fails on the client at once and releases the server only when its CancelRequest arrives, then leaves pgx a")
+	fmt.Println("connection in an unknown state, which it closes; statement_timeout fails with 57014 once the server has")
+	fmt.Println("stopped, and the session stays usable.")
+	return passed
+}
+
+// blockedUpdate runs the UPDATE of the locked row on its own connection
+// until the context deadline or statement_timeout ends it, and polls for the
+// moment its backend stops waiting
+func blockedUpdate(db *sql.DB, timeout time.Duration, serverSide bool) (cancelMechanism, error) {
+	r := cancelMechanism{name: "context deadline"}
+	if serverSide {
+		r.name = "statement_timeout"
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+	var pid int
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		return r, err
+	}
+	stmtCtx, cancel := context.WithTimeout(ctx, timeout)
+	if serverSide {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET statement_timeout = %d", timeout.Milliseconds())); err != nil {
+			cancel()
+			return r, err
+		}
+		defer conn.ExecContext(ctx, "RESET statement_timeout")
+		// Only a backstop: the server is expected to end the statement first
+		stmtCtx, cancel = context.WithTimeout(ctx, 3*timeout)
+	}
+	defer cancel()
+
+	start := time.Now()
+	_, r.err = conn.ExecContext(stmtCtx, "UPDATE test_cancel SET value = 'locked by B' WHERE id = 1")
+	r.client = time.Since(start)
+	if r.err == nil {
+		return r, errors.New("the blocked UPDATE completed while the lock was held")
+	}
+	for time.Since(start) < r.client+timeout {
+		var waiting bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE pid = $1 AND wait_event_type = 'Lock')", pid).Scan(&waiting); err != nil {
+			return r, err
+		}
+		if !waiting {
+			r.released = time.Since(start)
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	var after int
+	r.reused = conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&after) == nil && after == pid
+	return r, nil
+}
@@ -0,0 +1,132 @@
+// Scenario: a high rate of cancel requests through a pooler, checking that
+// each one only cancels the statement it was sent for.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// cancelStress counts both sides of the run. Cancellers run statements under
+// deadlines of a few milliseconds so that pgx sends a cancel request for
+// nearly every one; victims run short statements without any deadline, so a
+// cancel reaching one of them was routed to the wrong session.
+type cancelStress struct {
+	cancels        atomic.Int64 // canceller statements which hit their deadline
+	cancellerOK    atomic.Int64
+	victimOK       atomic.Int64
+	victimFailures atomic.Int64 // victim errors other than query_canceled
+
+	mu        sync.Mutex
+	misrouted []string // tags of victim statements canceled by someone else's cancel
+}
+
+func init() {
+	registerScenario("cancelstress", scenario{
+		standalone: func(o *options) bool {
+			return runCancelStress(o.connStr, o.cancelClients, o.cancelClients, o.cancelDuration)
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = 2 * o.cancelClients },
+	})
+}
+
+// runCancelStress runs cancellers and victims on one pool for duration. Point
+// DATABASE_URL at PgBouncer to exercise its cancel key mapping; with
+// transaction pooling a late cancel can reach a server connection which has
+// moved on to another client.
+func runCancelStress(connStr string, cancellers, victims int, duration time.Duration) bool {
+	db, err := openDB(connStr, "pg-idle-test-cancelstress")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(cancellers + victims)
+	db.SetMaxIdleConns(cancellers + victims)
+
+	s := &cancelStress{}
+	var stopping atomic.Bool
+	var wg sync.WaitGroup
+	for i := 0; i < cancellers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 0; !stopping.Load(); seq++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Duration(1+rand.Intn(20))*time.Millisecond)
+				_, err := db.ExecContext(ctx, fmt.Sprintf("/* cancelstress canceller=%d seq=%d */ SELECT pg_sleep(0.05)", i, seq))
+				cancel()
+				if err != nil {
+					s.cancels.Add(1)
+				} else {
+					s.cancellerOK.Add(1)
+				}
+			}
+		}()
+	}
+	for i := 0; i < victims; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 0; !stopping.Load(); seq++ {
+				tag := fmt.Sprintf("victim=%d seq=%d", i, seq)
+				_, err := db.ExecContext(context.Background(), fmt.Sprintf("/* cancelstress %s */ SELECT pg_sleep(0.02)", tag))
+				var pgErr *pgconn.PgError
+				switch {
+				case err == nil:
+					s.victimOK.Add(1)
+				case errors.As(err, &pgErr) && pgErr.Code == "57014":
+					fmt.Fprintf(os.Stderr, "[%s] CANCEL_STRESS: misrouted cancel hit %s\n", time.Now().Format("04:05"), tag)
+					s.mu.Lock()
+					s.misrouted = append(s.misrouted, tag)
+					s.mu.Unlock()
+				default:
+					s.victimFailures.Add(1)
+				}
+			}
+		}()
+	}
+
+	start := time.Now()
+	for time.Since(start) < duration {
+		time.Sleep(5 * time.Second)
+		fmt.Fprintf(os.Stderr, "[%s] CANCEL_STRESS: cancels=%d victims ok=%d misrouted=%d\n", time.Now().Format("04:05"),
+			s.cancels.Load(), s.victimOK.Load(), len(s.misroutedTags()))
+	}
+	stopping.Store(true)
+	wg.Wait()
+
+	misrouted := s.misroutedTags()
+	elapsed := time.Since(start).Seconds()
+	fmt.Println()
+	fmt.Println(">>> CANCEL STRESS REPORT")
+	fmt.Printf("cancellers:  %d statements canceled by their deadline (%.0f/s), %d finished first\n", s.cancels.Load(), float64(s.cancels.Load())/elapsed, s.cancellerOK.Load())
+	fmt.Printf("victims:     %d statements ok, %d canceled by a cancel meant for another session, %d other errors\n", s.victimOK.Load(), len(misrouted), s.victimFailures.Load())
+	for i, tag := range misrouted {
+		if i == 10 {
+			fmt.Printf("             ... %d more\n", len(misrouted)-i)
+			break
+		}
+		fmt.Printf("             misrouted cancel hit %s\n", tag)
+	}
+	fmt.Println()
+	if len(misrouted) > 0 {
+		fmt.Printf(">>> CANCEL STRESS: FAIL %d cancel requests canceled another client's statement\n", len(misrouted))
+		return false
+	}
+	fmt.Printf(">>> CANCEL STRESS: PASS no cancel request reached another client's statement\n")
+	return true
+}
+
+func (s *cancelStress) misroutedTags() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.misrouted...)
+}
@@ -0,0 +1,139 @@
+// Attribution of connection checkout latency to queueing, dialing and session reset.
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// timedConnector times new connections for the statement whose checkout
+// dials them. Connections dialed by database/sql's background opener for a
+// queued request are not attributed and count as queue time.
+type timedConnector struct {
+	driver.Connector
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := time.Now()
+	conn, err := c.Connector.Connect(ctx)
+	if q, ok := ctx.Value(inflightKey{}).(*inflightQuery); ok {
+		q.dial.Add(int64(time.Since(start)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{stdlibConn: conn.(*stdlib.Conn)}, nil
+}
+
+// timedConn times ResetSession, which database/sql runs when an idle
+// connection is checked out again and which pgx turns into a ping if the
+// connection has been idle for more than a second. The driver calls counted
+// in badconn.go are wrapped too; everything else is promoted from the embedded
+// stdlib connection, including Conn, through which Raw callers reach pgx.
+type timedConn struct {
+	*stdlibConn
+}
+
+// stdlibConn names the embedded field so that it does not shadow the
+// promoted (*stdlib.Conn).Conn method
+type stdlibConn = stdlib.Conn
+
+// pgxConnOf returns the pgx connection under a driver connection passed to
+// (*sql.Conn).Raw, or an error if the pool was not opened on pgx
+func pgxConnOf(driverConn any) (*pgx.Conn, error) {
+	c, ok := driverConn.(interface{ Conn() *pgx.Conn })
+	if !ok {
+		return nil, fmt.Errorf("driver connection %T has no pgx connection", driverConn)
+	}
+	return c.Conn(), nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	start := time.Now()
+	err := c.stdlibConn.ResetSession(ctx)
+	countOp("reset", err)
+	if q, ok := ctx.Value(inflightKey{}).(*inflightQuery); ok {
+		q.reset.Add(int64(time.Since(start)))
+	}
+	return err
+}
+
+// checkoutSample splits one checkout; queue is the remainder of the time from
+// the call into database/sql until the statement started on a connection
+type checkoutSample struct {
+	queue, dial, reset time.Duration
+	failed             bool // the statement never got a connection
+}
+
+var (
+	checkoutMu      sync.Mutex
+	checkoutSamples []checkoutSample
+)
+
+// recordCheckout is called once per tracked statement, when it starts on a
+// connection or, if it never does, when it returns
+func recordCheckout(q *inflightQuery, failed bool) {
+	if q.checkedOut.Swap(true) {
+		return
+	}
+	dial, reset := time.Duration(q.dial.Load()), time.Duration(q.reset.Load())
+	s := checkoutSample{queue: time.Since(q.start) - dial - reset, dial: dial, reset: reset, failed: failed}
+	checkoutMu.Lock()
+	checkoutSamples = append(checkoutSamples, s)
+	checkoutMu.Unlock()
+}
+
+// printCheckoutReport prints the distribution of each component, counting
+// only the checkouts where it occurred, and its share of all checkout time
+func printCheckoutReport() {
+	checkoutMu.Lock()
+	samples := append([]checkoutSample(nil), checkoutSamples...)
+	checkoutMu.Unlock()
+	if len(samples) == 0 {
+		return
+	}
+	failed := 0
+	var total time.Duration
+	for _, s := range samples {
+		if s.failed {
+			failed++
+		}
+		total += s.queue + s.dial + s.reset
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> CHECKOUT ATTRIBUTION: %d checkouts, %d never got a connection\n", len(samples), failed)
+	fmt.Printf("%-8s %8s %8s %10s %10s %10s %10s\n", "Part", "Count", "Share%", "p50", "p95", "p99", "max")
+	for _, part := range []struct {
+		name string
+		of   func(checkoutSample) time.Duration
+	}{
+		{"queue", func(s checkoutSample) time.Duration { return s.queue }},
+		{"dial", func(s checkoutSample) time.Duration { return s.dial }},
+		{"reset", func(s checkoutSample) time.Duration { return s.reset }},
+	} {
+		var sorted []time.Duration
+		var sum time.Duration
+		for _, s := range samples {
+			// Queue time is counted for every checkout; dial and reset only where they happened
+			if d := part.of(s); d > 0 || part.name == "queue" {
+				sorted = append(sorted, d)
+				sum += d
+			}
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(sum) / float64(total)
+		}
+		fmt.Printf("%-8s %8d %8.1f %10s %10s %10s %10s\n", part.name, len(sorted), share,
+			ms(percentile(sorted, 0.5)), ms(percentile(sorted, 0.95)), ms(percentile(sorted, 0.99)), ms(percentile(sorted, 1)))
+	}
+}
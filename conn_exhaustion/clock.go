@@ -0,0 +1,37 @@
+// Client/server clock skew, so client events can be lined up with server logs.
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// clockSkew is the server clock minus the client clock, measured at startup.
+// Client events are reported with serverTime so they can be matched against
+// log_line_prefix timestamps and pg_stat_activity columns on the server.
+var clockSkew time.Duration
+
+// measureClockSkew compares clock_timestamp() with the midpoint of the round
+// trip, keeping the sample with the shortest round trip. The result is
+// accurate to within half that round trip.
+func measureClockSkew(db *sql.DB) (skew, rtt time.Duration, err error) {
+	rtt = -1
+	for i := 0; i < 5; i++ {
+		var server time.Time
+		before := time.Now()
+		if err := db.QueryRow("SELECT clock_timestamp()").Scan(&server); err != nil {
+			return 0, 0, err
+		}
+		after := time.Now()
+		if d := after.Sub(before); rtt < 0 || d < rtt {
+			rtt = d
+			skew = server.Sub(before.Add(d / 2))
+		}
+	}
+	return skew, rtt, nil
+}
+
+// serverTime converts a client timestamp to the server's clock
+func serverTime(t time.Time) time.Time {
+	return t.Add(clockSkew)
+}
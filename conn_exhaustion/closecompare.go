@@ -0,0 +1,96 @@
+// Close-strategy comparison: how quickly the server cleans up after each.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+func init() {
+	registerScenario("closecompare", scenario{
+		standalone: func(o *options) bool { return runCloseCompare(o.connStr, o.closeConns) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = o.closeConns + 1 },
+	})
+}
+
+// runCloseCompare opens conns sessions per close strategy, leaves half of them
+// inside an open transaction, closes the pool and measures how long the
+// backends stay visible in pg_stat_activity. Server log lines caused by each
+// strategy ("unexpected EOF on client connection", "connection reset by peer")
+// are counted by the test script from the Postgres log.
+func runCloseCompare(connStr string, conns int) bool {
+	monitor, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer monitor.Close()
+	monitor.SetMaxOpenConns(1)
+
+	saved := closeStrategy
+	defer func() { closeStrategy = saved }()
+
+	fmt.Println(">>> CLOSE_COMPARE")
+	fmt.Printf("%-10s %8s %12s %10s\n", "Strategy", "Sessions", "Cleanup", "Leftover")
+	ok := true
+	for _, strategy := range closeStrategies {
+		closeStrategy = strategy
+		appName := "pg-idle-test-close-" + strategy
+		fmt.Fprintf(os.Stderr, "[%s] CLOSE_COMPARE: %s, application_name=%s\n", time.Now().Format("04:05"), strategy, appName)
+		opened, err := openAndHold(connStr, appName, conns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", strategy, err)
+			ok = false
+			continue
+		}
+
+		// The pool has been closed; wait for the server to notice
+		start := time.Now()
+		var remaining int
+		for time.Since(start) < 10*time.Second {
+			monitor.QueryRow("SELECT count(*) FROM pg_stat_activity WHERE application_name = $1", appName).Scan(&remaining)
+			if remaining == 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		fmt.Printf("%-10s %8d %12s %10d\n", strategy, opened, time.Since(start).Round(time.Millisecond), remaining)
+		ok = ok && remaining == 0
+	}
+	return ok
+}
+
+// openAndHold checks out conns connections at once, opens a transaction on
+// every second one and closes the whole pool
+func openAndHold(connStr, appName string, conns int) (int, error) {
+	db, err := openDB(connStr, appName)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(conns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var held []*sql.Conn
+	for i := 0; i < conns; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return len(held), err
+		}
+		held = append(held, conn)
+		if i%2 == 1 {
+			conn.ExecContext(ctx, "BEGIN")
+		}
+		conn.ExecContext(ctx, "SELECT 1")
+	}
+	// Return the raw connections to the pool (open transactions included) so
+	// that db.Close closes them with the configured strategy
+	for _, conn := range held {
+		conn.Close()
+	}
+	return len(held), nil
+}
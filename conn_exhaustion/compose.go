@@ -0,0 +1,220 @@
+// Fault composition from the command line: "poison + latency(200ms) +
+// kill-backend@45s" instead of a new scenario file per combination.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// composeKinds are the faults a composition can name, with the injection of
+// fuzz.go each runs:
+//   - lock, poison: the row lock held outside the pool or left on a pooled
+//     connection, rolled back or terminated when the fault ends
+//   - kill-backend (or kill): pg_terminate_backend of one worker session
+//   - latency(d): d added to every write to the server
+//   - dns(d): d added to every host lookup of a new connection
+//   - ddl: an ALTER TABLE of the workload's table queued behind a reader
+//     idle in transaction, both rolled back when the fault ends
+var composeKinds = []string{"lock", "poison", "kill-backend", "kill", "latency", "dns", "ddl"}
+
+// poisonTableRE finds the table in a workload's poison statement
+var poisonTableRE = regexp.MustCompile(`(?i)\b(?:UPDATE|FROM)\s+(\w+)`)
+
+// workloadTable is the table the workload's poison statement locks
+func workloadTable(wl workload) string {
+	if m := poisonTableRE.FindStringSubmatch(wl.poisonSQL()); m != nil {
+		return m[1]
+	}
+	return "test_row"
+}
+
+// composeWorkerApp is the application_name of the worker pool, so
+// kill-backend only picks worker sessions
+const composeWorkerApp = "pg-idle-test-compose"
+
+// composedFault is one term of a composition: kind[(arg)][@from[-to]]. A
+// fault without @ starts with the composition; one without an end lasts
+// until -hold-duration.
+type composedFault struct {
+	term     string
+	kind     string
+	arg      time.Duration
+	from, to time.Duration
+}
+
+// parseComposition splits spec on "+" and validates every term
+func parseComposition(spec string, hold time.Duration) ([]composedFault, error) {
+	var faults []composedFault
+	for _, term := range strings.Split(spec, "+") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return nil, fmt.Errorf("empty term in %q", spec)
+		}
+		f := composedFault{term: term, to: hold}
+		kind, at, timed := strings.Cut(term, "@")
+		if arg, ok := strings.CutSuffix(kind, ")"); ok {
+			name, raw, ok := strings.Cut(arg, "(")
+			if !ok {
+				return nil, fmt.Errorf("%s: unbalanced parenthesis", term)
+			}
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s: invalid duration %q", term, raw)
+			}
+			kind, f.arg = name, d
+		}
+		f.kind = strings.TrimSpace(kind)
+		if !slices.Contains(composeKinds, f.kind) {
+			return nil, fmt.Errorf("unknown fault %q (known: %s)", f.kind, strings.Join(composeKinds, ", "))
+		}
+		if f.kind == "kill" {
+			f.kind = "kill-backend"
+		}
+		needsArg := f.kind == "latency" || f.kind == "dns"
+		if needsArg != (f.arg > 0) {
+			return nil, fmt.Errorf("%s: latency and dns take a duration, e.g. latency(200ms); the others take none", term)
+		}
+		if timed {
+			from, to, ranged := strings.Cut(at, "-")
+			var err error
+			if f.from, err = time.ParseDuration(from); err != nil || f.from < 0 {
+				return nil, fmt.Errorf("%s: invalid start %q", term, from)
+			}
+			if ranged {
+				if f.to, err = time.ParseDuration(to); err != nil || f.to <= f.from {
+					return nil, fmt.Errorf("%s: invalid end %q", term, to)
+				}
+			} else if f.to <= f.from && f.kind != "kill-backend" {
+				return nil, fmt.Errorf("%s: starts after -hold-duration %v, give an end", term, hold)
+			}
+		}
+		if f.kind == "kill-backend" {
+			f.to = f.from
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+// composedDDL counts the ddl faults, which hold two control connections each
+func composedDDL(faults []composedFault) int {
+	n := 0
+	for _, f := range faults {
+		if f.kind == "ddl" {
+			n++
+		}
+	}
+	return n
+}
+
+func init() {
+	registerScenario("compose", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runComposition(h.db, h.connStr, h.wl, h.o.composition)
+		},
+		validate: func(o *options) (err error) {
+			if o.compose == "" {
+				return fmt.Errorf("compose needs -compose, e.g. -compose='poison + latency(200ms) + kill-backend@45s'")
+			}
+			if o.composition, err = parseComposition(o.compose, o.hold); err != nil {
+				return fmt.Errorf("Invalid -compose: %v", err)
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns += 2 + 2*composedDDL(o.composition) // injection control, and reader and migration of each ddl
+		},
+		appName:          composeWorkerApp,
+		latencyInjection: true,
+	})
+}
+
+// runComposition starts every fault at its time and starts a phase whenever
+// the set of active faults changes, so the phase report compares each
+// combination. Like fuzz, it passes if the pool recovers after the last
+// fault ended.
+func runComposition(db *sql.DB, connStr string, wl workload, faults []composedFault) bool {
+	ctl, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to open injection control connection: %v\n", err)
+		return false
+	}
+	defer ctl.Close()
+	ctl.SetMaxOpenConns(2 + 2*composedDDL(faults))
+
+	fmt.Printf(">>> COMPOSE: %d faults\n", len(faults))
+	var end time.Duration
+	boundaries := []time.Duration{0}
+	for _, f := range faults {
+		fmt.Printf("    %-28s %6.1fs - %6.1fs\n", f.term, f.from.Seconds(), f.to.Seconds())
+		end = max(end, f.to)
+		boundaries = append(boundaries, f.from, f.to)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+	boundaries = slices.Compact(boundaries)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, f := range faults {
+		wg.Add(1)
+		e := fuzzEvent{at: f.from, kind: f.kind, hold: f.to - f.from, delay: f.arg}
+		if f.kind == "kill-backend" {
+			e.kind = "kill" // the worker session with the lowest PID
+		}
+		time.AfterFunc(f.from, func() {
+			defer wg.Done()
+			fmt.Printf(">>> COMPOSE: +%5.1fs inject %s\n", time.Since(start).Seconds(), f.term)
+			recordEvent("composed fault: %s", f.term)
+			if err := inject(db, ctl, wl, composeWorkerApp, e); err != nil {
+				fmt.Printf(">>> COMPOSE: +%5.1fs %s failed: %v\n", time.Since(start).Seconds(), f.term, err)
+			}
+		})
+	}
+	for _, b := range boundaries {
+		if b >= end && end > 0 {
+			break
+		}
+		time.Sleep(time.Until(start.Add(b)))
+		var active []string
+		for _, f := range faults {
+			if f.from <= b && b < f.to {
+				active = append(active, f.term)
+			}
+		}
+		if len(active) == 0 {
+			active = []string{"none"}
+		}
+		// An instantaneous kill-backend does not change the active set
+		if name := "compose:" + strings.Join(active, "+"); name != currentPhase.Load().name {
+			startPhase(name)
+		}
+	}
+	time.Sleep(time.Until(start.Add(end)))
+	wg.Wait()
+
+	startPhase("compose:settle")
+	time.Sleep(5 * time.Second)
+	startPhase("compose:recovered")
+	time.Sleep(5 * time.Second)
+
+	p := currentPhase.Load()
+	p.mu.Lock()
+	ok, failed := p.ok, p.failed
+	p.mu.Unlock()
+	fmt.Println()
+	if ok == 0 || failed > 0 {
+		fmt.Printf(">>> COMPOSE: FAIL stall: %d ok and %d failed iterations 5s after the last fault ended\n", ok, failed)
+		return false
+	}
+	fmt.Printf(">>> COMPOSE: PASS pool recovered, %d ok iterations after the last fault ended\n", ok)
+	return true
+}
@@ -0,0 +1,248 @@
+// Run configuration files: the scenario, DSN and flags of a run in one TOML or
+// YAML file.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configSetting is one key of a config file with its values, several for a
+// list such as phase
+type configSetting struct {
+	key    string
+	values []string
+	line   int
+}
+
+// runConfig is a parsed config file. Keys are flag names without the dash,
+// plus scenario and dsn. Sections (TOML [table], YAML nested mappings) only
+// group keys for the reader.
+type runConfig struct {
+	path     string
+	scenario string
+	dsn      string
+	settings []configSetting
+}
+
+func configFormat(path string) (string, error) {
+	if name, ok := strings.CutPrefix(path, builtinPrefix); ok {
+		path = builtinPath(name)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return "toml", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	}
+	return "", fmt.Errorf("%s: unknown config format, use .toml, .yaml or .yml", path)
+}
+
+// loadConfig parses the flat subset of TOML and YAML the tool writes: key
+// and value pairs, quoted or bare scalars, inline [a, b] lists and, in YAML,
+// "- item" lists
+func loadConfig(path string) (*runConfig, error) {
+	format, err := configFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &runConfig{path: path}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		if format == "toml" && strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			continue
+		}
+		if format == "yaml" && strings.HasPrefix(line, "- ") {
+			if len(cfg.settings) == 0 {
+				return nil, fmt.Errorf("%s:%d: list item without a key", path, n)
+			}
+			v, err := configScalar(strings.TrimSpace(line[2:]))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			last := &cfg.settings[len(cfg.settings)-1]
+			last.values = append(last.values, v)
+			continue
+		}
+		sep := "="
+		if format == "yaml" {
+			sep = ":"
+		}
+		key, raw, ok := strings.Cut(line, sep)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key %s value", path, n, sep)
+		}
+		key, raw = strings.TrimSpace(key), strings.TrimSpace(raw)
+		if raw == "" {
+			// A YAML section or the start of a "- item" list
+			cfg.settings = append(cfg.settings, configSetting{key: key, line: n})
+			continue
+		}
+		values, err := configValues(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+		}
+		cfg.settings = append(cfg.settings, configSetting{key: key, values: values, line: n})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// scenario and dsn are not flags
+	settings := cfg.settings[:0]
+	for _, s := range cfg.settings {
+		switch {
+		case s.key == "scenario" && len(s.values) == 1:
+			cfg.scenario = s.values[0]
+		case s.key == "dsn" && len(s.values) == 1:
+			cfg.dsn = s.values[0]
+		case len(s.values) > 0:
+			settings = append(settings, s)
+		}
+	}
+	cfg.settings = settings
+	return cfg, nil
+}
+
+// stripConfigComment removes a # comment outside quotes
+func stripConfigComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func configValues(raw string) ([]string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		v, err := configScalar(raw)
+		return []string{v}, err
+	}
+	if !strings.HasSuffix(raw, "]") {
+		return nil, fmt.Errorf("unterminated list")
+	}
+	var values []string
+	var quote rune
+	start := 1
+	for i, c := range raw {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && (c == ',' || i == len(raw)-1):
+			if item := strings.TrimSpace(raw[start:i]); item != "" {
+				v, err := configScalar(item)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+			start = i + 1
+		}
+	}
+	return values, nil
+}
+
+func configScalar(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("unterminated string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+	return raw, nil
+}
+
+// apply sets every flag of the file which was not given on the command line,
+// so the command line overrides the file
+func (cfg *runConfig) apply(fs *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, s := range cfg.settings {
+		f := fs.Lookup(s.key)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown setting %s", cfg.path, s.line, s.key)
+		}
+		if explicit[s.key] {
+			continue
+		}
+		for _, v := range s.values {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("%s:%d: %s: %v", cfg.path, s.line, s.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configSkipped are flags which describe how to run the tool rather than the
+// run itself
+var configSkipped = map[string]bool{"config": true, "write-config": true, "instance-name": true, "preflight-only": true}
+
+// writeConfig writes the scenario, DSN and every setting differing from its
+// default to path, in the format its extension names
+func writeConfig(path, scenario, dsn string, fs *flag.FlagSet) error {
+	format, err := configFormat(path)
+	if err != nil {
+		return err
+	}
+	sep := " = "
+	if format == "yaml" {
+		sep = ": "
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# pg-idle-test run configuration, replay with -config=%s\n", filepath.Base(path))
+	fmt.Fprintf(&b, "scenario%s%s\n", sep, strconv.Quote(scenario))
+	if dsn != "" {
+		fmt.Fprintf(&b, "dsn%s%s\n", sep, strconv.Quote(dsn))
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if configSkipped[f.Name] {
+			return
+		}
+		if phases, ok := f.Value.(*phaseFlags); ok {
+			if len(*phases) == 0 {
+				return
+			}
+			var specs []string
+			for _, phase := range *phases {
+				var parts []string
+				for _, s := range phase {
+					parts = append(parts, s.name+"="+s.value)
+				}
+				specs = append(specs, strconv.Quote(strings.Join(parts, ",")))
+			}
+			fmt.Fprintf(&b, "%s%s[%s]\n", f.Name, sep, strings.Join(specs, ", "))
+			return
+		}
+		if v := f.Value.String(); v != f.DefValue {
+			fmt.Fprintf(&b, "%s%s%s\n", f.Name, sep, strconv.Quote(v))
+		}
+	})
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
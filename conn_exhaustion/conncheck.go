@@ -0,0 +1,197 @@
+// Scenario: client_connection_check_interval (PG14+) aborting queries whose
+// client vanished mid-query.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// connCheckQueries are the statements left running by the killed client:
+// pg_sleep stands in for a long query, and the lock wait is the blocked
+// worker of test_client_kill.sh, which otherwise outlives its client until
+// the lock is released
+var connCheckQueries = []struct{ name, sql string }{
+	{"sleep", "SELECT pg_sleep(%g)"},
+	{"lockwait", "UPDATE test_conncheck SET val = val + 1 WHERE id = 1"},
+}
+
+var connCheckIntervals = []string{"0", "1s"}
+
+const connCheckKillAfter = 2 * time.Second
+
+type connCheckResult struct {
+	wasted time.Duration // from the client's death until its backend exited
+	lived  bool          // backend kept running for most of the rest of the query
+}
+
+func init() {
+	registerScenario("conncheck", scenario{
+		standalone: func(o *options) bool { return runConnCheck(o.connStr, o.connCheckQuery) },
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns = 3           // query child, lock holder and poller
+			n.minVersion = 140000 // client_connection_check_interval
+		},
+	})
+}
+
+// runConnCheck kills a child process in the middle of each query with
+// client_connection_check_interval off and on, and measures how long the
+// server kept working for the dead client
+func runConnCheck(connStr string, queryTime time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_conncheck")
+	setup.Exec("CREATE TABLE test_conncheck (id INT PRIMARY KEY, val INT)")
+	setup.Exec("INSERT INTO test_conncheck VALUES (1, 0)")
+
+	results := map[string]connCheckResult{}
+	for _, q := range connCheckQueries {
+		for _, interval := range connCheckIntervals {
+			fmt.Fprintf(os.Stderr, "[%s] CONN_CHECK: %s interval=%s\n", time.Now().Format("04:05"), q.name, interval)
+			query := q.sql
+			if strings.Contains(query, "%g") {
+				query = fmt.Sprintf(query, queryTime.Seconds())
+			}
+			r, err := connCheckOnce(connStr, setup, query, q.name == "lockwait", interval, queryTime)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %s interval=%s: %v\n", q.name, interval, err)
+				return false
+			}
+			results[q.name+"/"+interval] = r
+		}
+	}
+
+	fmt.Println()
+	fmt.Println(">>> CONN CHECK REPORT")
+	fmt.Printf("%-10s %-10s %14s %s\n", "Query", "Interval", "WastedSeconds", "Outcome")
+	ok := true
+	for _, q := range connCheckQueries {
+		for _, interval := range connCheckIntervals {
+			r := results[q.name+"/"+interval]
+			note := "aborted after the client died"
+			if r.lived {
+				note = "ran to completion for a dead client"
+				ok = ok && interval == "0"
+			}
+			fmt.Printf("%-10s %-10s %14.1f %s\n", q.name, interval, r.wasted.Seconds(), note)
+		}
+	}
+	fmt.Println()
+	if !ok {
+		fmt.Println(">>> CONN CHECK: FAIL client_connection_check_interval did not abort a query of a dead client")
+		return false
+	}
+	fmt.Println(">>> CONN CHECK: PASS client_connection_check_interval aborted every query of a dead client")
+	return true
+}
+
+// connCheckOnce starts a child which runs query with the given interval, kills
+// it connCheckKillAfter into the query and follows its backend until it
+// exits. With holdLock the row is locked by setup for queryTime so that the
+// query waits on it.
+func connCheckOnce(connStr string, setup *sql.DB, query string, holdLock bool, interval string, queryTime time.Duration) (connCheckResult, error) {
+	var r connCheckResult
+	if holdLock {
+		tx, err := setup.Begin()
+		if err != nil {
+			return r, err
+		}
+		if _, err := tx.Exec("UPDATE test_conncheck SET val = val + 1 WHERE id = 1"); err != nil {
+			tx.Rollback()
+			return r, err
+		}
+		release := time.AfterFunc(queryTime, func() { tx.Rollback() })
+		defer func() {
+			release.Stop()
+			tx.Rollback()
+		}()
+	}
+
+	cmd, err := childCommand(connStr, "querychild", "client_connection_check_interval="+interval, query)
+	if err != nil {
+		return r, err
+	}
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return r, err
+	}
+	if err := cmd.Start(); err != nil {
+		return r, err
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	var pid int
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if n, _ := fmt.Sscanf(scanner.Text(), "RUNNING pid=%d", &pid); n == 1 {
+			break
+		}
+		fmt.Println(scanner.Text())
+	}
+	if pid == 0 {
+		return r, fmt.Errorf("query child exited before running the query")
+	}
+	go io.Copy(io.Discard, stdout)
+
+	start := time.Now()
+	time.Sleep(connCheckKillAfter)
+	cmd.Process.Kill()
+	killed := time.Now()
+	fmt.Printf(">>> CONN_CHECK: killed the client %s into its query (server PID %d)\n", connCheckKillAfter, pid)
+
+	deadline := start.Add(queryTime + 5*time.Second)
+	for {
+		var alive bool
+		if err := setup.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE pid = $1)", pid).Scan(&alive); err != nil {
+			return r, err
+		}
+		if !alive {
+			break
+		}
+		if time.Now().After(deadline) {
+			setup.Exec("SELECT pg_terminate_backend($1)", pid)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	r.wasted = time.Since(killed)
+	r.lived = r.wasted > queryTime/2
+	return r, nil
+}
+
+// runQueryChild is the child side of conncheck: it applies the setting,
+// reports its PID and runs query until it finishes or the child is killed
+func runQueryChild(connStr string, setting string, query string) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "querychild: %v\n", err)
+		os.Exit(1)
+	}
+	name, value, _ := strings.Cut(setting, "=")
+	var pid int
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid() FROM set_config($1, $2, false)", name, value).Scan(&pid); err != nil {
+		fmt.Fprintf(os.Stderr, "querychild: %s: %v\n", setting, err)
+		os.Exit(1)
+	}
+	fmt.Printf("RUNNING pid=%d\n", pid)
+	conn.ExecContext(ctx, query)
+}
@@ -0,0 +1,251 @@
+// Construction of the worker pool and its connection close strategy.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// closeStrategies are the ways a pooled connection can be closed:
+//   - graceful: pgx sends Terminate, then closes the socket (FIN)
+//   - fin: the Terminate message is dropped, the socket is closed (FIN)
+//   - rst: the Terminate message is dropped and SO_LINGER=0 makes the close send RST
+//
+// Dropping Terminate relies on seeing the plaintext message, so fin and rst
+// require sslmode=disable.
+var closeStrategies = []string{"graceful", "fin", "rst"}
+
+// closeStrategy applies to pools opened with openDB
+var closeStrategy = "graceful"
+
+// extraRuntimeParams are startup parameters added to pools opened with openDB
+var extraRuntimeParams map[string]string
+
+// queryExecMode overrides pgx's default_query_exec_mode for pools opened with
+// openDB; "" keeps the connection string's
+var queryExecMode string
+
+// terminateMsg is the frontend Terminate message
+var terminateMsg = []byte{'X', 0, 0, 0, 4}
+
+// abruptCloseConn hides the Terminate message from the server and optionally
+// resets the connection on close
+type abruptCloseConn struct {
+	net.Conn
+	rst bool
+}
+
+func (c *abruptCloseConn) Write(b []byte) (int, error) {
+	if bytes.Equal(b, terminateMsg) {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *abruptCloseConn) Close() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok && c.rst {
+		tcp.SetLinger(0)
+	}
+	return c.Conn.Close()
+}
+
+// injectedLatency delays every write on pools opened with latencyInjection
+// set, standing in for a latency toxic between client and server
+var (
+	latencyInjection bool
+	injectedLatency  atomic.Int64 // nanoseconds
+)
+
+type latencyConn struct {
+	net.Conn
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	if d := injectedLatency.Load(); d > 0 {
+		time.Sleep(time.Duration(d))
+	}
+	return c.Conn.Write(b)
+}
+
+// injectedDNSLatency delays every host lookup of pools opened with openDB,
+// standing in for a slow resolver; dnsLookups and dnsWait count the lookups
+// and the time spent in them
+var (
+	injectedDNSLatency atomic.Int64 // nanoseconds
+	dnsLookups         atomic.Int64
+	dnsWait            atomic.Int64 // nanoseconds
+)
+
+func slowLookup(lookup pgconn.LookupFunc) pgconn.LookupFunc {
+	return func(ctx context.Context, host string) ([]string, error) {
+		start := time.Now()
+		dnsLookups.Add(1)
+		defer func() { dnsWait.Add(int64(time.Since(start))) }()
+		if d := injectedDNSLatency.Load(); d > 0 {
+			t := time.NewTimer(time.Duration(d))
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+		}
+		return lookup(ctx, host)
+	}
+}
+
+// sessionConn is the outermost wrapper of every connection dialed by openDB
+// and carries the backend PID, captured once per physical connection
+type sessionConn struct {
+	net.Conn
+	pid atomic.Int32
+}
+
+// sessionOf finds the sessionConn under a pgx connection, looking through TLS
+func sessionOf(conn *pgx.Conn) *sessionConn {
+	nc := conn.PgConn().Conn()
+	if tlsConn, ok := nc.(*tls.Conn); ok {
+		nc = tlsConn.NetConn()
+	}
+	s, _ := nc.(*sessionConn)
+	return s
+}
+
+// socketOf unwraps the dial wrappers of openDB down to the connection it
+// dialed; an encrypted connection stays the *tls.Conn over them
+func socketOf(conn *pgx.Conn) net.Conn {
+	nc := conn.PgConn().Conn()
+	for {
+		switch c := nc.(type) {
+		case *sessionConn:
+			nc = c.Conn
+		case *silentDropConn:
+			nc = c.Conn
+		case *latencyConn:
+			nc = c.Conn
+		case *abruptCloseConn:
+			nc = c.Conn
+		default:
+			return nc
+		}
+	}
+}
+
+// pooledPID is the backend PID openDB captured for conn's session. It fails
+// on pools not opened by openDB, which have no captured PID.
+func pooledPID(conn *sql.Conn) (int32, error) {
+	var pid int32
+	err := conn.Raw(func(driverConn any) error {
+		c, err := pgxConnOf(driverConn)
+		if err != nil {
+			return err
+		}
+		s := sessionOf(c)
+		if s == nil {
+			return errors.New("connection was not dialed by openDB")
+		}
+		pid = s.pid.Load()
+		return nil
+	})
+	return pid, err
+}
+
+// capturePID runs once after each connect. pg_backend_pid() is used rather
+// than the PID from BackendKeyData, which is PgBouncer's own behind a pooler.
+func capturePID(ctx context.Context, conn *pgx.Conn) error {
+	connectsTotal.Add(1)
+	if s := sessionOf(conn); s != nil {
+		var pid int32
+		if err := conn.QueryRow(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+			return err
+		}
+		s.pid.Store(pid)
+		closedBackends.Delete(pid)
+	}
+	return nil
+}
+
+// pidTracer attaches the cached backend PID to every statement
+type pidTracer struct{}
+
+func (pidTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	if s := sessionOf(conn); s != nil {
+		statementStarted(ctx, s.pid.Load())
+	}
+	return ctx
+}
+
+func (pidTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {}
+
+// openDB opens a database/sql pool through pgx stdlib using the configured
+// close strategy and acquire check, timing checkouts for the checkout
+// attribution report and tagging statements for the orphan detector. A
+// non-empty appName sets application_name so the sessions can be told apart
+// in pg_stat_activity.
+func openDB(connStr string, appName string) (*sql.DB, error) {
+	cfg, err := pgx.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+	if appName != "" {
+		cfg.RuntimeParams["application_name"] = appName
+	}
+	for name, value := range extraRuntimeParams {
+		cfg.RuntimeParams[name] = value
+	}
+	if mode, ok := queryExecModes[queryExecMode]; ok {
+		cfg.DefaultQueryExecMode = mode
+	}
+	if strategy := closeStrategy; strategy != "graceful" {
+		dial := cfg.DialFunc
+		cfg.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &abruptCloseConn{Conn: conn, rst: strategy == "rst"}, nil
+		}
+	}
+	if latencyInjection {
+		dial := cfg.DialFunc
+		cfg.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &latencyConn{Conn: conn}, nil
+		}
+	}
+	if after := silentDropAfter; after > 0 {
+		dial := cfg.DialFunc
+		cfg.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newSilentDropConn(conn, after), nil
+		}
+	}
+	dial := cfg.DialFunc
+	cfg.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &sessionConn{Conn: conn}, nil
+	}
+	cfg.LookupFunc = slowLookup(cfg.LookupFunc)
+	cfg.Tracer = pidTracer{}
+	return sql.OpenDB(timedConnector{stdlib.GetConnector(*cfg,
+		stdlib.OptionAfterConnect(capturePID), stdlib.OptionResetSession(validateOnAcquire))}), nil
+}
@@ -0,0 +1,243 @@
+// Client-side connection storm: thousands of connections from one process.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// stormResult is shared by the connecting goroutines and the sampler
+type stormResult struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	failures  map[string]int
+	examples  map[string]string
+	firstFail map[string]int64 // open connections when the class first occurred
+
+	open     atomic.Int64
+	maxLagNs atomic.Int64 // worst scheduler lag in the current sample interval
+}
+
+func classifyStormError(err error) string {
+	var pgErr *pgconn.PgError
+	switch {
+	case isFDExhaustion(err):
+		return "fd_exhaustion"
+	case errors.Is(err, syscall.ENFILE):
+		return "system_fd_exhaustion"
+	case isPortExhaustion(err):
+		return "port_exhaustion"
+	case errors.As(err, &pgErr) && (pgErr.Code == "53300" || pgErr.Code == "53400"):
+		return "server_connection_limit"
+	case errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err):
+		return "connect_timeout"
+	}
+	return classifyError(err)
+}
+
+// openFDs counts the file descriptors of this process, or -1 if unknown
+func openFDs() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return len(entries)
+		}
+	}
+	return -1
+}
+
+// localPortRange returns the Linux ephemeral port range, or 0, 0 if unknown
+func localPortRange() (int, int) {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 0, 0
+	}
+	var lo, hi int
+	fmt.Sscan(string(b), &lo, &hi)
+	return lo, hi
+}
+
+// measureSchedulerLag records how late a 5ms sleep wakes up, a proxy for Go
+// scheduler and GC pressure while thousands of goroutines are parked in reads
+func measureSchedulerLag(ctx context.Context, r *stormResult) {
+	const interval = 5 * time.Millisecond
+	for ctx.Err() == nil {
+		start := time.Now()
+		time.Sleep(interval)
+		lag := int64(time.Since(start) - interval)
+		for {
+			cur := r.maxLagNs.Load()
+			if lag <= cur || r.maxLagNs.CompareAndSwap(cur, lag) {
+				break
+			}
+		}
+	}
+}
+
+func init() {
+	registerScenario("connstorm", scenario{
+		standalone: func(o *options) bool { return runConnStorm(o.connStr, o.stormConns, o.stormRate, o.stormHold) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = o.stormConns },
+	})
+}
+
+// runConnStorm opens target connections (at most rate per second, 0 for no
+// limit), holds them for hold and reports where the client ran out of room
+func runConnStorm(connStr string, target int, rate float64, hold time.Duration) bool {
+	soft, hard, haveLimit := fdLimit()
+	portLo, portHi := localPortRange()
+	fmt.Printf(">>> CONN_STORM: target=%d GOMAXPROCS=%d", target, runtime.GOMAXPROCS(0))
+	if haveLimit {
+		fmt.Printf(" nofile=%d/%d", soft, hard)
+	}
+	if portHi > 0 {
+		fmt.Printf(" ephemeral_ports=%d-%d", portLo, portHi)
+	}
+	fmt.Println()
+
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(target)
+	db.SetMaxIdleConns(target)
+
+	r := &stormResult{failures: map[string]int{}, examples: map[string]string{}, firstFail: map[string]int64{}}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go measureSchedulerLag(ctx, r)
+
+	var failed atomic.Int64
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			fmt.Fprintf(os.Stderr, "[%s] CONN_STORM: open=%d failed=%d fds=%d goroutines=%d sched_lag_max=%.1fms\n",
+				time.Now().Format("04:05"), r.open.Load(), failed.Load(), openFDs(), runtime.NumGoroutine(),
+				float64(r.maxLagNs.Swap(0))/1e6)
+		}
+	}()
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < target; i++ {
+		if rate > 0 {
+			if wait := time.Duration(float64(i)/rate*float64(time.Second)) - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			connCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			t0 := time.Now()
+			conn, err := db.Conn(connCtx)
+			if err == nil {
+				err = conn.PingContext(connCtx)
+			}
+			if err != nil {
+				failed.Add(1)
+				class := classifyStormError(err)
+				r.mu.Lock()
+				if r.failures[class] == 0 {
+					r.examples[class] = err.Error()
+					r.firstFail[class] = r.open.Load()
+				}
+				r.failures[class]++
+				r.mu.Unlock()
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			r.mu.Lock()
+			r.latencies = append(r.latencies, time.Since(t0))
+			r.mu.Unlock()
+			r.open.Add(1)
+			<-release
+			conn.Close()
+		}()
+	}
+
+	// Wait for the last connects to land, then hold
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if r.open.Load()+failed.Load() >= int64(target) {
+			break
+		}
+	}
+	peak := r.open.Load()
+	fmt.Printf(">>> CONN_STORM: %d connections open after %.1fs, holding for %s\n", peak, time.Since(start).Seconds(), hold)
+	time.Sleep(hold)
+	close(release)
+	wg.Wait()
+	stop()
+
+	return reportConnStorm(r, target, peak, soft, haveLimit, portLo, portHi)
+}
+
+func reportConnStorm(r *stormResult, target int, peak int64, nofile uint64, haveLimit bool, portLo, portHi int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	fmt.Println()
+	fmt.Println(">>> CONN_STORM REPORT")
+	fmt.Printf("%-28s %d of %d\n", "Peak open connections", peak, target)
+	fmt.Printf("%-28s p50=%s p99=%s max=%s\n", "Connect latency",
+		percentile(r.latencies, 0.5).Round(time.Millisecond), percentile(r.latencies, 0.99).Round(time.Millisecond),
+		percentile(r.latencies, 1).Round(time.Millisecond))
+	classes := make([]string, 0, len(r.failures))
+	for class := range r.failures {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Printf("%-28s %d failures, first at %d open: %s\n", class, r.failures[class], r.firstFail[class], r.examples[class])
+	}
+
+	var guidance []string
+	if n := r.failures["fd_exhaustion"]; n > 0 && haveLimit {
+		guidance = append(guidance, fmt.Sprintf("process ran out of file descriptors (nofile=%d): raise `ulimit -n` to at least %d, or use fewer connections per process", nofile, target+256))
+	}
+	if r.failures["system_fd_exhaustion"] > 0 {
+		guidance = append(guidance, "system-wide file table is full: raise fs.file-max")
+	}
+	if r.failures["port_exhaustion"] > 0 {
+		guidance = append(guidance, fmt.Sprintf("ephemeral ports exhausted (range %d-%d, %d ports per destination): widen net.ipv4.ip_local_port_range, reuse connections instead of reconnecting, or spread across destination addresses", portLo, portHi, portHi-portLo+1))
+	}
+	if r.failures["server_connection_limit"] > 0 {
+		guidance = append(guidance, "the server refused connections before the client hit its own limits: put a pooler in front of Postgres or shrink pool sizes")
+	}
+	if p99 := percentile(r.latencies, 0.99); p99 > time.Second {
+		guidance = append(guidance, fmt.Sprintf("connect p99 is %s: connection setup (TLS, auth, backend fork) dominates at this scale, so pools should be pre-warmed and not churned", p99.Round(time.Millisecond)))
+	}
+	if len(guidance) == 0 {
+		guidance = append(guidance, fmt.Sprintf("no client-side limit reached at %d connections", target))
+	}
+	fmt.Println()
+	fmt.Println(">>> GUIDANCE")
+	for _, g := range guidance {
+		fmt.Println("  - " + strings.TrimSpace(g))
+	}
+	return int(peak) == target
+}
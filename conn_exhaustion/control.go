@@ -0,0 +1,152 @@
+// Phase changes driven by rows inserted into a control table, or by
+// notifications on a control channel.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// controlCommands are the phases which move the run forward rather than only
+// labelling the phase report:
+//   - inject: end the warmup and inject the fault
+//   - stop: end the fault and finish the run (poison and sleep modes)
+var controlCommands = []string{"inject", "stop"}
+
+// phaseControl follows the control table from its own connection, the
+// control channel, or both. Every other phase inserted or notified starts a
+// phase of that name in the phase report, so that an external tool can mark
+// what it is doing to the database at the time.
+type phaseControl struct {
+	db      *sql.DB
+	table   string // sanitized, empty without a control table
+	channel *controlChannel
+	mu      sync.Mutex
+	seen    map[string]chan struct{}
+}
+
+// phaseCtl is nil unless -control-table or -control-channel is set
+var phaseCtl *phaseControl
+
+func newPhaseControl() *phaseControl {
+	c := &phaseControl{seen: map[string]chan struct{}{}}
+	for _, command := range controlCommands {
+		c.seen[command] = make(chan struct{})
+	}
+	return c
+}
+
+// followTable creates the control table if needed and follows rows inserted
+// after the start of the run
+func (c *phaseControl) followTable(ctx context.Context, connStr string, table string) error {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	c.db, c.table = db, pgx.Identifier(strings.Split(table, ".")).Sanitize()
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + c.table + ` (
+		id BIGSERIAL PRIMARY KEY,
+		phase TEXT NOT NULL,
+		inserted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		seen_at TIMESTAMPTZ)`); err != nil {
+		db.Close()
+		return err
+	}
+	var last int64
+	if err := db.QueryRow("SELECT COALESCE(max(id), 0) FROM " + c.table).Scan(&last); err != nil {
+		db.Close()
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			last = c.poll(last)
+		}
+	}()
+	return nil
+}
+
+// poll handles the rows after id last and returns the highest id seen
+func (c *phaseControl) poll(last int64) int64 {
+	rows, err := c.db.Query("UPDATE "+c.table+" SET seen_at = now() WHERE id > $1 RETURNING id, phase", last)
+	if err != nil {
+		return last
+	}
+	type row struct {
+		id    int64
+		phase string
+	}
+	var inserted []row
+	for rows.Next() {
+		var r row
+		if rows.Scan(&r.id, &r.phase) == nil {
+			inserted = append(inserted, r)
+		}
+	}
+	rows.Close()
+	// RETURNING has no order
+	sort.Slice(inserted, func(i, j int) bool { return inserted[i].id < inserted[j].id })
+	for _, r := range inserted {
+		last = max(last, r.id)
+		fmt.Printf(">>> CONTROL: row %d phase %q\n", r.id, r.phase)
+		c.handle(r.phase)
+	}
+	return last
+}
+
+// handle releases the awaits of a command, or starts any other phase
+func (c *phaseControl) handle(phase string) {
+	if ch, ok := c.seen[phase]; ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+		return
+	}
+	startPhase(phase)
+}
+
+// await sleeps for d, or under control waits until command has been inserted
+// or notified (at any point of the run)
+func (c *phaseControl) await(command string, d time.Duration) {
+	if c == nil {
+		time.Sleep(d)
+		return
+	}
+	if c.table != "" {
+		fmt.Printf(">>> CONTROL: waiting for INSERT INTO %s (phase) VALUES ('%s')\n", c.table, command)
+	}
+	if c.channel != nil {
+		c.channel.await(command, c.seen[command])
+	} else {
+		<-c.seen[command]
+	}
+	recordEvent("control %s", command)
+}
+
+func (c *phaseControl) close() {
+	if c == nil {
+		return
+	}
+	if c.db != nil {
+		c.db.Close()
+	}
+	c.channel.close()
+}
@@ -0,0 +1,174 @@
+// Phase control over LISTEN/NOTIFY on the target database, which lets several
+// harness processes (agents) move through inject and stop together without a
+// control network of their own.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// controlAppName is the application_name of the channel's sessions, which the
+// activity and wait event samplers leave out of their counts
+const controlAppName = "pg-idle-test-control"
+
+// controlChannel listens on its own pgx connection and notifies from another,
+// neither of them through the instrumented driver, so the coordination
+// traffic never shows up in the workload's connects, retries or latencies.
+// A payload is a phase, as for the control table, or "ready <command>
+// <agent>", announced by each agent while it waits for command.
+type controlChannel struct {
+	listener *pgx.Conn
+	notifier *sql.DB
+	channel  string
+	agent    string
+	agents   int // with more than one, a command is released once that many agents are ready for it
+	cancel   context.CancelFunc
+	done     chan struct{} // the listening goroutine returned
+
+	mu    sync.Mutex
+	ready map[string]map[string]bool // command -> agents ready
+	seen  map[string]chan struct{}   // of the phaseControl
+}
+
+// listen subscribes to channel and hands its phases to c
+func (c *phaseControl) listen(ctx context.Context, connStr, channel, agent string, agents int) error {
+	cfg, err := pgx.ParseConfig(connStr)
+	if err != nil {
+		return err
+	}
+	cfg.RuntimeParams["application_name"] = controlAppName
+	listener, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := listener.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		listener.Close(ctx)
+		return err
+	}
+	notifier := stdlib.OpenDB(*cfg)
+	notifier.SetMaxOpenConns(1)
+	ctx, cancel := context.WithCancel(ctx)
+	ch := &controlChannel{listener: listener, notifier: notifier, channel: channel, agent: agent, agents: agents,
+		cancel: cancel, done: make(chan struct{}), ready: map[string]map[string]bool{}, seen: c.seen}
+	c.channel = ch
+	fmt.Printf(">>> CONTROL: listening on channel %s as agent %s\n", channel, agent)
+	go func() {
+		defer close(ch.done)
+		for {
+			n, err := listener.WaitForNotification(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Fprintf(os.Stderr, "WARNING: Control channel %s lost: %v\n", channel, err)
+				}
+				return
+			}
+			if command, from, ok := parseReady(n.Payload); ok {
+				ch.markReady(c, command, from)
+				continue
+			}
+			fmt.Printf(">>> CONTROL: channel %s phase %q\n", channel, n.Payload)
+			c.handle(n.Payload)
+		}
+	}()
+	return nil
+}
+
+// parseReady splits a "ready <command> <agent>" payload
+func parseReady(payload string) (command, agent string, ok bool) {
+	f := strings.SplitN(payload, " ", 3)
+	if len(f) != 3 || f[0] != "ready" {
+		return "", "", false
+	}
+	return f[1], f[2], true
+}
+
+// markReady counts agent as ready for command, and releases it once the
+// barrier of agents is complete
+func (ch *controlChannel) markReady(c *phaseControl, command, agent string) {
+	if _, ok := ch.seen[command]; !ok {
+		return
+	}
+	ch.mu.Lock()
+	if ch.ready[command] == nil {
+		ch.ready[command] = map[string]bool{}
+	}
+	first := !ch.ready[command][agent]
+	ch.ready[command][agent] = true
+	n := len(ch.ready[command])
+	ch.mu.Unlock()
+	if first && agent != ch.agent {
+		fmt.Printf(">>> CONTROL: agent %s ready for %s (%d of %d)\n", agent, command, n, ch.agents)
+	}
+	if ch.agents > 1 && n >= ch.agents {
+		select {
+		case <-ch.seen[command]:
+		default:
+			fmt.Printf(">>> CONTROL: all %d agents ready for %s\n", ch.agents, command)
+			c.handle(command)
+		}
+	}
+}
+
+// await announces this agent as ready for command, again every second so
+// that agents started later still count it, until released is closed: by
+// the barrier, or by anyone notifying the command itself
+func (ch *controlChannel) await(command string, released chan struct{}) {
+	channel := pgx.Identifier{ch.channel}.Sanitize()
+	if ch.agents > 1 {
+		fmt.Printf(">>> CONTROL: waiting for %d agents on %s, or NOTIFY %s, '%s'\n", ch.agents, ch.channel, channel, command)
+	} else {
+		fmt.Printf(">>> CONTROL: waiting for NOTIFY %s, '%s'\n", channel, command)
+	}
+	payload := fmt.Sprintf("ready %s %s", command, ch.agent)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if _, err := ch.notifier.Exec("SELECT pg_notify($1, $2)", ch.channel, payload); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Unable to notify %s: %v\n", ch.channel, err)
+		}
+		select {
+		case <-released:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// close reports the agents seen on the channel and disconnects
+func (ch *controlChannel) close() {
+	if ch == nil {
+		return
+	}
+	ch.mu.Lock()
+	for _, command := range controlCommands {
+		var agents []string
+		for agent := range ch.ready[command] {
+			agents = append(agents, agent)
+		}
+		if len(agents) > 0 {
+			sort.Strings(agents)
+			fmt.Printf(">>> CONTROL: agents ready for %s: %s\n", command, strings.Join(agents, ", "))
+		}
+	}
+	ch.mu.Unlock()
+	ch.cancel()
+	<-ch.done
+	ch.listener.Close(context.Background())
+	ch.notifier.Close()
+}
+
+// defaultAgent names this process on the control channel
+func defaultAgent() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
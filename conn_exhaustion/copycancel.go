@@ -0,0 +1,195 @@
+// Scenario: a COPY FROM STDIN canceled mid-stream by its context deadline,
+// and the state it leaves the connection, the table and the server in.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	copyCancelAfter = 2 * time.Second
+	copyCancelRows  = 20_000_000 // more than the deadline lets through
+)
+
+// copyCancelSource streams rows of a 100 byte payload, pausing a millisecond
+// every 1000 rows when paced, as a client reading its input from elsewhere
+type copyCancelSource struct {
+	paced   bool
+	sent    int
+	payload string
+}
+
+func (s *copyCancelSource) Next() bool {
+	if s.paced && s.sent%1000 == 999 {
+		time.Sleep(time.Millisecond)
+	}
+	s.sent++
+	return s.sent <= copyCancelRows
+}
+
+func (s *copyCancelSource) Values() ([]any, error) { return []any{s.sent, s.payload}, nil }
+
+func (s *copyCancelSource) Err() error { return nil }
+
+type copyCancelResult struct {
+	sent      int
+	err       error
+	returned  time.Duration // from the deadline to CopyFrom's return
+	stopped   time.Duration // from the deadline until the backend left the COPY, -1 if it never did
+	committed int64         // rows of the canceled COPY in the table afterwards
+	connErr   error         // next statement on the same *sql.Conn
+	poolErr   error         // next statement on the pool
+	samePID   bool          // the pool's next statement ran on the COPY's backend
+}
+
+func init() {
+	registerScenario("copycancel", scenario{
+		standalone: func(o *options) bool { return runCopyCancel(o.connStr) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 3 }, // pool of two and poller
+	})
+}
+
+// runCopyCancel streams COPY FROM STDIN into test_copy through pgx's
+// CopyFrom on a connection checked out of a database/sql pool, once as fast
+// as the network takes it and once paced by the client, each under a
+// copyCancelAfter deadline. It passes if each canceled COPY left no rows,
+// its backend stopped within 5s and the pool's next statement succeeded.
+func runCopyCancel(connStr string) bool {
+	poller, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer poller.Close()
+	poller.SetMaxOpenConns(1)
+	poller.Exec("DROP TABLE IF EXISTS test_copy")
+	if _, err := poller.Exec("CREATE TABLE test_copy (id INT, payload TEXT)"); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to create test_copy: %v\n", err)
+		return false
+	}
+
+	db, err := openDB(connStr, "pg-idle-test-copycancel")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(2)
+	db.SetMaxIdleConns(2)
+
+	configs := []string{"network-bound", "client-paced"}
+	results := map[string]copyCancelResult{}
+	for _, config := range configs {
+		fmt.Printf(">>> COPY CANCEL: %s COPY FROM STDIN of up to %d rows, deadline %v\n", config, copyCancelRows, copyCancelAfter)
+		r, err := copyCancelOnce(db, poller, config == "client-paced")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", config, err)
+			return false
+		}
+		results[config] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> COPY CANCEL REPORT (deadline %v)\n", copyCancelAfter)
+	fmt.Printf("%-14s %10s %-10s %10s %10s %10s %-13s %-13s\n", "Source", "Rows sent", "Error", "Returned", "Stopped", "Committed", "Same conn", "Pool")
+	pass := true
+	for _, config := range configs {
+		r := results[config]
+		class, stopped := "none", "never"
+		if r.err != nil {
+			class = classifyError(r.err)
+		}
+		if r.stopped >= 0 {
+			stopped = ms(r.stopped)
+		}
+		next := ", new pid"
+		if r.samePID {
+			next = ", same pid"
+		}
+		fmt.Printf("%-14s %10d %-10s %10s %10s %10d %-13s %-13s\n", config, r.sent, class, ms(r.returned), stopped, r.committed,
+			copyCancelOutcome(r.connErr, ""), copyCancelOutcome(r.poolErr, next))
+		if r.err == nil {
+			fmt.Printf("  %s: the COPY finished before the deadline, nothing was canceled\n", config)
+			continue
+		}
+		pass = pass && r.committed == 0 && r.stopped >= 0 && r.poolErr == nil
+	}
+	fmt.Println()
+	fmt.Println("Returned and Stopped count from the deadline: Returned until CopyFrom gave up on the client, Stopped until")
+	fmt.Println("the backend was gone or no longer in the COPY. pgx does not send a CopyFail on a deadline; it interrupts")
+	fmt.Println("the socket and closes the connection, and the server aborts the COPY when it sees the connection end,")
+	fmt.Println("so the rows already sent are rolled back with it. The *sql.Conn the COPY ran on is dead from then on,")
+	fmt.Println("while the pool discards it and dials a new connection for its next statement.")
+	if !pass {
+		fmt.Println(">>> COPY CANCEL: FAIL a canceled COPY left rows behind, kept running on the server or broke the pool")
+		return false
+	}
+	fmt.Println(">>> COPY CANCEL: PASS every canceled COPY was rolled back and stopped, and the pool kept working")
+	return true
+}
+
+func copyCancelOnce(db, poller *sql.DB, paced bool) (copyCancelResult, error) {
+	r := copyCancelResult{stopped: -1}
+	poller.Exec("TRUNCATE test_copy")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+	var pid int32
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		return r, err
+	}
+
+	src := &copyCancelSource{paced: paced, payload: strings.Repeat("x", 100)}
+	copyCtx, cancel := context.WithTimeout(ctx, copyCancelAfter)
+	deadline, _ := copyCtx.Deadline()
+	var noPgx error
+	err = conn.Raw(func(driverConn any) error {
+		c, err := pgxConnOf(driverConn)
+		if err != nil {
+			noPgx = err
+			return err
+		}
+		_, err = c.CopyFrom(copyCtx, pgx.Identifier{"test_copy"}, []string{"id", "payload"}, src)
+		return err
+	})
+	cancel()
+	r.returned, r.sent, r.err = time.Since(deadline), src.sent, err
+	if noPgx != nil {
+		return r, fmt.Errorf("unable to run COPY through pgx: %w", noPgx)
+	}
+
+	for time.Since(deadline) < 5*time.Second {
+		var inCopy bool
+		if poller.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE pid = $1 AND state = 'active' AND query ILIKE 'copy%')", pid).Scan(&inCopy) == nil && !inCopy {
+			r.stopped = time.Since(deadline)
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	poller.QueryRow("SELECT count(*) FROM test_copy").Scan(&r.committed)
+
+	_, r.connErr = conn.ExecContext(ctx, "SELECT 1")
+	conn.Close()
+	var next int32
+	r.poolErr = db.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&next)
+	r.samePID = r.poolErr == nil && next == pid
+	return r, nil
+}
+
+// copyCancelOutcome describes the next statement after the COPY
+func copyCancelOutcome(err error, detail string) string {
+	if err != nil {
+		return "failed: " + classifyError(err)
+	}
+	return "ok" + detail
+}
@@ -0,0 +1,169 @@
+// Scenario: CPU saturation of the database server, where every statement
+// runs slower without any lock or pool being at fault, and the latency
+// signature which tells it apart from lock contention and pool exhaustion.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cpuBurnBaseline is how long the signature is sampled before the burn
+const cpuBurnBaseline = 5 * time.Second
+
+// cpuBurnWindow is what the signature samples once a second in one window
+type cpuBurnWindow struct {
+	name       string
+	probes     []time.Duration // SELECT 1 on a connection outside the pool
+	onCPU      int             // peak active sessions without a wait event
+	lockWaits  int             // peak sessions waiting on a heavyweight lock
+	poolWaits  int64           // checkouts of the worker pool which waited
+	secs       float64
+	ok, failed int
+	p50, p95   time.Duration
+}
+
+func init() {
+	registerScenario("cpuburn", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runCPUBurn(h)
+		},
+		validate: func(o *options) error {
+			if o.cpuBurners < 1 {
+				return errors.New("-cpu-burners must be at least 1")
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns += o.cpuBurners + 1 }, // burners and probe
+	})
+}
+
+// runCPUBurn samples the signature for cpuBurnBaseline, then keeps
+// -cpu-burners server backends spinning in PL/pgSQL loops for -hold-duration
+// while the workload runs, and checks that the stall diagnosis names CPU
+// saturation rather than the lock queue the slower lock holders leave behind
+func runCPUBurn(h *harness) bool {
+	probe, err := sql.Open("pgx", h.connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to open probe connection: %v\n", err)
+		return false
+	}
+	defer probe.Close()
+	probe.SetMaxOpenConns(1)
+	if err := probe.Ping(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to open probe connection: %v\n", err)
+		return false
+	}
+
+	startPhase("before cpu burn")
+	before := sampleCPUBurn(h, probe, "before cpu burn", cpuBurnBaseline)
+
+	burners, err := sql.Open("pgx", h.connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to open burner connections: %v\n", err)
+		return false
+	}
+	defer burners.Close()
+	burners.SetMaxOpenConns(h.o.cpuBurners)
+	// The loop ends on its own at the end of the hold, so the server stops
+	// burning even if the client dies
+	burn := fmt.Sprintf(`DO $$BEGIN WHILE clock_timestamp() < now() + interval '%d milliseconds' LOOP END LOOP; END$$`, h.o.hold.Milliseconds())
+	ctx, cancel := context.WithTimeout(context.Background(), h.o.hold+5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var burnErr error
+	for i := 0; i < h.o.cpuBurners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := burners.ExecContext(ctx, burn); err != nil && ctx.Err() == nil {
+				mu.Lock()
+				burnErr = err
+				mu.Unlock()
+			}
+		}()
+	}
+	fmt.Printf(">>> CPU BURN: %d backends spinning on the server for %v\n", h.o.cpuBurners, h.o.hold)
+	recordEvent("%d server backends burning CPU", h.o.cpuBurners)
+	startPhase("cpu burn")
+	during := sampleCPUBurn(h, probe, "cpu burn", h.o.hold)
+	diagnosis := diagnoseStall(gatherEvidence(h.db.Stats(), 0))
+	cancel()
+	wg.Wait()
+	startPhase("after cpu burn")
+	recordEvent("CPU burn ended")
+	if burnErr != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Burner failed: %v\n", burnErr)
+		return false
+	}
+
+	fmt.Println()
+	fmt.Println(">>> CPU SATURATION SIGNATURE")
+	fmt.Printf("%-16s %10s %10s %8s %8s %10s %10s %7s %10s %12s\n", "Window", "Probe p50", "Probe max", "Iter/s", "Errors", "p50", "p95", "On CPU", "Lock waits", "Pool waits/s")
+	for _, w := range []cpuBurnWindow{before, during} {
+		sort.Slice(w.probes, func(i, j int) bool { return w.probes[i] < w.probes[j] })
+		fmt.Printf("%-16s %10s %10s %8.1f %8d %10s %10s %7d %10d %12.1f\n", w.name, ms(percentile(w.probes, 0.5)), ms(percentile(w.probes, 1)),
+			float64(w.ok)/w.secs, w.failed, ms(w.p50), ms(w.p95), w.onCPU, w.lockWaits, float64(w.poolWaits)/w.secs)
+	}
+	fmt.Printf("diagnosis: %s\n", diagnosis)
+	fmt.Println()
+	fmt.Println("Probe is a SELECT 1 on a connection outside the pool, so it measures the server rather than the pool:")
+	fmt.Println("  cpu saturation:   the probe slows down with everything else, sessions are active without a wait event,")
+	fmt.Println("                    latency rises across the whole distribution rather than in a tail")
+	fmt.Println("  lock contention:  the probe stays fast, workers wait on Lock behind one blocker, few sessions on CPU,")
+	fmt.Println("                    p50 stays low while p95 and errors climb with the iterations touching the row")
+	fmt.Println("  pool exhaustion:  the probe stays fast, the pool's sessions are idle on the server while pool waits climb")
+	fmt.Println("The burners run in the server's own processes, so the container or host needs fewer cores than")
+	fmt.Println("-cpu-burners for the run to saturate it.")
+	fmt.Println()
+	if !strings.HasPrefix(diagnosis, "CPU saturation") {
+		fmt.Println(">>> CPU BURN: FAIL the stall diagnosis did not name CPU saturation")
+		return false
+	}
+	fmt.Println(">>> CPU BURN: PASS diagnosed as CPU saturation")
+	return true
+}
+
+// sampleCPUBurn probes the server and counts sessions on CPU and waiting on
+// locks once a second for d, and reads the workers' outcomes from the
+// current phase
+func sampleCPUBurn(h *harness, probe *sql.DB, name string, d time.Duration) cpuBurnWindow {
+	w := cpuBurnWindow{name: name}
+	p := currentPhase.Load()
+	waitsBefore := h.db.Stats().WaitCount
+	start := time.Now()
+	for time.Since(start) < d {
+		t := time.Now()
+		var one, onCPU, lockWaits int
+		if err := probe.QueryRow("SELECT 1").Scan(&one); err == nil {
+			w.probes = append(w.probes, time.Since(t))
+		}
+		err := probe.QueryRow(`
+			SELECT count(*) FILTER (WHERE wait_event IS NULL), count(*) FILTER (WHERE wait_event_type = 'Lock')
+			FROM pg_stat_activity
+			WHERE datname = current_database() AND state = 'active' AND pid <> pg_backend_pid()`).Scan(&onCPU, &lockWaits)
+		if err == nil {
+			w.onCPU, w.lockWaits = max(w.onCPU, onCPU), max(w.lockWaits, lockWaits)
+			fmt.Fprintf(os.Stderr, "[%s] CPU_BURN: %s, %d sessions on CPU, %d waiting on locks\n", time.Now().Format("04:05"), name, onCPU, lockWaits)
+		}
+		time.Sleep(max(time.Second-time.Since(t), 0))
+	}
+	w.secs = time.Since(start).Seconds()
+	w.poolWaits = h.db.Stats().WaitCount - waitsBefore
+	p.mu.Lock()
+	w.ok, w.failed = p.ok, p.failed
+	sorted := append([]time.Duration(nil), p.latencies...)
+	p.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	w.p50, w.p95 = percentile(sorted, 0.5), percentile(sorted, 0.95)
+	return w
+}
@@ -0,0 +1,218 @@
+// Scenario: a client process dying or hanging while its transaction holds the
+// poison lock, and how long the server keeps the lock.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// crashConfig is one run of crashlock: how the lock holder is stopped and the
+// session settings it applied before taking the lock
+type crashConfig struct {
+	name     string
+	signal   os.Signal
+	settings []string // name=value, applied with set_config
+}
+
+var crashKeepalives = []string{"tcp_keepalives_idle=2", "tcp_keepalives_interval=1", "tcp_keepalives_count=3"}
+
+// crashConfigs pair each way of stopping the holder with the server's
+// keepalive settings, keepalives probing after 2s idle, and for a hung holder
+// idle_in_transaction_session_timeout. A killed process's kernel closes its
+// socket, so the server reads EOF at once; a frozen one still ACKs keepalive
+// probes, so only a timeout on the server ends its transaction.
+func crashConfigs() []crashConfig {
+	configs := []crashConfig{
+		{"kill", os.Kill, nil},
+		{"kill+keepalive", os.Kill, crashKeepalives},
+	}
+	if freezeSignal != nil {
+		configs = append(configs,
+			crashConfig{"freeze", freezeSignal, nil},
+			crashConfig{"freeze+keepalive", freezeSignal, crashKeepalives},
+			crashConfig{"freeze+idle_tx_timeout", freezeSignal, []string{"idle_in_transaction_session_timeout=5s"}},
+		)
+	}
+	return configs
+}
+
+type crashResult struct {
+	keepalives string        // effective idle/interval/count of the holder's session
+	gone       time.Duration // until the holder's session disappeared, 0 if it outlived the wait
+	writer     time.Duration // how long a writer queued on the row waited
+	writerErr  error
+}
+
+func init() {
+	registerScenario("crashlock", scenario{
+		standalone: func(o *options) bool { return runCrashLock(o.connStr, o.crashWait) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 3 }, // holder, writer and poller
+	})
+}
+
+// runCrashLock stops a child holding the row lock in each configuration and
+// polls the server until the session and its lock are gone, up to wait
+func runCrashLock(connStr string, wait time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_crash")
+	setup.Exec("CREATE TABLE test_crash (id INT PRIMARY KEY, val INT)")
+	setup.Exec("INSERT INTO test_crash VALUES (1, 0)")
+
+	configs := crashConfigs()
+	results := make([]crashResult, len(configs))
+	for i, c := range configs {
+		fmt.Fprintf(os.Stderr, "[%s] CRASH_LOCK: %s\n", time.Now().Format("04:05"), c.name)
+		r, err := crashOnce(connStr, setup, c, wait)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", c.name, err)
+			return false
+		}
+		results[i] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> CRASH LOCK REPORT")
+	fmt.Printf("%-24s %-12s %12s %12s\n", "Config", "Keepalives", "SessionGone", "WriterWait")
+	for i, c := range configs {
+		r := results[i]
+		gone := fmt.Sprintf(">%.0fs", wait.Seconds())
+		if r.gone > 0 {
+			gone = fmt.Sprintf("%.2fs", r.gone.Seconds())
+		}
+		writer := fmt.Sprintf("%.2fs", r.writer.Seconds())
+		if r.writerErr != nil {
+			writer = classifyError(r.writerErr)
+		}
+		fmt.Printf("%-24s %-12s %12s %12s\n", c.name, r.keepalives, gone, writer)
+	}
+	fmt.Println()
+	fmt.Println("Keepalives are idle/interval/count of the holder's backend (0 is the OS default, unused on Unix sockets);")
+	fmt.Println("they only matter when no FIN or RST arrives at all, as when the client's host crashes or the network partitions.")
+	if freezeSignal == nil {
+		fmt.Printf("kill stops the holder with %s; the freeze configs need SIGSTOP, which this platform lacks.\n", killMethod)
+	}
+	return true
+}
+
+func crashOnce(connStr string, setup *sql.DB, c crashConfig, wait time.Duration) (crashResult, error) {
+	var r crashResult
+	cmd, err := childCommand(connStr, append([]string{"lockholder"}, c.settings...)...)
+	if err != nil {
+		return r, err
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return r, err
+	}
+	defer stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return r, err
+	}
+	if err := cmd.Start(); err != nil {
+		return r, err
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	var pid int
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if n, _ := fmt.Sscanf(scanner.Text(), "LOCKED pid=%d keepalives=%s", &pid, &r.keepalives); n == 2 {
+			break
+		}
+		fmt.Println(scanner.Text())
+	}
+	if pid == 0 {
+		return r, fmt.Errorf("lock holder exited before taking the lock")
+	}
+	go io.Copy(io.Discard, stdout)
+
+	writerDone := make(chan struct{})
+	writerStart := time.Now()
+	go func() {
+		defer close(writerDone)
+		ctx, cancel := context.WithTimeout(context.Background(), wait+5*time.Second)
+		defer cancel()
+		_, r.writerErr = setup.ExecContext(ctx, "UPDATE test_crash SET val = val + 1 WHERE id = 1")
+		r.writer = time.Since(writerStart)
+	}()
+	time.Sleep(200 * time.Millisecond) // let the writer queue on the row
+
+	fmt.Printf(">>> CRASH_LOCK: %s: stopping the lock holder (server PID %d)\n", c.name, pid)
+	sent := time.Now()
+	if err := cmd.Process.Signal(c.signal); err != nil {
+		return r, err
+	}
+	for time.Since(sent) < wait {
+		var alive bool
+		if err := setup.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE pid = $1)", pid).Scan(&alive); err != nil {
+			return r, err
+		}
+		if !alive {
+			r.gone = time.Since(sent)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if r.gone == 0 {
+		fmt.Printf(">>> CRASH_LOCK: %s: session still holds the lock after %s, terminating it\n", c.name, wait)
+		setup.Exec("SELECT pg_terminate_backend($1)", pid)
+	}
+	<-writerDone
+	return r, nil
+}
+
+// runLockHolder is the child side of crashlock: it applies the settings, takes
+// the row lock in an open transaction and reports its PID, then waits to be
+// killed (or for stdin to close when the parent exits)
+func runLockHolder(connStr string, settings []string) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lockholder: %v\n", err)
+		os.Exit(1)
+	}
+	for _, s := range settings {
+		name, value, _ := strings.Cut(s, "=")
+		if _, err := conn.ExecContext(ctx, "SELECT set_config($1, $2, false)", name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "lockholder: %s: %v\n", s, err)
+			os.Exit(1)
+		}
+	}
+	var pid int
+	var keepalives string
+	err = conn.QueryRowContext(ctx, `SELECT pg_backend_pid(),
+		current_setting('tcp_keepalives_idle') || '/' || current_setting('tcp_keepalives_interval') || '/' || current_setting('tcp_keepalives_count')`).
+		Scan(&pid, &keepalives)
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "BEGIN")
+	}
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "UPDATE test_crash SET val = val + 1 WHERE id = 1")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lockholder: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("LOCKED pid=%d keepalives=%s\n", pid, keepalives)
+	io.Copy(io.Discard, os.Stdin)
+}
@@ -0,0 +1,104 @@
+// Deadline propagation audit: how much of a worker iteration's deadline is
+// left when it reaches each layer on the way to the database.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deadlineLayers are the points a worker iteration passes, in order:
+//   - admission: the iteration starts, before the -admission semaphore
+//   - checkout: a statement calls into database/sql for a connection
+//   - execute: the statement starts on a connection
+var deadlineLayers = []string{"admission", "checkout", "execute"}
+
+const deadlineExamples = 10
+
+type deadlineExample struct {
+	layer  string
+	worker int
+	left   time.Duration
+	sql    string
+}
+
+// deadlineAuditor collects the time left per layer; statements reaching a
+// layer with less than warn left are flagged
+type deadlineAuditor struct {
+	warn time.Duration
+
+	mu         sync.Mutex
+	left       map[string][]time.Duration
+	noDeadline map[string]int
+	flagged    map[string]int
+	examples   []deadlineExample
+}
+
+// deadlines is nil unless -deadline-audit was given
+var deadlines *deadlineAuditor
+
+func newDeadlineAuditor(warn time.Duration) *deadlineAuditor {
+	return &deadlineAuditor{warn: warn, left: map[string][]time.Duration{}, noDeadline: map[string]int{}, flagged: map[string]int{}}
+}
+
+// audit records the deadline left on ctx at layer. Only worker iterations are
+// audited; the pool monitor and other helpers share the instrumented layers.
+func (a *deadlineAuditor) audit(ctx context.Context, layer, sql string) {
+	if a == nil {
+		return
+	}
+	tag, ok := ctx.Value(workerKey{}).(*workerTag)
+	if !ok {
+		return
+	}
+	deadline, ok := ctx.Deadline()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !ok {
+		a.noDeadline[layer]++
+		return
+	}
+	left := time.Until(deadline)
+	a.left[layer] = append(a.left[layer], left)
+	if left >= a.warn {
+		return
+	}
+	a.flagged[layer]++
+	if len(a.examples) < deadlineExamples {
+		a.examples = append(a.examples, deadlineExample{layer: layer, worker: tag.worker, left: left, sql: sql})
+	}
+}
+
+// print shows, per layer, the distribution of the deadline left and how many
+// iterations or statements arrived with less than warn left. The budget spent
+// between two layers is the drop from one row to the next.
+func (a *deadlineAuditor) print() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Println()
+	fmt.Printf(">>> DEADLINE AUDIT (flagging less than %v left)\n", a.warn)
+	fmt.Printf("%-10s %8s %10s %10s %10s %10s %10s %8s %8s\n", "Layer", "Count", "NoDeadline", "Left p50", "Left p5", "Left p1", "Left min", "Flagged", "Expired")
+	for _, layer := range deadlineLayers {
+		sorted := append([]time.Duration(nil), a.left[layer]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		expired := sort.Search(len(sorted), func(i int) bool { return sorted[i] > 0 })
+		fmt.Printf("%-10s %8d %10d %10s %10s %10s %10s %8d %8d\n", layer, len(sorted), a.noDeadline[layer],
+			ms(percentile(sorted, 0.5)), ms(percentile(sorted, 0.05)), ms(percentile(sorted, 0.01)), ms(percentile(sorted, 0)),
+			a.flagged[layer], expired)
+	}
+	if len(a.examples) > 0 {
+		fmt.Println()
+		fmt.Println("First flagged:")
+		for _, e := range a.examples {
+			fmt.Printf("  %-10s worker=%-3d left=%-10s %s\n", e.layer, e.worker, ms(e.left), e.sql)
+		}
+	}
+	fmt.Println("A drop between admission and checkout is spent at the semaphore or in the client; between checkout and")
+	fmt.Println("execute, queueing for a connection, dialing and session reset.")
+}
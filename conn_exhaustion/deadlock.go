@@ -0,0 +1,178 @@
+// Scenario: two groups of workers updating the same two rows in opposite
+// order, so the server has to break deadlocks, and the state the victims'
+// connections go back to the pool in.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const deadlockRun = 20 * time.Second
+
+// deadlockGroup is the workers taking the rows in one order
+type deadlockGroup struct {
+	name        string
+	first, then int // row ids in update order
+
+	commits, deadlocks, failed int64
+	victimWait                 time.Duration // in the statement the server aborted
+	aborted                    int64         // 25P02 errors: a statement ran in a transaction already aborted
+}
+
+func init() {
+	registerScenario("deadlock", scenario{
+		standalone: func(o *options) bool { return runDeadlock(o.connStr, o.workers, o.maxOpen) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = o.maxOpen + 2 }, // pool, setup and state poller
+	})
+}
+
+// runDeadlock runs group A updating row 1 then row 2 and group B row 2 then
+// row 1, each in a database/sql transaction rolled back on error. It passes
+// if no pooled connection was seen idle in a transaction after a deadlock
+// and no statement ran into an aborted transaction.
+func runDeadlock(connStr string, workers, maxOpen int) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	schemaSpec{rows: 2, fillfactor: 100}.create(setup)
+	var deadlockTimeout string
+	setup.QueryRow("SHOW deadlock_timeout").Scan(&deadlockTimeout)
+
+	const appName = "pg-idle-test-deadlock"
+	db, err := openDB(connStr, appName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxOpen)
+
+	groups := []*deadlockGroup{{name: "A", first: 1, then: 2}, {name: "B", first: 2, then: 1}}
+	fmt.Printf(">>> DEADLOCK: %d workers on %d connections for %v, group A updates rows 1,2 and group B rows 2,1 (deadlock_timeout %s)\n",
+		workers, maxOpen, deadlockRun, deadlockTimeout)
+
+	var stopping atomic.Bool
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		g := groups[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopping.Load() {
+				wait, err := deadlockIteration(db, g)
+				var pgErr *pgconn.PgError
+				errors.As(err, &pgErr)
+				mu.Lock()
+				switch {
+				case err == nil:
+					g.commits++
+				case pgErr != nil && pgErr.Code == "40P01":
+					g.deadlocks++
+					g.victimWait += wait
+				case pgErr != nil && pgErr.Code == "25P02":
+					g.aborted++
+					g.failed++
+				default:
+					g.failed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Pooled connections the poller finds idle in a transaction sit in the
+	// pool aborted or open, since every iteration ends its transaction
+	dirty := map[int32]string{}
+	start := time.Now()
+	for time.Since(start) < deadlockRun {
+		time.Sleep(500 * time.Millisecond)
+		rows, err := setup.Query(`
+			SELECT pid, state FROM pg_stat_activity
+			WHERE application_name = $1 AND state LIKE 'idle in transaction%' AND now() - state_change > interval '200 milliseconds'`, appName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Connection state poll failed: %v\n", err)
+			continue
+		}
+		for rows.Next() {
+			var pid int32
+			var state string
+			if rows.Scan(&pid, &state) == nil {
+				dirty[pid] = state
+			}
+		}
+		rows.Close()
+		mu.Lock()
+		fmt.Fprintf(os.Stderr, "[%s] DEADLOCK: A commits=%d deadlocks=%d, B commits=%d deadlocks=%d\n", time.Now().Format("04:05"),
+			groups[0].commits, groups[0].deadlocks, groups[1].commits, groups[1].deadlocks)
+		mu.Unlock()
+	}
+	stopping.Store(true)
+	wg.Wait()
+
+	fmt.Println()
+	fmt.Println(">>> DEADLOCK REPORT")
+	fmt.Printf("%-6s %-10s %8s %10s %12s %11s %8s %9s\n", "Group", "Order", "Commits", "Deadlocks", "Deadlocks/s", "Victim wait", "Failed", "Aborted")
+	var total, aborted int64
+	for _, g := range groups {
+		wait := "-"
+		if g.deadlocks > 0 {
+			wait = ms(g.victimWait / time.Duration(g.deadlocks))
+		}
+		fmt.Printf("%-6s %-10s %8d %10d %12.2f %11s %8d %9d\n", g.name, fmt.Sprintf("%d then %d", g.first, g.then), g.commits, g.deadlocks,
+			float64(g.deadlocks)/deadlockRun.Seconds(), wait, g.failed, g.aborted)
+		total += g.deadlocks
+		aborted += g.aborted
+	}
+	fmt.Println()
+	fmt.Printf("Deadlocks: %d, %.1f%% of transactions; victims split A %d / B %d\n", total,
+		100*float64(total)/float64(max(total+groups[0].commits+groups[1].commits, 1)), groups[0].deadlocks, groups[1].deadlocks)
+	fmt.Println("The victim is the transaction whose deadlock check ran first, the one which had waited deadlock_timeout;")
+	fmt.Println("Victim wait is how long its second UPDATE waited before the server aborted it with 40P01.")
+	if len(dirty) > 0 || aborted > 0 {
+		for pid, state := range dirty {
+			fmt.Printf("  pooled connection pid=%d seen %s\n", pid, state)
+		}
+		fmt.Printf(">>> DEADLOCK: FAIL %d pooled connections seen idle in a transaction, %d statements in an aborted transaction\n", len(dirty), aborted)
+		return false
+	}
+	fmt.Println(">>> DEADLOCK: PASS every victim's connection went back to the pool outside a transaction")
+	return true
+}
+
+// deadlockIteration updates the group's rows in its order in one
+// transaction, sleeping between the two so the other group takes its first
+// row, and rolls back on error. It returns how long the statement which
+// failed ran.
+func deadlockIteration(db *sql.DB, g *deadlockGroup) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for i, id := range []int{g.first, g.then} {
+		start := time.Now()
+		if _, err := tx.ExecContext(ctx, "UPDATE test_row SET val = val + 1 WHERE id = $1", id); err != nil {
+			return time.Since(start), err
+		}
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return 0, tx.Commit()
+}
@@ -0,0 +1,39 @@
+// SQL driver selection: the worker pool and canceldriver run through pgx
+// stdlib by default or through lib/pq in binaries built with -tags libpq.
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// sqlDrivers are the values of -driver
+var sqlDrivers = []string{"pgx", "libpq"}
+
+// sqlDriver is the driver of the worker pool and canceldriver
+var sqlDriver = "pgx"
+
+// driverModules are the modules implementing each of sqlDrivers
+var driverModules = map[string]string{
+	"pgx":   "github.com/jackc/pgx/v5",
+	"libpq": "github.com/lib/pq",
+}
+
+// openLibpq opens a lib/pq pool; it and libpqErrorClass are set by libpq.go,
+// which is only built with -tags libpq
+var (
+	openLibpq       func(connStr, appName string) (*sql.DB, error)
+	libpqErrorClass func(err error) string
+)
+
+// openDriverDB opens a pool through -driver. Only pgx pools have the close
+// strategy, acquire check, checkout attribution and orphan tagging of openDB.
+func openDriverDB(connStr, appName string) (*sql.DB, error) {
+	if sqlDriver == "pgx" {
+		return openDB(connStr, appName)
+	}
+	if openLibpq == nil {
+		return nil, errors.New("-driver=libpq needs a binary built with -tags libpq")
+	}
+	return openLibpq(connStr, appName)
+}
@@ -0,0 +1,79 @@
+// Files compiled into the binary, so it runs on a host with nothing but
+// network access to the database.
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// builtinFiles are the preset run configs and the examples referenced by the
+// README
+//
+//go:embed configs/*.toml run_example.toml plan_example.json rotate_example.sql
+var builtinFiles embed.FS
+
+// builtinPrefix names an embedded file instead of one on disk, e.g.
+// -config=builtin:poison or plan builtin:plan_example.json
+const builtinPrefix = "builtin:"
+
+// builtinPath maps a builtin: name to its path in builtinFiles; a bare name
+// is a preset in configs/
+func builtinPath(name string) string {
+	if !strings.Contains(name, ".") {
+		return "configs/" + name + ".toml"
+	}
+	if _, err := fs.Stat(builtinFiles, name); err != nil {
+		return "configs/" + name
+	}
+	return name
+}
+
+// readInput reads path from disk or, with the builtin: prefix, from the binary
+func readInput(path string) ([]byte, error) {
+	if name, ok := strings.CutPrefix(path, builtinPrefix); ok {
+		b, err := builtinFiles.ReadFile(builtinPath(name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: no such built-in file (see the configs command)", path)
+		}
+		return b, nil
+	}
+	return os.ReadFile(path)
+}
+
+// runConfigs lists the built-in files with the first line of their comment, or
+// prints one so it can be copied and edited
+func runConfigs(args []string) bool {
+	if len(args) == 1 {
+		b, err := readInput(builtinPrefix + args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		os.Stdout.Write(b)
+		return true
+	}
+	fmt.Println("Built-in files, run with -config=builtin:<name> or print with configs <name>:")
+	fs.WalkDir(builtinFiles, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := p
+		if dir, file := path.Split(p); dir == "configs/" {
+			name = strings.TrimSuffix(file, ".toml")
+		}
+		b, _ := builtinFiles.ReadFile(p)
+		summary, _, _ := strings.Cut(string(b), "\n")
+		if summary, ok := strings.CutPrefix(summary, "#"); ok {
+			fmt.Printf("  %-26s %s\n", name, strings.TrimSpace(summary))
+		} else {
+			fmt.Printf("  %s\n", name)
+		}
+		return nil
+	})
+	return true
+}
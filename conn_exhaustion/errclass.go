@@ -0,0 +1,125 @@
+// Error taxonomy for worker failures.
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Error buckets, in report order
+var errorClasses = []string{
+	"admission_timeout", // context expired while waiting at the -admission semaphore
+	"pool_wait_timeout", // context expired while database/sql waited for a free connection
+	"dial_failure",      // new connection could not be established
+	"server_fatal",      // server terminated or refused the session (FATAL/PANIC)
+	"cancel",            // statement canceled: client context deadline or server statement_timeout
+	"lock_timeout",      // lock_timeout (55P03)
+	"constraint",        // integrity constraint violation (class 23)
+	"broken_conn",       // connection lost mid-statement
+	"other",
+}
+
+func classifyError(err error) string {
+	if errors.Is(err, errAdmissionTimeout) {
+		return "admission_timeout"
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return classifyServerError(pgErr.Severity, pgErr.Code)
+	}
+	if libpqErrorClass != nil {
+		if class := libpqErrorClass(err); class != "" {
+			return class
+		}
+	}
+
+	switch {
+	case isConnectError(err):
+		return "dial_failure"
+	case err == context.DeadlineExceeded || err == context.Canceled:
+		// database/sql returns the bare context error when it gives up waiting
+		// for a connection; pgx always wraps errors from an in-flight statement
+		return "pool_wait_timeout"
+	case pgconn.Timeout(err) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		return "cancel"
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return "broken_conn"
+	}
+	return "other"
+}
+
+// classifyServerError buckets an error the server sent, whichever driver
+// decoded it
+func classifyServerError(severity, code string) string {
+	switch {
+	case severity == "FATAL" || severity == "PANIC":
+		return "server_fatal"
+	case code == "55P03":
+		return "lock_timeout"
+	case code == "57014":
+		return "cancel"
+	case len(code) == 5 && code[:2] == "23":
+		return "constraint"
+	}
+	return "other"
+}
+
+// isConnectError reports whether err came from establishing a connection. The
+// pgconn connect error type is matched by name since it is unexported in older
+// pgx releases.
+func isConnectError(err error) bool {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if name := fmt.Sprintf("%T", e); name == "*pgconn.connectError" || name == "*pgconn.ConnectError" {
+			return true
+		}
+		if opErr, ok := e.(*net.OpError); ok && opErr.Op == "dial" {
+			return true
+		}
+	}
+	return false
+}
+
+// errorReport counts worker failures per class and keeps the first example
+type errorReport struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	examples map[string]string
+}
+
+var workerErrors = &errorReport{counts: map[string]int{}, examples: map[string]string{}}
+
+// add records err and returns its class
+func (r *errorReport) add(err error) string {
+	class := classifyError(err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[class]++
+	if _, ok := r.examples[class]; !ok {
+		r.examples[class] = err.Error()
+	}
+	return class
+}
+
+func (r *errorReport) print() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Println()
+	fmt.Println(">>> ERROR CLASSIFICATION")
+	fmt.Printf("%-20s %8s   %s\n", "Class", "Count", "Example")
+	for _, class := range errorClasses {
+		if r.counts[class] == 0 {
+			continue
+		}
+		fmt.Printf("%-20s %8d   %s\n", class, r.counts[class], r.examples[class])
+	}
+}
@@ -0,0 +1,219 @@
+// Error surface recording and comparison across driver versions.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errorSurface is everything application error handling could branch on for
+// one failure. Messages are kept for reading but not used for comparison since
+// they embed PIDs, addresses and timings.
+type errorSurface struct {
+	Time        time.Time `json:"time"`
+	ServerTime  time.Time `json:"server_time"` // Time on the server's clock, for matching server logs
+	Driver      string    `json:"driver"`
+	PID         int       `json:"pid,omitempty"` // backend PID of the connection, if known
+	Chain       []string  `json:"chain"`         // %T of each error in the wrap chain, outermost first
+	Messages    []string  `json:"messages"`      // Error() of each error in the chain
+	SQLState    string    `json:"sqlstate,omitempty"`
+	NetTimeout  *bool     `json:"net_timeout,omitempty"` // set if a net.Error is in the chain
+	Deadline    bool      `json:"deadline_exceeded"`
+	Canceled    bool      `json:"canceled"`
+	BadConn     bool      `json:"bad_conn"`
+	SafeToRetry bool      `json:"safe_to_retry"`
+	PgTimeout   bool      `json:"pgconn_timeout"`
+}
+
+// signature identifies errors with the same surface
+func (s errorSurface) signature() string {
+	sig := strings.Join(s.Chain, " > ")
+	if s.SQLState != "" {
+		sig += " sqlstate=" + s.SQLState
+	}
+	if s.NetTimeout != nil {
+		sig += fmt.Sprintf(" net_timeout=%t", *s.NetTimeout)
+	}
+	return sig + fmt.Sprintf(" deadline=%t canceled=%t bad_conn=%t safe_to_retry=%t pgconn_timeout=%t",
+		s.Deadline, s.Canceled, s.BadConn, s.SafeToRetry, s.PgTimeout)
+}
+
+// driverVersion reports the module and version of -driver compiled into this
+// binary
+func driverVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == driverModules[sqlDriver] {
+				return dep.Path + " " + dep.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+func describeError(err error) errorSurface {
+	now := time.Now()
+	s := errorSurface{
+		Time:        now,
+		ServerTime:  serverTime(now),
+		Driver:      driverVersion(),
+		Deadline:    errors.Is(err, context.DeadlineExceeded),
+		Canceled:    errors.Is(err, context.Canceled),
+		BadConn:     errors.Is(err, driver.ErrBadConn),
+		SafeToRetry: pgconn.SafeToRetry(err),
+		PgTimeout:   pgconn.Timeout(err),
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		s.SQLState = pgErr.Code
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		timeout := netErr.Timeout()
+		s.NetTimeout = &timeout
+	}
+
+	// Walk the chain depth-first, following both Unwrap() error and Unwrap() []error
+	var walk func(error)
+	walk = func(e error) {
+		if e == nil {
+			return
+		}
+		s.Chain = append(s.Chain, fmt.Sprintf("%T", e))
+		s.Messages = append(s.Messages, e.Error())
+		switch u := e.(type) {
+		case interface{ Unwrap() error }:
+			walk(u.Unwrap())
+		case interface{ Unwrap() []error }:
+			for _, inner := range u.Unwrap() {
+				walk(inner)
+			}
+		}
+	}
+	walk(err)
+	return s
+}
+
+// errorRecorder appends the surface of every failure to a JSON Lines file
+type errorRecorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+var errRecorder *errorRecorder
+
+func openErrorRecorder(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	errRecorder = &errorRecorder{enc: json.NewEncoder(f)}
+	return nil
+}
+
+// recordError is a no-op unless -error-log was given
+func recordError(err error, pid int) {
+	if errRecorder == nil {
+		return
+	}
+	s := describeError(err)
+	s.PID = pid
+	errRecorder.mu.Lock()
+	defer errRecorder.mu.Unlock()
+	errRecorder.enc.Encode(s)
+}
+
+func loadErrorSurfaces(path string) (map[string]int, map[string]errorSurface, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer f.Close()
+
+	counts := map[string]int{}
+	examples := map[string]errorSurface{}
+	driver := "unknown"
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var s errorSurface
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return nil, nil, "", fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		// Every recorded error has at least its own message
+		if len(s.Messages) == 0 {
+			return nil, nil, "", fmt.Errorf("%s:%d: error without messages", path, line)
+		}
+		sig := s.signature()
+		counts[sig]++
+		if _, ok := examples[sig]; !ok {
+			examples[sig] = s
+		}
+		driver = s.Driver
+	}
+	return counts, examples, driver, scanner.Err()
+}
+
+// diffErrorSurfaces prints the error signatures of two runs side by side,
+// marking those which only appear in one of them
+func diffErrorSurfaces(pathA, pathB string) error {
+	countsA, examplesA, driverA, err := loadErrorSurfaces(pathA)
+	if err != nil {
+		return err
+	}
+	countsB, examplesB, driverB, err := loadErrorSurfaces(pathB)
+	if err != nil {
+		return err
+	}
+
+	sigs := map[string]bool{}
+	for sig := range countsA {
+		sigs[sig] = true
+	}
+	for sig := range countsB {
+		sigs[sig] = true
+	}
+	sorted := make([]string, 0, len(sigs))
+	for sig := range sigs {
+		sorted = append(sorted, sig)
+	}
+	sort.Strings(sorted)
+
+	fmt.Printf("A: %s (%s)\n", pathA, driverA)
+	fmt.Printf("B: %s (%s)\n", pathB, driverB)
+	fmt.Println()
+	printf := func(mark, a, b, sig string) { fmt.Printf("%-4s %8s %8s   %s\n", mark, a, b, sig) }
+	printf("", "A", "B", "Signature")
+	changed := 0
+	for _, sig := range sorted {
+		mark := ""
+		switch {
+		case countsA[sig] == 0:
+			mark, changed = "+B", changed+1
+		case countsB[sig] == 0:
+			mark, changed = "-A", changed+1
+		}
+		printf(mark, fmt.Sprint(countsA[sig]), fmt.Sprint(countsB[sig]), sig)
+		if ex, ok := examplesA[sig]; ok && mark != "" {
+			fmt.Printf("%22s example: %s\n", "", ex.Messages[0])
+		} else if ex, ok := examplesB[sig]; ok && mark != "" {
+			fmt.Printf("%22s example: %s\n", "", ex.Messages[0])
+		}
+	}
+	fmt.Println()
+	fmt.Printf("%d signatures, %d only in one run\n", len(sorted), changed)
+	return nil
+}
@@ -0,0 +1,223 @@
+// Scenario: one two-statement operation written three ways, as two calls on
+// the *sql.DB, on a checked-out *sql.Conn and in a *sql.Tx, compared for the
+// pool pressure each puts on the pool and whether the second statement sees
+// the session state the first one set.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	execPatternRun   = 10 * time.Second
+	execPatternThink = 5 * time.Millisecond // application work between the two statements
+)
+
+// execPattern runs the operation for request id with the two statements
+// below and returns how long it held a pooled connection
+type execPattern struct {
+	name, code string
+	run        func(ctx context.Context, db *sql.DB, id string) (inherited bool, held time.Duration, err error)
+}
+
+// The first statement reads what the session carries over and sets
+// pg_idle_test.request_id, session-wide or until the end of the transaction;
+// the second records whether it still sees it
+const (
+	execPatternSet    = "SELECT COALESCE(current_setting('pg_idle_test.request_id', true), ''), set_config('pg_idle_test.request_id', $1, $2)"
+	execPatternInsert = "INSERT INTO test_patterns (pattern, request_id, seen) VALUES ($1, $2, current_setting('pg_idle_test.request_id', true))"
+)
+
+var execPatterns = []execPattern{
+	{"db", "db.QueryRowContext, then db.ExecContext", execPatternDB},
+	{"conn", "db.Conn, both statements, conn.Close", execPatternConn},
+	{"tx", "db.BeginTx, both statements with set_config local, tx.Commit", execPatternTx},
+}
+
+type execPatternResult struct {
+	ok, failed int64
+	held       time.Duration // connection time of the operations which completed
+	waitCount  int64
+	waitTime   time.Duration
+	inherited  int64 // operations whose session already carried another request's id
+	mismatched int64 // committed rows whose second statement saw another id or none
+}
+
+func init() {
+	registerScenario("execpatterns", scenario{
+		standalone: func(o *options) bool { return runExecPatterns(o.connStr, o.workers, o.maxOpen, o.queryTimeout) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = o.maxOpen + 1 }, // pool and setup
+	})
+}
+
+// runExecPatterns runs each pattern for execPatternRun with workers on maxOpen
+// connections. It passes if the transaction pattern never saw another
+// request's state, the one of the three which needs no session reset to be
+// correct.
+func runExecPatterns(connStr string, workers, maxOpen int, timeout time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_patterns")
+	if _, err := setup.Exec("CREATE TABLE test_patterns (pattern TEXT, request_id TEXT, seen TEXT)"); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to create test_patterns: %v\n", err)
+		return false
+	}
+
+	results := map[string]execPatternResult{}
+	for _, p := range execPatterns {
+		fmt.Printf(">>> EXEC PATTERNS: %s (%s), %d workers on %d connections for %v\n", p.name, p.code, workers, maxOpen, execPatternRun)
+		r, err := execPatternOnce(connStr, p, workers, maxOpen, timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", p.name, err)
+			return false
+		}
+		setup.QueryRow("SELECT count(*) FROM test_patterns WHERE pattern = $1 AND seen IS DISTINCT FROM request_id", p.name).Scan(&r.mismatched)
+		results[p.name] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> EXEC PATTERNS REPORT (two statements sharing a session setting, %v of work between them)\n", execPatternThink)
+	fmt.Printf("%-6s %8s %8s %8s %10s %8s %10s %10s %11s\n", "Style", "Ops", "Ops/s", "Failed", "Held/op", "Waits", "Mean wait", "Inherited", "Wrong seen")
+	for _, p := range execPatterns {
+		r := results[p.name]
+		held, wait := "-", "-"
+		if r.ok > 0 {
+			held = ms(r.held / time.Duration(r.ok))
+		}
+		if r.waitCount > 0 {
+			wait = ms(r.waitTime / time.Duration(r.waitCount))
+		}
+		fmt.Printf("%-6s %8d %8.1f %8d %10s %8d %10s %10d %11d\n", p.name, r.ok, float64(r.ok)/execPatternRun.Seconds(), r.failed,
+			held, r.waitCount, wait, r.inherited, r.mismatched)
+	}
+	fmt.Println()
+	fmt.Println("Held/op is how long an operation kept a pooled connection: the db pattern gives it back between the")
+	fmt.Println("statements and holds one only while each runs, so it puts the least pressure on the pool, but its second")
+	fmt.Println("statement runs on whichever connection is free and sees another request's setting or none (Wrong seen).")
+	fmt.Println("The conn pattern keeps the session across the work in between and sees its own setting, but leaves it")
+	fmt.Println("behind for the next checkout (Inherited) unless -session-reset clears it. The tx pattern holds the")
+	fmt.Println("connection as long as conn, in a transaction, and its set_config ends with the transaction.")
+	tx := results["tx"]
+	if tx.inherited > 0 || tx.mismatched > 0 {
+		fmt.Printf(">>> EXEC PATTERNS: FAIL the tx pattern saw another request's state (%d inherited, %d wrong)\n", tx.inherited, tx.mismatched)
+		return false
+	}
+	fmt.Println(">>> EXEC PATTERNS: PASS the tx pattern ran both statements in one session without leaking its state")
+	return true
+}
+
+func execPatternOnce(connStr string, p execPattern, workers, maxOpen int, timeout time.Duration) (execPatternResult, error) {
+	var r execPatternResult
+	db, err := openDB(connStr, "pg-idle-test-execpatterns-"+p.name)
+	if err != nil {
+		return r, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxOpen)
+	if err := db.Ping(); err != nil {
+		return r, err
+	}
+
+	var stopping atomic.Bool
+	var seq atomic.Int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	statsBefore := db.Stats()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopping.Load() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				inherited, held, err := p.run(ctx, db, fmt.Sprintf("%s-%d", p.name, seq.Add(1)))
+				cancel()
+				mu.Lock()
+				if err == nil {
+					r.ok++
+					r.held += held
+				} else {
+					r.failed++
+				}
+				if inherited {
+					r.inherited++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	time.Sleep(execPatternRun)
+	stopping.Store(true)
+	wg.Wait()
+	stats := db.Stats()
+	r.waitCount = stats.WaitCount - statsBefore.WaitCount
+	r.waitTime = stats.WaitDuration - statsBefore.WaitDuration
+	return r, nil
+}
+
+// execPatternDB runs each statement on the *sql.DB, which checks out a
+// connection for it and puts it back right after
+func execPatternDB(ctx context.Context, db *sql.DB, id string) (bool, time.Duration, error) {
+	var prev, set string
+	start := time.Now()
+	if err := db.QueryRowContext(ctx, execPatternSet, id, false).Scan(&prev, &set); err != nil {
+		return false, 0, err
+	}
+	held := time.Since(start)
+	time.Sleep(execPatternThink)
+	start = time.Now()
+	_, err := db.ExecContext(ctx, execPatternInsert, "db", id)
+	return prev != "", held + time.Since(start), err
+}
+
+// execPatternConn runs both statements on one checked-out *sql.Conn, with the
+// setting session-wide
+func execPatternConn(ctx context.Context, db *sql.DB, id string) (bool, time.Duration, error) {
+	start := time.Now()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer conn.Close()
+	var prev, set string
+	if err := conn.QueryRowContext(ctx, execPatternSet, id, false).Scan(&prev, &set); err != nil {
+		return false, 0, err
+	}
+	time.Sleep(execPatternThink)
+	if _, err := conn.ExecContext(ctx, execPatternInsert, "conn", id); err != nil {
+		return prev != "", 0, err
+	}
+	conn.Close()
+	return prev != "", time.Since(start), nil
+}
+
+// execPatternTx runs both statements in a *sql.Tx, with the setting local to
+// the transaction
+func execPatternTx(ctx context.Context, db *sql.DB, id string) (bool, time.Duration, error) {
+	start := time.Now()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+	var prev, set string
+	if err := tx.QueryRowContext(ctx, execPatternSet, id, true).Scan(&prev, &set); err != nil {
+		return false, 0, err
+	}
+	time.Sleep(execPatternThink)
+	if _, err := tx.ExecContext(ctx, execPatternInsert, "tx", id); err != nil {
+		return prev != "", 0, err
+	}
+	err = tx.Commit()
+	return prev != "", time.Since(start), err
+}
@@ -0,0 +1,62 @@
+// Expectations of a rehearsal: the stall diagnosis a run must reach and the
+// invariant result it must end with, so a preset reproducing a known incident
+// fails when the incident did not happen.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// invariantExpectations are the values of -expect-invariant
+var invariantExpectations = []string{"pass", "fail", "any"}
+
+// expectationsSet reports whether the run asks for more than a passing
+// invariant check, the default
+func expectationsSet(o *options) bool {
+	return o.expectDiagnosis != "" || o.expectInvariant != "pass"
+}
+
+// checkExpectations compares the invariant check and the recorded stall
+// diagnoses with -expect-invariant and -expect-diagnosis. Without either it
+// returns the invariant check's result as before.
+func checkExpectations(o *options, invariantPassed bool) bool {
+	if !expectationsSet(o) {
+		return invariantPassed
+	}
+	var met, missed []string
+	switch {
+	case o.expectInvariant == "any":
+		met = append(met, "invariant result not checked")
+	case invariantPassed == (o.expectInvariant == "pass"):
+		met = append(met, "invariant "+o.expectInvariant+"ed as expected")
+	default:
+		missed = append(missed, "invariant expected to "+o.expectInvariant)
+	}
+	if o.expectDiagnosis != "" {
+		summary.mu.Lock()
+		diagnoses := summary.diagnoses
+		summary.mu.Unlock()
+		found := ""
+		for _, d := range diagnoses {
+			if strings.Contains(d, o.expectDiagnosis) {
+				found = d
+				break
+			}
+		}
+		switch {
+		case found != "":
+			met = append(met, fmt.Sprintf("stall diagnosed as %q", found))
+		case len(diagnoses) == 0:
+			missed = append(missed, fmt.Sprintf("no stall diagnosed, expected %q", o.expectDiagnosis))
+		default:
+			missed = append(missed, fmt.Sprintf("no stall diagnosis contains %q (got %q)", o.expectDiagnosis, diagnoses[0]))
+		}
+	}
+	if len(missed) > 0 {
+		fmt.Printf(">>> EXPECTATIONS: FAIL %s\n", strings.Join(missed, "; "))
+		return false
+	}
+	fmt.Printf(">>> EXPECTATIONS: PASS %s\n", strings.Join(met, "; "))
+	return true
+}
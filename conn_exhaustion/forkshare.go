@@ -0,0 +1,257 @@
+// Scenario: a pooled connection inherited by a worker process, as a pool
+// opened before fork() in a prefork server leaves it, with both processes
+// talking over the one socket, and a detector for sockets open in more than
+// one process.
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// forkShareQueries each process sends over the shared connection
+const forkShareQueries = 200
+
+// forkShareTally is what one process saw: results carrying its own marker,
+// results carrying the other process's, and errors
+type forkShareTally struct {
+	sent, own, foreign, errors int
+	firstErr                   string
+}
+
+func init() {
+	registerScenario("forkshare", scenario{
+		standalone: func(o *options) bool { return runForkShare(o.connStr) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 2 }, // pool of one and a fresh connection after
+	})
+}
+
+// runForkShare checks out a connection of a pool of one, hands a duplicate of
+// its socket to a child process of this binary and lets both send
+// forkShareQueries statements tagged with their own marker at once. It passes
+// if the detector found the socket open in both processes, or, where it
+// cannot look, if the markers caught the crossed responses.
+func runForkShare(connStr string) bool {
+	db, err := openDB(connStr, "pg-idle-test-forkshare")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to check out a connection: %v\n", err)
+		return false
+	}
+	var pid int32
+	conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+	var socket *os.File
+	err = conn.Raw(func(driverConn any) error {
+		c, err := pgxConnOf(driverConn)
+		if err != nil {
+			return err
+		}
+		f, ok := socketOf(c).(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("the connection is encrypted; the child cannot speak TLS on an inherited socket, use sslmode=disable")
+		}
+		socket, err = f.File()
+		return err
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to share the connection's socket: %v\n", err)
+		conn.Close()
+		return false
+	}
+
+	// The duplicate names the same socket as the pool's descriptor
+	inode, inodeErr := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", socket.Fd()))
+
+	cmd, err := childCommand(connStr, "forkchild")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return false
+	}
+	cmd.ExtraFiles = []*os.File{socket} // fd 3 in the child
+	cmd.Stderr = os.Stderr
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to start the worker process (inheriting sockets needs Unix): %v\n", err)
+		return false
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	socket.Close()
+	lines := bufio.NewScanner(stdout)
+	if !lines.Scan() || lines.Text() != "READY" {
+		fmt.Fprintf(os.Stderr, "ERROR: worker process exited before taking the socket\n")
+		return false
+	}
+
+	var owners []int
+	detectErr := inodeErr
+	if detectErr == nil {
+		owners = socketOwners(inode)
+	}
+	fmt.Printf(">>> FORK SHARE: backend PID %d, socket of the pooled connection open in processes %v (this one %d, child %d)\n",
+		pid, owners, os.Getpid(), cmd.Process.Pid)
+	if detectErr != nil {
+		fmt.Printf(">>> FORK SHARE: detector unavailable here: %v\n", detectErr)
+	}
+
+	// Both send at once
+	var parent forkShareTally
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < forkShareQueries; i++ {
+			qctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			marker := fmt.Sprintf("parent:%d", i)
+			var got string
+			err := conn.QueryRowContext(qctx, "SELECT $1::text", marker).Scan(&got)
+			cancel()
+			parent.count(got, marker, "parent:", err)
+		}
+	}()
+	io.WriteString(stdin, "go\n")
+	wg.Wait()
+	var child forkShareTally
+	if lines.Scan() {
+		fmt.Sscanf(lines.Text(), "CHILD sent=%d own=%d foreign=%d errors=%d", &child.sent, &child.own, &child.foreign, &child.errors)
+		if _, first, ok := strings.Cut(lines.Text(), " first="); ok {
+			child.firstErr = first
+		}
+	}
+	conn.Close()
+
+	// The pool hands the same connection to the next statement
+	var nextErr error
+	var next int32
+	for i := 0; i < 3 && nextErr == nil; i++ {
+		qctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		nextErr = db.QueryRowContext(qctx, "SELECT pg_backend_pid()").Scan(&next)
+		cancel()
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> FORK SHARE REPORT (one pooled connection, %d statements from each process)\n", forkShareQueries)
+	fmt.Printf("%-8s %6s %8s %8s %7s  %s\n", "Process", "Sent", "Own", "Foreign", "Errors", "First error")
+	for _, row := range []struct {
+		name string
+		t    forkShareTally
+	}{{"parent", parent}, {"child", child}} {
+		fmt.Printf("%-8s %6d %8d %8d %7d  %s\n", row.name, row.t.sent, row.t.own, row.t.foreign, row.t.errors, truncate(row.t.firstErr, 70))
+	}
+	switch {
+	case nextErr != nil:
+		fmt.Printf("Pool afterwards: next statement failed: %s\n", classifyError(nextErr))
+	case next == pid:
+		fmt.Printf("Pool afterwards: next statement ran on the shared backend %d\n", next)
+	default:
+		fmt.Printf("Pool afterwards: the shared connection was discarded, next statement ran on backend %d\n", next)
+	}
+	fmt.Println()
+	fmt.Println("Foreign counts results carrying the other process's marker: the server answers messages in the order")
+	fmt.Println("they arrive, and whichever process reads the socket first takes the response, so a process gets")
+	fmt.Println("another's rows, a response of the wrong type (unexpected message) or waits for one already read.")
+	fmt.Println("Nothing fails cleanly: wrong results are silent. Open pools after fork() in each worker, or close")
+	fmt.Println("inherited ones in the child without a Terminate. The detector looks up the socket's inode in the")
+	fmt.Println("file descriptors of every process (/proc on Linux); a client socket open in two processes is shared.")
+	crossed := parent.foreign+child.foreign+parent.errors+child.errors > 0
+	if len(owners) > 1 || detectErr != nil && crossed {
+		fmt.Println(">>> FORK SHARE: PASS the connection shared across processes was detected")
+		return true
+	}
+	fmt.Println(">>> FORK SHARE: FAIL the shared connection went undetected")
+	return false
+}
+
+func (t *forkShareTally) count(got, marker, own string, err error) {
+	t.sent++
+	switch {
+	case err != nil:
+		t.errors++
+		if t.firstErr == "" {
+			t.firstErr = oneLine(err.Error())
+		}
+	case got == marker:
+		t.own++
+	case !strings.HasPrefix(got, own):
+		t.foreign++
+	}
+}
+
+// socketOwners lists the processes with a file descriptor open on inode, a
+// /proc/self/fd link target such as socket:[12345]
+func socketOwners(inode string) []int {
+	var owners []int
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		pid, _ := strconv.Atoi(filepath.Base(proc))
+		fds, _ := os.ReadDir(filepath.Join(proc, "fd"))
+		for _, fd := range fds {
+			if target, _ := os.Readlink(filepath.Join(proc, "fd", fd.Name())); target == inode {
+				owners = append(owners, pid)
+				break
+			}
+		}
+	}
+	return owners
+}
+
+// runForkChild is the worker process of forkshare: it speaks the protocol on
+// the inherited socket (fd 3) with simple queries tagged child:N, from its
+// first message, as a forked worker reusing its parent's connection would
+func runForkChild() {
+	conn, err := net.FileConn(os.NewFile(3, "inherited"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "forkchild: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("READY")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	fe := pgproto3.NewFrontend(conn, conn)
+	var t forkShareTally
+	for i := 0; i < forkShareQueries; i++ {
+		marker := fmt.Sprintf("child:%d", i)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fe.Send(&pgproto3.Query{String: fmt.Sprintf("SELECT '%s'::text", marker)})
+		var got string
+		err := fe.Flush()
+	receive:
+		for err == nil {
+			var msg pgproto3.BackendMessage
+			msg, err = fe.Receive()
+			switch m := msg.(type) {
+			case *pgproto3.DataRow:
+				if len(m.Values) == 1 {
+					got = string(m.Values[0])
+				}
+			case *pgproto3.ErrorResponse:
+				err = fmt.Errorf("%s: %s", m.Code, m.Message)
+			case *pgproto3.ReadyForQuery:
+				break receive
+			}
+		}
+		t.count(got, marker, "child:", err)
+	}
+	// Exit without a Terminate, which would end the parent's session too
+	fmt.Printf("CHILD sent=%d own=%d foreign=%d errors=%d first=%s\n", t.sent, t.own, t.foreign, t.errors, t.firstErr)
+}
@@ -0,0 +1,249 @@
+// Randomized fault composition from a replayable seed.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fuzzKinds are the injections the fuzz mode composes:
+//   - lock: take the row lock and hold it outside the pool, then roll back (like sleep)
+//   - poison: take the row lock and return the connection to the pool, then terminate it (like poison)
+//   - kill: pg_terminate_backend one of the worker sessions
+//   - latency: delay every write to the server on worker connections
+var fuzzKinds = []string{"lock", "poison", "kill", "latency"}
+
+// fuzzWorkerApp is the application_name of the worker pool in fuzz mode, so
+// kill injections only pick worker sessions
+const fuzzWorkerApp = "pg-idle-test-fuzz"
+
+type fuzzEvent struct {
+	at     time.Duration
+	kind   string
+	hold   time.Duration // lock, poison, latency
+	delay  time.Duration // latency
+	victim int           // kill: index into the sorted worker PIDs
+}
+
+func (e fuzzEvent) String() string {
+	switch e.kind {
+	case "kill":
+		return fmt.Sprintf("+%5.1fs kill victim=%d", e.at.Seconds(), e.victim)
+	case "latency":
+		return fmt.Sprintf("+%5.1fs latency delay=%v hold=%v", e.at.Seconds(), e.delay, e.hold)
+	}
+	return fmt.Sprintf("+%5.1fs %s hold=%v", e.at.Seconds(), e.kind, e.hold)
+}
+
+// fuzzSchedule derives the injections from seed alone, so a failing seed
+// replays the same schedule
+func fuzzSchedule(seed int64, window time.Duration, kinds []string) []fuzzEvent {
+	rng := rand.New(rand.NewSource(seed))
+	events := make([]fuzzEvent, 3+rng.Intn(6))
+	for i := range events {
+		events[i] = fuzzEvent{
+			at:     time.Duration(rng.Int63n(int64(window))).Truncate(100 * time.Millisecond),
+			kind:   kinds[rng.Intn(len(kinds))],
+			hold:   time.Duration(1+rng.Intn(20)) * 500 * time.Millisecond,
+			delay:  time.Duration(5+rng.Intn(196)) * time.Millisecond,
+			victim: rng.Intn(1000),
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].at < events[j].at })
+	return events
+}
+
+// parseFuzzKinds validates a comma-separated -fuzz-inject value
+func parseFuzzKinds(list string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.TrimSpace(kind)
+		if !slices.Contains(fuzzKinds, kind) {
+			return nil, fmt.Errorf("unknown injection %q (known: %s)", kind, strings.Join(fuzzKinds, ","))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+func init() {
+	registerScenario("fuzz", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			h.hint = fmt.Sprintf(">>> REPLAY: rerun with the same flags and -seed=%d", h.o.seed)
+			return runFuzz(h.db, h.connStr, h.wl, h.o.seed, h.o.fuzzWindow, h.o.fuzzKinds)
+		},
+		validate: func(o *options) (err error) {
+			if o.fuzzKinds, err = parseFuzzKinds(o.fuzzInject); err != nil {
+				return fmt.Errorf("Invalid -fuzz-inject: %v", err)
+			}
+			if o.seed == 0 {
+				o.seed = time.Now().UnixNano()
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns += 2 // injection control
+		},
+		appName:          fuzzWorkerApp,
+		latencyInjection: true,
+	})
+}
+
+// runFuzz runs the schedule against the worker pool, then checks that the pool
+// recovers: after a settle period every worker iteration must succeed again.
+// Counter consistency is checked by the invariant afterwards.
+func runFuzz(db *sql.DB, connStr string, wl workload, seed int64, window time.Duration, kinds []string) bool {
+	ctl, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to open fuzz control connection: %v\n", err)
+		return false
+	}
+	defer ctl.Close()
+	ctl.SetMaxOpenConns(2)
+
+	events := fuzzSchedule(seed, window, kinds)
+	fmt.Printf(">>> FUZZ: seed=%d window=%v injections=%d\n", seed, window, len(events))
+	for _, e := range events {
+		fmt.Printf("    %s\n", e)
+	}
+
+	start := time.Now()
+	startPhase("fuzz")
+	var wg sync.WaitGroup
+	for _, e := range events {
+		wg.Add(1)
+		time.AfterFunc(e.at, func() {
+			defer wg.Done()
+			fmt.Printf(">>> FUZZ: +%5.1fs inject %s\n", time.Since(start).Seconds(), e)
+			recordEvent("fuzz injection: %s", strings.TrimSpace(e.String()))
+			if err := inject(db, ctl, wl, fuzzWorkerApp, e); err != nil {
+				fmt.Printf(">>> FUZZ: +%5.1fs %s failed: %v\n", time.Since(start).Seconds(), e.kind, err)
+			}
+		})
+	}
+	time.Sleep(window)
+	wg.Wait()
+
+	startPhase("fuzz:settle")
+	time.Sleep(5 * time.Second)
+	startPhase("fuzz:recovered")
+	time.Sleep(5 * time.Second)
+
+	p := currentPhase.Load()
+	p.mu.Lock()
+	ok, failed := p.ok, p.failed
+	p.mu.Unlock()
+	fmt.Println()
+	if ok == 0 || failed > 0 {
+		fmt.Printf(">>> FUZZ: FAIL stall: %d ok and %d failed iterations 5s after the last injection ended (seed=%d)\n", ok, failed, seed)
+		return false
+	}
+	fmt.Printf(">>> FUZZ: PASS pool recovered, %d ok iterations after the last injection ended (seed=%d)\n", ok, seed)
+	return true
+}
+
+// inject runs one injection against the worker pool, whose sessions kill
+// picks from by application_name app, and returns when it has ended
+func inject(db, ctl *sql.DB, wl workload, app string, e fuzzEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	switch e.kind {
+	case "lock", "poison":
+		// The pool may be exhausted by an earlier injection; give up rather than queue
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		var pid int
+		conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+		if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+			conn.Close()
+			return err
+		}
+		if _, err := conn.ExecContext(ctx, wl.poisonSQL()); err != nil {
+			conn.ExecContext(context.Background(), "ROLLBACK")
+			conn.Close()
+			return err
+		}
+		if e.kind == "poison" {
+			conn.Close()
+			time.Sleep(e.hold)
+			_, err = ctl.Exec("SELECT pg_terminate_backend($1)", pid)
+			return err
+		}
+		time.Sleep(e.hold)
+		_, err = conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+		return err
+	case "kill":
+		rows, err := ctl.QueryContext(ctx, "SELECT pid FROM pg_stat_activity WHERE application_name = $1 ORDER BY pid", app)
+		if err != nil {
+			return err
+		}
+		var pids []int
+		for rows.Next() {
+			var pid int
+			rows.Scan(&pid)
+			pids = append(pids, pid)
+		}
+		rows.Close()
+		if len(pids) == 0 {
+			return fmt.Errorf("no worker sessions")
+		}
+		_, err = ctl.ExecContext(ctx, "SELECT pg_terminate_backend($1)", pids[e.victim%len(pids)])
+		return err
+	case "ddl":
+		// A reader outside the pool keeps ACCESS SHARE on the workload's table
+		// in an open transaction; the ALTER TABLE queues behind it for ACCESS
+		// EXCLUSIVE, and every later statement on the table behind the ALTER
+		table := workloadTable(wl)
+		reader, err := ctl.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		if _, err := reader.ExecContext(ctx, "BEGIN"); err != nil {
+			return err
+		}
+		if _, err := reader.ExecContext(ctx, "SELECT 1 FROM "+table+" LIMIT 1"); err != nil {
+			reader.ExecContext(context.Background(), "ROLLBACK")
+			return err
+		}
+		migration, err := ctl.Conn(ctx)
+		if err != nil {
+			reader.ExecContext(context.Background(), "ROLLBACK")
+			return err
+		}
+		defer migration.Close()
+		migration.ExecContext(ctx, "BEGIN")
+		migration.ExecContext(ctx, "SET LOCAL lock_timeout = 0")
+		altered := make(chan error, 1)
+		go func() {
+			_, err := migration.ExecContext(context.Background(), "ALTER TABLE "+table+" ADD COLUMN pg_idle_test_ddl INT")
+			altered <- err
+		}()
+		time.Sleep(e.hold)
+		reader.ExecContext(context.Background(), "ROLLBACK")
+		err = <-altered
+		migration.ExecContext(context.Background(), "ROLLBACK")
+		return err
+	case "latency":
+		injectedLatency.Add(int64(e.delay))
+		time.Sleep(e.hold)
+		injectedLatency.Add(-int64(e.delay))
+	case "dns":
+		injectedDNSLatency.Add(int64(e.delay))
+		time.Sleep(e.hold)
+		injectedDNSLatency.Add(-int64(e.delay))
+	}
+	return nil
+}
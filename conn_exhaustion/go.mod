@@ -1,14 +1,18 @@
-module conn_exhaustion
+module github.com/ardentperf/pg-idle-test/conn_exhaustion
 
 go 1.24.0
 
-require github.com/jackc/pgx/v5 v5.5.1
+require (
+	github.com/HdrHistogram/hdrhistogram-go v1.3.0
+	github.com/jackc/pgx/v5 v5.5.1
+	github.com/lib/pq v1.12.3
+	golang.org/x/sync v0.17.0
+)
 
 require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
 	github.com/jackc/puddle/v2 v2.2.2 // indirect
 	golang.org/x/crypto v0.9.0 // indirect
-	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/text v0.29.0 // indirect
 )
@@ -0,0 +1,182 @@
+// Periodic audit of session settings on the pooled connections, catching
+// state which leaks between checkouts outside a transaction.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gucDrift is one setting whose value on a pooled connection differed from
+// the baseline of a fresh connection
+type gucDrift struct {
+	name, value string
+}
+
+type gucAuditor struct {
+	db       *sql.DB
+	settings []string
+	baseline map[string]string
+
+	mu       sync.Mutex
+	rounds   int
+	audited  map[int32]bool              // backend PIDs checked at least once
+	drifted  map[gucDrift]map[int32]bool // backend PIDs seen with each drifted value
+	reported map[gucDrift]bool
+}
+
+// gucAudit is nil unless -guc-audit was given
+var gucAudit *gucAuditor
+
+// newGUCAuditor takes the baseline from a connection of db, which must not
+// have run any workload yet
+func newGUCAuditor(db *sql.DB, settings []string) (*gucAuditor, error) {
+	a := &gucAuditor{db: db, settings: settings, audited: map[int32]bool{}, drifted: map[gucDrift]map[int32]bool{}, reported: map[gucDrift]bool{}}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if a.baseline, _, err = a.read(context.Background(), conn); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// read returns the settings and backend PID of conn
+func (a *gucAuditor) read(ctx context.Context, conn *sql.Conn) (map[string]string, int32, error) {
+	pid, err := pooledPID(conn)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := conn.QueryContext(ctx, "SELECT name, coalesce(current_setting(name, true), '<unset>') FROM unnest($1::text[]) name", a.settings)
+	if err != nil {
+		return nil, pid, err
+	}
+	defer rows.Close()
+	values := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, pid, err
+		}
+		values[name] = value
+	}
+	return values, pid, rows.Err()
+}
+
+// run audits every interval until the process exits
+func (a *gucAuditor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		selfOverhead.since("session setting audit", start, a.auditIdle())
+	}
+}
+
+// auditIdle checks out every idle pooled connection at once, so each is
+// audited rather than the same one again, and reads its settings as the next
+// checkout would see them, after the acquire check and session reset. It
+// returns the number of connections read.
+func (a *gucAuditor) auditIdle() int {
+	var conns []*sql.Conn
+	for i := a.db.Stats().Idle; i > 0; i-- {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		conn, err := a.db.Conn(ctx)
+		cancel()
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	a.mu.Lock()
+	a.rounds++
+	a.mu.Unlock()
+	read := 0
+	for _, conn := range conns {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		values, pid, err := a.read(ctx, conn)
+		cancel()
+		if err != nil {
+			continue
+		}
+		read++
+		a.mu.Lock()
+		a.audited[pid] = true
+		for _, name := range a.settings {
+			if values[name] == a.baseline[name] {
+				continue
+			}
+			d := gucDrift{name, values[name]}
+			if a.drifted[d] == nil {
+				a.drifted[d] = map[int32]bool{}
+			}
+			a.drifted[d][pid] = true
+			if !a.reported[d] {
+				a.reported[d] = true
+				fmt.Fprintf(os.Stderr, "WARNING: Session setting drift on pooled connection pid=%d: %s = %q, baseline %q\n", pid, name, values[name], a.baseline[name])
+				recordEvent("pooled connection pid %d has %s = %q instead of %q", pid, name, values[name], a.baseline[name])
+			}
+		}
+		a.mu.Unlock()
+	}
+	return read
+}
+
+// print lists every drifted value with the number of connections it was seen on
+func (a *gucAuditor) print() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Println()
+	fmt.Printf(">>> SESSION SETTING AUDIT: %d rounds, %d pooled connections audited\n", a.rounds, len(a.audited))
+	fmt.Printf("%-24s %-24s %-24s %11s\n", "Setting", "Baseline", "Seen", "Connections")
+	drifts := make([]gucDrift, 0, len(a.drifted))
+	for d := range a.drifted {
+		drifts = append(drifts, d)
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].name != drifts[j].name {
+			return drifts[i].name < drifts[j].name
+		}
+		return drifts[i].value < drifts[j].value
+	})
+	for _, name := range a.settings {
+		seen := false
+		for _, d := range drifts {
+			if d.name == name {
+				seen = true
+				fmt.Printf("%-24s %-24s %-24s %11d\n", name, a.baseline[name], d.value, len(a.drifted[d]))
+			}
+		}
+		if !seen {
+			fmt.Printf("%-24s %-24s %-24s %11s\n", name, a.baseline[name], "(no drift)", "-")
+		}
+	}
+}
+
+// parseGUCList splits -guc-audit-settings
+func parseGUCList(list string) []string {
+	var settings []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			settings = append(settings, name)
+		}
+	}
+	return settings
+}
@@ -0,0 +1,176 @@
+// Scenario: a session setting changed with SET and never reset on a pooled
+// connection, which fails unrelated work on whichever checkout gets it next
+// while looking idle and clean to a transaction status check.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gucLeakPool    = 5
+	gucLeakWorkers = 10
+	gucLeakRun     = 10 * time.Second
+)
+
+// gucLeakResets are the session resets the scenario runs under: the leak
+// without one, and the reset which clears it
+var gucLeakResets = []string{"none", "reset_all"}
+
+type gucLeakResult struct {
+	pid         int32 // backend of the connection the setting was left on
+	txStatus    byte  // its transaction status when it went back to the pool
+	statements  int
+	failed      int
+	leakedRuns  int // statements on the leaked connection
+	leakedFails int
+	stillLeaked bool // the last statement on it failed too
+	firstErr    string
+}
+
+func init() {
+	registerScenario("gucleak", scenario{
+		standalone: func(o *options) bool { return runGUCLeak(o.connStr) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = gucLeakPool },
+	})
+}
+
+// runGUCLeak runs once per reset of gucLeakResets, with the txprobe acquire
+// check on: one checkout sets statement_timeout to 50ms and puts the
+// connection back, then gucLeakWorkers workers run a 100ms statement on the
+// pool for gucLeakRun. It passes if the failures without a reset were all on
+// the leaked connection and RESET ALL prevented them.
+func runGUCLeak(connStr string) bool {
+	savedCheck, savedReset := acquireCheck, sessionReset
+	defer func() { acquireCheck, sessionReset = savedCheck, savedReset }()
+	acquireCheck = "txprobe"
+
+	results := map[string]*gucLeakResult{}
+	for _, reset := range gucLeakResets {
+		sessionReset = reset
+		fmt.Fprintf(os.Stderr, "[%s] GUC LEAK: session reset %s\n", time.Now().Format("04:05"), reset)
+		r, err := gucLeakOnce(connStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+			return false
+		}
+		fmt.Printf(">>> GUC LEAK: %s: PID %d went back to the pool with statement_timeout = 50ms and TxStatus=%c\n", reset, r.pid, r.txStatus)
+		results[reset] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> SESSION GUC LEAK REPORT (%d workers on %d connections for %v, acquire check txprobe)\n", gucLeakWorkers, gucLeakPool, gucLeakRun)
+	fmt.Printf("%-10s %11s %7s %12s %13s %17s %13s  %s\n", "Reset", "Statements", "Failed", "Leaked runs", "Leaked fails", "Failed elsewhere", "Still leaked", "First error")
+	for _, reset := range gucLeakResets {
+		r := results[reset]
+		fmt.Printf("%-10s %11d %7d %12d %13d %17d %13v  %s\n", reset, r.statements, r.failed, r.leakedRuns, r.leakedFails,
+			r.failed-r.leakedFails, r.stillLeaked, truncate(r.firstErr, 60))
+	}
+	fmt.Println()
+	fmt.Println("Every statement is SELECT pg_sleep(0.1), unrelated to the checkout which ran SET and well inside any")
+	fmt.Println("sane timeout, so each failure is the leaked 50ms statement_timeout (57014 canceling statement due to")
+	fmt.Println("statement timeout) of the session it landed on. The connection goes back idle outside a transaction,")
+	fmt.Println("so the txprobe check (TxStatus) passes it, and a canceled statement does not mark it bad: the pool")
+	fmt.Println("keeps handing it out and roughly one checkout in the pool size fails for as long as it lives. Use")
+	fmt.Println("SET LOCAL inside a transaction, RESET what was SET before returning the connection, or reset with")
+	fmt.Println("-session-reset=reset_all or discard_all; -guc-audit finds such connections while a run goes on.")
+	none, reset := results["none"], results["reset_all"]
+	if none.leakedFails == 0 || none.failed > none.leakedFails || reset.failed > 0 {
+		fmt.Println(">>> GUC LEAK: FAIL the failures did not follow the leaked setting")
+		return false
+	}
+	fmt.Printf(">>> GUC LEAK: PASS %d statements failed on the leaked connection without a reset, none with RESET ALL\n", none.leakedFails)
+	return true
+}
+
+func gucLeakOnce(connStr string) (*gucLeakResult, error) {
+	r := &gucLeakResult{}
+	db, err := openDB(connStr, "pg-idle-test-gucleak")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(gucLeakPool)
+	db.SetMaxIdleConns(gucLeakPool)
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, "SET statement_timeout = '50ms'"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if r.pid, err = pooledPID(conn); err == nil {
+		err = conn.Raw(func(driverConn any) error {
+			c, err := pgxConnOf(driverConn)
+			if err != nil {
+				return err
+			}
+			r.txStatus = c.PgConn().TxStatus()
+			return nil
+		})
+	}
+	conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the leaked connection's session: %w", err)
+	}
+
+	var mu sync.Mutex
+	var stopping atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < gucLeakWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopping.Load() {
+				pid, err := gucLeakStatement(db)
+				mu.Lock()
+				r.statements++
+				if err != nil {
+					r.failed++
+					if r.firstErr == "" {
+						r.firstErr = oneLine(err.Error())
+					}
+				}
+				if pid == r.pid {
+					r.leakedRuns++
+					r.stillLeaked = err != nil
+					if err != nil {
+						r.leakedFails++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	time.Sleep(gucLeakRun)
+	stopping.Store(true)
+	wg.Wait()
+	return r, nil
+}
+
+// gucLeakStatement runs the workers' statement on a checked-out connection
+// and returns the backend it ran on
+func gucLeakStatement(db *sql.DB) (int32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	pid, err := pooledPID(conn)
+	if err != nil {
+		return 0, err
+	}
+	_, err = conn.ExecContext(ctx, "SELECT pg_sleep(0.1)")
+	return pid, err
+}
@@ -0,0 +1,155 @@
+// GUC sweep scenario: change server or session settings between phases.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type gucSetting struct {
+	name  string
+	value string
+}
+
+var gucName = regexp.MustCompile(`^[a-z_][a-z0-9_.]*$`)
+
+// parseGUCs parses "work_mem=64MB,jit=off"
+func parseGUCs(spec string) ([]gucSetting, error) {
+	var settings []gucSetting
+	for _, kv := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || !gucName.MatchString(name) {
+			return nil, fmt.Errorf("invalid setting %q, want name=value", kv)
+		}
+		settings = append(settings, gucSetting{name: name, value: value})
+	}
+	return settings, nil
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// phaseFlags collects repeated -phase flags
+type phaseFlags [][]gucSetting
+
+func (p *phaseFlags) String() string { return fmt.Sprint(len(*p), " phases") }
+
+func (p *phaseFlags) Set(spec string) error {
+	settings, err := parseGUCs(spec)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, settings)
+	return nil
+}
+
+// setSessionGUCs applies SET to every connection of the pool by checking them
+// all out at once. Sessions opened later keep the server defaults.
+func setSessionGUCs(db *sql.DB, settings []gucSetting) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var conns []*sql.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < db.Stats().MaxOpenConnections; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		for _, s := range settings {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf("SET %s = %s", s.name, quoteLiteral(s.value))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setServerGUCs uses ALTER SYSTEM and reloads the configuration, which requires
+// superuser. An empty value resets the setting.
+func setServerGUCs(db *sql.DB, settings []gucSetting) error {
+	for _, s := range settings {
+		stmt := fmt.Sprintf("ALTER SYSTEM SET %s = %s", s.name, quoteLiteral(s.value))
+		if s.value == "" {
+			stmt = fmt.Sprintf("ALTER SYSTEM RESET %s", s.name)
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("SELECT pg_reload_conf()")
+	return err
+}
+
+func init() {
+	registerScenario("gucsweep", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			runGUCSweep(h.db, h.o.phases, h.o.gucScope, h.o.phaseDuration)
+			return true
+		},
+		validate: func(o *options) error {
+			if len(o.phases) == 0 || (o.gucScope != "session" && o.gucScope != "server") {
+				return errors.New("gucsweep needs at least one -phase and -guc-scope=session|server")
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			if o.gucScope == "server" {
+				for _, phase := range o.phases {
+					for _, s := range phase {
+						n.alterSystem = append(n.alterSystem, s.name)
+					}
+				}
+			}
+		},
+	})
+}
+
+// runGUCSweep runs one phase per -phase flag. Server-scope settings are reset
+// at the end so the sweep leaves no configuration behind.
+func runGUCSweep(db *sql.DB, phases phaseFlags, scope string, phaseDuration time.Duration) {
+	touched := map[string]bool{}
+	for _, settings := range phases {
+		var desc []string
+		for _, s := range settings {
+			desc = append(desc, s.name+"="+s.value)
+			touched[s.name] = true
+		}
+		var err error
+		if scope == "server" {
+			err = setServerGUCs(db, settings)
+		} else {
+			err = setSessionGUCs(db, settings)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to apply %s settings %s: %v\n", scope, strings.Join(desc, ","), err)
+		}
+		name := scope + ":" + strings.Join(desc, ",")
+		fmt.Printf(">>> PHASE: %s\n", name)
+		startPhase(name)
+		time.Sleep(phaseDuration)
+	}
+
+	if scope == "server" {
+		var reset []gucSetting
+		for name := range touched {
+			reset = append(reset, gucSetting{name: name})
+		}
+		if err := setServerGUCs(db, reset); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to reset server settings: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Introspection endpoints served on -http-addr while a run is in progress.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// httpMux holds the introspection endpoints; features register their
+// handlers in init
+var httpMux = http.NewServeMux()
+
+func serveHTTP(addr string) {
+	if err := http.ListenAndServe(addr, httpMux); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: HTTP endpoint on %s failed: %v\n", addr, err)
+	}
+}
@@ -0,0 +1,110 @@
+// Scenario: the server closes idle sessions while the pool still counts them as healthy.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// connectsTotal counts connections established by pools opened with openDB
+var connectsTotal atomic.Int64
+
+type idleCloseResult struct {
+	statements, failed int
+	reconnects         int64
+	badConn            int64 // ErrBadConn returns, each retried by database/sql
+	p50, max           time.Duration
+	errors             map[string]int // by class
+}
+
+func init() {
+	registerScenario("idleclose", scenario{
+		standalone: func(o *options) bool { return runIdleClose(o.connStr, o.idleCloseTimeout) },
+		needs:      func(o *options, n *preflightNeeds) { n.minVersion = 140000 }, // idle_session_timeout
+	})
+}
+
+// runIdleClose makes the server end pooled sessions after timeout idle, the
+// way idle_session_timeout (or a pooler's client_idle_timeout) does, and
+// measures what the application sees when it next uses them: either an error
+// or, when pgx notices the closed connection while resetting it and
+// database/sql retries on another connection, only extra latency.
+func runIdleClose(connStr string, timeout time.Duration) bool {
+	saved := extraRuntimeParams
+	defer func() { extraRuntimeParams = saved }()
+	extraRuntimeParams = map[string]string{"idle_session_timeout": fmt.Sprint(timeout.Milliseconds())}
+
+	configs := []struct {
+		name        string
+		maxIdleTime time.Duration
+	}{
+		{"pool", 0},
+		{"maxidletime", timeout / 2},
+	}
+	fmt.Printf(">>> IDLE CLOSE: server closes sessions idle for %v\n", timeout)
+	results := map[string]idleCloseResult{}
+	for _, cfg := range configs {
+		fmt.Fprintf(os.Stderr, "[%s] IDLE_CLOSE: %s\n", time.Now().Format("04:05"), cfg.name)
+		db, err := openDB(connStr, "pg-idle-test-idleclose-"+cfg.name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", cfg.name, err)
+			return false
+		}
+		db.SetMaxOpenConns(10)
+		db.SetMaxIdleConns(10)
+		db.SetConnMaxIdleTime(cfg.maxIdleTime)
+		results[cfg.name] = idleCloseOnce(db, timeout)
+		db.Close()
+	}
+
+	fmt.Println()
+	fmt.Println(">>> IDLE CLOSE REPORT (statements after idle gaps)")
+	fmt.Printf("%-12s %10s %8s %11s %11s %10s %10s   %s\n", "Config", "Statements", "Failed", "Reconnects", "ErrBadConn", "p50", "max", "Errors")
+	for _, cfg := range configs {
+		r := results[cfg.name]
+		var classes []string
+		for class, n := range r.errors {
+			classes = append(classes, fmt.Sprintf("%s=%d", class, n))
+		}
+		sort.Strings(classes)
+		fmt.Printf("%-12s %10d %8d %11d %11d %10s %10s   %s\n", cfg.name, r.statements, r.failed, r.reconnects, r.badConn,
+			ms(r.p50), ms(r.max), strings.Join(classes, " "))
+	}
+	fmt.Println()
+	fmt.Println("ErrBadConn returns without failures are closed sessions hidden by the driver's retry; they cost a reconnect each.")
+	return true
+}
+
+func idleCloseOnce(db *sql.DB, timeout time.Duration) idleCloseResult {
+	r := idleCloseResult{errors: map[string]int{}}
+	var latencies []time.Duration
+	var connectsBefore, badConnBefore int64
+	for round := 0; round < 4; round++ {
+		if round == 1 {
+			connectsBefore, badConnBefore = connectsTotal.Load(), badConnTotal()
+		}
+		burst, errs := statementBurst(db, 10)
+		// The first burst opens the connections; later ones follow an idle gap
+		if round > 0 {
+			latencies = append(latencies, burst...)
+			for _, err := range errs {
+				r.failed++
+				r.errors[classifyError(err)]++
+			}
+		}
+		if round < 3 {
+			time.Sleep(timeout * 2)
+		}
+	}
+	r.reconnects = connectsTotal.Load() - connectsBefore
+	r.badConn = badConnTotal() - badConnBefore
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.statements = len(latencies)
+	r.p50, r.max = percentile(latencies, 0.5), percentile(latencies, 1)
+	return r
+}
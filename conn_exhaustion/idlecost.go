@@ -0,0 +1,51 @@
+// Cost model for idle sessions on a managed database: the share of the
+// instance they occupy, priced at the instance's hourly rate.
+package main
+
+import "fmt"
+
+// hoursPerMonth is the average month providers bill on
+const hoursPerMonth = 730
+
+// idleCostModel is the instance the sessions run on. An instance is bought
+// whole and sized by whichever resource runs out first, so sessions cost
+// the larger of their memory and CPU share of it.
+type idleCostModel struct {
+	pricePerHour float64
+	vcpus        float64
+	memoryGB     float64
+}
+
+// monthly returns the instance share and monthly cost of sessions using
+// memory bytes (negative if unknown) and cpu vCPUs each
+func (m idleCostModel) monthly(sessions int, memory, cpu float64) (memShare, cpuShare, cost float64) {
+	if memory > 0 {
+		memShare = float64(sessions) * memory / (m.memoryGB * (1 << 30))
+	}
+	cpuShare = float64(sessions) * cpu / m.vcpus
+	return memShare, cpuShare, max(memShare, cpuShare) * m.pricePerHour * hoursPerMonth
+}
+
+// print reports the cost of one idle session and of sessions of them, the
+// idle connections an over-provisioned pool keeps open
+func (m idleCostModel) print(sessions int, memory, cpu float64) {
+	fmt.Println()
+	fmt.Printf(">>> IDLE CONNECTION COST (instance of %g vCPU and %g GB at $%.3f/h, %d h a month)\n", m.vcpus, m.memoryGB, m.pricePerHour, hoursPerMonth)
+	fmt.Printf("%-22s %12s %8s %12s %8s %12s\n", "Idle sessions", "Memory", "Share", "vCPU", "Share", "$/month")
+	for _, n := range []int{1, sessions} {
+		memShare, cpuShare, cost := m.monthly(n, memory, cpu)
+		mem := "unknown"
+		if memory >= 0 {
+			mem = fmt.Sprintf("%.1f MB", float64(n)*memory/(1<<20))
+		}
+		fmt.Printf("%-22d %12s %7.2f%% %12.4f %7.2f%% %12.2f\n", n, mem, 100*memShare, float64(n)*cpu, 100*cpuShare, cost)
+	}
+	fmt.Println()
+	fmt.Println("Memory is each idle session's own memory contexts after one catalog lookup, read from")
+	fmt.Println("pg_backend_memory_contexts (Postgres 14+). It leaves out the backend process itself, its page tables")
+	fmt.Println("and private libraries, a few MB more per session, so the figure is a floor. vCPU is the latency the")
+	fmt.Println("idle sessions added to each probe statement times the probe rate, spread over the sessions; on Postgres")
+	fmt.Println("14+ snapshots no longer scale with idle sessions and it is mostly noise. The cost is the larger share")
+	fmt.Println("times the instance price: what a pool kept open beyond its peak use adds once it decides the instance")
+	fmt.Println("size. Set -instance-price, -instance-vcpus and -instance-memory-gb to the provider's instance class.")
+}
@@ -0,0 +1,153 @@
+// Scenario: idle sessions at scale, what each costs the server in memory and
+// in the latency of the sessions doing work next to them.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	idleScaleProbes   = 4
+	idleScaleProbeRun = 5 * time.Second
+)
+
+// idleScaleStep is the probe workload measured with sessions idle next to it
+type idleScaleStep struct {
+	sessions int
+	p50, p95 time.Duration
+	rate     float64 // probe statements per second
+	memory   float64 // mean bytes of memory contexts per idle session, -1 if unknown
+}
+
+func init() {
+	registerScenario("idlescale", scenario{
+		standalone: func(o *options) bool {
+			return runIdleScale(o.connStr, o.idleConns, idleCostModel{o.instancePrice, o.instanceVCPUs, o.instanceMemoryGB})
+		},
+		validate: func(o *options) error {
+			if o.idleConns < 4 || o.instancePrice < 0 || o.instanceVCPUs <= 0 || o.instanceMemoryGB <= 0 {
+				return fmt.Errorf("idlescale needs -idle-conns of at least 4 and a positive -instance-vcpus and -instance-memory-gb")
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = o.idleConns + idleScaleProbes },
+	})
+}
+
+// runIdleScale opens idle sessions in four steps up to idleConns, each after
+// a catalog lookup as an application's first statement would do and reading
+// its own memory, and at every step runs idleScaleProbes probes of SELECT 1
+// for idleScaleProbeRun. The cost model prices the top step.
+func runIdleScale(connStr string, idleConns int, model idleCostModel) bool {
+	idle, err := openDB(connStr, "pg-idle-test-idlescale")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer idle.Close()
+	idle.SetMaxOpenConns(idleConns)
+	probe, err := openDB(connStr, "pg-idle-test-idlescale-probe")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer probe.Close()
+	probe.SetMaxOpenConns(idleScaleProbes)
+	probe.SetMaxIdleConns(idleScaleProbes)
+
+	ctx := context.Background()
+	var held []*sql.Conn
+	defer func() {
+		for _, conn := range held {
+			conn.Close()
+		}
+	}()
+	var memTotal float64
+	memKnown := true
+	var steps []idleScaleStep
+	for _, target := range []int{0, idleConns / 4, idleConns / 2, idleConns} {
+		for len(held) < target {
+			conn, err := idle.Conn(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Unable to open idle session %d: %v\n", len(held)+1, err)
+				return false
+			}
+			held = append(held, conn)
+			var n int
+			conn.QueryRowContext(ctx, "SELECT count(*) FROM pg_class c JOIN pg_attribute a ON a.attrelid = c.oid WHERE c.relname = 'pg_class'").Scan(&n)
+			// pg_backend_memory_contexts is Postgres 14+
+			var bytes int64
+			if err := conn.QueryRowContext(ctx, "SELECT sum(total_bytes) FROM pg_backend_memory_contexts").Scan(&bytes); err != nil {
+				memKnown = false
+			}
+			memTotal += float64(bytes)
+		}
+		fmt.Fprintf(os.Stderr, "[%s] IDLE SCALE: %d idle sessions, probing\n", time.Now().Format("04:05"), len(held))
+		step := idleScaleProbe(probe)
+		step.sessions, step.memory = len(held), -1
+		if memKnown && len(held) > 0 {
+			step.memory = memTotal / float64(len(held))
+		}
+		steps = append(steps, step)
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> IDLE SCALE REPORT (%d probes of SELECT 1 for %v per step)\n", idleScaleProbes, idleScaleProbeRun)
+	fmt.Printf("%-14s %10s %10s %10s %16s\n", "Idle sessions", "Probe p50", "Probe p95", "Probe/s", "Memory/session")
+	for _, s := range steps {
+		memory := "-"
+		if s.memory >= 0 {
+			memory = fmt.Sprintf("%.2f MB", s.memory/(1<<20))
+		}
+		fmt.Printf("%-14d %10s %10s %10.0f %16s\n", s.sessions, ms(s.p50), ms(s.p95), s.rate, memory)
+	}
+	base, top := steps[0], steps[len(steps)-1]
+	// Latency the idle sessions added to each probe statement, at the rate the
+	// probes ran, is server time per second: a vCPU-equivalent
+	cpu := max(0, (top.p50-base.p50).Seconds()*top.rate) / float64(top.sessions)
+	model.print(top.sessions, top.memory, cpu)
+	return true
+}
+
+// idleScaleProbe runs the probes for idleScaleProbeRun
+func idleScaleProbe(db *sql.DB) idleScaleStep {
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var stopping atomic.Bool
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < idleScaleProbes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var one int
+			for !stopping.Load() {
+				t0 := time.Now()
+				if db.QueryRow("SELECT 1").Scan(&one) != nil {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				d := time.Since(t0)
+				mu.Lock()
+				latencies = append(latencies, d)
+				mu.Unlock()
+			}
+		}()
+	}
+	time.Sleep(idleScaleProbeRun)
+	stopping.Store(true)
+	wg.Wait()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return idleScaleStep{
+		p50:  percentile(latencies, 0.50),
+		p95:  percentile(latencies, 0.95),
+		rate: float64(len(latencies)) / time.Since(start).Seconds(),
+	}
+}
@@ -0,0 +1,184 @@
+// Scenario: poison with idle_in_transaction_session_timeout set, to see
+// whether the server ever finds the poisoned backend idle long enough to
+// kill it, and what the pool makes of the kill.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// idleTxWatch follows the poisoned backend; nil outside idletxtimeout
+type idleTxWatch struct {
+	pid      int32
+	poisoned time.Time
+
+	mu         sync.Mutex
+	killedAt   time.Time
+	longest    time.Duration // longest idle in transaction stretch seen
+	nextErr    error         // first worker error on the poisoned backend after the kill
+	nextErrAt  time.Time
+	firstOK    time.Time // first committed worker iteration after the kill
+	badConnAt0 int64
+}
+
+var idleTx *idleTxWatch
+
+func init() {
+	registerScenario("idletxtimeout", scenario{
+		inject: func(h *harness) bool {
+			return runIdleTxTimeout(h)
+		},
+		validate: func(o *options) error {
+			if o.idleTxTimeout <= 0 || (o.gucScope != "session" && o.gucScope != "server") {
+				return errors.New("idletxtimeout needs a positive -idle-tx-timeout and -guc-scope=session|server")
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns++ // backend watcher
+			if o.gucScope == "server" {
+				n.alterSystem = append(n.alterSystem, "idle_in_transaction_session_timeout")
+			}
+		},
+	})
+}
+
+// iteration records the first error a worker got from the poisoned backend
+// and the first commit after the kill
+func (w *idleTxWatch) iteration(pid int32, err error) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.killedAt.IsZero() {
+		return
+	}
+	switch {
+	case err == nil && w.firstOK.IsZero():
+		w.firstOK = time.Now()
+	case err != nil && pid == w.pid && w.nextErr == nil:
+		w.nextErr, w.nextErrAt = err, time.Now()
+	}
+}
+
+func runIdleTxTimeout(h *harness) bool {
+	timeout := []gucSetting{{name: "idle_in_transaction_session_timeout", value: fmt.Sprint(h.o.idleTxTimeout.Milliseconds())}}
+	var err error
+	if h.o.gucScope == "server" {
+		err = setServerGUCs(h.db, timeout)
+		defer func() {
+			if err := setServerGUCs(h.db, []gucSetting{{name: timeout[0].name}}); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Unable to reset idle_in_transaction_session_timeout: %v\n", err)
+			}
+		}()
+	} else {
+		err = setSessionGUCs(h.db, timeout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to set idle_in_transaction_session_timeout: %v\n", err)
+		return false
+	}
+	fmt.Printf(">>> IDLE TX TIMEOUT: idle_in_transaction_session_timeout=%v (%s scope)\n", h.o.idleTxTimeout, h.o.gucScope)
+
+	watcher, err := sql.Open("pgx", h.connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to open backend watcher: %v\n", err)
+		return false
+	}
+	defer watcher.Close()
+	watcher.SetMaxOpenConns(1)
+
+	// holdBlockingLock, but keeping the PID for the watcher
+	conn, err := h.db.Conn(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to check out the connection to poison: %v\n", err)
+		return false
+	}
+	w := &idleTxWatch{badConnAt0: badConnTotal()}
+	conn.QueryRowContext(context.Background(), "SELECT pg_backend_pid()").Scan(&w.pid)
+	conn.ExecContext(context.Background(), "BEGIN")
+	conn.ExecContext(context.Background(), h.wl.poisonSQL())
+	conn.Close()
+	w.poisoned = time.Now()
+	idleTx = w
+	fmt.Printf(">>> POISON: Lock acquired by PID %d, connection returned to pool with open transaction\n", w.pid)
+	recordEvent("row lock taken by PID %d, connection returned to pool with the transaction open", w.pid)
+	startPhase("poison")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.watch(watcher, stop)
+	}()
+	phaseCtl.await("stop", h.o.hold)
+	close(stop)
+	<-done
+	w.print(h.o.idleTxTimeout)
+	return true
+}
+
+// watch polls the poisoned backend every 100ms for its idle in transaction
+// stretches until it is gone or stop is closed
+func (w *idleTxWatch) watch(db *sql.DB, stop chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var idle sql.NullFloat64
+		err := db.QueryRow(`
+			SELECT CASE WHEN state = 'idle in transaction' THEN extract(epoch FROM now() - state_change) END
+			FROM pg_stat_activity WHERE pid = $1`, w.pid).Scan(&idle)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			w.mu.Lock()
+			w.killedAt = time.Now()
+			w.mu.Unlock()
+			fmt.Printf(">>> IDLE TX TIMEOUT: PID %d gone %.1fs after the poison\n", w.pid, time.Since(w.poisoned).Seconds())
+			recordEvent("poisoned PID %d terminated by idle_in_transaction_session_timeout", w.pid)
+			startPhase("after kill")
+			return
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "WARNING: Backend watcher query failed: %v\n", err)
+		case idle.Valid:
+			w.mu.Lock()
+			w.longest = max(w.longest, time.Duration(idle.Float64*float64(time.Second)))
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *idleTxWatch) print(timeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Println()
+	fmt.Printf(">>> IDLE TX TIMEOUT REPORT: PID %d, timeout %v\n", w.pid, timeout)
+	fmt.Printf("%-30s %s\n", "Longest idle in transaction", ms(w.longest))
+	if w.killedAt.IsZero() {
+		fmt.Printf("%-30s %s\n", "Server kill", "none: workers picked the connection up before it was idle long enough")
+		return
+	}
+	fmt.Printf("%-30s +%.1fs after the poison\n", "Server kill", w.killedAt.Sub(w.poisoned).Seconds())
+	if w.nextErr != nil {
+		fmt.Printf("%-30s +%.1fs [%s] %s\n", "Next use of the connection", w.nextErrAt.Sub(w.killedAt).Seconds(), classifyError(w.nextErr), oneLine(w.nextErr.Error()))
+	} else {
+		fmt.Printf("%-30s %s\n", "Next use of the connection", "no worker error from the PID; the pool discarded it on checkout")
+	}
+	fmt.Printf("%-30s %d during the run\n", "ErrBadConn retries", badConnTotal()-w.badConnAt0)
+	if !w.firstOK.IsZero() {
+		fmt.Printf("%-30s +%.1fs after the kill, see the \"after kill\" phase for throughput\n", "First commit", w.firstOK.Sub(w.killedAt).Seconds())
+	} else {
+		fmt.Printf("%-30s %s\n", "First commit", "none before the end of the hold")
+	}
+}
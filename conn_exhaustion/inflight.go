@@ -0,0 +1,142 @@
+// Registry of the statements currently in flight on the client.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inflightQuery is one statement between the call into database/sql and its return
+type inflightQuery struct {
+	worker int // -1 outside the worker goroutines
+	sql    string
+	start  time.Time
+	pid    atomic.Int32 // backend PID, once the statement reached a connection
+
+	// Checkout components, see checkout.go
+	dial, reset atomic.Int64 // nanoseconds
+	checkedOut  atomic.Bool
+}
+
+var (
+	inflightMu sync.Mutex
+	inflight   = map[*inflightQuery]struct{}{}
+)
+
+// workerTag identifies the worker iteration a statement belongs to
+type workerTag struct {
+	worker    int
+	pid       atomic.Int32 // backend PID of the iteration's last statement
+	untracked bool         // sampled out by -low-overhead
+}
+
+type workerKey struct{}
+
+// withWorker tags ctx with the worker number reported for its statements
+func withWorker(ctx context.Context, worker int) (context.Context, *workerTag) {
+	tag := &workerTag{worker: worker}
+	return context.WithValue(ctx, workerKey{}, tag), tag
+}
+
+type inflightKey struct{}
+
+// trackQuery registers a statement as in flight; the returned context carries
+// the entry so lower layers can fill in the backend PID, and done removes it
+func trackQuery(ctx context.Context, query string) (context.Context, *inflightQuery, func()) {
+	q := &inflightQuery{worker: -1, sql: oneLine(query), start: time.Now()}
+	if tag, ok := ctx.Value(workerKey{}).(*workerTag); ok {
+		q.worker = tag.worker
+	}
+	deadlines.audit(ctx, "checkout", q.sql)
+	inflightMu.Lock()
+	inflight[q] = struct{}{}
+	inflightMu.Unlock()
+	return context.WithValue(ctx, inflightKey{}, q), q, func() {
+		recordCheckout(q, true) // no-op if the statement started on a connection
+		inflightMu.Lock()
+		delete(inflight, q)
+		inflightMu.Unlock()
+	}
+}
+
+// inflightSnapshot is the JSON form of one in-flight statement
+type inflightSnapshot struct {
+	Worker int     `json:"worker"`
+	PID    int     `json:"pid,omitempty"`
+	AgeMs  float64 `json:"age_ms"`
+	SQL    string  `json:"sql"`
+}
+
+// inflightNow lists the in-flight statements, oldest first
+func inflightNow() []inflightSnapshot {
+	now := time.Now()
+	inflightMu.Lock()
+	snap := make([]inflightSnapshot, 0, len(inflight))
+	for q := range inflight {
+		snap = append(snap, inflightSnapshot{Worker: q.worker, PID: int(q.pid.Load()), AgeMs: float64(now.Sub(q.start).Microseconds()) / 1000, SQL: q.sql})
+	}
+	inflightMu.Unlock()
+	sort.Slice(snap, func(i, j int) bool { return snap[i].AgeMs > snap[j].AgeMs })
+	return snap
+}
+
+// statementStarted is called with the connection's backend PID when a
+// statement starts on it, attaching the PID to the in-flight entry and worker
+// iteration and ending the statement's checkout
+func statementStarted(ctx context.Context, pid int32) {
+	if q, ok := ctx.Value(inflightKey{}).(*inflightQuery); ok {
+		q.pid.Store(pid)
+		// A statement retried after ErrBadConn starts again; audit the first start
+		if !q.checkedOut.Load() {
+			deadlines.audit(ctx, "execute", q.sql)
+		}
+		recordCheckout(q, false)
+	}
+	if tag, ok := ctx.Value(workerKey{}).(*workerTag); ok {
+		tag.pid.Store(pid)
+	}
+}
+
+func printInflight(w io.Writer) {
+	snap := inflightNow()
+	fmt.Fprintf(w, ">>> INFLIGHT: %d statements\n", len(snap))
+	fmt.Fprintf(w, "%6s %8s %10s   %s\n", "Worker", "PID", "Age", "SQL")
+	for _, q := range snap {
+		pid := "-"
+		if q.PID != 0 {
+			pid = fmt.Sprint(q.PID)
+		}
+		fmt.Fprintf(w, "%6d %8s %8.1fms   %s\n", q.Worker, pid, q.AgeMs, q.SQL)
+	}
+}
+
+func init() {
+	httpMux.HandleFunc("/inflight", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "text" {
+			printInflight(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inflightNow())
+	})
+}
+
+// dumpInflightOnSignal prints the registry whenever the process gets the
+// dump signal (SIGUSR1 where available)
+func dumpInflightOnSignal() {
+	c := make(chan os.Signal, 1)
+	if !notifyDumpSignal(c) {
+		return
+	}
+	for range c {
+		printInflight(os.Stderr)
+	}
+}
@@ -0,0 +1,60 @@
+// End-of-run invariant checks comparing committed state with acknowledged writes.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// verifier is implemented by workloads which can check their committed state
+// against the writes the workers saw succeed. Lost writes (acknowledged but not
+// committed, e.g. inside a poisoned transaction that was later rolled back) and
+// unacknowledged writes (reported as failed but committed anyway, e.g. canceled
+// after the server already finished) both break the invariant.
+type verifier interface {
+	verify(ctx context.Context, conn *sql.Conn) (ok bool, detail string, err error)
+}
+
+// checkInvariants verifies the workload on a brand new connection so that an
+// open transaction left behind in the worker pool cannot hide its own writes.
+// It returns false if the invariant check failed or could not be run.
+func checkInvariants(connStr string, wl workload) bool {
+	v, ok := wl.(verifier)
+	if !ok {
+		fmt.Println(">>> INVARIANT: not supported by this workload")
+		return true
+	}
+
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Invariant check failed to connect: %v\n", err)
+		return false
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Invariant check failed to connect: %v\n", err)
+		return false
+	}
+	defer conn.Close()
+
+	passed, detail, err := v.verify(ctx, conn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Invariant check failed: %v\n", err)
+		return false
+	}
+	if passed {
+		detail = "PASS " + detail
+	} else {
+		detail = "FAIL " + detail
+	}
+	fmt.Printf(">>> INVARIANT: %s\n", detail)
+	recordInvariant(detail)
+	return passed
+}
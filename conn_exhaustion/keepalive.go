@@ -0,0 +1,209 @@
+// Idle-connection keepalive pinger and NAT silent-drop comparison scenario.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// silentDropAfter makes connections opened with openDB behave like a flow
+// forgotten by a NAT gateway or firewall once idle this long: writes vanish
+// without an error and no response ever arrives. 0 disables it.
+var silentDropAfter time.Duration
+
+// silentDropConn is the client-side silent-drop fault injector
+type silentDropConn struct {
+	net.Conn
+	after   time.Duration
+	last    atomic.Int64 // unix nanoseconds of the last traffic
+	dropped atomic.Bool
+}
+
+func newSilentDropConn(conn net.Conn, after time.Duration) *silentDropConn {
+	c := &silentDropConn{Conn: conn, after: after}
+	c.last.Store(time.Now().UnixNano())
+	return c
+}
+
+func (c *silentDropConn) Write(b []byte) (int, error) {
+	if time.Since(time.Unix(0, c.last.Load())) > c.after {
+		c.dropped.Store(true)
+	}
+	if c.dropped.Load() {
+		// Reads block until pgx's context deadline, since the server never saw the request
+		return len(b), nil
+	}
+	c.last.Store(time.Now().UnixNano())
+	return c.Conn.Write(b)
+}
+
+func (c *silentDropConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.dropped.Load() {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// runKeepalivePinger pings every idle pooled connection each interval. All
+// idle connections are checked out at once so each one is pinged, not the
+// same connection over and over.
+func runKeepalivePinger(ctx context.Context, db *sql.DB, interval time.Duration, pings *atomic.Int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		idle := db.Stats().Idle
+		conns := make([]*sql.Conn, 0, idle)
+		for i := 0; i < idle; i++ {
+			pingCtx, cancel := context.WithTimeout(ctx, interval/2)
+			conn, err := db.Conn(pingCtx)
+			if err == nil {
+				if conn.PingContext(pingCtx) == nil {
+					pings.Add(1)
+				}
+				conns = append(conns, conn)
+			}
+			cancel()
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+type keepaliveConfig struct {
+	name        string
+	maxIdleTime time.Duration
+	keepalive   time.Duration
+}
+
+type keepaliveResult struct {
+	statements, failed int
+	p50, max           time.Duration
+	pings              int64
+	idleClosed         int64
+}
+
+func init() {
+	registerScenario("keepalivecompare", scenario{
+		standalone: func(o *options) bool {
+			natTimeout := silentDropAfter
+			if natTimeout == 0 {
+				natTimeout = 5 * time.Second
+			}
+			return runKeepaliveCompare(o.connStr, natTimeout)
+		},
+	})
+}
+
+// runKeepaliveCompare runs bursts separated by idle gaps longer than the
+// silent-drop timeout, once without mitigation, once with SetConnMaxIdleTime
+// below the timeout and once with the keepalive pinger
+func runKeepaliveCompare(connStr string, natTimeout time.Duration) bool {
+	saved := silentDropAfter
+	defer func() { silentDropAfter = saved }()
+	silentDropAfter = natTimeout
+
+	configs := []keepaliveConfig{
+		{name: "none"},
+		{name: "maxidletime", maxIdleTime: natTimeout * 4 / 5},
+		{name: "keepalive", keepalive: natTimeout * 2 / 5},
+	}
+	fmt.Printf(">>> KEEPALIVE: silent drop after %v idle\n", natTimeout)
+	results := map[string]keepaliveResult{}
+	for _, cfg := range configs {
+		fmt.Fprintf(os.Stderr, "[%s] KEEPALIVE: %s\n", time.Now().Format("04:05"), cfg.name)
+		r, err := keepaliveOnce(connStr, cfg, natTimeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", cfg.name, err)
+			return false
+		}
+		results[cfg.name] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> KEEPALIVE REPORT (statements after idle gaps)")
+	fmt.Printf("%-12s %10s %8s %10s %10s %8s %12s\n", "Config", "Statements", "Failed", "p50", "max", "Pings", "IdleClosed")
+	for _, cfg := range configs {
+		r := results[cfg.name]
+		fmt.Printf("%-12s %10d %8d %10s %10s %8d %12d\n", cfg.name, r.statements, r.failed, ms(r.p50), ms(r.max), r.pings, r.idleClosed)
+	}
+	return true
+}
+
+func keepaliveOnce(connStr string, cfg keepaliveConfig, natTimeout time.Duration) (keepaliveResult, error) {
+	var r keepaliveResult
+	db, err := openDB(connStr, "pg-idle-test-keepalive-"+cfg.name)
+	if err != nil {
+		return r, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+	db.SetConnMaxIdleTime(cfg.maxIdleTime)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	var pings atomic.Int64
+	if cfg.keepalive > 0 {
+		go runKeepalivePinger(ctx, db, cfg.keepalive, &pings)
+	}
+
+	var latencies []time.Duration
+	for round := 0; round < 3; round++ {
+		burstLatencies, errs := statementBurst(db, 10)
+		// The first burst opens the connections; later ones follow an idle gap
+		if round > 0 {
+			latencies = append(latencies, burstLatencies...)
+			r.failed += len(errs)
+		}
+		if round < 2 {
+			time.Sleep(natTimeout + natTimeout/2)
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.statements = len(latencies)
+	r.p50, r.max = percentile(latencies, 0.5), percentile(latencies, 1)
+	r.pings = pings.Load()
+	r.idleClosed = db.Stats().MaxIdleTimeClosed
+	return r, nil
+}
+
+// statementBurst runs n concurrent short statements with a 2s timeout and
+// returns their latencies and errors
+func statementBurst(db *sql.DB, n int) ([]time.Duration, []error) {
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			start := time.Now()
+			_, err := db.ExecContext(ctx, "SELECT pg_sleep(0.05)")
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, time.Since(start))
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return latencies, errs
+}
@@ -0,0 +1,219 @@
+// Automatic termination of the session blocking the workers, as an operator
+// or a watchdog would do it, and how fast the pool recovers afterwards.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blockerKill is one termination and the recovery that followed it
+type blockerKill struct {
+	pid          int32
+	blockedFor   time.Duration // how long it had blocked workers when killed
+	state, query string
+	at           time.Time
+	terminated   bool
+	baseline     float64 // committed iterations/s in the 5s before it blocked
+
+	firstCommit time.Duration // to the first committed worker iteration
+	poolFree    time.Duration // to the first second without checkout waits
+	throughput  time.Duration // to the first second at 90% of the baseline rate
+}
+
+type blockerKiller struct {
+	db, pool *sql.DB
+	after    time.Duration
+
+	commits atomic.Int64 // committed worker iterations
+
+	mu        sync.Mutex
+	firstSeen map[int32]time.Time
+	perSecond []int64 // committed iterations in each second of the run
+	kills     []*blockerKill
+}
+
+// killer is nil unless -kill-blocker-after was given
+var killer *blockerKiller
+
+// newBlockerKiller opens its own connection, which must be able to
+// terminate the blocker: a superuser or a member of its role or of
+// pg_signal_backend
+func newBlockerKiller(connStr string, pool *sql.DB, after time.Duration) (*blockerKiller, error) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &blockerKiller{db: db, pool: pool, after: after, firstSeen: map[int32]time.Time{}}, nil
+}
+
+// iteration counts a worker iteration and completes the first-commit
+// measurement of the last kill
+func (k *blockerKiller) iteration(err error) {
+	if k == nil || err != nil {
+		return
+	}
+	k.commits.Add(1)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if n := len(k.kills); n > 0 && k.kills[n-1].firstCommit == 0 {
+		k.kills[n-1].firstCommit = time.Since(k.kills[n-1].at)
+	}
+}
+
+// run looks for blockers every second until the process exits
+func (k *blockerKiller) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	prev := k.pool.Stats().WaitCount
+	for range ticker.C {
+		start := time.Now()
+		stats := k.pool.Stats()
+		waits := stats.WaitCount - prev
+		prev = stats.WaitCount
+		k.second(k.commits.Swap(0), waits, stats)
+		blockers, err := k.blockers()
+		selfOverhead.since("blocker killer", start, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Blocker query failed: %v\n", err)
+			continue
+		}
+		k.check(blockers)
+	}
+}
+
+// blockers returns the sessions which block a statement of this process
+// without waiting themselves, with their state and last statement
+func (k *blockerKiller) blockers() (map[int32][2]string, error) {
+	rows, err := k.db.Query(`
+		SELECT DISTINCT b.pid, coalesce(b.state, ''), coalesce(b.query, '')
+		FROM pg_stat_activity w
+		CROSS JOIN unnest(pg_blocking_pids(w.pid)) blocker
+		JOIN pg_stat_activity b ON b.pid = blocker
+		WHERE w.datname = current_database() AND left(w.query, length($1)) = $1
+		  AND cardinality(pg_blocking_pids(b.pid)) = 0`, queryTag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blockers := map[int32][2]string{}
+	for rows.Next() {
+		var pid int32
+		var state, query string
+		if err := rows.Scan(&pid, &state, &query); err != nil {
+			return nil, err
+		}
+		blockers[pid] = [2]string{state, query}
+	}
+	return blockers, rows.Err()
+}
+
+// check terminates every blocker seen continuously for -kill-blocker-after
+func (k *blockerKiller) check(blockers map[int32][2]string) {
+	now := time.Now()
+	k.mu.Lock()
+	for pid := range k.firstSeen {
+		if _, ok := blockers[pid]; !ok {
+			delete(k.firstSeen, pid)
+		}
+	}
+	var due []*blockerKill
+	for pid, b := range blockers {
+		first, ok := k.firstSeen[pid]
+		if !ok {
+			k.firstSeen[pid] = now
+			continue
+		}
+		if now.Sub(first) >= k.after {
+			delete(k.firstSeen, pid)
+			kill := &blockerKill{pid: pid, blockedFor: now.Sub(first), state: b[0], query: b[1]}
+			kill.baseline = k.rateBefore(kill.blockedFor)
+			due = append(due, kill)
+		}
+	}
+	k.mu.Unlock()
+
+	for _, kill := range due {
+		kill.at = time.Now()
+		if err := k.db.QueryRow("SELECT pg_terminate_backend($1)", kill.pid).Scan(&kill.terminated); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Unable to terminate blocker PID %d: %v\n", kill.pid, err)
+		}
+		fmt.Printf(">>> KILL BLOCKER: terminated PID %d (%s for %.0fs): %s\n", kill.pid, kill.state, kill.blockedFor.Seconds(), shortQuery(kill.query))
+		recordEvent("blocker PID %d terminated after blocking workers for %.0fs", kill.pid, kill.blockedFor.Seconds())
+		k.mu.Lock()
+		k.kills = append(k.kills, kill)
+		k.mu.Unlock()
+	}
+}
+
+// second records one second of committed iterations and pool waits and
+// completes the pool and throughput measurements of the last kill
+func (k *blockerKiller) second(commits, waits int64, stats sql.DBStats) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.perSecond = append(k.perSecond, commits)
+	n := len(k.kills)
+	if n == 0 {
+		return
+	}
+	kill := k.kills[n-1]
+	since := time.Since(kill.at)
+	if kill.poolFree == 0 && waits == 0 && stats.InUse < stats.MaxOpenConnections {
+		kill.poolFree = since
+	}
+	if kill.throughput == 0 && float64(commits) >= 0.9*kill.baseline {
+		kill.throughput = since
+	}
+}
+
+// rateBefore is the committed rate of the 5 seconds before ago
+func (k *blockerKiller) rateBefore(ago time.Duration) float64 {
+	end := len(k.perSecond) - int(ago/time.Second)
+	start := max(end-5, 0)
+	if end <= start {
+		return 0
+	}
+	var sum int64
+	for _, c := range k.perSecond[start:end] {
+		sum += c
+	}
+	return float64(sum) / float64(end-start)
+}
+
+func (k *blockerKiller) print() {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	fmt.Println()
+	fmt.Printf(">>> BLOCKER TERMINATION: %d sessions terminated after blocking workers for %v\n", len(k.kills), k.after)
+	after := func(d time.Duration) string {
+		if d == 0 {
+			return "not in run"
+		}
+		return fmt.Sprintf("+%.1fs", d.Seconds())
+	}
+	fmt.Printf("%8s %10s %-20s %12s %10s %12s %10s\n", "PID", "Blocked", "State", "FirstCommit", "PoolFree", "Throughput", "Baseline")
+	for _, kill := range k.kills {
+		state := kill.state
+		if !kill.terminated {
+			state += " (not terminated)"
+		}
+		fmt.Printf("%8d %9.1fs %-20s %12s %10s %12s %8.1f/s\n", kill.pid, kill.blockedFor.Seconds(), state,
+			after(kill.firstCommit), after(kill.poolFree), after(kill.throughput), kill.baseline)
+	}
+	if len(k.kills) > 0 {
+		fmt.Println("Times are from pg_terminate_backend: to the first committed worker iteration, the first second without")
+		fmt.Println("checkout waits and a free connection, and the first second back at 90% of the committed rate before the block.")
+	}
+}
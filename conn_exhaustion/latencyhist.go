@@ -0,0 +1,161 @@
+// Per-statement latency histograms of the worker statements, reported per
+// interval and for the whole run.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// The histograms count microseconds up to histHighest with histDigits
+// significant digits, so every percentile is within 1% of the true value
+const (
+	histHighest = int64(time.Hour / time.Microsecond)
+	histDigits  = 2
+)
+
+// latencyHistogram counts latencies in an HDR histogram, created on first
+// use so that the zero value is ready; the exact maximum is kept alongside
+type latencyHistogram struct {
+	hist   *hdrhistogram.Histogram
+	errors int64
+	max    time.Duration
+}
+
+func (h *latencyHistogram) init() {
+	if h.hist == nil {
+		h.hist = hdrhistogram.New(1, histHighest, histDigits)
+	}
+}
+
+func (h *latencyHistogram) record(d time.Duration, failed bool) {
+	h.init()
+	// Longer statements than histHighest count as histHighest
+	h.hist.RecordValue(min(max(d.Microseconds(), 0), histHighest))
+	if failed {
+		h.errors++
+	}
+	h.max = max(h.max, d)
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	h.init()
+	if o.hist != nil {
+		h.hist.Merge(o.hist)
+	}
+	h.errors += o.errors
+	h.max = max(h.max, o.max)
+}
+
+// count is the number of latencies recorded
+func (h *latencyHistogram) count() int64 {
+	if h.hist == nil {
+		return 0
+	}
+	return h.hist.TotalCount()
+}
+
+// quantile returns the q-quantile, capped at the exact maximum
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count() == 0 {
+		return 0
+	}
+	return min(time.Duration(h.hist.ValueAtQuantile(100*q))*time.Microsecond, h.max)
+}
+
+// statementLatencies keeps one histogram per worker statement text for the
+// current interval and one for the run
+type statementLatencies struct {
+	mu       sync.Mutex
+	interval map[string]*latencyHistogram
+	run      map[string]*latencyHistogram
+}
+
+var queryLatencies = &statementLatencies{interval: map[string]*latencyHistogram{}, run: map[string]*latencyHistogram{}}
+
+// record adds one statement of a worker iteration; other statements through
+// execContext and queryRowContext are not counted
+func (s *statementLatencies) record(ctx context.Context, query string, d time.Duration, err error) {
+	if _, ok := ctx.Value(workerKey{}).(*workerTag); !ok {
+		return
+	}
+	query = oneLine(query)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.interval[query]
+	if h == nil {
+		h = &latencyHistogram{}
+		s.interval[query] = h
+	}
+	h.record(d, err != nil)
+}
+
+// rotate folds the current interval into the run and returns it
+func (s *statementLatencies) rotate() map[string]*latencyHistogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	interval := s.interval
+	s.interval = map[string]*latencyHistogram{}
+	for query, h := range interval {
+		if s.run[query] == nil {
+			s.run[query] = &latencyHistogram{}
+		}
+		s.run[query].merge(h)
+	}
+	return interval
+}
+
+func sortedStatements(hists map[string]*latencyHistogram) []string {
+	queries := make([]string, 0, len(hists))
+	for query := range hists {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+	return queries
+}
+
+// logIntervals prints every statement's interval histogram every interval
+func (s *statementLatencies) logIntervals(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		hists := s.rotate()
+		for _, query := range sortedStatements(hists) {
+			h := hists[query]
+			if jsonOutput() {
+				emitJSON("query_latency", map[string]any{
+					"sql": query, "count": h.count(), "errors": h.errors, "p50_ms": h.quantile(0.5).Seconds() * 1000,
+					"p95_ms": h.quantile(0.95).Seconds() * 1000, "p99_ms": h.quantile(0.99).Seconds() * 1000, "max_ms": h.max.Seconds() * 1000,
+				})
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "[%s] QUERY_LATENCY: n=%d errors=%d p50=%s p95=%s p99=%s max=%s %s\n", time.Now().Format("04:05"),
+				h.count(), h.errors, ms(h.quantile(0.5)), ms(h.quantile(0.95)), ms(h.quantile(0.99)), ms(h.max), query)
+		}
+	}
+}
+
+// print reports the whole run per statement
+func (s *statementLatencies) print() {
+	s.rotate()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.run) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Println(">>> QUERY LATENCY")
+	fmt.Printf("%10s %8s %10s %10s %10s %10s   %s\n", "Count", "Errors", "p50", "p95", "p99", "max", "SQL")
+	for _, query := range sortedStatements(s.run) {
+		h := s.run[query]
+		fmt.Printf("%10d %8d %10s %10s %10s %10s   %s\n", h.count(), h.errors,
+			ms(h.quantile(0.5)), ms(h.quantile(0.95)), ms(h.quantile(0.99)), ms(h.max), query)
+	}
+	fmt.Printf("Percentiles are within 1%% (HDR histograms of %d significant digits); errors count toward the latencies.\n", histDigits)
+}
@@ -0,0 +1,118 @@
+// Retrying ledger workloads: naive retries versus idempotency keys.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ledgerWorkload records one logical write per worker iteration: a ledger row
+// tagged with a client-generated key plus an increment of the contended
+// counter, in a single autocommit statement. A failed attempt is retried with
+// a fresh timeout. Without a unique key, an attempt which committed but was
+// reported as failed (e.g. canceled just after the server finished) is applied
+// twice; with ON CONFLICT DO NOTHING the retry becomes a no-op instead.
+type ledgerWorkload struct {
+	idempotent bool
+	retries    int
+
+	acked   sync.Map     // keys of logical writes acknowledged to the worker
+	retried atomic.Int64 // attempts after the first
+}
+
+func (w *ledgerWorkload) setup(db *sql.DB) {
+	schemaSpec{rows: 1, fillfactor: 100}.create(db)
+	db.Exec("DROP TABLE IF EXISTS test_ledger")
+	db.Exec("CREATE TABLE test_ledger (id BIGSERIAL PRIMARY KEY, idem_key TEXT NOT NULL, created_at TIMESTAMPTZ DEFAULT now())")
+	if w.idempotent {
+		db.Exec("CREATE UNIQUE INDEX test_ledger_idem_key ON test_ledger (idem_key)")
+	} else {
+		db.Exec("CREATE INDEX test_ledger_idem_key ON test_ledger (idem_key)")
+	}
+}
+
+func (w *ledgerWorkload) query() string {
+	conflict := ""
+	if w.idempotent {
+		conflict = " ON CONFLICT (idem_key) DO NOTHING"
+	}
+	return "WITH ins AS (INSERT INTO test_ledger (idem_key) VALUES ($1)" + conflict + " RETURNING 1) " +
+		"UPDATE test_row SET val = val + 1 WHERE id = 1 AND EXISTS (SELECT 1 FROM ins)"
+}
+
+func (w *ledgerWorkload) run(ctx context.Context, db *sql.DB, worker int, iteration int) error {
+	key := fmt.Sprintf("%d:%d", worker, iteration)
+	timeout := 500 * time.Millisecond
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	var err error
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if attempt > 0 {
+			w.retried.Add(1)
+			attemptCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		}
+		_, err = execContext(attemptCtx, db, w.query(), key)
+		cancel()
+		if err == nil {
+			w.acked.Store(key, true)
+			return nil
+		}
+	}
+	return err
+}
+
+// verify compares the committed ledger with the acknowledged logical writes
+func (w *ledgerWorkload) verify(ctx context.Context, conn *sql.Conn) (bool, string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT idem_key, count(*) FROM test_ledger GROUP BY idem_key")
+	if err != nil {
+		return false, "", err
+	}
+	defer rows.Close()
+
+	committed := map[string]int{}
+	var duplicates, unacked int
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			return false, "", err
+		}
+		committed[key] = n
+		duplicates += n - 1
+		if _, ok := w.acked.Load(key); !ok {
+			unacked++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, "", err
+	}
+
+	var acked, lost int
+	w.acked.Range(func(k, _ any) bool {
+		acked++
+		if committed[k.(string)] == 0 {
+			lost++
+		}
+		return true
+	})
+
+	var counter int
+	if err := conn.QueryRowContext(ctx, "SELECT val FROM test_row WHERE id = 1").Scan(&counter); err != nil {
+		return false, "", err
+	}
+
+	detail := fmt.Sprintf("writes=%d committed=%d counter=%d retries=%d lost=%d duplicated=%d unacknowledged_applied=%d",
+		acked, len(committed), counter, w.retried.Load(), lost, duplicates, unacked)
+	return lost == 0 && duplicates == 0, detail, nil
+}
+
+func (w *ledgerWorkload) poisonSQL() string {
+	return "UPDATE test_row SET val = val + 1 WHERE id = 1 -- POISON"
+}
@@ -0,0 +1,38 @@
+//go:build libpq
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+func init() {
+	openLibpq = func(connStr, appName string) (*sql.DB, error) {
+		dsn := connStr
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			if dsn, err = pq.ParseURL(dsn); err != nil {
+				return nil, err
+			}
+		}
+		if appName != "" {
+			dsn += " application_name='" + appName + "'"
+		}
+		connector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(connector), nil
+	}
+	libpqErrorClass = func(err error) string {
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) {
+			return ""
+		}
+		return classifyServerError(pqErr.Severity, string(pqErr.Code))
+	}
+}
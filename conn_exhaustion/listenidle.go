@@ -0,0 +1,188 @@
+// Scenario: LISTEN issued on pooled connections which then sit idle in the
+// database/sql pool while notifications arrive, and what becomes of the
+// notifications when the pool reaps the connections.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	listenIdleChannel = "pg_idle_test_listen"
+	listenIdleConns   = 4 // connections which LISTEN
+	listenIdleKeep    = 2 // SetMaxIdleConns of the pool
+	listenIdleBatch   = 20
+)
+
+// listenIdleSession is one connection which issued LISTEN
+type listenIdleSession struct {
+	pid      int32
+	fate     string
+	sent     int // notifications sent while the session was listening
+	readable int // notifications a pgx.Conn taken with Raw could still read
+}
+
+func init() {
+	registerScenario("listenidle", scenario{
+		standalone: func(o *options) bool { return runListenIdle(o.connStr) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = listenIdleConns + 1 }, // pool and notifier
+	})
+}
+
+// runListenIdle issues LISTEN on listenIdleConns pooled connections at once
+// and puts them back into a pool keeping listenIdleKeep idle, sends a batch of
+// notifications and checks out the kept connections to count what they
+// buffered, then lets SetConnMaxIdleTime reap them during a second batch
+func runListenIdle(connStr string) bool {
+	notifier, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer notifier.Close()
+	notifier.SetMaxOpenConns(1)
+
+	db, err := openDB(connStr, "pg-idle-test-listenidle")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(listenIdleConns)
+	db.SetMaxIdleConns(listenIdleKeep)
+
+	ctx := context.Background()
+	sessions := map[int32]*listenIdleSession{}
+	var conns []*sql.Conn
+	for i := 0; i < listenIdleConns; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to check out a connection: %v\n", err)
+			return false
+		}
+		var pid int32
+		if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err == nil {
+			_, err = conn.ExecContext(ctx, "LISTEN "+listenIdleChannel)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to LISTEN: %v\n", err)
+			return false
+		}
+		sessions[pid] = &listenIdleSession{pid: pid, fate: "closed by MaxIdleConns"}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	fmt.Printf(">>> LISTEN IDLE: %d connections LISTEN on %s and go back to a pool keeping %d idle (%d closed)\n",
+		listenIdleConns, listenIdleChannel, listenIdleKeep, db.Stats().MaxIdleClosed)
+
+	// The server only sends to sessions still connected
+	listening := func() []*listenIdleSession {
+		var live []*listenIdleSession
+		for _, s := range sessions {
+			var alive bool
+			notifier.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE pid = $1)", s.pid).Scan(&alive)
+			if alive {
+				live = append(live, s)
+			}
+		}
+		return live
+	}
+	notify := func(batch string) {
+		for i := 0; i < listenIdleBatch; i++ {
+			live := listening()
+			if _, err := notifier.Exec("SELECT pg_notify($1, $2)", listenIdleChannel, fmt.Sprintf("%s-%d", batch, i)); err == nil {
+				for _, s := range live {
+					s.sent++
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	notify("pooled")
+	// Check out every idle connection at once so each is drained
+	conns = conns[:0]
+	for i := 0; i < listenIdleKeep; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to check out a connection: %v\n", err)
+			return false
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		var pid int32
+		var channels int
+		conn.QueryRowContext(ctx, "SELECT pg_backend_pid(), (SELECT count(*) FROM pg_listening_channels())").Scan(&pid, &channels)
+		// database/sql has no way to hand out a notification; the pgx
+		// connection underneath queued them while reading the statement's
+		// response
+		readable := 0
+		err := conn.Raw(func(driverConn any) error {
+			c, err := pgxConnOf(driverConn)
+			if err != nil {
+				return err
+			}
+			for {
+				wctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				n, err := c.WaitForNotification(wctx)
+				cancel()
+				if err != nil || n == nil {
+					return nil
+				}
+				readable++
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to drain the notifications of pid=%d: %v\n", pid, err)
+			return false
+		}
+		if s := sessions[pid]; s != nil {
+			s.readable, s.fate = readable, "pooled, drained on checkout"
+		}
+		fmt.Printf("    checked out pid=%d, listening on %d channels, %d notifications buffered\n", pid, channels, readable)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	db.SetConnMaxIdleTime(time.Second)
+	for _, s := range listening() {
+		s.fate = "closed by ConnMaxIdleTime"
+	}
+	notify("reaped")
+	time.Sleep(3 * time.Second)
+	stats := db.Stats()
+	fmt.Printf(">>> LISTEN IDLE: SetConnMaxIdleTime(1s) closed %d connections during and after the second batch\n", stats.MaxIdleTimeClosed)
+
+	fmt.Println()
+	fmt.Printf(">>> LISTEN IDLE REPORT (%d notifications per batch on %s)\n", listenIdleBatch, listenIdleChannel)
+	fmt.Printf("%-8s %-28s %6s %9s %6s\n", "PID", "Fate", "Sent", "Readable", "Lost")
+	var sent, readable int
+	var sorted []*listenIdleSession
+	for _, s := range sessions {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].pid < sorted[j].pid })
+	for _, s := range sorted {
+		sent += s.sent
+		readable += s.readable
+		fmt.Printf("%-8d %-28s %6d %9d %6d\n", s.pid, s.fate, s.sent, s.readable, s.sent-s.readable)
+	}
+	fmt.Println()
+	fmt.Printf("Notifications: %d sent to listening sessions, %d readable through Raw, 0 through database/sql\n", sent, readable)
+	fmt.Println("Sent counts notifications sent while the session was listening. database/sql never reads an idle")
+	fmt.Println("connection, so they wait in the socket until the connection's next statement, where pgx queues them")
+	fmt.Println("for WaitForNotification, which only code unwrapping the connection with Raw can call. A LISTEN on a")
+	fmt.Println("connection the pool closes, because more were returned than MaxIdleConns keeps or because one sat")
+	fmt.Println("idle past ConnMaxIdleTime, ends with the session, along with whatever it had not read. A listener")
+	fmt.Println("needs a dedicated connection outside the pool (pgx.Connect and WaitForNotification).")
+	return true
+}
@@ -0,0 +1,171 @@
+// Scenario: workers bounded by the server's lock_timeout instead of their
+// context deadline, against the same blocker, compared for what each does
+// to the pool.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	lockTimeoutBaseline = 5 * time.Second  // before the blocker and after it lets go
+	lockTimeoutBlock    = 20 * time.Second // the blocker holds the row this long
+)
+
+type lockTimeoutResult struct {
+	ok, failed int64
+	classes    map[string]int64
+	connects   int64         // connections opened after the warm-up
+	statements int64         // worker statements after the warm-up
+	waitCount  int64         // checkouts which waited for a connection
+	waitTime   time.Duration // total wait for a connection
+	recovery   time.Duration // from the blocker's rollback to the first commit
+}
+
+func init() {
+	registerScenario("locktimeout", scenario{
+		standalone: func(o *options) bool { return runLockTimeout(o.connStr, o.workers, o.maxOpen, o.queryTimeout) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = o.maxOpen + 2 }, // pool, setup and blocker
+	})
+}
+
+// runLockTimeout runs the counter workload twice against a session which
+// holds the row lock outside the pool: bounded by a context deadline of
+// timeout, whose expiry makes pgx cancel the statement and close the
+// connection, and by lock_timeout set to timeout, with the deadline only a
+// backstop at three times that, which fails the statement with 55P03 and
+// leaves the session usable.
+func runLockTimeout(connStr string, workers, maxOpen int, timeout time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	schemaSpec{rows: 1, fillfactor: 100}.create(setup)
+
+	configs := []string{"context deadline", "lock_timeout"}
+	results := map[string]lockTimeoutResult{}
+	for _, config := range configs {
+		fmt.Printf(">>> LOCK TIMEOUT: %s, %d workers on %d connections, %v\n", config, workers, maxOpen, timeout)
+		r, err := lockTimeoutOnce(connStr, setup, config == "lock_timeout", workers, maxOpen, timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", config, err)
+			return false
+		}
+		results[config] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> LOCK TIMEOUT COMPARISON (row locked for %v outside the pool)\n", lockTimeoutBlock)
+	fmt.Printf("%-17s %8s %8s %9s %14s %8s %10s %10s   %s\n", "Bound", "OK", "Failed", "Connects", "Stmts/connect", "Waits", "Wait time", "Recovery", "Errors")
+	for _, config := range configs {
+		r := results[config]
+		var classes []string
+		for class, n := range r.classes {
+			classes = append(classes, fmt.Sprintf("%s=%d", class, n))
+		}
+		sort.Strings(classes)
+		reuse := "-"
+		if r.connects > 0 {
+			reuse = fmt.Sprintf("%.1f", float64(r.statements)/float64(r.connects))
+		}
+		fmt.Printf("%-17s %8d %8d %9d %14s %8d %9.1fs %10s   %s\n", config, r.ok, r.failed, r.connects, reuse, r.waitCount,
+			r.waitTime.Seconds(), ms(r.recovery), strings.Join(classes, " "))
+	}
+	fmt.Println()
+	fmt.Println("Connects counts the connections each pool opened after its warm-up: every statement a context deadline")
+	fmt.Println("cancels costs one, since pgx closes a connection whose statement it gave up on, while a 55P03 from")
+	fmt.Println("lock_timeout leaves the session in the pool. Waits and Wait time are the pool's checkouts which queued for")
+	fmt.Println("a connection; Recovery is from the blocker's rollback to the pool's next commit.")
+	return true
+}
+
+func lockTimeoutOnce(connStr string, setup *sql.DB, serverSide bool, workers, maxOpen int, timeout time.Duration) (lockTimeoutResult, error) {
+	r := lockTimeoutResult{classes: map[string]int64{}}
+	saved := extraRuntimeParams
+	defer func() { extraRuntimeParams = saved }()
+	deadline := timeout
+	name := "deadline"
+	if serverSide {
+		extraRuntimeParams = map[string]string{"lock_timeout": fmt.Sprint(timeout.Milliseconds())}
+		deadline, name = 3*timeout, "locktimeout"
+	}
+	db, err := openDB(connStr, "pg-idle-test-locktimeout-"+name)
+	if err != nil {
+		return r, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxOpen)
+	if err := db.Ping(); err != nil {
+		return r, err
+	}
+
+	var measuring, stopping atomic.Bool
+	var released atomic.Int64 // UnixNano of the blocker's rollback
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopping.Load() {
+				ctx, cancel := context.WithTimeout(context.Background(), deadline)
+				_, err := db.ExecContext(ctx, "UPDATE test_row SET val = val + 1 WHERE id = 1")
+				cancel()
+				if measuring.Load() {
+					mu.Lock()
+					r.statements++
+					if err == nil {
+						r.ok++
+						if at := released.Load(); at != 0 && r.recovery == 0 {
+							r.recovery = time.Since(time.Unix(0, at))
+						}
+					} else {
+						r.failed++
+						r.classes[classifyError(err)]++
+					}
+					mu.Unlock()
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+	}
+
+	time.Sleep(lockTimeoutBaseline) // warm-up: the pool opens its connections
+	connectsBefore, statsBefore := connectsTotal.Load(), db.Stats()
+	measuring.Store(true)
+	time.Sleep(lockTimeoutBaseline)
+
+	blocker, err := setup.Conn(context.Background())
+	if err != nil {
+		stopping.Store(true)
+		wg.Wait()
+		return r, err
+	}
+	blocker.ExecContext(context.Background(), "BEGIN")
+	blocker.ExecContext(context.Background(), "UPDATE test_row SET val = val WHERE id = 1")
+	fmt.Fprintf(os.Stderr, "[%s] LOCK_TIMEOUT: row locked for %v\n", time.Now().Format("04:05"), lockTimeoutBlock)
+	time.Sleep(lockTimeoutBlock)
+	blocker.ExecContext(context.Background(), "ROLLBACK")
+	released.Store(time.Now().UnixNano())
+	blocker.Close()
+	time.Sleep(lockTimeoutBaseline)
+
+	stopping.Store(true)
+	wg.Wait()
+	stats := db.Stats()
+	r.connects = connectsTotal.Load() - connectsBefore
+	r.waitCount = stats.WaitCount - statsBefore.WaitCount
+	r.waitTime = stats.WaitDuration - statsBefore.WaitDuration
+	return r, nil
+}
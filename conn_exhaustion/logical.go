@@ -0,0 +1,343 @@
+// Idle logical decoding consumer: a subscriber which stops acknowledging or
+// stops reading holds back its slot while the workload keeps writing.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// logicalSlot is a permanent slot, so that like a real subscriber's it
+// survives the consumer's connection being ended by wal_sender_timeout
+const logicalSlot = "pg_idle_test_logical"
+
+// logicalStalls are the consumer faults: nofeedback keeps reading but never
+// sends a status update, noread stops reading the socket altogether
+var logicalStalls = []string{"nofeedback", "noread"}
+
+// logicalConsumer decodes logicalSlot with test_decoding, confirming what it
+// received once a second and whenever the server asks, pg_recvlogical style.
+// It reconnects if the server ends the stream.
+type logicalConsumer struct {
+	connStr string
+
+	mu    sync.Mutex
+	stall string // "" while consuming normally
+	ended []string
+
+	received   atomic.Int64 // decoded bytes
+	reconnects atomic.Int64
+}
+
+func (c *logicalConsumer) setStall(kind string) {
+	c.mu.Lock()
+	c.stall = kind
+	c.mu.Unlock()
+}
+
+func (c *logicalConsumer) currentStall() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stall
+}
+
+func openLogicalStream(ctx context.Context, connStr string) (*pgconn.PgConn, error) {
+	cfg, err := pgconn.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RuntimeParams["replication"] = "database"
+	cfg.RuntimeParams["application_name"] = "pg-idle-test-logical"
+	conn, err := pgconn.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// 0/0 resumes from the slot's confirmed_flush_lsn
+	if err := startReplication(ctx, conn, "START_REPLICATION SLOT "+logicalSlot+" LOGICAL 0/0"); err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// run consumes until ctx is done. It is the only user of its connection.
+func (c *logicalConsumer) run(ctx context.Context) {
+	var conn *pgconn.PgConn
+	var pos lsn
+	var lastStatus time.Time
+	drop := func(err error) {
+		c.mu.Lock()
+		c.ended = append(c.ended, fmt.Sprintf("[%s] %s", time.Now().Format("04:05"), oneLine(err.Error())))
+		c.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "[%s] LOGICAL: stream ended: %v\n", time.Now().Format("04:05"), err)
+		conn.Close(context.Background())
+		conn = nil
+	}
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+	for ctx.Err() == nil {
+		if conn == nil {
+			var err error
+			if conn, err = openLogicalStream(ctx, c.connStr); err != nil {
+				if ctx.Err() == nil {
+					fmt.Fprintf(os.Stderr, "[%s] LOGICAL: unable to start streaming: %v\n", time.Now().Format("04:05"), err)
+					time.Sleep(1 * time.Second)
+				}
+				continue
+			}
+			if lastStatus.IsZero() {
+				lastStatus = time.Now()
+			} else {
+				c.reconnects.Add(1)
+				fmt.Fprintf(os.Stderr, "[%s] LOGICAL: reconnected\n", time.Now().Format("04:05"))
+			}
+		}
+		stall := c.currentStall()
+		if stall == "noread" {
+			// The walsender blocks once the socket buffers are full
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if stall == "" && time.Since(lastStatus) >= time.Second {
+			if err := sendStandbyStatusUpdate(conn, pos); err != nil {
+				drop(err)
+				continue
+			}
+			lastStatus = time.Now()
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		msg, err := conn.ReceiveMessage(rctx)
+		cancel()
+		if err != nil {
+			if !pgconn.Timeout(err) && ctx.Err() == nil {
+				drop(err)
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 0 {
+				continue
+			}
+			switch msg.Data[0] {
+			case xLogDataByteID:
+				xld, err := parseXLogData(msg.Data[1:])
+				if err != nil {
+					drop(err)
+					continue
+				}
+				pos = max(pos, xld.walStart)
+				c.received.Add(int64(len(xld.walData)))
+			case primaryKeepaliveMessageByteID:
+				ka, err := parsePrimaryKeepalive(msg.Data[1:])
+				if err != nil {
+					drop(err)
+					continue
+				}
+				// Everything up to the server's WAL end has been sent
+				pos = max(pos, ka.serverWALEnd)
+				if ka.replyRequested && stall == "" {
+					if err := sendStandbyStatusUpdate(conn, pos); err != nil {
+						drop(err)
+						continue
+					}
+					lastStatus = time.Now()
+				}
+			}
+		case *pgproto3.ErrorResponse:
+			drop(pgconn.ErrorResponseToPgError(msg))
+		}
+	}
+}
+
+// logicalSample is the slot as seen from the primary
+type logicalSample struct {
+	lag      int64 // WAL bytes not yet confirmed by the consumer
+	retained int64 // WAL bytes the slot keeps from being removed
+	active   bool
+	walDir   int64 // size of pg_wal, -1 without pg_monitor
+}
+
+func sampleLogicalSlot(db *sql.DB) (logicalSample, error) {
+	s := logicalSample{walDir: -1}
+	err := db.QueryRow(`SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn)::bigint,
+		pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn)::bigint, active
+		FROM pg_replication_slots WHERE slot_name = $1`, logicalSlot).Scan(&s.lag, &s.retained, &s.active)
+	db.QueryRow("SELECT sum(size)::bigint FROM pg_ls_waldir()").Scan(&s.walDir)
+	return s, err
+}
+
+// kB formats WAL byte counts for the report
+func kB(n int64) string {
+	return fmt.Sprintf("%dkB", n/1024)
+}
+
+// logicalPhase is what the sampler saw during one phase
+type logicalPhase struct {
+	name        string
+	maxLag      int64
+	maxRetained int64
+	maxWALDir   int64
+	inactive    int           // samples with no consumer connected
+	caughtUp    time.Duration // recover phases: until the lag was back to normal, 0 if never
+	reconnects  int64
+}
+
+func init() {
+	registerScenario("logicalstall", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runLogicalStall(h.connStr, h.o.logicalKinds, h.o.logicalStall)
+		},
+		validate: func(o *options) error {
+			o.logicalKinds = strings.Split(o.logicalStalls, ",")
+			for _, kind := range o.logicalKinds {
+				if !slices.Contains(logicalStalls, kind) {
+					return fmt.Errorf("Invalid -logical-stalls %q, use a list of %s", o.logicalStalls, strings.Join(logicalStalls, ","))
+				}
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns++ // slot sampler; the consumer counts against max_wal_senders
+		},
+	})
+}
+
+// runLogicalStall decodes a slot for the rest of the run, stalling the
+// consumer for stallDuration with each fault in kinds and giving it 10s to
+// recover after each. It checks that every stall held back the slot and that
+// the consumer caught up again.
+func runLogicalStall(connStr string, kinds []string, stallDuration time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.SetMaxOpenConns(1)
+	var walLevel, senderTimeout string
+	setup.QueryRow("SELECT current_setting('wal_level'), current_setting('wal_sender_timeout')").Scan(&walLevel, &senderTimeout)
+	setup.Exec("SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1 AND NOT active", logicalSlot)
+	if _, err := setup.Exec("SELECT pg_create_logical_replication_slot($1, 'test_decoding')", logicalSlot); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to create logical slot %s (wal_level=%s): %v\n", logicalSlot, walLevel, err)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "55000" {
+			fmt.Println(">>> LOGICAL DECODING: FAIL logical decoding needs wal_level=logical")
+		} else if errors.As(err, &pgErr) && pgErr.Code == "42501" {
+			fmt.Println(">>> LOGICAL DECODING: FAIL the role needs the REPLICATION attribute")
+		}
+		return false
+	}
+	defer setup.Exec("SELECT pg_drop_replication_slot($1)", logicalSlot)
+	fmt.Printf(">>> LOGICAL: decoding slot %s, stalls %s of %v each (wal_sender_timeout=%s)\n",
+		logicalSlot, strings.Join(kinds, ","), stallDuration, senderTimeout)
+
+	consumer := &logicalConsumer{connStr: connStr}
+	ctx, cancel := context.WithCancel(context.Background())
+	consumed := make(chan struct{})
+	go func() {
+		consumer.run(ctx)
+		close(consumed)
+	}()
+
+	// sample tracks the slot every second until deadline, and until the lag
+	// is at most target if target is not negative
+	sample := func(p *logicalPhase, d time.Duration, target int64) {
+		startPhase("logical:" + p.name)
+		reconnects := consumer.reconnects.Load()
+		start := time.Now()
+		for time.Since(start) < d {
+			time.Sleep(1 * time.Second)
+			s, err := sampleLogicalSlot(setup)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Unable to sample slot %s: %v\n", logicalSlot, err)
+				continue
+			}
+			p.maxLag, p.maxRetained, p.maxWALDir = max(p.maxLag, s.lag), max(p.maxRetained, s.retained), max(p.maxWALDir, s.walDir)
+			if !s.active {
+				p.inactive++
+			}
+			fmt.Fprintf(os.Stderr, "[%s] LOGICAL: %s lag=%s retained=%s active=%t\n",
+				time.Now().Format("04:05"), p.name, kB(s.lag), kB(s.retained), s.active)
+			if target >= 0 && p.caughtUp == 0 && s.lag <= target {
+				p.caughtUp = time.Since(start)
+			}
+		}
+		p.reconnects = consumer.reconnects.Load() - reconnects
+	}
+
+	phases := []*logicalPhase{{name: "streaming"}}
+	sample(phases[0], 10*time.Second, -1)
+	// Back to normal is within twice the healthy lag, one WAL page at least
+	normal := max(2*phases[0].maxLag, 8192)
+	for _, kind := range kinds {
+		stalled := &logicalPhase{name: "stall:" + kind}
+		consumer.setStall(kind)
+		recordEvent("logical consumer stalled: %s", kind)
+		sample(stalled, stallDuration, -1)
+		recovered := &logicalPhase{name: "recover:" + kind}
+		consumer.setStall("")
+		recordEvent("logical consumer resumed after %s", kind)
+		sample(recovered, 10*time.Second, normal)
+		phases = append(phases, stalled, recovered)
+	}
+	cancel()
+	<-consumed
+
+	fmt.Println()
+	fmt.Println(">>> LOGICAL DECODING REPORT")
+	fmt.Printf("%-22s %12s %12s %12s %9s %11s %10s\n", "Phase", "MaxLag", "MaxRetained", "MaxPgWal", "Inactive", "Reconnects", "CaughtUp")
+	for _, p := range phases {
+		walDir := "n/a"
+		if p.maxWALDir >= 0 {
+			walDir = kB(p.maxWALDir)
+		}
+		caughtUp := ""
+		if strings.HasPrefix(p.name, "recover:") {
+			caughtUp = "never"
+			if p.caughtUp > 0 {
+				caughtUp = fmt.Sprintf("%.0fs", p.caughtUp.Seconds())
+			}
+		}
+		fmt.Printf("%-22s %12s %12s %12s %8ds %11d %10s\n", p.name, kB(p.maxLag), kB(p.maxRetained), walDir, p.inactive, p.reconnects, caughtUp)
+	}
+	fmt.Printf("decoded: %d bytes of test_decoding output\n", consumer.received.Load())
+	consumer.mu.Lock()
+	for _, e := range consumer.ended {
+		fmt.Printf("stream ended: %s\n", e)
+	}
+	consumer.mu.Unlock()
+	fmt.Println()
+
+	passed := true
+	for i := 1; i < len(phases); i += 2 {
+		stalled, recovered := phases[i], phases[i+1]
+		if stalled.maxLag <= normal {
+			fmt.Printf(">>> LOGICAL DECODING: FAIL %s did not hold back the slot; is the workload writing?\n", stalled.name)
+			passed = false
+		} else if recovered.caughtUp == 0 {
+			fmt.Printf(">>> LOGICAL DECODING: FAIL the consumer did not catch up within 10s of the %s\n", stalled.name)
+			passed = false
+		}
+	}
+	if passed {
+		fmt.Println(">>> LOGICAL DECODING: PASS every stall held back confirmed_flush_lsn and WAL, and the consumer caught up after it")
+	}
+	return passed
+}
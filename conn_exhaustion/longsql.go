@@ -0,0 +1,188 @@
+// Scenario: statements with very large SQL text, their latency, server log
+// volume and truncation in pg_stat_activity.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// longSQLVariant builds the statement of one variant; every variant selects
+// the same rows so that latency differences come from the text alone
+type longSQLVariant struct {
+	name  string
+	build func(ids, commentBytes int) (string, []any)
+}
+
+var longSQLVariants = []longSQLVariant{
+	{"baseline", func(ids, commentBytes int) (string, []any) {
+		return "SELECT count(*) FROM test_longsql WHERE id IN (1, 2, 3)", nil
+	}},
+	{"inlist", func(ids, commentBytes int) (string, []any) {
+		list := make([]string, ids)
+		for i := range list {
+			list[i] = fmt.Sprint(i + 1)
+		}
+		return "SELECT count(*) FROM test_longsql WHERE id IN (" + strings.Join(list, ", ") + ")", nil
+	}},
+	{"anyarray", func(ids, commentBytes int) (string, []any) {
+		list := make([]int64, ids)
+		for i := range list {
+			list[i] = int64(i + 1)
+		}
+		return "SELECT count(*) FROM test_longsql WHERE id = ANY($1)", []any{list}
+	}},
+	{"comment", func(ids, commentBytes int) (string, []any) {
+		return "/* " + strings.Repeat("x", commentBytes) + " */ SELECT count(*) FROM test_longsql WHERE id IN (1, 2, 3)", nil
+	}},
+}
+
+// longSQLEndTag is appended to the probe statement of each variant to see
+// whether a correlation tag at the end of the text survives pg_stat_activity
+const longSQLEndTag = "/* longsql-end-tag */"
+
+type longSQLResult struct {
+	sqlBytes     int
+	p50, p95     time.Duration
+	failed       int
+	logBytes     int64 // server log growth, -1 if the log file cannot be read
+	visibleBytes int   // length of the probe's query text in pg_stat_activity
+	startTagLost bool
+	endTagLost   bool
+}
+
+func init() {
+	registerScenario("longsql", scenario{
+		standalone: func(o *options) bool {
+			return runLongSQL(o.connStr, o.longSQLIDs, o.longSQLComment, o.longSQLIterations)
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = 5 + 1 },
+	})
+}
+
+// runLongSQL runs iterations of each variant on 4 workers and probes what
+// pg_stat_activity shows of one long-running instance of it
+func runLongSQL(connStr string, ids, commentBytes, iterations int) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_longsql")
+	setup.Exec("CREATE TABLE test_longsql (id INT PRIMARY KEY)")
+	setup.Exec("INSERT INTO test_longsql SELECT generate_series(1, $1::int)", ids)
+
+	var logMin, querySize string
+	setup.QueryRow("SELECT current_setting('log_min_duration_statement'), current_setting('track_activity_query_size')").Scan(&logMin, &querySize)
+
+	appName := "pg-idle-test-longsql"
+	db, err := openDB(connStr, appName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(5)
+	db.SetMaxIdleConns(5)
+
+	results := make([]longSQLResult, len(longSQLVariants))
+	for i, v := range longSQLVariants {
+		fmt.Fprintf(os.Stderr, "[%s] LONG_SQL: %s\n", time.Now().Format("04:05"), v.name)
+		query, args := v.build(ids, commentBytes)
+		r := &results[i]
+		r.sqlBytes = len(queryTag) + len(query)
+		logBefore := serverLogSize(setup)
+
+		var mu sync.Mutex
+		var latencies []time.Duration
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := w; n < iterations; n += 4 {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					start := time.Now()
+					var count int
+					err := db.QueryRowContext(ctx, query, args...).Scan(&count)
+					elapsed := time.Since(start)
+					cancel()
+					mu.Lock()
+					if err != nil {
+						r.failed++
+					} else {
+						latencies = append(latencies, elapsed)
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		r.p50, r.p95 = percentile(latencies, 0.50), percentile(latencies, 0.95)
+
+		// The probe sleeps so that the sampler catches it running
+		probe := strings.Replace(query, "SELECT count(*)", "SELECT pg_sleep(0.5), count(*)", 1) + " " + longSQLEndTag
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			db.Exec(probe, args...)
+		}()
+		time.Sleep(200 * time.Millisecond)
+		var visible string
+		setup.QueryRow("SELECT query FROM pg_stat_activity WHERE application_name = $1 AND state = 'active' LIMIT 1", appName).Scan(&visible)
+		<-done
+		r.visibleBytes = len(visible)
+		r.startTagLost = !strings.HasPrefix(visible, queryTag)
+		r.endTagLost = !strings.HasSuffix(visible, longSQLEndTag)
+
+		r.logBytes = -1
+		if logAfter := serverLogSize(setup); logBefore >= 0 && logAfter >= 0 {
+			r.logBytes = logAfter - logBefore
+		}
+	}
+
+	fmt.Println()
+	fmt.Println(">>> LONG SQL REPORT")
+	fmt.Printf("log_min_duration_statement=%s track_activity_query_size=%s, %d iterations per variant\n\n", logMin, querySize, iterations)
+	fmt.Printf("%-10s %10s %10s %10s %7s %12s %10s %9s %7s\n", "Variant", "SQLBytes", "p50", "p95", "Failed", "LogBytes", "Visible", "StartTag", "EndTag")
+	ok := true
+	for i, v := range longSQLVariants {
+		r := results[i]
+		logBytes := "n/a"
+		if r.logBytes >= 0 {
+			logBytes = fmt.Sprint(r.logBytes)
+		}
+		ok = ok && r.failed == 0 && !r.startTagLost
+		fmt.Printf("%-10s %10d %10s %10s %7d %12s %10d %9s %7s\n", v.name, r.sqlBytes, ms(r.p50), ms(r.p95), r.failed, logBytes,
+			r.visibleBytes, keptOrLost(r.startTagLost), keptOrLost(r.endTagLost))
+	}
+	fmt.Println()
+	fmt.Println("Visible is the length of the probe's text in pg_stat_activity; tags past track_activity_query_size are cut off.")
+	fmt.Println("LogBytes needs logging_collector and superuser or pg_read_server_files; set log_min_duration_statement=0 to see the bloat.")
+	return ok
+}
+
+func keptOrLost(lost bool) string {
+	if lost {
+		return "lost"
+	}
+	return "kept"
+}
+
+// serverLogSize is the size of the server's current log file, or -1 if it
+// cannot be read
+func serverLogSize(db *sql.DB) int64 {
+	var size int64
+	if err := db.QueryRow("SELECT size FROM pg_stat_file(pg_current_logfile())").Scan(&size); err != nil {
+		return -1
+	}
+	return size
+}
@@ -0,0 +1,71 @@
+// Prometheus /metrics endpoint with the worker pool's stats, worker errors and
+// connections seen back in the pool inside a transaction.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// metricsPool is the worker pool scraped by /metrics and sampled at each
+// phase change, set by runHarness
+var metricsPool atomic.Pointer[sql.DB]
+
+// openTxCheckouts counts pooled connections the monitor checked out with a
+// transaction still open, the poison the scenario is about
+var openTxCheckouts atomic.Int64
+
+func init() {
+	httpMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+}
+
+type metricsWriter struct{ w io.Writer }
+
+func (m metricsWriter) metric(name, kind, help string, value float64) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
+
+// writeMetrics writes the text exposition format; series of a pool or phase
+// are left out until the harness has one
+func writeMetrics(w io.Writer) {
+	m := metricsWriter{w}
+	if db := metricsPool.Load(); db != nil {
+		s := db.Stats()
+		m.metric("pg_idle_test_pool_max_open_connections", "gauge", "SetMaxOpenConns of the worker pool.", float64(s.MaxOpenConnections))
+		m.metric("pg_idle_test_pool_open_connections", "gauge", "Connections of the worker pool, in use and idle.", float64(s.OpenConnections))
+		m.metric("pg_idle_test_pool_in_use_connections", "gauge", "Connections of the worker pool in use.", float64(s.InUse))
+		m.metric("pg_idle_test_pool_idle_connections", "gauge", "Idle connections of the worker pool.", float64(s.Idle))
+		m.metric("pg_idle_test_pool_wait_count_total", "counter", "Checkouts which waited for a connection.", float64(s.WaitCount))
+		m.metric("pg_idle_test_pool_wait_duration_seconds_total", "counter", "Time checkouts waited for a connection.", s.WaitDuration.Seconds())
+		m.metric("pg_idle_test_pool_max_idle_closed_total", "counter", "Connections closed by SetMaxIdleConns.", float64(s.MaxIdleClosed))
+		m.metric("pg_idle_test_pool_max_idle_time_closed_total", "counter", "Connections closed by SetConnMaxIdleTime.", float64(s.MaxIdleTimeClosed))
+		m.metric("pg_idle_test_pool_max_lifetime_closed_total", "counter", "Connections closed by SetConnMaxLifetime.", float64(s.MaxLifetimeClosed))
+	}
+	m.metric("pg_idle_test_connections_established_total", "counter", "Connections established by the tool's pgx pools.", float64(connectsTotal.Load()))
+	m.metric("pg_idle_test_open_tx_checkouts_total", "counter", "Pooled connections the monitor checked out inside an open transaction.", float64(openTxCheckouts.Load()))
+
+	inflightMu.Lock()
+	statements := len(inflight)
+	inflightMu.Unlock()
+	m.metric("pg_idle_test_inflight_statements", "gauge", "Statements between the call into database/sql and its return.", float64(statements))
+
+	fmt.Fprintln(w, "# HELP pg_idle_test_worker_errors_total Worker iteration failures by error class.")
+	fmt.Fprintln(w, "# TYPE pg_idle_test_worker_errors_total counter")
+	workerErrors.mu.Lock()
+	for _, class := range errorClasses {
+		fmt.Fprintf(w, "pg_idle_test_worker_errors_total{class=%q} %d\n", class, workerErrors.counts[class])
+	}
+	workerErrors.mu.Unlock()
+
+	if p := currentPhase.Load(); p != nil {
+		fmt.Fprintln(w, "# HELP pg_idle_test_phase Current phase of the run, value 1.")
+		fmt.Fprintln(w, "# TYPE pg_idle_test_phase gauge")
+		fmt.Fprintf(w, "pg_idle_test_phase{phase=%q} 1\n", p.name)
+	}
+}
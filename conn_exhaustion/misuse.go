@@ -0,0 +1,350 @@
+// Scenario: known database/sql anti-patterns which poison or drain the pool,
+// each demonstrated on its own pool and followed by what detection sees.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// misusePool is the size of each case's pool, small enough for one mistake per
+// connection to take the whole pool down
+const misusePool = 3
+
+type misuseCase struct {
+	name    string
+	pattern string
+	// run commits the mistake and returns the errors the misusing code saw
+	run func(db *sql.DB) []error
+}
+
+var misuseCases = []misuseCase{
+	{"manualbegin", "BEGIN, UPDATE and COMMIT sent with db.Exec by concurrent requests, each statement on whichever pooled connection is free", misuseManualBegin},
+	{"rowsleak", "db.Query whose rows are read partially and never closed, once per pooled connection", misuseRowsLeak},
+	{"connleak", "db.Conn checked out and never closed, once per pooled connection", misuseConnLeak},
+	{"cancelcommit", "BEGIN on a *sql.Conn, context canceled before COMMIT, early return without ROLLBACK (a *sql.Tx is rolled back by database/sql instead)", misuseCancelCommit},
+	{"sharedtx", "one *sql.Tx used by several goroutines, each rolling it back on its first error", misuseSharedTx},
+}
+
+func misuseNames() []string {
+	names := make([]string, len(misuseCases))
+	for i, c := range misuseCases {
+		names[i] = c.name
+	}
+	return names
+}
+
+func misuseManualBegin(db *sql.DB) []error {
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for w := 0; w < 2*misusePool; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				for _, stmt := range []string{"BEGIN", "UPDATE test_misuse SET val = val + 1 WHERE id = 1", "SELECT pg_sleep(0.02)", "COMMIT"} {
+					ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+					_, err := db.ExecContext(ctx, stmt)
+					cancel()
+					if err != nil {
+						mu.Lock()
+						errs = append(errs, err)
+						mu.Unlock()
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func misuseRowsLeak(db *sql.DB) []error {
+	var errs []error
+	for i := 0; i < misusePool; i++ {
+		rows, err := db.Query("SELECT id FROM test_misuse")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rows.Next() // first row only: the connection stays with rows until Close
+	}
+	return errs
+}
+
+func misuseConnLeak(db *sql.DB) []error {
+	var errs []error
+	for i := 0; i < misusePool; i++ {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := conn.PingContext(context.Background()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func misuseCancelCommit(db *sql.DB) []error {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		cancel()
+		return []error{err}
+	}
+	defer conn.Close()
+	for _, stmt := range []string{"BEGIN", "UPDATE test_misuse SET val = val + 1 WHERE id = 1"} {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			cancel()
+			return []error{err}
+		}
+	}
+	cancel() // e.g. the client went away while the handler was between statements
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+func misuseSharedTx(db *sql.DB) []error {
+	tx, err := db.Begin()
+	if err != nil {
+		return []error{err}
+	}
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				err := func() error {
+					rows, err := tx.Query("SELECT id FROM test_misuse")
+					if err != nil {
+						return err
+					}
+					defer rows.Close()
+					for rows.Next() {
+						time.Sleep(5 * time.Millisecond)
+					}
+					_, err = tx.Exec("UPDATE test_misuse SET val = val + 1 WHERE id = $1", 1+w)
+					return err
+				}()
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					tx.Rollback()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	tx.Commit()
+	return errs
+}
+
+// misuseDetection is what the pool and server show right after a mistake
+type misuseDetection struct {
+	openTx       int // pooled connections handed out inside a transaction
+	leaked       int // connections which could not be checked out at all
+	probes       int
+	probeClasses map[string]int
+	diagnosis    string
+	evidence     []string
+}
+
+func (d misuseDetection) detected() bool {
+	return d.openTx > 0 || d.leaked > 0 || len(d.probeClasses) > 0
+}
+
+// detectMisuse audits the pool's transaction state, then runs probe updates
+// against the contended row and gathers the stall evidence while they wait.
+// It fails if the audit cannot read a pooled connection's transaction status.
+func detectMisuse(db *sql.DB) (misuseDetection, error) {
+	d := misuseDetection{probes: 2 * misusePool, probeClasses: map[string]int{}}
+
+	var conns []*sql.Conn
+	var auditErr error
+	for i := 0; i < misusePool; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		conn, err := db.Conn(ctx)
+		cancel()
+		if err != nil {
+			d.leaked++
+			continue
+		}
+		conns = append(conns, conn)
+		auditErr = conn.Raw(func(driverConn any) error {
+			c, err := pgxConnOf(driverConn)
+			if err != nil {
+				return err
+			}
+			if c.PgConn().TxStatus() != 'I' {
+				d.openTx++
+				openTxSeen.Store(time.Now().UnixNano())
+			}
+			return nil
+		})
+		if auditErr != nil {
+			break
+		}
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if auditErr != nil {
+		return d, fmt.Errorf("unable to audit the transaction status of a pooled connection: %w", auditErr)
+	}
+
+	waitsBefore := db.Stats().WaitCount
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < d.probes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if _, err := db.ExecContext(ctx, "UPDATE test_misuse SET val = val + 1 WHERE id = 1"); err != nil {
+				mu.Lock()
+				d.probeClasses[classifyError(err)]++
+				mu.Unlock()
+			}
+		}()
+	}
+	const settle = 500 * time.Millisecond
+	time.Sleep(settle)
+	stats := db.Stats()
+	ev := gatherEvidence(stats, float64(stats.WaitCount-waitsBefore)/settle.Seconds())
+	wg.Wait()
+	openTxSeen.Store(0)
+
+	if d.detected() {
+		d.diagnosis = diagnoseStall(ev)
+		d.evidence = ev.lines()
+	}
+	return d, nil
+}
+
+func init() {
+	registerScenario("misuse", scenario{
+		standalone: func(o *options) bool { return runMisuse(o.connStr, o.misuse) },
+		validate: func(o *options) error {
+			if o.misuse != "all" && !slices.Contains(misuseNames(), o.misuse) {
+				return fmt.Errorf("Invalid -misuse %q, use all|%s", o.misuse, strings.Join(misuseNames(), "|"))
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = misusePool + 1 },
+	})
+}
+
+// runMisuse demonstrates each selected anti-pattern on a fresh pool and fails
+// if one of them went unnoticed by every detection
+func runMisuse(connStr string, selected string) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_misuse")
+	setup.Exec("CREATE TABLE test_misuse (id INT PRIMARY KEY, val INT)")
+	setup.Exec("INSERT INTO test_misuse SELECT g, 0 FROM generate_series(1, 5) g")
+	statsDB = setup
+
+	type row struct {
+		name       string
+		errs       int
+		d          misuseDetection
+		probesFail int
+	}
+	var rows []row
+	for _, c := range misuseCases {
+		if selected != "all" && selected != c.name {
+			continue
+		}
+		appName := "pg-idle-test-misuse-" + c.name
+		db, err := openDB(connStr, appName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", c.name, err)
+			return false
+		}
+		db.SetMaxOpenConns(misusePool)
+		db.SetMaxIdleConns(misusePool)
+
+		fmt.Println()
+		fmt.Printf(">>> MISUSE %s: %s\n", c.name, c.pattern)
+		errs := c.run(db)
+		byMessage := map[string]int{}
+		for _, err := range errs {
+			byMessage[err.Error()]++
+		}
+		msgs := make([]string, 0, len(byMessage))
+		for msg := range byMessage {
+			msgs = append(msgs, msg)
+		}
+		sort.Strings(msgs)
+		for _, msg := range msgs {
+			fmt.Printf("    misusing code saw: %d x %s\n", byMessage[msg], msg)
+		}
+		if len(errs) == 0 {
+			fmt.Printf("    misusing code saw: no errors\n")
+		}
+
+		d, err := detectMisuse(db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", c.name, err)
+			db.Close()
+			return false
+		}
+		fmt.Printf("    detection: %d of %d connections checked out inside a transaction, %d could not be checked out\n", d.openTx, misusePool, d.leaked)
+		failed := 0
+		var classes []string
+		for _, class := range errorClasses {
+			if n := d.probeClasses[class]; n > 0 {
+				failed += n
+				classes = append(classes, fmt.Sprintf("%s=%d", class, n))
+			}
+		}
+		fmt.Printf("    detection: %d of %d probe updates failed %s\n", failed, d.probes, strings.Join(classes, " "))
+		if d.diagnosis != "" {
+			fmt.Printf("    DIAGNOSIS: %s\n", d.diagnosis)
+			for _, line := range d.evidence {
+				fmt.Printf("    evidence: %s\n", line)
+			}
+		} else {
+			fmt.Printf("    detection: pool healthy afterwards, the mistake only surfaced in the code which made it\n")
+		}
+		rows = append(rows, row{c.name, len(errs), d, failed})
+
+		// Leaked connections never return to the pool, so end their sessions
+		setup.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE application_name = $1", appName)
+		db.Close()
+	}
+
+	fmt.Println()
+	fmt.Println(">>> MISUSE REPORT")
+	fmt.Printf("%-14s %8s %8s %8s %13s %9s\n", "Case", "CodeErrs", "OpenTx", "Leaked", "ProbesFailed", "Detected")
+	ok := true
+	for _, r := range rows {
+		detected := r.errs > 0 || r.d.detected()
+		ok = ok && detected
+		fmt.Printf("%-14s %8d %8d %8d %13s %9t\n", r.name, r.errs, r.d.openTx, r.d.leaked, fmt.Sprintf("%d/%d", r.probesFail, r.d.probes), detected)
+	}
+	return ok
+}
@@ -0,0 +1,405 @@
+// In-process Postgres wire protocol responder: for calibration it answers
+// every statement at once, so what a client measures against it is the
+// client's own cost, and for driver edge cases it misbehaves on request.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// mockBackendPIDs start far above any real PID so closedBackends and the
+// orphan detector never confuse a mock session with a server backend
+const mockBackendPIDs = 900_000_000
+
+// mockPostgres accepts connections on a loopback port and answers the
+// simple and extended query protocols: statements returning rows get one
+// int4 row (see execute), and the rest their command tag with one row
+// affected. Parameters are
+// declared bigint, which is all the calibration statements take.
+type mockPostgres struct {
+	ln        net.Listener
+	behavior  mockBehavior
+	tlsConfig *tls.Config // with behavior.tls
+
+	sessions   atomic.Int32
+	statements atomic.Int64
+	cancels    atomic.Int32 // CancelRequests received
+
+	// terminated gets, for each Terminate held open by holdAfterTerminate,
+	// how long the client took to close the socket itself
+	terminated chan time.Duration
+}
+
+// mockBehavior is how a server can misbehave; the zero value is a server
+// which behaves
+type mockBehavior struct {
+	dropAfterAuth      bool          // close the connection after AuthenticationOk, before ReadyForQuery
+	readyDelay         time.Duration // hold ReadyForQuery back this long after each statement's results
+	holdAfterTerminate bool          // leave the connection open after Terminate until the client closes it
+
+	// Faults on the first statement the server runs, which the driver sees
+	// mid-result; later statements, on that session or a new one, are
+	// answered normally
+	tls             bool // accept SSLRequest with a self-signed certificate
+	noticeFlood     int  // NoticeResponses ahead of the results
+	truncateDataRow bool // write the DataRow but its last bytes, then close
+	duplicateReady  bool // end it with two ReadyForQuery
+	closeAfterFirst bool // close the TCP connection after its ReadyForQuery, without ErrorResponse or TLS close_notify
+}
+
+func startMockPostgres(behavior mockBehavior) (*mockPostgres, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	m := &mockPostgres{ln: ln, behavior: behavior, terminated: make(chan time.Duration, 16)}
+	if behavior.tls {
+		if m.tlsConfig, err = mockTLSConfig(); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m, nil
+}
+
+func (m *mockPostgres) connStr() string {
+	sslmode := "disable"
+	if m.tlsConfig != nil {
+		sslmode = "require"
+	}
+	return fmt.Sprintf("postgres://mock@%s/mock?sslmode=%s", m.ln.Addr(), sslmode)
+}
+
+// mockTLSConfig makes a throwaway self-signed certificate, which
+// sslmode=require accepts without verifying
+func mockTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pg-idle-test mock"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, nil
+}
+
+func (m *mockPostgres) close() { m.ln.Close() }
+
+// mockPortal is a bound statement with the result formats the client asked for
+type mockPortal struct {
+	query   string
+	formats []int16
+}
+
+// errMockClosed ends a session the fault closed mid-message
+var errMockClosed = errors.New("mock session closed by a fault")
+
+// mockSession is the state of one client connection
+type mockSession struct {
+	m        *mockPostgres
+	raw      net.Conn // the TCP connection, under TLS when the client asked
+	conn     net.Conn
+	b        *pgproto3.Backend
+	pid      uint32
+	txStatus byte
+
+	// set by the server's first statement for the ReadyForQuery that ends it
+	extraReady, closeAfterReady bool
+}
+
+func (m *mockPostgres) serve(raw net.Conn) {
+	defer raw.Close()
+	s := &mockSession{m: m, raw: raw, conn: raw, txStatus: 'I'}
+	s.b = pgproto3.NewBackend(raw, raw)
+	for {
+		msg, err := s.b.ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(*pgproto3.StartupMessage); ok {
+			break
+		}
+		if _, ok := msg.(*pgproto3.CancelRequest); ok {
+			m.cancels.Add(1)
+			return
+		}
+		if _, ok := msg.(*pgproto3.SSLRequest); ok && m.tlsConfig != nil {
+			if _, err := raw.Write([]byte("S")); err != nil {
+				return
+			}
+			s.conn = tls.Server(raw, m.tlsConfig)
+			s.b = pgproto3.NewBackend(s.conn, s.conn)
+			continue
+		}
+		// GSSEncRequest, or SSLRequest without TLS: refused, the client goes on in plaintext
+		if _, err := raw.Write([]byte("N")); err != nil {
+			return
+		}
+	}
+	b := s.b
+	s.pid = uint32(mockBackendPIDs + m.sessions.Add(1))
+	b.Send(&pgproto3.AuthenticationOk{})
+	if m.behavior.dropAfterAuth {
+		b.Flush()
+		return
+	}
+	for _, p := range [][2]string{{"server_version", "16.0"}, {"server_encoding", "UTF8"}, {"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"}, {"TimeZone", "UTC"}, {"integer_datetimes", "on"}, {"standard_conforming_strings", "on"}} {
+		b.Send(&pgproto3.ParameterStatus{Name: p[0], Value: p[1]})
+	}
+	b.Send(&pgproto3.BackendKeyData{ProcessID: s.pid})
+	b.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if b.Flush() != nil {
+		return
+	}
+
+	statements := map[string]string{}
+	portals := map[string]mockPortal{}
+	for {
+		msg, err := b.Receive()
+		if err != nil {
+			return
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.Parse:
+			statements[msg.Name] = msg.Query
+			b.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Describe:
+			if msg.ObjectType == 'S' {
+				query := statements[msg.Name]
+				b.Send(&pgproto3.ParameterDescription{ParameterOIDs: mockParamOIDs(query)})
+				s.describe(query, nil)
+			} else {
+				p := portals[msg.Name]
+				s.describe(p.query, p.formats)
+			}
+		case *pgproto3.Bind:
+			portals[msg.DestinationPortal] = mockPortal{query: statements[msg.PreparedStatement], formats: append([]int16(nil), msg.ResultFormatCodes...)}
+			b.Send(&pgproto3.BindComplete{})
+		case *pgproto3.Execute:
+			p := portals[msg.Portal]
+			err = s.execute(p.query, p.formats)
+		case *pgproto3.Close:
+			b.Send(&pgproto3.CloseComplete{})
+		case *pgproto3.Sync:
+			err = s.ready()
+		case *pgproto3.Flush:
+			err = b.Flush()
+		case *pgproto3.Query:
+			empty := true
+			for _, query := range strings.Split(msg.String, ";") {
+				if mockCommand(query) == "" {
+					continue
+				}
+				empty = false
+				s.describe(query, nil)
+				if err = s.execute(query, nil); err != nil {
+					break
+				}
+			}
+			if empty {
+				b.Send(&pgproto3.EmptyQueryResponse{})
+			}
+			if err == nil {
+				err = s.ready()
+			}
+		case *pgproto3.Terminate:
+			if m.behavior.holdAfterTerminate {
+				at := time.Now()
+				for err == nil {
+					_, err = b.Receive()
+				}
+				select {
+				case m.terminated <- time.Since(at):
+				default:
+				}
+			}
+			return
+		default:
+			b.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "0A000", Message: fmt.Sprintf("mock server does not support %T", msg)})
+			err = b.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ready ends a statement's results with ReadyForQuery, which readyDelay
+// holds back after the rest has reached the client, and applies the faults
+// the server's first statement left for it
+func (s *mockSession) ready() error {
+	b := s.b
+	if s.m.behavior.readyDelay > 0 {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		time.Sleep(s.m.behavior.readyDelay)
+	}
+	b.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+	if s.extraReady {
+		s.extraReady = false
+		b.Send(&pgproto3.ReadyForQuery{TxStatus: s.txStatus})
+	}
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	if s.closeAfterReady {
+		// Straight on the TCP connection: no ErrorResponse, no TLS close_notify
+		s.raw.Close()
+		return errMockClosed
+	}
+	return nil
+}
+
+// describe sends the row description of a statement, or NoData
+func (s *mockSession) describe(query string, formats []int16) {
+	if !mockReturnsRows(query) {
+		s.b.Send(&pgproto3.NoData{})
+		return
+	}
+	format := int16(0)
+	if len(formats) > 0 {
+		format = formats[0]
+	}
+	s.b.Send(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+		{Name: []byte("?column?"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1, Format: format},
+	}})
+}
+
+// execute sends the statement's row, if any, and its command tag, and
+// updates the transaction status. The value of a row is the session's PID
+// for pg_backend_pid(), the literal of SELECT <integer> and otherwise 1.
+func (s *mockSession) execute(query string, formats []int16) error {
+	b, behavior := s.b, s.m.behavior
+	first := s.m.statements.Add(1) == 1
+	if first {
+		for i := 0; i < behavior.noticeFlood; i++ {
+			b.Send(&pgproto3.NoticeResponse{Severity: "NOTICE", Code: "00000", Message: fmt.Sprintf("mock notice %d of %d", i+1, behavior.noticeFlood)})
+		}
+		s.extraReady = behavior.duplicateReady
+		s.closeAfterReady = behavior.closeAfterFirst
+	}
+	command := mockCommand(query)
+	if mockReturnsRows(query) {
+		value := uint32(1)
+		if strings.Contains(query, "pg_backend_pid()") {
+			value = s.pid
+		} else if words := strings.Fields(query); len(words) == 2 && command == "SELECT" {
+			if n, err := strconv.ParseUint(words[1], 10, 31); err == nil {
+				value = uint32(n)
+			}
+		}
+		text := []byte(fmt.Sprint(value))
+		if len(formats) > 0 && formats[0] == 1 {
+			text = binary.BigEndian.AppendUint32(nil, value)
+		}
+		row := &pgproto3.DataRow{Values: [][]byte{text}}
+		if first && behavior.truncateDataRow {
+			if err := b.Flush(); err != nil {
+				return err
+			}
+			msg := row.Encode(nil)
+			s.conn.Write(msg[:len(msg)-2])
+			return errMockClosed
+		}
+		b.Send(row)
+	}
+	tag := command
+	switch command {
+	case "SELECT", "UPDATE", "DELETE":
+		tag += " 1"
+	case "INSERT":
+		tag += " 0 1"
+	case "BEGIN", "START":
+		s.txStatus = 'T'
+	case "COMMIT", "ROLLBACK", "END", "ABORT":
+		s.txStatus = 'I'
+	}
+	b.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+	return nil
+}
+
+// mockCommand is the first keyword of query, after comments, upper case
+func mockCommand(query string) string {
+	for {
+		query = strings.TrimSpace(query)
+		switch {
+		case strings.HasPrefix(query, "/*"):
+			if _, rest, ok := strings.Cut(query, "*/"); ok {
+				query = rest
+				continue
+			}
+			return ""
+		case strings.HasPrefix(query, "--"):
+			_, query, _ = strings.Cut(query, "\n")
+			continue
+		}
+		if words := strings.Fields(query); len(words) > 0 {
+			return strings.ToUpper(words[0])
+		}
+		return ""
+	}
+}
+
+func mockReturnsRows(query string) bool {
+	return mockCommand(query) == "SELECT" || strings.Contains(strings.ToUpper(query), " RETURNING ")
+}
+
+// mockParamOIDs declares every $n placeholder of query bigint
+func mockParamOIDs(query string) []uint32 {
+	oids := make([]uint32, mockParams(query))
+	for i := range oids {
+		oids[i] = 20
+	}
+	return oids
+}
+
+// mockParams is the highest $n placeholder in query
+func mockParams(query string) int {
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '$' {
+			continue
+		}
+		k := 0
+		for i++; i < len(query) && query[i] >= '0' && query[i] <= '9'; i++ {
+			k = k*10 + int(query[i]-'0')
+		}
+		n = max(n, k)
+	}
+	return n
+}
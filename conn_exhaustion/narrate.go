@@ -0,0 +1,113 @@
+// Narrated output for demos: plain-language explanations between the metrics.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// narrating is set by -narrate
+var narrating bool
+
+// narrate prints an explanation in line with the POOL_STATS and ERROR output
+func narrate(format string, args ...any) {
+	if !narrating {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[%s] NARRATE: %s\n", time.Now().Format("04:05"), fmt.Sprintf(format, args...))
+}
+
+var phaseNarration = map[string]string{
+	"warmup":            "Workers are running against a healthy pool: each checks out a connection, runs a short statement and returns it.",
+	"warmup:cold":       "Shared buffers were evicted, so the first statements read from disk; compare this phase with warmup:warm.",
+	"warmup:warm":       "The test relations are in shared buffers; latency here is the warm-cache baseline for the fault phases.",
+	"poison":            "The locking transaction's connection went back to the pool while still open. Whichever worker checks it out next inherits the transaction, and every other worker queues on the row lock.",
+	"planflip:off":      "Index scans are now disabled on every session, so the same statements switch to sequential scans; watch the watchdog attribute the slowdown to a plan change.",
+	"planflip:restored": "Planner settings are back to their defaults; plans and latency should recover.",
+	"portchurn:churn":   "Connections are closed after every statement, so each one leaves a socket in TIME_WAIT on the client until the ephemeral port range runs out.",
+	"portchurn:reuse":   "The same load with pooled connections reused; TIME_WAIT should stop growing.",
+}
+
+// narratePhase explains a phase change, if there is anything to say about it
+func narratePhase(name string) {
+	if text, ok := phaseNarration[name]; ok {
+		narrate("%s", text)
+	}
+}
+
+var errorNarration = map[string]string{
+	"admission_timeout": "a worker gave up waiting at the admission semaphore before it even asked the pool for a connection",
+	"dial_failure":      "the pool tried to open a new connection and the dial failed",
+	"server_fatal":      "the server terminated a session, for example idle_in_transaction_session_timeout ending the lock holder",
+	"cancel":            "a statement ran past its deadline and the driver cancelled it on the server",
+	"lock_timeout":      "lock_timeout ended a statement waiting for the row lock",
+	"constraint":        "a write violated a constraint, typically a retry re-applying a write that had already committed",
+	"broken_conn":       "a pooled connection turned out to be dead when a worker used it",
+}
+
+// setNarrationDeadline adds the explanations which quote the workers'
+// iteration deadline, -query-timeout
+func setNarrationDeadline(timeout time.Duration, adaptive bool) {
+	deadline := fmt.Sprintf("%v", timeout)
+	if adaptive {
+		deadline = fmt.Sprintf("adaptive (from %v)", timeout)
+	}
+	phaseNarration["sleep"] = fmt.Sprintf("The locking session stays idle in transaction outside the pool. Workers queue on its row lock until their %s context deadline cancels them.", deadline)
+	errorNarration["pool_wait_timeout"] = fmt.Sprintf("a worker gave up waiting for a free pool connection: every connection is checked out and none came back within the %s deadline", deadline)
+}
+
+var narratedErrors sync.Map
+
+// narrateError explains the first error of each class
+func narrateError(class string) {
+	if _, seen := narratedErrors.LoadOrStore(class, true); seen {
+		return
+	}
+	if text, ok := errorNarration[class]; ok {
+		narrate("First %s error: %s.", class, text)
+	}
+}
+
+// poolNarrator explains pool state transitions seen by the monitor
+type poolNarrator struct {
+	exhausted bool
+}
+
+func (n *poolNarrator) observe(stats sql.DBStats, waitsDelta float64) {
+	if !narrating {
+		return
+	}
+	full := stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections
+	switch {
+	case full && waitsDelta > 0 && !n.exhausted:
+		n.exhausted = true
+		pid, state, secs := lockHolder()
+		if pid == 0 {
+			narrate("Pool now exhausted: all %d connections are in use and %.1f checkouts a second had to wait.",
+				stats.InUse, waitsDelta)
+			return
+		}
+		narrate("Pool now exhausted: all %d connections are in use and %.1f checkouts a second had to wait, because PID %d (%s, transaction open %.0fs) holds the row lock the workers need.",
+			stats.InUse, waitsDelta, pid, state, secs)
+	case !full && waitsDelta == 0 && n.exhausted:
+		n.exhausted = false
+		narrate("Pool recovered: %d of %d connections in use and no checkout had to wait.", stats.InUse, stats.MaxOpenConnections)
+	}
+}
+
+// lockHolder finds the session blocking other sessions in this database
+func lockHolder() (pid int, state string, secs float64) {
+	if statsDB == nil {
+		return 0, "", 0
+	}
+	statsDB.QueryRow(`
+		SELECT pid, COALESCE(state, ''), COALESCE(EXTRACT(epoch FROM now() - xact_start), 0)
+		FROM pg_stat_activity
+		WHERE pid IN (SELECT unnest(pg_blocking_pids(pid)) FROM pg_stat_activity WHERE datname = current_database())
+		ORDER BY xact_start
+		LIMIT 1`).Scan(&pid, &state, &secs)
+	return pid, state, secs
+}
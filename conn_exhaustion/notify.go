@@ -0,0 +1,64 @@
+// Webhook notifications when an unattended run trips an assertion or stalls.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// notifier posts to a Slack incoming webhook ({"text": ...}) or, with the
+// json format, a generic webhook receiving the fields of notification
+type notifier struct {
+	url       string
+	format    string // slack or json
+	reportURL string
+	mode      string
+	client    *http.Client
+}
+
+type notification struct {
+	Event     string `json:"event"` // stall or failure
+	Mode      string `json:"mode"`
+	Text      string `json:"text"`
+	ReportURL string `json:"report_url,omitempty"`
+	Time      string `json:"time"`
+}
+
+var notifyFormats = []string{"slack", "json"}
+
+// notify is nil unless -notify-webhook was given
+var notify *notifier
+
+func newNotifier(url, format, reportURL, mode string) *notifier {
+	return &notifier{url: url, format: format, reportURL: reportURL, mode: mode, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// send posts one notification; failures are reported but never fail the run
+func (n *notifier) send(event, text string) {
+	if n == nil {
+		return
+	}
+	msg := notification{Event: event, Mode: n.mode, Text: text, ReportURL: n.reportURL, Time: time.Now().UTC().Format(time.RFC3339)}
+	var body any = msg
+	if n.format == "slack" {
+		slack := fmt.Sprintf("*pg-idle-test %s: %s*\n%s", n.mode, event, text)
+		if n.reportURL != "" {
+			slack += fmt.Sprintf("\n<%s|Full report>", n.reportURL)
+		}
+		body = map[string]string{"text": slack}
+	}
+	payload, _ := json.Marshal(body)
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Notification failed: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(os.Stderr, "ERROR: Notification failed: webhook returned %s\n", resp.Status)
+	}
+}
@@ -0,0 +1,239 @@
+// Command line options shared by every scenario.
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+)
+
+// options holds the flag values. Flags named after a scenario in their help
+// only matter to that scenario; the rest apply to every run under the worker
+// harness. Settings read by openDB (close strategy, acquire check, session
+// reset, silent drop) stay package variables bound to their flags.
+type options struct {
+	connStr string
+	mode    string
+
+	workload string
+	wl       workloadOptions
+
+	slowQuery      time.Duration
+	explainAnalyze bool
+	cacheMode      string
+	keepalive      time.Duration
+	controlTable   string
+	controlChannel string
+	agent          string
+	agents         int
+	httpAddr       string
+	errorLog       string
+	csvPath        string
+
+	phases             phaseFlags
+	gucScope           string
+	idleTxTimeout      time.Duration
+	phaseDuration      time.Duration
+	latencyProfileSpec string
+	profiles           []latencyProfile // parsed from latencyProfileSpec
+
+	stormConns        int
+	stormRate         float64
+	stormHold         time.Duration
+	churnGoroutines   int
+	acquireIterations int
+	idleCloseTimeout  time.Duration
+	misuse            string
+	crashWait         time.Duration
+	connCheckQuery    time.Duration
+	cancelClients     int
+	cancelDuration    time.Duration
+	longSQLIDs        int
+	longSQLComment    int
+	longSQLIterations int
+	prepStatements    int
+	rotateStatements  string
+	walStreams        int
+	logicalStalls     string
+	logicalKinds      []string // parsed from logicalStalls
+	logicalStall      time.Duration
+	closeConns        int
+	drainTimeout      time.Duration
+	standbyURL        string
+	backpressureRate  int
+	backpressureQueue int
+	promoteCmd        string
+	deployInstances   int
+	deployOverlap     time.Duration
+	poolSize          int
+	instanceName      string
+
+	seed       int64
+	fuzzWindow time.Duration
+	fuzzInject string
+	fuzzKinds  []string // parsed from fuzzInject
+
+	compose     string
+	composition []composedFault // parsed from compose
+
+	serverlessInvocations int
+	serverlessConcurrency int
+
+	stmtCacheModes string
+
+	idleConns        int
+	instancePrice    float64
+	instanceVCPUs    float64
+	instanceMemoryGB float64
+
+	// Worker harness
+	workers          int
+	maxOpen          int
+	maxIdle          int
+	queryTimeout     time.Duration
+	warmup           time.Duration
+	hold             time.Duration
+	admission        int
+	adaptiveTimeout  bool
+	deadlineAudit    time.Duration
+	dnsLatency       time.Duration
+	cpuBurners       int
+	latencyInterval  time.Duration
+	sloSpec          string
+	gucAudit         time.Duration
+	gucAuditSettings string
+	activityStats    bool
+	blockingInterval time.Duration
+	orphanDetect     bool
+	waitSample       time.Duration
+	poisonAudit      time.Duration
+	killBlockerAfter time.Duration
+	calibrate        bool
+
+	expectDiagnosis string
+	expectInvariant string
+
+	configPath      string
+	writeConfigPath string
+
+	preflight     bool
+	preflightOnly bool
+	summaryPath   string
+	alertRules    string
+	notifyWebhook string
+	notifyFormat  string
+	reportURL     string
+}
+
+// defineFlags registers every flag on fs and returns the options they fill in
+func defineFlags(fs *flag.FlagSet) *options {
+	o := &options{}
+	fs.StringVar(&o.workload, "workload", "counter", "workload preset: "+workloadNames())
+	fs.IntVar(&o.wl.docSize, "doc-size", 8192, "approximate JSONB document size in bytes (jsonb workload)")
+	fs.IntVar(&o.wl.schema.rows, "rows", 1, "rows in test_row (counter workload)")
+	fs.IntVar(&o.wl.schema.columns, "columns", 0, "extra TEXT columns in test_row (counter workload)")
+	fs.IntVar(&o.wl.schema.indexes, "indexes", 0, "secondary indexes on test_row, val first (counter workload)")
+	fs.IntVar(&o.wl.schema.fillfactor, "fillfactor", 100, "test_row fillfactor (counter workload)")
+	fs.IntVar(&o.wl.retries, "retries", 3, "retries per failed write (naive-retry and idempotent workloads)")
+	fs.BoolVar(&o.wl.deferrable, "deferrable", false, "use SERIALIZABLE READ ONLY DEFERRABLE transactions (readonly workload)")
+	fs.IntVar(&o.wl.serialRetries, "serialization-retries", 0, "retries of a transaction failed with 40001 or 40P01 (serializable workload)")
+	fs.DurationVar(&o.wl.serialBackoff, "serialization-backoff", 0, "base of the full jitter backoff doubling per retry, 0 to retry at once (serializable workload)")
+	fs.IntVar(&o.workers, "workers", 20, "worker goroutines running the workload")
+	fs.IntVar(&o.maxOpen, "max-open", 10, "SetMaxOpenConns of the worker pool")
+	fs.IntVar(&o.maxIdle, "max-idle", 10, "SetMaxIdleConns of the worker pool")
+	fs.DurationVar(&o.queryTimeout, "query-timeout", 500*time.Millisecond, "deadline of each workload iteration")
+	fs.BoolVar(&o.adaptiveTimeout, "adaptive-timeout", false, "derive each iteration's deadline from 3x the rolling p99 of committed iterations, starting from -query-timeout")
+	fs.DurationVar(&o.deadlineAudit, "deadline-audit", 0, "record the deadline left at admission, checkout and execute and flag statements reaching a layer with less than this left (0 disables)")
+	fs.DurationVar(&o.gucAudit, "guc-audit", 0, "check the -guc-audit-settings of every idle pooled connection this often and report drift from a fresh connection (0 disables)")
+	fs.StringVar(&o.gucAuditSettings, "guc-audit-settings", "TimeZone,DateStyle,search_path,statement_timeout", "comma-separated session settings checked by -guc-audit")
+	fs.DurationVar(&o.dnsLatency, "dns-latency", 300*time.Millisecond, "host lookup delay of new connections during the dns faults of poisondns")
+	fs.IntVar(&o.cpuBurners, "cpu-burners", 16, "server backends spinning on CPU during the hold of cpuburn")
+	fs.BoolVar(&o.activityStats, "activity-stats", false, "sample pg_stat_activity of the database every second on a dedicated connection: sessions by state, oldest transaction, longest lock wait")
+	fs.DurationVar(&o.blockingInterval, "blocking-interval", 0, "print the tree of backends blocked by others from pg_blocking_pids this often when it changed, e.g. 5s (0 disables)")
+	fs.BoolVar(&o.orphanDetect, "orphans", false, "poll pg_stat_activity every second on a dedicated connection for statements still running after the client closed their connection")
+	fs.DurationVar(&o.waitSample, "wait-sample", 0, "sample the wait events of the database's non-idle backends this often and report a breakdown per phase, e.g. 100ms (0 disables)")
+	fs.BoolVar(&o.calibrate, "calibrate", false, "before the run, measure the harness's own cost per iteration against an in-process mock server and include it in the overhead report")
+	fs.DurationVar(&o.poisonAudit, "poison-audit", 0, "look this often for pooled connections idle in a transaction or holding session-level advisory locks, e.g. 2s (0 disables)")
+	fs.DurationVar(&o.killBlockerAfter, "kill-blocker-after", 0, "terminate a session once it has blocked worker statements this long, then report how fast the pool recovered (0 disables)")
+	fs.DurationVar(&o.latencyInterval, "latency-interval", 10*time.Second, "print per-statement latency percentiles of the worker statements this often (0 only reports them at the end)")
+	fs.StringVar(&o.sloSpec, "slo", "", "latency objective to evaluate every phase against, e.g. 99.9%<200ms: error budget used and burn rate per phase")
+	fs.DurationVar(&o.warmup, "warmup", 20*time.Second, "time the workers run before the fault is injected")
+	fs.DurationVar(&o.hold, "hold-duration", 70*time.Second, "how long poison, sleep, planflip, portchurn, walsenders, walstall and cpuburn hold their fault")
+	fs.IntVar(&o.admission, "admission", 0, "admit at most this many concurrent workload iterations, in arrival order, above the worker pool (0 disables)")
+	fs.DurationVar(&o.slowQuery, "slow-query", 0, "capture EXPLAIN for worker statements running longer than this (0 disables)")
+	fs.BoolVar(&o.explainAnalyze, "explain-analyze", false, "capture EXPLAIN (ANALYZE, BUFFERS) inside a rolled-back transaction instead of EXPLAIN")
+	fs.Var(&o.phases, "phase", "gucsweep phase settings, e.g. work_mem=64MB,jit=off (repeatable, one phase each)")
+	fs.DurationVar(&o.idleTxTimeout, "idle-tx-timeout", 5*time.Second, "idletxtimeout: idle_in_transaction_session_timeout to set, at -guc-scope")
+	fs.StringVar(&o.gucScope, "guc-scope", "session", "gucsweep and idletxtimeout scope: session (SET on pooled connections) or server (ALTER SYSTEM, superuser)")
+	fs.DurationVar(&o.phaseDuration, "phase-duration", 20*time.Second, "duration of each gucsweep and rttsweep phase")
+	fs.StringVar(&o.latencyProfileSpec, "latency-profiles", latencyProfileNames(), "rttsweep phases, in order")
+	fs.StringVar(&o.cacheMode, "cache", "asis", "shared buffers before the workers start: asis, cold (pg_buffercache_evict, PG17+) or warm (pg_prewarm)")
+	fs.IntVar(&o.stormConns, "storm-conns", 2000, "connections to open (connstorm)")
+	fs.Float64Var(&o.stormRate, "storm-rate", 0, "connections opened per second, 0 for no limit (connstorm)")
+	fs.DurationVar(&o.stormHold, "storm-hold", 10*time.Second, "how long to hold the connections once open (connstorm)")
+	fs.IntVar(&o.serverlessInvocations, "serverless-invocations", 500, "short-lived invocations run per mode (serverless)")
+	fs.IntVar(&o.serverlessConcurrency, "serverless-concurrency", 50, "invocations running at once (serverless)")
+	fs.IntVar(&o.churnGoroutines, "churn-goroutines", 50, "goroutines reconnecting for every statement (portchurn)")
+	fs.StringVar(&closeStrategy, "close-strategy", "graceful", "how pooled connections are closed: "+strings.Join(closeStrategies, "|"))
+	fs.StringVar(&acquireCheck, "acquire-check", "none", "validation when an idle pooled connection is handed out: "+strings.Join(acquireChecks, "|"))
+	fs.StringVar(&outputFormat, "output", "text", "format of the pool stats, worker error and event stream on stderr: "+strings.Join(outputFormats, "|"))
+	fs.StringVar(&sqlDriver, "driver", "pgx", "database/sql driver of the worker pool and canceldriver: "+strings.Join(sqlDrivers, "|")+" (libpq needs -tags libpq)")
+	fs.IntVar(&o.acquireIterations, "acquire-iterations", 2000, "checkouts timed per strategy (acquirecompare, resetcompare)")
+	fs.StringVar(&sessionReset, "session-reset", "none", "reset run when a used pooled connection is handed out: "+strings.Join(sessionResetOrder, "|"))
+	fs.DurationVar(&o.keepalive, "keepalive", 0, "ping idle pooled connections at this interval (0 disables)")
+	fs.DurationVar(&silentDropAfter, "silent-drop", 0, "simulate a NAT silently dropping connections idle this long (0 disables; keepalivecompare defaults to 5s)")
+	fs.DurationVar(&o.idleCloseTimeout, "idle-close-timeout", 2*time.Second, "idle_session_timeout set on the pooled sessions (idleclose)")
+	fs.StringVar(&o.misuse, "misuse", "all", "anti-pattern to demonstrate (misuse): all|"+strings.Join(misuseNames(), "|"))
+	fs.DurationVar(&o.crashWait, "crash-wait", 20*time.Second, "how long to wait for the server to release a dead holder's lock (crashlock)")
+	fs.DurationVar(&o.connCheckQuery, "conncheck-query", 15*time.Second, "how long each abandoned query runs (conncheck)")
+	fs.IntVar(&o.cancelClients, "cancel-clients", 20, "victim and canceller goroutines each (cancelstress)")
+	fs.DurationVar(&o.cancelDuration, "cancel-duration", 30*time.Second, "how long to send cancel requests (cancelstress)")
+	fs.IntVar(&o.longSQLIDs, "longsql-ids", 10000, "IN list and array length (longsql)")
+	fs.IntVar(&o.longSQLComment, "longsql-comment", 64*1024, "comment size in bytes (longsql)")
+	fs.IntVar(&o.longSQLIterations, "longsql-iterations", 200, "statements per variant (longsql)")
+	fs.IntVar(&o.prepStatements, "prep-statements", 5000, "distinct statement texts per exec mode (prepchurn)")
+	fs.StringVar(&o.stmtCacheModes, "stmtcache-modes", "cache_statement,cache_describe,exec", "pgx exec modes run in order (stmtcache)")
+	fs.StringVar(&o.rotateStatements, "rotate-statements", builtinPrefix+"rotate_example.sql", "file of ';'-terminated statements run pinned and rotated (rotate)")
+	fs.IntVar(&o.walStreams, "wal-streams", 0, "replication streams to open, 0 for max_wal_senders+2 (walsenders)")
+	fs.StringVar(&o.logicalStalls, "logical-stalls", strings.Join(logicalStalls, ","), "consumer stalls, in order (logicalstall)")
+	fs.DurationVar(&o.logicalStall, "logical-stall", 20*time.Second, "how long each consumer stall lasts (logicalstall)")
+	fs.IntVar(&o.idleConns, "idle-conns", 200, "idle sessions opened in four steps (idlescale)")
+	fs.Float64Var(&o.instancePrice, "instance-price", 0.25, "price in dollars per hour of the database instance (idlescale cost model)")
+	fs.Float64Var(&o.instanceVCPUs, "instance-vcpus", 2, "vCPUs of the database instance (idlescale cost model)")
+	fs.Float64Var(&o.instanceMemoryGB, "instance-memory-gb", 16, "memory in GB of the database instance (idlescale cost model)")
+	fs.IntVar(&o.closeConns, "close-conns", 20, "sessions per close strategy (closecompare)")
+	fs.DurationVar(&o.drainTimeout, "drain-timeout", 150*time.Millisecond, "drain deadline for the deadline strategy (shutdown)")
+	fs.StringVar(&o.standbyURL, "standby-url", "", "connection string of the standby of DATABASE_URL to promote (promote)")
+	fs.StringVar(&o.promoteCmd, "promote-cmd", "", "shell command promoting the standby instead of pg_promote(), e.g. pg_ctl promote (promote)")
+	fs.IntVar(&o.backpressureRate, "backpressure-rate", 200, "requests offered per second (backpressure)")
+	fs.IntVar(&o.backpressureQueue, "backpressure-queue", 50, "queue depth of the fixed worker pool (backpressure)")
+	fs.IntVar(&o.deployInstances, "deploy-instances", 3, "application instances replaced one at a time (rollingdeploy)")
+	fs.DurationVar(&o.deployOverlap, "deploy-overlap", 5*time.Second, "how long old and new instance run side by side (rollingdeploy)")
+	fs.IntVar(&o.poolSize, "instance-pool", 10, "pool size of each application instance (rollingdeploy)")
+	fs.StringVar(&o.instanceName, "instance-name", "", "internal: name of a rollingdeploy child instance")
+	fs.Int64Var(&o.seed, "seed", 0, "fuzz schedule seed, 0 picks one from the clock (fuzz)")
+	fs.DurationVar(&o.fuzzWindow, "fuzz-window", 40*time.Second, "time over which injections start (fuzz)")
+	fs.StringVar(&o.fuzzInject, "fuzz-inject", strings.Join(fuzzKinds, ","), "injections to compose (fuzz)")
+	fs.StringVar(&o.compose, "compose", "", "faults of compose joined with +, each kind[(duration)][@from[-to]], e.g. 'poison + latency(200ms)@10s-30s + kill-backend@45s'")
+	fs.StringVar(&o.expectDiagnosis, "expect-diagnosis", "", "fail the run unless a stall diagnosis contains this text (fault injection scenarios)")
+	fs.StringVar(&o.expectInvariant, "expect-invariant", "pass", "invariant check result the run expects: "+strings.Join(invariantExpectations, "|"))
+	fs.StringVar(&o.configPath, "config", "", "read the scenario, DSN and settings from this TOML or YAML file; flags given override it")
+	fs.StringVar(&o.writeConfigPath, "write-config", "", "write the run's scenario, DSN and settings to this TOML or YAML file for replay with -config")
+	fs.BoolVar(&o.preflight, "preflight", true, "check privileges, extensions and connection headroom before starting")
+	fs.BoolVar(&o.preflightOnly, "preflight-only", false, "run the preflight checks and exit")
+	fs.BoolVar(&lowOverhead, "low-overhead", false, "sample the pool every 5s and instrument 1 in 10 worker iterations, for small instances or runs on the database host")
+	fs.BoolVar(&narrating, "narrate", false, "interleave plain-language explanations of what is happening with the metrics, for demos")
+	fs.StringVar(&o.summaryPath, "summary", "", "write a Markdown summary of the run to this file (- for stdout)")
+	fs.StringVar(&o.alertRules, "alert-rules", "", "write Prometheus alerting rules with SQL checks for the failure modes the run observed to this file (- for stdout)")
+	fs.StringVar(&o.notifyWebhook, "notify-webhook", "", "post to this webhook when a stall is diagnosed or the run fails")
+	fs.StringVar(&o.notifyFormat, "notify-format", "slack", "webhook payload: "+strings.Join(notifyFormats, "|"))
+	fs.StringVar(&o.reportURL, "report-url", "", "link to the run's report artifact, included in notifications")
+	fs.StringVar(&o.controlTable, "control-table", "", "table whose inserted rows drive the run: 'inject' and 'stop' replace the timeline, other phases label the phase report")
+	fs.StringVar(&o.controlChannel, "control-channel", "", "LISTEN/NOTIFY channel whose notifications drive the run like -control-table rows, shared by the agents of a coordinated run")
+	fs.StringVar(&o.agent, "agent", defaultAgent(), "name of this process on the -control-channel")
+	fs.IntVar(&o.agents, "agents", 0, "with -control-channel, release 'inject' and 'stop' once this many agents wait for them")
+	fs.StringVar(&o.httpAddr, "http-addr", "", "serve introspection endpoints (/inflight, /metrics) on this address, e.g. localhost:6060")
+	fs.StringVar(&o.csvPath, "csv", "", "write the one-second pool samples of the worker pool to this CSV file")
+	fs.StringVar(&o.errorLog, "error-log", "", "write the error chain of every worker failure to this JSON Lines file")
+	return o
+}
@@ -0,0 +1,152 @@
+// Detection of statements still running on the server after the client
+// closed their connection.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// queryTag prefixes every statement sent on openDB connections so that this
+// process's statements can be found in pg_stat_activity
+var queryTag = fmt.Sprintf("/* pg-idle-test client=%d */ ", os.Getpid())
+
+// closedBackends maps the backend PID of every connection the client has
+// closed to when it did. A PID is removed again if a new connection gets it.
+var closedBackends sync.Map // int32 -> time.Time
+
+func (s *sessionConn) Close() error {
+	if pid := s.pid.Load(); pid != 0 {
+		closedBackends.Store(pid, time.Now())
+	}
+	return s.Conn.Close()
+}
+
+// orphan is a backend seen running a tagged statement after its connection closed
+type orphan struct {
+	pid      int32
+	closedAt time.Time
+	lastSeen time.Time
+	query    string
+}
+
+// orphanDetector polls pg_stat_activity once a second from its own connection
+type orphanDetector struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	orphans map[int32]*orphan
+}
+
+// orphans is nil unless -orphans was given and the detector's connection
+// could be opened
+var orphans *orphanDetector
+
+func startOrphanDetector(ctx context.Context, connStr string) *orphanDetector {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return nil
+	}
+	db.SetMaxOpenConns(1)
+	d := &orphanDetector{db: db, orphans: map[int32]*orphan{}}
+	go func() {
+		ticker := time.NewTicker(monitorTick())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			start := time.Now()
+			d.poll()
+			selfOverhead.since("orphan detector", start, 1)
+		}
+	}()
+	return d
+}
+
+func (d *orphanDetector) poll() {
+	rows, err := d.db.Query("SELECT pid, query FROM pg_stat_activity WHERE state = 'active' AND left(query, length($1)) = $1", queryTag)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var pid int32
+		var query string
+		if rows.Scan(&pid, &query) != nil {
+			continue
+		}
+		closed, ok := closedBackends.Load(pid)
+		if !ok {
+			continue
+		}
+		d.mu.Lock()
+		o := d.orphans[pid]
+		if o == nil {
+			o = &orphan{pid: pid, closedAt: closed.(time.Time), query: query[len(queryTag):]}
+			d.orphans[pid] = o
+			fmt.Fprintf(os.Stderr, "[%s] ORPHAN: PID %d still running %.0fs after its connection closed: %s\n",
+				now.Format("04:05"), pid, now.Sub(o.closedAt).Seconds(), oneLine(o.query))
+		}
+		o.lastSeen = now
+		d.mu.Unlock()
+	}
+}
+
+// totals reports the orphaned backends and the server time they spent after
+// their client had gone (to the last poll that still saw them)
+func (d *orphanDetector) totals() (int, time.Duration) {
+	if d == nil {
+		return 0, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var seconds time.Duration
+	for _, o := range d.orphans {
+		seconds += o.lastSeen.Sub(o.closedAt)
+	}
+	return len(d.orphans), seconds
+}
+
+// longest is the most time one orphaned backend was seen running after its
+// client had gone
+func (d *orphanDetector) longest() time.Duration {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var longest time.Duration
+	for _, o := range d.orphans {
+		longest = max(longest, o.lastSeen.Sub(o.closedAt))
+	}
+	return longest
+}
+
+func (d *orphanDetector) print() {
+	if d == nil {
+		return
+	}
+	n, seconds := d.totals()
+	fmt.Println()
+	fmt.Printf(">>> ORPHANED QUERIES: %d backends ran statements for %.1fs in total after the client closed their connection\n", n, seconds.Seconds())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pids := make([]int32, 0, len(d.orphans))
+	for pid := range d.orphans {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	for _, pid := range pids {
+		o := d.orphans[pid]
+		fmt.Printf("    PID %d: %.1fs after close: %s\n", pid, o.lastSeen.Sub(o.closedAt).Seconds(), oneLine(o.query))
+	}
+}
@@ -0,0 +1,43 @@
+// Structured JSON Lines output of the stderr stream for post-processing.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// outputFormats are the values of -output:
+//   - text: the POOL_STATS, ERROR and WARNING lines as they always were
+//   - jsonl: one JSON object per pool stats sample, worker error and scenario
+//     event, each with "ts" and "event" keys
+var outputFormats = []string{"text", "jsonl"}
+
+var outputFormat = "text"
+
+var jsonlMu sync.Mutex
+
+func jsonOutput() bool { return outputFormat == "jsonl" }
+
+// emitJSON writes one event to stderr; fields must not use the keys ts and event
+func emitJSON(event string, fields map[string]any) {
+	body, err := json.Marshal(fields)
+	if err != nil {
+		body = []byte(fmt.Sprintf(`{"marshal_error":%q}`, err.Error()))
+	}
+	head, _ := json.Marshal(struct {
+		TS    string `json:"ts"`
+		Event string `json:"event"`
+	}{serverTime(time.Now()).Format(time.RFC3339Nano), event})
+	line := head[:len(head)-1]
+	if len(body) > 2 {
+		line = append(append(line, ','), body[1:]...)
+	} else {
+		line = append(line, '}')
+	}
+	jsonlMu.Lock()
+	defer jsonlMu.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
@@ -0,0 +1,149 @@
+// Low-overhead monitoring and the harness's measurement of its own cost, for
+// runs on small instances or on the database host itself.
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/metrics"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lowOverhead is set by -low-overhead
+var lowOverhead bool
+
+const (
+	lowOverheadTick  = 5 * time.Second
+	lowOverheadEvery = 10 // one in this many worker iterations is instrumented
+)
+
+// monitorTick is how often the pool monitor and the one-second pollers sample
+func monitorTick() time.Duration {
+	if lowOverhead {
+		return lowOverheadTick
+	}
+	return time.Second
+}
+
+// instrumented reports whether a worker iteration's statements go through the
+// in-flight tracker, checkout attribution, deadline audit, latency histograms
+// and slow-query watchdog, and print their errors. Phase counts and error
+// classes take every iteration either way.
+func instrumented(iteration int) bool {
+	return !lowOverhead || iteration%lowOverheadEvery == 0
+}
+
+// untracked reports a statement of an iteration left out by instrumented
+func untracked(ctx context.Context) bool {
+	tag, ok := ctx.Value(workerKey{}).(*workerTag)
+	return ok && tag.untracked
+}
+
+// monitorCost is what one monitor spent on the client and sent to the server
+type monitorCost struct {
+	ticks      int64
+	statements int64
+	busy       time.Duration
+}
+
+type overheadMeter struct {
+	mu       sync.Mutex
+	monitors map[string]*monitorCost
+
+	instrumented, sampledOut atomic.Int64 // worker iterations
+
+	start    time.Time
+	startCPU cpuTimes
+}
+
+var selfOverhead = &overheadMeter{monitors: map[string]*monitorCost{}}
+
+// since charges one tick of a monitor which started at start and sent
+// statements to the server
+func (m *overheadMeter) since(name string, start time.Time, statements int) {
+	busy := time.Since(start)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.monitors[name]
+	if c == nil {
+		c = &monitorCost{}
+		m.monitors[name] = c
+	}
+	c.ticks++
+	c.statements += int64(statements)
+	c.busy += busy
+}
+
+// iteration counts a worker iteration as instrumented or sampled out
+func (m *overheadMeter) iteration(instrumented bool) {
+	if instrumented {
+		m.instrumented.Add(1)
+	} else {
+		m.sampledOut.Add(1)
+	}
+}
+
+// cpuTimes is the process's CPU time by the runtime's estimate
+type cpuTimes struct {
+	user, gc float64 // seconds
+}
+
+func readCPUTimes() cpuTimes {
+	samples := []metrics.Sample{{Name: "/cpu/classes/user:cpu-seconds"}, {Name: "/cpu/classes/gc/total:cpu-seconds"}}
+	metrics.Read(samples)
+	var t cpuTimes
+	if samples[0].Value.Kind() == metrics.KindFloat64 {
+		t.user = samples[0].Value.Float64()
+	}
+	if samples[1].Value.Kind() == metrics.KindFloat64 {
+		t.gc = samples[1].Value.Float64()
+	}
+	return t
+}
+
+// begin marks the start of the measured run
+func (m *overheadMeter) begin() {
+	m.start, m.startCPU = time.Now(), readCPUTimes()
+}
+
+// print reports the client's CPU over the run and what each monitor cost
+func (m *overheadMeter) print() {
+	wall := time.Since(m.start).Seconds()
+	cpu := readCPUTimes()
+	user, gc := cpu.user-m.startCPU.user, cpu.gc-m.startCPU.gc
+	fmt.Println()
+	mode := "full instrumentation"
+	if lowOverhead {
+		mode = fmt.Sprintf("-low-overhead: %v ticks, 1 in %d iterations instrumented", lowOverheadTick, lowOverheadEvery)
+	}
+	fmt.Printf(">>> HARNESS OVERHEAD (%s)\n", mode)
+	if wall > 0 && user+gc > 0 {
+		fmt.Printf("Client CPU: %.1fs over %.0fs, %.2f cores on average, %.0f%% of it garbage collection\n",
+			user+gc, wall, (user+gc)/wall, 100*gc/(user+gc))
+	}
+	fmt.Printf("Worker iterations: %d instrumented, %d sampled out\n", m.instrumented.Load(), m.sampledOut.Load())
+	if calibrated != nil {
+		latency, cpu := calibrated.overhead()
+		fmt.Printf("Calibrated harness cost per iteration: %+.1fµs on average, %+.1fµs CPU over the bare driver\n",
+			float64(latency.Nanoseconds())/1000, float64(cpu.Nanoseconds())/1000)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.monitors))
+	for name := range m.monitors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Printf("%-22s %7s %11s %10s %10s %12s\n", "Monitor", "Ticks", "Statements", "Busy", "Per tick", "Statements/s")
+	for _, name := range names {
+		c := m.monitors[name]
+		fmt.Printf("%-22s %7d %11d %9.2fs %10s %12.2f\n", name, c.ticks, c.statements, c.busy.Seconds(),
+			ms(c.busy/time.Duration(max(c.ticks, 1))), float64(c.statements)/max(wall, 1))
+	}
+	fmt.Println("Busy is wall time inside each monitor's work, including its round trips; Statements/s is what the monitors")
+	fmt.Println("add to the server's load on top of the workload.")
+}
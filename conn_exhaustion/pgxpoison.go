@@ -0,0 +1,287 @@
+// Scenario: the poison fault against pgxpool next to database/sql, with
+// pgxpool's own Stat counters.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgxPoisonPools are the pools compared:
+//   - database/sql: the stdlib driver behind openDB, as every other mode uses
+//   - pgxpool: pgx's native pool, which destroys a connection released
+//     outside a transaction-idle state and pings connections idle for more
+//     than a second on acquire
+var pgxPoisonPools = []string{"database/sql", "pgxpool"}
+
+const (
+	pgxPoisonSteady = 5 * time.Second
+	pgxPoisonHold   = 15 * time.Second
+)
+
+// poisonPool is the part of a pool the comparison drives
+type poisonPool interface {
+	exec(ctx context.Context, query string, args ...any) error
+	// poison takes the row lock in a transaction and returns the connection
+	// to the pool, reporting the backend that holds it
+	poison(ctx context.Context) (int, error)
+	// fill opens n connections and returns them to the pool idle
+	fill(ctx context.Context, n int)
+	stats() string
+	close()
+}
+
+type sqlPoisonPool struct{ db *sql.DB }
+
+func (p sqlPoisonPool) exec(ctx context.Context, query string, args ...any) error {
+	_, err := p.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (p sqlPoisonPool) poison(ctx context.Context) (int, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var pid int
+	conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+	conn.ExecContext(ctx, "BEGIN")
+	_, err = conn.ExecContext(ctx, "SELECT * FROM test_pgxpoison WHERE id = 1 FOR UPDATE")
+	return pid, err
+}
+
+func (p sqlPoisonPool) fill(ctx context.Context, n int) { fillPool(ctx, p.db, n) }
+
+func (p sqlPoisonPool) stats() string {
+	s := p.db.Stats()
+	return fmt.Sprintf("open=%d in_use=%d idle=%d waits=%d wait=%v max_idle_closed=%d",
+		s.OpenConnections, s.InUse, s.Idle, s.WaitCount, s.WaitDuration.Round(time.Millisecond), s.MaxIdleClosed)
+}
+
+func (p sqlPoisonPool) close() { p.db.Close() }
+
+type pgxPoisonPool struct{ pool *pgxpool.Pool }
+
+func (p pgxPoisonPool) exec(ctx context.Context, query string, args ...any) error {
+	_, err := p.pool.Exec(ctx, query, args...)
+	return err
+}
+
+func (p pgxPoisonPool) poison(ctx context.Context) (int, error) {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	var pid int
+	conn.QueryRow(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+	conn.Exec(ctx, "BEGIN")
+	_, err = conn.Exec(ctx, "SELECT * FROM test_pgxpoison WHERE id = 1 FOR UPDATE")
+	return pid, err
+}
+
+func (p pgxPoisonPool) fill(ctx context.Context, n int) {
+	var conns []*pgxpool.Conn
+	for i := 0; i < n; i++ {
+		if conn, err := p.pool.Acquire(ctx); err == nil {
+			conn.Ping(ctx)
+			conns = append(conns, conn)
+		}
+	}
+	for _, conn := range conns {
+		conn.Release()
+	}
+}
+
+func (p pgxPoisonPool) stats() string {
+	s := p.pool.Stat()
+	return fmt.Sprintf("total=%d acquired=%d idle=%d acquires=%d empty_acquires=%d canceled_acquires=%d new_conns=%d acquire_wait=%v",
+		s.TotalConns(), s.AcquiredConns(), s.IdleConns(), s.AcquireCount(), s.EmptyAcquireCount(), s.CanceledAcquireCount(),
+		s.NewConnsCount(), s.AcquireDuration().Round(time.Millisecond))
+}
+
+func (p pgxPoisonPool) close() { p.pool.Close() }
+
+func openPoisonPool(connStr, kind, appName string, size int) (poisonPool, error) {
+	if kind == "database/sql" {
+		db, err := openDB(connStr, appName)
+		if err != nil {
+			return nil, err
+		}
+		db.SetMaxOpenConns(size)
+		db.SetMaxIdleConns(size)
+		return sqlPoisonPool{db}, nil
+	}
+	cfg, err := pgxpool.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxConns = int32(size)
+	cfg.ConnConfig.RuntimeParams["application_name"] = appName
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return pgxPoisonPool{pool}, nil
+}
+
+type pgxPoisonResult struct {
+	steadyOK, steadyFailed int64
+	poisonOK, poisonFailed int64
+	lockHeld               bool // the poisoning backend was still idle in transaction at the end of the hold
+	deadEarly, deadLate    int  // probe errors after terminating idle sessions, within and after a second of idle
+	stats                  string
+}
+
+func init() {
+	registerScenario("pgxpoison", scenario{
+		standalone: func(o *options) bool {
+			return runPgxPoison(o.connStr, o.workers, o.maxOpen, o.queryTimeout)
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = o.maxOpen + 1 },
+	})
+}
+
+// runPgxPoison runs the poison fault against each pool with the same workers:
+// 5s steady, then 15s after a connection went back to the pool inside a
+// transaction holding the workers' row lock. It then terminates the pool's
+// idle sessions and probes it before and after pgx's one-second idle ping.
+// It passes if pgxpool did not keep the poisoned connection.
+func runPgxPoison(connStr string, workers, size int, timeout time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_pgxpoison")
+	setup.Exec("CREATE TABLE test_pgxpoison (id INT PRIMARY KEY, val BIGINT)")
+	setup.Exec("INSERT INTO test_pgxpoison VALUES (1, 0)")
+
+	results := map[string]pgxPoisonResult{}
+	for _, kind := range pgxPoisonPools {
+		fmt.Printf(">>> PGX POISON: %s, %d workers on %d connections\n", kind, workers, size)
+		r, err := pgxPoisonOnce(connStr, setup, kind, workers, size, timeout)
+		// Never leave a poisoned session behind for the next pool
+		setup.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE application_name LIKE 'pg-idle-test-pgxpoison-%'")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", kind, err)
+			return false
+		}
+		results[kind] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> PGX POISON REPORT")
+	fmt.Printf("%-13s %9s %9s %9s %9s %9s %10s %10s\n", "Pool", "SteadyOK", "SteadyErr", "PoisonOK", "PoisonErr", "LockHeld", "Dead<1s", "Dead>1s")
+	for _, kind := range pgxPoisonPools {
+		r := results[kind]
+		fmt.Printf("%-13s %9d %9d %9d %9d %9v %7d/%d %7d/%d\n", kind, r.steadyOK, r.steadyFailed, r.poisonOK, r.poisonFailed,
+			r.lockHeld, r.deadEarly, acquireProbes, r.deadLate, acquireProbes)
+	}
+	fmt.Println()
+	for _, kind := range pgxPoisonPools {
+		fmt.Printf("%-13s %s\n", kind+":", results[kind].stats)
+	}
+	fmt.Println()
+	fmt.Println("database/sql returns a connection to the pool whatever its transaction state, so the lock stays with an idle")
+	fmt.Println("pooled session; pgxpool's Release destroys a connection not idle outside a transaction, which rolls it back.")
+	fmt.Println("Dead<1s and Dead>1s are probe errors after the idle sessions were terminated, before and after both pools' ping")
+	fmt.Println("of connections idle for more than a second would catch them.")
+	pgx := results["pgxpool"]
+	if pgx.lockHeld {
+		fmt.Println("FAIL: pgxpool kept the poisoned connection")
+		return false
+	}
+	fmt.Println("PASS: pgxpool discarded the poisoned connection")
+	return true
+}
+
+func pgxPoisonOnce(connStr string, setup *sql.DB, kind string, workers, size int, timeout time.Duration) (pgxPoisonResult, error) {
+	var r pgxPoisonResult
+	appName := "pg-idle-test-pgxpoison-" + kind
+	if kind == "database/sql" {
+		appName = "pg-idle-test-pgxpoison-stdlib"
+	}
+	pool, err := openPoisonPool(connStr, kind, appName, size)
+	if err != nil {
+		return r, err
+	}
+	defer pool.close()
+	ctx := context.Background()
+
+	// drive runs the workers against the row for d
+	drive := func(phase string, d time.Duration) (int64, int64) {
+		var ok, failed atomic.Int64
+		deadline := time.Now().Add(d)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					qctx, cancel := context.WithTimeout(ctx, timeout)
+					err := pool.exec(qctx, "UPDATE test_pgxpoison SET val = val + 1 WHERE id = 1")
+					cancel()
+					if err != nil {
+						failed.Add(1)
+						time.Sleep(10 * time.Millisecond)
+					} else {
+						ok.Add(1)
+					}
+				}
+			}()
+		}
+		tick := time.NewTicker(1 * time.Second)
+		for time.Now().Before(deadline) {
+			<-tick.C
+			fmt.Fprintf(os.Stderr, "[%s] PGX_POISON: %s %s ok=%d failed=%d %s\n",
+				time.Now().Format("04:05"), kind, phase, ok.Load(), failed.Load(), pool.stats())
+		}
+		tick.Stop()
+		wg.Wait()
+		return ok.Load(), failed.Load()
+	}
+
+	r.steadyOK, r.steadyFailed = drive("steady", pgxPoisonSteady)
+	pid, err := pool.poison(ctx)
+	if err != nil {
+		return r, err
+	}
+	fmt.Printf(">>> POISON: %s: lock taken by PID %d, connection returned to the pool with the transaction open\n", kind, pid)
+	r.poisonOK, r.poisonFailed = drive("poisoned", pgxPoisonHold)
+	var state sql.NullString
+	setup.QueryRow("SELECT state FROM pg_stat_activity WHERE pid = $1", pid).Scan(&state)
+	r.lockHeld = state.String == "idle in transaction"
+	setup.Exec("SELECT pg_terminate_backend($1)", pid)
+
+	// Dead connections, probed at once and after the idle ping threshold
+	for _, wait := range []time.Duration{100 * time.Millisecond, 1500 * time.Millisecond} {
+		pool.fill(ctx, size)
+		setup.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE application_name = $1", appName)
+		time.Sleep(wait)
+		dead := 0
+		for i := 0; i < acquireProbes; i++ {
+			qctx, cancel := context.WithTimeout(ctx, timeout)
+			if err := pool.exec(qctx, "SELECT 1"); err != nil {
+				dead++
+			}
+			cancel()
+		}
+		if wait < time.Second {
+			r.deadEarly = dead
+		} else {
+			r.deadLate = dead
+		}
+	}
+	r.stats = pool.stats()
+	return r, nil
+}
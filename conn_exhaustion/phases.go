@@ -0,0 +1,139 @@
+// Per-phase workload metrics.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// phaseMetrics collects worker iteration outcomes between two phase changes
+type phaseMetrics struct {
+	name  string
+	start time.Time
+
+	// pg_stat_database block counters at phase start, if statsDB is set
+	blksHit, blksRead int64
+	// time the worker pool's checkouts had waited at phase start
+	waited time.Duration
+
+	mu        sync.Mutex
+	end       time.Time
+	ok        int
+	failed    int
+	sloBad    int // failed or slower than -slo
+	latencies []time.Duration
+}
+
+var (
+	currentPhase atomic.Pointer[phaseMetrics]
+	phaseHistory []*phaseMetrics
+	// phaseMu serializes phase changes, which the control table poller
+	// makes as well
+	phaseMu sync.Mutex
+
+	// statsDB is a side connection used to sample server-side counters per phase
+	statsDB *sql.DB
+)
+
+// startPhase ends the current phase (if any) and starts recording a new one
+func startPhase(name string) {
+	phaseMu.Lock()
+	defer phaseMu.Unlock()
+	p := &phaseMetrics{name: name, start: time.Now(), blksHit: -1}
+	if statsDB != nil {
+		statsDB.QueryRow("SELECT blks_hit, blks_read FROM pg_stat_database WHERE datname = current_database()").Scan(&p.blksHit, &p.blksRead)
+	}
+	if db := metricsPool.Load(); db != nil {
+		p.waited = db.Stats().WaitDuration
+	}
+	if prev := currentPhase.Swap(p); prev != nil {
+		prev.mu.Lock()
+		prev.end = p.start
+		prev.mu.Unlock()
+	}
+	phaseHistory = append(phaseHistory, p)
+	if name != "" {
+		recordEvent("phase %s started", name)
+		narratePhase(name)
+	}
+}
+
+// recordIteration is called by the workers after every workload iteration
+func recordIteration(d time.Duration, err error) {
+	p := currentPhase.Load()
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failed++
+	} else {
+		p.ok++
+	}
+	if slo != nil && (err != nil || d > slo.latency) {
+		p.sloBad++
+	}
+	p.latencies = append(p.latencies, d)
+}
+
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+// phaseRow is one line of the phase report
+type phaseRow struct {
+	name          string
+	secs          float64
+	ok, failed    int
+	sloBad        int
+	p50, p95, max time.Duration
+	hitRatio      string
+	waited        time.Duration // checkouts of the worker pool waiting for a connection
+}
+
+// phaseRows summarizes every finished phase; the current phase must have been
+// closed with startPhase("")
+func phaseRows() []phaseRow {
+	var rows []phaseRow
+	for i, p := range phaseHistory[:len(phaseHistory)-1] {
+		row := phaseRow{name: p.name, hitRatio: "-"}
+		if next := phaseHistory[i+1]; p.blksHit >= 0 && next.blksHit >= 0 {
+			hits, reads := next.blksHit-p.blksHit, next.blksRead-p.blksRead
+			if hits+reads > 0 {
+				row.hitRatio = fmt.Sprintf("%.1f", 100*float64(hits)/float64(hits+reads))
+			}
+		}
+		row.waited = phaseHistory[i+1].waited - p.waited
+		p.mu.Lock()
+		sorted := append([]time.Duration(nil), p.latencies...)
+		row.secs = p.end.Sub(p.start).Seconds()
+		row.ok, row.failed, row.sloBad = p.ok, p.failed, p.sloBad
+		p.mu.Unlock()
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		row.p50, row.p95, row.max = percentile(sorted, 0.5), percentile(sorted, 0.95), percentile(sorted, 1)
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func ms(d time.Duration) string { return fmt.Sprintf("%.1fms", float64(d.Microseconds())/1000) }
+
+// printPhaseReport prints one line per phase so phases can be compared directly
+func printPhaseReport() {
+	startPhase("") // close the last phase
+	fmt.Println()
+	fmt.Println(">>> PHASE REPORT")
+	fmt.Printf("%-40s %8s %8s %8s %10s %10s %10s %8s\n", "Phase", "Secs", "Iter/s", "Errors", "p50", "p95", "max", "Hit%")
+	for _, row := range phaseRows() {
+		fmt.Printf("%-40s %8.0f %8.1f %8d %10s %10s %10s %8s\n", row.name, row.secs, float64(row.ok)/row.secs, row.failed,
+			ms(row.p50), ms(row.p95), ms(row.max), row.hitRatio)
+	}
+}
@@ -0,0 +1,88 @@
+package repro
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Benchmarks run against DATABASE_URL and are skipped without it:
+//
+//	DATABASE_URL=postgres://... go test -run=^$ -bench=. -count=10 ./pkg/repro | tee new.txt
+//	benchstat old.txt new.txt
+
+func benchDSN(b *testing.B) string {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		b.Skip("DATABASE_URL not set")
+	}
+	return dsn
+}
+
+// BenchmarkCheckout measures a database/sql checkout and return of an idle
+// pooled connection under parallel load
+func BenchmarkCheckout(b *testing.B) {
+	db := OpenPool(b, benchDSN(b), 10)
+	ctx := context.Background()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			conn.Close()
+		}
+	})
+}
+
+// BenchmarkCancelLatency measures how long after its deadline a statement
+// waiting on a row lock returns, reported as overshoot-ms/op
+func BenchmarkCancelLatency(b *testing.B) {
+	db := OpenPool(b, benchDSN(b), 2)
+	CreateTable(b, db)
+	BlockRow(b, db, Table, 1)
+	const timeout = 10 * time.Millisecond
+	var overshoot time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		_, err := db.ExecContext(ctx, "UPDATE "+Table+" SET val = val + 1 WHERE id = 1")
+		overshoot += time.Since(start) - timeout
+		cancel()
+		if err == nil {
+			b.Fatal("update succeeded while the row was locked")
+		}
+	}
+	b.ReportMetric(float64(overshoot.Microseconds())/1000/float64(b.N), "overshoot-ms/op")
+}
+
+// BenchmarkConnectTLS measures a new connection including the TLS handshake
+// and startup; it fails if the server falls back to plaintext
+func BenchmarkConnectTLS(b *testing.B) {
+	cfg, err := pgx.ParseConfig(benchDSN(b))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if cfg.TLSConfig == nil {
+		b.Skip("DATABASE_URL has sslmode=disable")
+	}
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := pgx.ConnectConfig(ctx, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, ok := conn.PgConn().Conn().(*tls.Conn); !ok {
+			b.Fatal("server did not negotiate TLS")
+		}
+		conn.Close(ctx)
+	}
+}
@@ -0,0 +1,43 @@
+package repro_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ardentperf/pg-idle-test/conn_exhaustion/pkg/repro"
+)
+
+// A reproduction for cancellation of a statement stuck on a row lock held
+// outside the pool. The examples have no output and are only compiled, since
+// they need a server.
+func Example() {
+	testCancelBlockedUpdate := func(t *testing.T) {
+		db := repro.OpenPool(t, os.Getenv("DATABASE_URL"), 2)
+		repro.CreateTable(t, db)
+		blocker := repro.BlockRow(t, db, repro.Table, 1)
+		defer blocker.Release()
+		repro.ExpectCancelWithin(t, 500*time.Millisecond, 200*time.Millisecond, func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, "UPDATE repro_row SET val = val + 1 WHERE id = 1")
+			return err
+		})
+	}
+	_ = testCancelBlockedUpdate
+}
+
+// A reproduction against a pool poisoned with a connection returned inside an
+// open transaction, ended from outside the pool with Terminate.
+func ExampleStartPoisonedPool() {
+	testPoisonedPool := func(t *testing.T) {
+		dsn := os.Getenv("DATABASE_URL")
+		p := repro.StartPoisonedPool(t, dsn, 2)
+		err := repro.ExpectCancelWithin(t, 500*time.Millisecond, 200*time.Millisecond, func(ctx context.Context) error {
+			_, err := p.DB.ExecContext(ctx, "UPDATE repro_row SET val = val + 1 WHERE id = 1")
+			return err
+		})
+		t.Logf("statement on the poisoned pool: %v", err)
+		repro.Terminate(t, dsn, p.PID)
+	}
+	_ = testPoisonedPool
+}
@@ -0,0 +1,180 @@
+// Package repro provides the building blocks of pg-idle-test as helpers for
+// minimal go test reproductions of pgx and database/sql issues.
+//
+// A reproduction for cancellation of a statement stuck on a row lock is:
+//
+//	func TestCancelBlockedUpdate(t *testing.T) {
+//		db := repro.OpenPool(t, os.Getenv("DATABASE_URL"), 2)
+//		repro.CreateTable(t, db)
+//		repro.BlockRow(t, db, repro.Table, 1)
+//		repro.ExpectCancelWithin(t, 500*time.Millisecond, 200*time.Millisecond, func(ctx context.Context) error {
+//			_, err := db.ExecContext(ctx, "UPDATE repro_row SET val = val + 1 WHERE id = 1")
+//			return err
+//		})
+//	}
+//
+// StartPoisonedPool sets up the pool poisoning this project is about instead,
+// with the lock held by a transaction left open on a pooled connection.
+//
+// All helpers register their cleanup with tb.Cleanup, so sessions holding
+// locks are terminated when the test ends even if it fails.
+package repro
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Table is the table created by StartPoisonedPool and CreateTable
+const Table = "repro_row"
+
+// OpenPool opens a database/sql pool of size connections with the pgx driver
+// and fails the test if the server cannot be reached
+func OpenPool(tb testing.TB, dsn string, size int) *sql.DB {
+	tb.Helper()
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		tb.Fatalf("repro: open: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(size)
+	db.SetMaxIdleConns(size)
+	if err := db.Ping(); err != nil {
+		tb.Fatalf("repro: ping: %v", err)
+	}
+	return db
+}
+
+// CreateTable (re)creates repro_row with a single row id=1, val=0
+func CreateTable(tb testing.TB, db *sql.DB) {
+	tb.Helper()
+	for _, stmt := range []string{
+		"DROP TABLE IF EXISTS " + Table,
+		"CREATE TABLE " + Table + " (id INT PRIMARY KEY, val INT NOT NULL)",
+		"INSERT INTO " + Table + " (id, val) VALUES (1, 0)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			tb.Fatalf("repro: %s: %v", stmt, err)
+		}
+	}
+}
+
+// Blocker is a session holding a row lock in an open transaction
+type Blocker struct {
+	// PID is the backend PID of the session holding the lock
+	PID int
+
+	once    sync.Once
+	release func()
+}
+
+// Release ends the blocking transaction. It is safe to call more than once.
+func (b *Blocker) Release() {
+	b.once.Do(b.release)
+}
+
+// BlockRow locks row id of table in an open transaction on a connection
+// checked out of db and kept out of the pool, like the sleep mode of
+// pg-idle-test. The transaction is rolled back by Release or at test cleanup.
+func BlockRow(tb testing.TB, db *sql.DB, table string, id int) *Blocker {
+	tb.Helper()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		tb.Fatalf("repro: checkout: %v", err)
+	}
+	b := &Blocker{PID: lockRow(tb, conn, table, id)}
+	b.release = func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+	}
+	tb.Cleanup(b.Release)
+	return b
+}
+
+// PoisonedPool is a pool with one connection returned inside an open
+// transaction which holds the lock on repro_row id=1
+type PoisonedPool struct {
+	DB *sql.DB
+	*Blocker
+}
+
+// StartPoisonedPool opens a pool of size connections, creates repro_row and
+// poisons it like the poison mode of pg-idle-test: a connection takes the row
+// lock inside BEGIN and goes back to the pool without COMMIT or ROLLBACK. The
+// next checkout of that connection runs inside the open transaction, and every
+// other statement on the row waits for the lock. Release terminates the
+// poisoned session from a separate connection, since the pool itself may be
+// exhausted by then.
+func StartPoisonedPool(tb testing.TB, dsn string, size int) *PoisonedPool {
+	tb.Helper()
+	db := OpenPool(tb, dsn, size)
+	CreateTable(tb, db)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		tb.Fatalf("repro: checkout: %v", err)
+	}
+	b := &Blocker{PID: lockRow(tb, conn, Table, 1)}
+	conn.Close() // back to the pool with the transaction open
+	b.release = func() { Terminate(tb, dsn, b.PID) }
+	tb.Cleanup(b.Release)
+	return &PoisonedPool{DB: db, Blocker: b}
+}
+
+// Terminate ends backend pid with pg_terminate_backend from a new connection
+func Terminate(tb testing.TB, dsn string, pid int) {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		tb.Errorf("repro: open: %v", err)
+		return
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, "SELECT pg_terminate_backend($1)", pid); err != nil {
+		tb.Errorf("repro: terminate PID %d: %v", pid, err)
+	}
+}
+
+// lockRow takes the row lock inside BEGIN and returns the backend PID
+func lockRow(tb testing.TB, conn *sql.Conn, table string, id int) int {
+	tb.Helper()
+	ctx := context.Background()
+	var pid int
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		tb.Fatalf("repro: pg_backend_pid: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		tb.Fatalf("repro: BEGIN: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT 1 FROM "+table+" WHERE id = $1 FOR UPDATE", id); err != nil {
+		tb.Fatalf("repro: lock %s id=%d: %v", table, id, err)
+	}
+	return pid
+}
+
+// ExpectCancelWithin runs fn with a context which expires after timeout and
+// fails the test unless fn returns an error no later than grace after the
+// deadline. A statement that waits on a lock past its deadline, for example
+// because cancellation never reached the server, fails here. The error
+// returned by fn is returned for further checks.
+func ExpectCancelWithin(tb testing.TB, timeout, grace time.Duration, fn func(ctx context.Context) error) error {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	err := fn(ctx)
+	elapsed := time.Since(start)
+	switch {
+	case err == nil:
+		tb.Errorf("repro: expected cancellation after %v, statement succeeded in %v", timeout, elapsed)
+	case elapsed > timeout+grace:
+		tb.Errorf("repro: cancellation took %v, want at most %v (%v deadline + %v grace): %v", elapsed, timeout+grace, timeout, grace, err)
+	}
+	return err
+}
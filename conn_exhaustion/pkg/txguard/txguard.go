@@ -0,0 +1,75 @@
+// Package txguard runs transactions on a database/sql connection so that the
+// connection can never go back to the pool inside a transaction.
+//
+// Code which runs BEGIN on a *sql.Conn and returns early when its context is
+// canceled between statements leaves the transaction open: database/sql
+// fails the next statement with the context error before it reaches the
+// server, and Close returns the connection to the pool still holding the
+// transaction's locks. WithTx always ends the transaction, using a fresh
+// context for the ROLLBACK, and discards the connection if it cannot.
+package txguard
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RollbackTimeout bounds the ROLLBACK issued after the caller's context ended
+var RollbackTimeout = 5 * time.Second
+
+// WithTx checks a connection out of db, runs fn inside BEGIN/COMMIT and
+// returns the connection to the pool outside any transaction. If fn returns
+// an error, panics, or ctx is done before COMMIT, the transaction is rolled
+// back on a context detached from ctx. A connection whose transaction state
+// cannot be confirmed idle afterwards is closed instead of reused.
+func WithTx(ctx context.Context, db *sql.DB, fn func(ctx context.Context, conn *sql.Conn) error) (err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { release(conn) }()
+
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), RollbackTimeout)
+		defer cancel()
+		if _, rbErr := conn.ExecContext(rollbackCtx, "ROLLBACK"); rbErr != nil && err == nil {
+			err = fmt.Errorf("txguard: rollback: %w", rbErr)
+		}
+	}()
+
+	if err = fn(ctx, conn); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if _, err = conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// release returns conn to the pool if it is outside a transaction and closes
+// the underlying connection otherwise
+func release(conn *sql.Conn) {
+	conn.Raw(func(driverConn any) error {
+		if c, ok := driverConn.(interface{ Conn() *pgx.Conn }); ok && c.Conn().PgConn().TxStatus() != 'I' {
+			return driver.ErrBadConn // database/sql closes the connection
+		}
+		return nil
+	})
+	conn.Close()
+}
@@ -0,0 +1,114 @@
+// Connection budget planner across services.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// planConfig describes the services sharing one Postgres instance
+type planConfig struct {
+	MaxConnections      int           `json:"max_connections"`
+	ReservedConnections int           `json:"reserved_connections"` // superuser_reserved_connections + reserved_connections
+	Services            []planService `json:"services"`
+}
+
+type planService struct {
+	Name      string `json:"name"`
+	Instances int    `json:"instances"`
+	PoolSize  int    `json:"pool_size"`
+	// DeploySurge is how many extra instances run during a rolling deploy
+	DeploySurge int `json:"deploy_surge"`
+	// StaleFraction is the share of the service's connections whose backends
+	// linger after a failure while clients reconnect, such as backends blocked
+	// on a lock whose cancel never reached them and which stay in CLOSE_WAIT.
+	// 1.0 means every backend is still there when the replacement connections
+	// arrive.
+	StaleFraction float64 `json:"stale_fraction"`
+}
+
+func (s planService) steady() int { return s.Instances * s.PoolSize }
+func (s planService) surge() int  { return s.DeploySurge * s.PoolSize }
+func (s planService) storm() int  { return int(float64(s.steady())*s.StaleFraction + 0.5) }
+
+func loadPlanConfig(path string) (*planConfig, error) {
+	b, err := readInput(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg planConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.MaxConnections <= 0 || len(cfg.Services) == 0 {
+		return nil, fmt.Errorf("%s: max_connections and at least one service are required", path)
+	}
+	if cfg.ReservedConnections < 0 || cfg.ReservedConnections >= cfg.MaxConnections {
+		return nil, fmt.Errorf("%s: reserved_connections (%d) must be at least 0 and below max_connections (%d)", path, cfg.ReservedConnections, cfg.MaxConnections)
+	}
+	return &cfg, nil
+}
+
+// runPlan prints the connection demand of each deploy and failure scenario
+// against the connections available to applications
+func runPlan(path string) bool {
+	cfg, err := loadPlanConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "plan: %v\n", err)
+		return false
+	}
+	budget := cfg.MaxConnections - cfg.ReservedConnections
+
+	type scenario struct {
+		name   string
+		demand int
+	}
+	var steady, allSurge, allStorm int
+	var worstSurge, worstStorm planService
+	for _, s := range cfg.Services {
+		steady += s.steady()
+		allSurge += s.surge()
+		allStorm += s.storm()
+		if s.surge() > worstSurge.surge() {
+			worstSurge = s
+		}
+		if s.storm() > worstStorm.storm() {
+			worstStorm = s
+		}
+	}
+	scenarios := []scenario{{"steady state, all pools full", steady}}
+	for _, s := range cfg.Services {
+		scenarios = append(scenarios, scenario{fmt.Sprintf("deploy %s (+%d instances)", s.Name, s.DeploySurge), steady + s.surge()})
+	}
+	scenarios = append(scenarios, scenario{"all services deploying at once", steady + allSurge})
+	for _, s := range cfg.Services {
+		scenarios = append(scenarios, scenario{fmt.Sprintf("reconnect storm in %s", s.Name), steady + s.storm()})
+	}
+	scenarios = append(scenarios,
+		scenario{"reconnect storm in every service", steady + allStorm},
+		scenario{fmt.Sprintf("storm in %s during deploy of %s", worstStorm.Name, worstSurge.Name), steady + worstSurge.surge() + worstStorm.storm()},
+	)
+
+	fmt.Printf(">>> CONNECTION BUDGET: max_connections=%d reserved=%d available=%d\n", cfg.MaxConnections, cfg.ReservedConnections, budget)
+	fmt.Println()
+	fmt.Printf("%-50s %8s %8s %6s\n", "Scenario", "Demand", "Budget%", "")
+	ok := true
+	worst := 0
+	for _, sc := range scenarios {
+		mark := "ok"
+		if sc.demand > budget {
+			mark, ok = "OVER", false
+		}
+		worst = max(worst, sc.demand)
+		fmt.Printf("%-50s %8d %7.0f%% %6s\n", sc.name, sc.demand, 100*float64(sc.demand)/float64(budget), mark)
+	}
+	fmt.Println()
+	fmt.Printf("Worst-case demand is %d connections", worst)
+	if worst > budget {
+		fmt.Printf(", %d over budget: shrink pools, deploy services one at a time, or put a pooler in front of Postgres\n", worst-budget)
+	} else {
+		fmt.Printf(", %d below budget\n", budget-worst)
+	}
+	return ok
+}
@@ -0,0 +1,82 @@
+// Plan-flip scenario: change planner GUCs mid-run instead of blocking a row.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// planFlipSettings force sequential scans, turning the primary key lookups of
+// the workloads into full table scans
+var planFlipSettings = []string{"enable_indexscan", "enable_bitmapscan", "enable_indexonlyscan"}
+
+// planFlipMinRows is the smallest test_row whose sequential scan takes long
+// enough for the watchdog's 20ms threshold to catch it
+const planFlipMinRows = 1000000
+
+func planFlip(value string) []gucSetting {
+	var settings []gucSetting
+	for _, name := range planFlipSettings {
+		settings = append(settings, gucSetting{name: name, value: value})
+	}
+	return settings
+}
+
+func init() {
+	registerScenario("planflip", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runPlanFlip(h.db, h.o.hold)
+		},
+		validate: func(o *options) error {
+			if o.wl.schema.rows < planFlipMinRows {
+				return fmt.Errorf("planflip needs a table whose full scan is slow, run it with -rows=%d or more", planFlipMinRows)
+			}
+			// The plan-flip scenario is judged by what the watchdog attributes
+			if o.slowQuery == 0 {
+				o.slowQuery = 20 * time.Millisecond
+			}
+			return nil
+		},
+	})
+}
+
+// runPlanFlip forces a plan change for half the hold time, then reverts it. The
+// watchdog's side connections get the same settings so that their EXPLAIN shows
+// the plan the workers are actually running.
+func runPlanFlip(db *sql.DB, hold time.Duration) bool {
+	pools := []*sql.DB{db, watchdog.db}
+	apply := func(value string) {
+		for _, pool := range pools {
+			if err := setSessionGUCs(pool, planFlip(value)); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Unable to set planner GUCs: %v\n", err)
+			}
+		}
+	}
+
+	waitsBefore := db.Stats().WaitCount
+	apply("off")
+	fmt.Printf(">>> PLANFLIP: %v = off on all pooled sessions\n", planFlipSettings)
+	recordEvent("%s set to off on all pooled sessions", strings.Join(planFlipSettings, ", "))
+	startPhase("planflip:off")
+	time.Sleep(hold / 2)
+
+	flipWaits := db.Stats().WaitCount - waitsBefore
+	apply("on")
+	fmt.Println(">>> PLANFLIP: planner GUCs restored")
+	recordEvent("planner GUCs restored")
+	startPhase("planflip:restored")
+	time.Sleep(hold / 2)
+
+	changes := watchdog.planChanges.Load()
+	fmt.Println()
+	if changes == 0 {
+		fmt.Printf(">>> ATTRIBUTION: FAIL no plan change detected by the slow-query watchdog (pool waits during flip=%d)\n", flipWaits)
+		return false
+	}
+	fmt.Printf(">>> ATTRIBUTION: PASS %d plan changes detected by the slow-query watchdog (pool waits during flip=%d)\n", changes, flipWaits)
+	return true
+}
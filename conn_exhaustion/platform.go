@@ -0,0 +1,175 @@
+// Scenario: what this client platform does when the server side of a
+// connection goes away, for comparing runs on Linux, macOS and Windows.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// platformKeepalive is the probe schedule the scenario asks the platform
+// for: a half-open connection is detected after about 5s idle
+var platformKeepalive = net.KeepAliveConfig{Enable: true, Idle: 2 * time.Second, Interval: time.Second, Count: 3}
+
+// platformProbe is how the client saw one server-side close
+type platformProbe struct {
+	name      string
+	elapsed   time.Duration // until the client's error, from the close or, idle, from the statement
+	err       error
+	sent      bool // the statement reached the socket before the error
+	secondErr error
+}
+
+func init() {
+	registerScenario("platform", scenario{
+		standalone: func(o *options) bool { return runPlatform(o.connStr) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 3 }, // probe, admin, keepalive dial
+	})
+}
+
+func runPlatform(connStr string) bool {
+	admin, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer admin.Close()
+	if err := admin.Ping(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+
+	fmt.Println(">>> PLATFORM BEHAVIOR")
+	soft, hard, fdOK := fdLimit()
+	lo, hi := localPortRange()
+	fmt.Printf("%-28s %s/%s\n", "Platform", runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("%-28s %s\n", "Kill of a child process", killMethod)
+	fmt.Printf("%-28s %s\n", "Freeze (crashlock)", availability(freezeSignal != nil, "SIGSTOP", "not available, freeze configs skipped"))
+	dump := make(chan os.Signal, 1)
+	fmt.Printf("%-28s %s\n", "In-flight dump", availability(notifyDumpSignal(dump), "SIGUSR1 or -http-addr", "-http-addr only"))
+	signal.Stop(dump)
+	fmt.Printf("%-28s %s\n", "File descriptor limit", availability(fdOK, fmt.Sprintf("%d soft, %d hard", soft, hard), "unknown"))
+	fmt.Printf("%-28s %s\n", "Ephemeral port range", availability(lo > 0, fmt.Sprintf("%d-%d", lo, hi), "unknown (Linux only)"))
+	fmt.Printf("%-28s %s\n", "Keepalive idle/interval/count", keepaliveSupport(connStr))
+
+	var probes []platformProbe
+	for _, active := range []bool{false, true} {
+		p, err := probeServerClose(admin, connStr, active)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return false
+		}
+		probes = append(probes, p)
+	}
+	fmt.Println()
+	fmt.Printf("%-20s %10s %-6s %-18s %s\n", "Backend terminated", "Detected", "Sent", "Class", "Error")
+	for _, p := range probes {
+		fmt.Printf("%-20s %10s %-6v %-18s %s\n", p.name, ms(p.elapsed), p.sent, classifyError(p.err), platformErrno(p.err))
+		fmt.Printf("%-20s %10s %-6s %-18s %s\n", "  next statement", "", "", classifyError(p.secondErr), platformErrno(p.secondErr))
+	}
+	fmt.Println()
+	fmt.Println("Detected is how long the statement took to fail, counted from pg_terminate_backend mid-statement. Sent=true means it was")
+	fmt.Println("written before the failure surfaced, so it is unsafe to retry blindly; a socket the client had already seen")
+	fmt.Println("closed fails before sending. A half-open connection, one whose server vanished without a FIN or RST, is only")
+	fmt.Println("detected by the keepalive schedule above or by a statement deadline.")
+	return true
+}
+
+func availability(ok bool, yes, no string) string {
+	if ok {
+		return yes
+	}
+	return no
+}
+
+// keepaliveSupport asks the platform for platformKeepalive on a TCP
+// connection to the server; SetKeepAliveConfig fails where a field such as
+// the probe count cannot be set
+func keepaliveSupport(connStr string) string {
+	cfg, err := pgconn.ParseConfig(connStr)
+	if err != nil {
+		return err.Error()
+	}
+	if cfg.Host == "" || cfg.Host[0] == '/' {
+		return "n/a, Unix socket connection"
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port)), 5*time.Second)
+	if err != nil {
+		return err.Error()
+	}
+	defer conn.Close()
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "n/a, not a TCP connection"
+	}
+	want := fmt.Sprintf("%v/%v/%d", platformKeepalive.Idle, platformKeepalive.Interval, platformKeepalive.Count)
+	if err := tcp.SetKeepAliveConfig(platformKeepalive); err != nil {
+		return fmt.Sprintf("%s refused: %v", want, err)
+	}
+	return want + " accepted"
+}
+
+// probeServerClose terminates the backend of a connection, idle or running a
+// statement, and times how the client learns of it
+func probeServerClose(admin *sql.DB, connStr string, active bool) (platformProbe, error) {
+	p := platformProbe{name: "while idle"}
+	if active {
+		p.name = "during a statement"
+	}
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return p, err
+	}
+	defer conn.Close(ctx)
+	pid := conn.PgConn().PID()
+
+	terminate := func() time.Time {
+		at := time.Now()
+		admin.Exec("SELECT pg_terminate_backend($1)", pid)
+		return at
+	}
+	var closedAt time.Time
+	if active {
+		terminated := make(chan time.Time, 1)
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			terminated <- terminate()
+		}()
+		_, p.err = conn.Exec(ctx, "SELECT pg_sleep(30)")
+		closedAt = <-terminated
+	} else {
+		terminate()
+		time.Sleep(200 * time.Millisecond) // the server's FIN has arrived, unread
+		closedAt = time.Now()
+		_, p.err = conn.Exec(ctx, "SELECT 1")
+	}
+	p.elapsed = time.Since(closedAt)
+	p.sent = !pgconn.SafeToRetry(p.err)
+	_, p.secondErr = conn.Exec(ctx, "SELECT 1")
+	return p, nil
+}
+
+// platformErrno names the system error under err, which differs between
+// platforms for the same close (ECONNRESET, WSAECONNRESET, EPIPE, EOF)
+func platformErrno(err error) string {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return "none"
+	case errors.As(err, &errno):
+		return fmt.Sprintf("errno %d (%v): %v", uintptr(errno), errno, err)
+	}
+	return err.Error()
+}
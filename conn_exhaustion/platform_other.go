@@ -0,0 +1,37 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// killMethod is what os.Kill does to a child process here: no signal, the
+// process is terminated and its sockets are closed by the system
+const killMethod = "TerminateProcess"
+
+// shellCommand runs command with the platform's shell
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// Winsock reports ephemeral port exhaustion as WSAEADDRINUSE or, once its
+// buffer space for sockets runs out first, WSAENOBUFS, and running out of
+// socket handles as WSAEMFILE rather than EMFILE
+const (
+	wsaemfile     = syscall.Errno(10024)
+	wsaeaddrinuse = syscall.Errno(10048)
+	wsaenobufs    = syscall.Errno(10055)
+)
+
+// isPortExhaustion reports a connect failing for lack of a free local port
+func isPortExhaustion(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, wsaeaddrinuse) || errors.Is(err, wsaenobufs)
+}
+
+// isFDExhaustion reports a socket failing for lack of handles
+func isFDExhaustion(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, wsaemfile)
+}
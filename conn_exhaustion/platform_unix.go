@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// killMethod is what os.Kill does to a child process here
+const killMethod = "SIGKILL"
+
+// shellCommand runs command with the platform's shell
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("sh", "-c", command)
+}
+
+// isPortExhaustion reports a connect failing for lack of a free local port
+func isPortExhaustion(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// isFDExhaustion reports a socket failing for lack of file descriptors
+func isFDExhaustion(err error) bool {
+	return errors.Is(err, syscall.EMFILE)
+}
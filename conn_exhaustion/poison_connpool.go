@@ -4,45 +4,67 @@ package main
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"os"
+	"os/exec"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5"
 )
 
 var startTime = time.Now()
+
 var prevWaitCount int64
 var prevWaitDuration time.Duration
 var prevMaxIdleClosed int64
 var prevMaxLifetimeClosed int64
 var prevMaxIdleTimeClosed int64
 
-// monitorPoolStats prints pool stats every second continuously
+// monitorPoolStats prints pool stats every second (every monitorTick with
+// -low-overhead) continuously
 func monitorPoolStats(db *sql.DB) {
-	ticker := time.NewTicker(1 * time.Second)
+	tick := monitorTick()
+	ticker := time.NewTicker(tick)
 	defer ticker.Stop()
+	var narrator poolNarrator
+	var stalls stallDetector
 
 	for range ticker.C {
+		tickStart := time.Now()
 		stats := db.Stats()
 
-		// Calculate rates
-		waitCountDelta := stats.WaitCount - prevWaitCount
-		waitDurationDelta := stats.WaitDuration - prevWaitDuration
-		maxIdleClosedDelta := stats.MaxIdleClosed - prevMaxIdleClosed
-		maxLifetimeClosedDelta := stats.MaxLifetimeClosed - prevMaxLifetimeClosed
-		maxIdleTimeClosedDelta := stats.MaxIdleTimeClosed - prevMaxIdleTimeClosed
-
 		// Calculate average wait time per wait (if any waits occurred)
+		waitDurationDelta := stats.WaitDuration - prevWaitDuration
 		var avgWaitMs float64
-		if waitCountDelta > 0 {
-			avgWaitMs = float64(waitDurationDelta.Milliseconds()) / float64(waitCountDelta)
+		if n := stats.WaitCount - prevWaitCount; n > 0 {
+			avgWaitMs = float64(waitDurationDelta.Milliseconds()) / float64(n)
 		}
 
-		timestamp := time.Now().Format("04:05")
-		fmt.Fprintf(os.Stderr, "[%s] POOL_STATS: Open=%d InUse=%d Idle=%d Waits/s=%d AvgWait=%.2fms MaxIdleClosed/s=%d MaxLifetimeClosed/s=%d MaxIdleTimeClosed/s=%d\n",
-			timestamp, stats.OpenConnections, stats.InUse, stats.Idle, waitCountDelta, avgWaitMs,
-			maxIdleClosedDelta, maxLifetimeClosedDelta, maxIdleTimeClosedDelta)
+		// Calculate rates per second over the tick, which need not be whole seconds
+		secs := tick.Seconds()
+		waitCountDelta := float64(stats.WaitCount-prevWaitCount) / secs
+		maxIdleClosedDelta := float64(stats.MaxIdleClosed-prevMaxIdleClosed) / secs
+		maxLifetimeClosedDelta := float64(stats.MaxLifetimeClosed-prevMaxLifetimeClosed) / secs
+		maxIdleTimeClosedDelta := float64(stats.MaxIdleTimeClosed-prevMaxIdleTimeClosed) / secs
+
+		if jsonOutput() {
+			emitJSON("pool_stats", map[string]any{
+				"open": stats.OpenConnections, "in_use": stats.InUse, "idle": stats.Idle,
+				"waits_per_s": waitCountDelta, "avg_wait_ms": avgWaitMs, "max_idle_closed_per_s": maxIdleClosedDelta,
+				"max_lifetime_closed_per_s": maxLifetimeClosedDelta, "max_idle_time_closed_per_s": maxIdleTimeClosedDelta,
+			})
+		} else {
+			timestamp := time.Now().Format("04:05")
+			fmt.Fprintf(os.Stderr, "[%s] POOL_STATS: Open=%d InUse=%d Idle=%d Waits/s=%.1f AvgWait=%.2fms MaxIdleClosed/s=%.1f MaxLifetimeClosed/s=%.1f MaxIdleTimeClosed/s=%.1f\n",
+				timestamp, stats.OpenConnections, stats.InUse, stats.Idle, waitCountDelta, avgWaitMs,
+				maxIdleClosedDelta, maxLifetimeClosedDelta, maxIdleTimeClosedDelta)
+		}
+		writePoolSample(stats, waitCountDelta, avgWaitMs, maxIdleClosedDelta, maxLifetimeClosedDelta, maxIdleTimeClosedDelta)
+		narrator.observe(stats, waitCountDelta)
+		stalls.observe(stats, waitCountDelta)
 
 		// Update previous values
 		prevWaitCount = stats.WaitCount
@@ -55,70 +77,29 @@ func monitorPoolStats(db *sql.DB) {
 		conn, err := db.Conn(context.Background())
 		if err == nil {
 			conn.Raw(func(driverConn interface{}) error {
-				if pgxConn, ok := driverConn.(*stdlib.Conn); ok {
+				if pgxConn, ok := driverConn.(interface{ Conn() *pgx.Conn }); ok {
 					txStatus := pgxConn.Conn().PgConn().TxStatus()
 					if txStatus != 'I' {
-						fmt.Fprintf(os.Stderr, "WARNING: Connection returned to pool with open transaction (TxStatus=%c)\n", txStatus)
+						openTxSeen.Store(time.Now().UnixNano())
+						openTxCheckouts.Add(1)
+						if jsonOutput() {
+							emitJSON("open_tx_checkout", map[string]any{"tx_status": string(txStatus)})
+						} else {
+							fmt.Fprintf(os.Stderr, "WARNING: Connection returned to pool with open transaction (TxStatus=%c)\n", txStatus)
+						}
 					}
 				}
 				return nil
 			})
 			conn.Close()
 		}
+		selfOverhead.since("pool monitor", tickStart, 0)
 	}
 }
 
-func main() {
-	if len(os.Args) < 2 || (os.Args[1] != "poison" && os.Args[1] != "sleep") {
-		fmt.Fprintf(os.Stderr, "Usage: %s <poison|sleep>\n", os.Args[0])
-		os.Exit(1)
-	}
-
-	connStr := os.Getenv("DATABASE_URL")
-	db, err := sql.Open("pgx", connStr)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
-		os.Exit(1)
-	}
-	defer db.Close()
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
-
-	// Test connection
-	if err := db.Ping(); err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect to database with DATABASE_URL='%s': %v\n", connStr, err)
-		os.Exit(1)
-	}
-
-	// Setup table
-	db.Exec("DROP TABLE IF EXISTS test_row")
-	db.Exec("CREATE TABLE test_row (id INT PRIMARY KEY, val INT)")
-	db.Exec("INSERT INTO test_row (id, val) VALUES (1, 0)")
-
-	fmt.Println(">>> Starting workers")
-	fmt.Println()
-
-	// Start pool stats monitor
-	go monitorPoolStats(db)
-
-	// Start workers
-	for i := 0; i < 20; i++ {
-		go func() {
-			for {
-				ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
-				if _, err := db.ExecContext(ctx, "UPDATE test_row SET val = val + 1 WHERE id = 1"); err != nil {
-					fmt.Fprintf(os.Stderr, "ERROR: Worker failed: %v\n", err)
-				}
-				db.ExecContext(ctx, "SELECT pg_sleep(0.01)")
-				cancel()
-				time.Sleep(100 * time.Millisecond)
-			}
-		}()
-	}
-
-	// Wait, then poison
-	time.Sleep(20 * time.Second)
-
+// holdBlockingLock takes the workload's row lock in an open transaction and
+// either returns the connection to the pool (poison) or holds it (sleep)
+func holdBlockingLock(db *sql.DB, wl workload, mode string, hold time.Duration) {
 	fmt.Println()
 	fmt.Println(">>> START BLOCKING: Holding row lock in open transaction...")
 
@@ -126,21 +107,342 @@ func main() {
 	var backendPID int
 	conn.QueryRowContext(context.Background(), "SELECT pg_backend_pid()").Scan(&backendPID)
 	conn.ExecContext(context.Background(), "BEGIN")
-	conn.ExecContext(context.Background(), "UPDATE test_row SET val = val + 1 WHERE id = 1 -- POISON")
+	conn.ExecContext(context.Background(), wl.poisonSQL())
 
-	if os.Args[1] == "poison" {
+	if mode == "poison" {
 		// Return connection to pool immediately with open transaction (default "poison" behavior)
 		conn.Close()
 		fmt.Printf(">>> POISON: Lock acquired by PID %d, connection returned to pool with open transaction\n", backendPID)
+		recordEvent("row lock taken by PID %d, connection returned to pool with the transaction open", backendPID)
+		startPhase("poison")
 		// Sleep so that workers continue to run; poison connection picked up and will not be idle
-		time.Sleep(70 * time.Second)
+		phaseCtl.await("stop", hold)
 	} else {
 		// Sleep before completing test; workers blocked by idle transaction
 		fmt.Printf(">>> SLEEP: Lock acquired by PID %d, sleeping with open transaction\n", backendPID)
-		time.Sleep(70 * time.Second)
+		recordEvent("row lock taken by PID %d, session held idle in transaction outside the pool", backendPID)
+		startPhase("sleep")
+		phaseCtl.await("stop", hold)
 		conn.Close()
 	}
+}
+
+func init() {
+	for _, mode := range []string{"poison", "sleep"} {
+		registerScenario(mode, scenario{
+			inject: func(h *harness) bool {
+				holdBlockingLock(h.db, h.wl, mode, h.o.hold)
+				return true
+			},
+		})
+	}
+}
+
+func main() {
+	o := defineFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <%s>\n", os.Args[0], strings.Join(modes, "|"))
+		fmt.Fprintf(os.Stderr, "       %s run <scenario> [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s errdiff <a.jsonl> <b.jsonl>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s plan <services.json>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s describe [-json] [scenario...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s configs [name]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) >= 2 && args[0] == "run" {
+		// run <scenario> [flags]: the flags follow the scenario name
+		name := args[1]
+		flag.CommandLine.Parse(args[2:])
+		args = append([]string{name}, flag.Args()...)
+	}
+	var cfg *runConfig
+	if o.configPath != "" {
+		var err error
+		if cfg, err = loadConfig(o.configPath); err == nil {
+			err = cfg.apply(flag.CommandLine)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -config: %v\n", err)
+			os.Exit(1)
+		}
+		if len(args) == 0 && cfg.scenario != "" {
+			args = []string{cfg.scenario}
+		}
+	}
+	if missing := unregisteredScenarios(); len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "Scenarios missing from the catalog or the registry: %s\n", strings.Join(missing, ", "))
+		os.Exit(1)
+	}
+	mode := ""
+	if len(args) > 0 {
+		mode = args[0]
+	}
+	if mode == "errdiff" && len(args) == 3 {
+		if err := diffErrorSurfaces(args[1], args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "errdiff: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if mode == "describe" {
+		if !describeScenarios(args[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if mode == "configs" && len(args) <= 2 {
+		if !runConfigs(args[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+	if mode == "plan" && len(args) == 2 {
+		if !runPlan(args[1]) {
+			os.Exit(2)
+		}
+		return
+	}
+	if mode == "lockholder" {
+		runLockHolder(os.Getenv("DATABASE_URL"), args[1:])
+		return
+	}
+	if mode == "querychild" && len(args) == 3 {
+		runQueryChild(os.Getenv("DATABASE_URL"), args[1], args[2])
+		return
+	}
+	if mode == "forkchild" {
+		runForkChild()
+		return
+	}
+	if mode == "invocation" && len(args) == 2 {
+		runInvocation(os.Getenv("DATABASE_URL"), args[1])
+		return
+	}
+	if mode == "instance" {
+		runInstance(os.Getenv("DATABASE_URL"), o.instanceName, o.poolSize)
+		return
+	}
+	s, ok := scenarios[mode]
+	newWorkload, wlOK := workloads[o.workload]
+	if !ok || !wlOK {
+		flag.Usage()
+		os.Exit(1)
+	}
+	o.mode = mode
+	o.connStr = os.Getenv("DATABASE_URL")
+	if cfg != nil && cfg.dsn != "" {
+		o.connStr = cfg.dsn
+	}
+	if o.workers < 1 || o.maxOpen < 1 || o.queryTimeout <= 0 {
+		fmt.Fprintf(os.Stderr, "-workers, -max-open and -query-timeout must be positive\n")
+		os.Exit(1)
+	}
+	if o.gucAudit > 0 && len(parseGUCList(o.gucAuditSettings)) == 0 {
+		fmt.Fprintf(os.Stderr, "-guc-audit needs at least one setting in -guc-audit-settings\n")
+		os.Exit(1)
+	}
+	if o.agents > 0 && o.controlChannel == "" {
+		fmt.Fprintf(os.Stderr, "-agents needs -control-channel\n")
+		os.Exit(1)
+	}
+	if !slices.Contains(invariantExpectations, o.expectInvariant) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if !slices.Contains(cacheModes, o.cacheMode) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if expectationsSet(o) && s.inject == nil {
+		fmt.Fprintf(os.Stderr, "-expect-diagnosis and -expect-invariant need a fault injection scenario\n")
+		os.Exit(1)
+	}
+	if o.sloSpec != "" {
+		if s.inject == nil {
+			fmt.Fprintf(os.Stderr, "-slo needs a fault injection scenario\n")
+			os.Exit(1)
+		}
+		var err error
+		if slo, err = parseSLO(o.sloSpec); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -slo: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if o.alertRules != "" {
+		if s.inject == nil {
+			fmt.Fprintf(os.Stderr, "-alert-rules needs a fault injection scenario\n")
+			os.Exit(1)
+		}
+		// The idle in transaction rule needs both, the orphaned statement
+		// rule the orphan detector
+		o.activityStats = true
+		o.orphanDetect = true
+		if o.poisonAudit == 0 {
+			o.poisonAudit = 2 * time.Second
+		}
+	}
+	if s.validate != nil {
+		if err := s.validate(o); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if !slices.Contains(sqlDrivers, sqlDriver) || !slices.Contains(outputFormats, outputFormat) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if sqlDriver == "libpq" && openLibpq == nil {
+		fmt.Fprintf(os.Stderr, "-driver=libpq needs a binary built with -tags libpq\n")
+		os.Exit(1)
+	}
+	if !slices.Contains(closeStrategies, closeStrategy) || !slices.Contains(acquireChecks, acquireCheck) ||
+		!slices.Contains(sessionResetOrder, sessionReset) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err := o.wl.schema.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid schema: %v\n", err)
+		os.Exit(1)
+	}
+	if !slices.Contains(notifyFormats, o.notifyFormat) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if o.notifyWebhook != "" {
+		notify = newNotifier(o.notifyWebhook, o.notifyFormat, o.reportURL, mode)
+	}
+	wl := newWorkload(o.wl)
+	if o.errorLog != "" {
+		if err := openErrorRecorder(o.errorLog); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create error log: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.csvPath != "" {
+		if err := openPoolCSV(o.csvPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create CSV file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.writeConfigPath != "" {
+		if err := writeConfig(o.writeConfigPath, mode, o.connStr, flag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if s.offline {
+		if !s.standalone(o) {
+			os.Exit(2)
+		}
+		return
+	}
+
+	if o.preflight || o.preflightOnly {
+		needs := preflightNeeds{mode: mode, conns: o.maxOpen + 2}
+		if closeStrategy != "graceful" {
+			needs.plaintext = "-close-strategy=" + closeStrategy
+		}
+		switch o.cacheMode {
+		case "cold":
+			needs.superuser, needs.minVersion = "pg_buffercache_evict", 170000
+			needs.extensions = append(needs.extensions, "pg_buffercache")
+		case "warm":
+			needs.extensions = append(needs.extensions, "pg_prewarm")
+		}
+		if s.needs != nil {
+			s.needs(o, &needs)
+		}
+		if o.slowQuery > 0 {
+			needs.conns += 2
+		}
+		if o.orphanDetect {
+			needs.conns++
+		}
+		if o.activityStats {
+			needs.conns++
+		}
+		if o.blockingInterval > 0 {
+			needs.conns++
+		}
+		if o.waitSample > 0 {
+			needs.conns++
+		}
+		if o.poisonAudit > 0 {
+			needs.conns++
+		}
+		if o.killBlockerAfter > 0 {
+			needs.conns++
+		}
+		if o.controlTable != "" {
+			needs.conns++
+		}
+		if o.controlChannel != "" {
+			needs.conns += 2 // listener and notifier
+		}
+		ok := runPreflight(o.connStr, needs)
+		if o.preflightOnly {
+			if !ok {
+				os.Exit(1)
+			}
+			return
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Preflight failed, fix the gaps above or run with -preflight=false\n")
+			os.Exit(1)
+		}
+	}
+
+	if o.orphanDetect {
+		orphans = startOrphanDetector(context.Background(), o.connStr)
+	}
+	if s.standalone != nil {
+		passed := s.standalone(o)
+		orphans.print()
+		if !passed {
+			os.Exit(2)
+		}
+		return
+	}
+
+	passed := runHarness(o, s, wl)
+	if o.summaryPath != "" {
+		if o.summaryPath == "-" {
+			fmt.Println()
+		}
+		if err := writeSummary(o.summaryPath, mode, o.workload, passed); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to write summary: %v\n", err)
+		}
+	}
+	if o.alertRules != "" {
+		if err := writeAlertRules(o.alertRules, mode, o); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to write alert rules: %v\n", err)
+		}
+	}
+	if !passed {
+		notify.send("failure", summaryMarkdown(mode, o.workload, passed))
+	}
 
 	fmt.Println()
 	fmt.Println(">>> TEST COMPLETE")
+	if !passed {
+		os.Exit(2)
+	}
+}
+
+// childCommand runs this binary with args as a child process. The child gets
+// connStr as its DATABASE_URL, in place of any inherited one, so that it
+// connects where the parent does when the DSN came from -config.
+func childCommand(connStr string, args ...string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), "DATABASE_URL="+connStr)
+	return cmd, nil
 }
@@ -0,0 +1,161 @@
+// Detection of pooled connections left holding server state between
+// checkouts: an open transaction, or a session-level advisory lock, which
+// outlives any transaction and survives the pool's reuse of the connection.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// poisonIdleAfter is how long a backend must have been idle before it counts
+// as sitting in the pool rather than between two statements of a checkout
+const poisonIdleAfter = time.Second
+
+// Classes of poisoning, in report order
+const (
+	poisonOpenTx   = "open_transaction" // idle in transaction, holding its locks
+	poisonAdvisory = "advisory_session" // idle outside a transaction with advisory locks granted
+)
+
+// poisonedConn is one backend of the pool seen idle in a poisoning class
+type poisonedConn struct {
+	pid                 int32
+	class, detail       string
+	firstSeen, lastSeen time.Time
+	polls               int
+}
+
+type poisonKey struct {
+	pid   int32
+	class string
+}
+
+type poisonAuditor struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	rounds   int
+	poisoned map[poisonKey]*poisonedConn
+}
+
+// poisonAudit is nil unless -poison-audit was given
+var poisonAudit *poisonAuditor
+
+// newPoisonAuditor opens the auditor's own connection, so it keeps polling
+// while the worker pool is exhausted
+func newPoisonAuditor(connStr string) (*poisonAuditor, error) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &poisonAuditor{db: db, poisoned: map[poisonKey]*poisonedConn{}}, nil
+}
+
+// run polls every interval until the process exits
+func (a *poisonAuditor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		if err := a.poll(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Poison audit query failed: %v\n", err)
+		}
+		selfOverhead.since("poison audit", start, 1)
+	}
+}
+
+// poll finds this process's backends, by the query tag of their last
+// statement, which have been idle for poisonIdleAfter in a transaction or
+// with advisory locks. A backend idle outside a transaction can only hold
+// session-level advisory locks; transaction-level ones end with it.
+func (a *poisonAuditor) poll() error {
+	rows, err := a.db.Query(`
+		SELECT a.pid, a.state, extract(epoch FROM now() - a.state_change),
+		       coalesce((SELECT string_agg(CASE WHEN l.objsubid = 1 THEN ((l.classid::bigint << 32) | l.objid::bigint)::text
+		                                        ELSE l.classid || ',' || l.objid END, ' ' ORDER BY l.classid, l.objid)
+		                 FROM pg_locks l WHERE l.pid = a.pid AND l.locktype = 'advisory' AND l.granted), '')
+		FROM pg_stat_activity a
+		WHERE a.datname = current_database() AND left(a.query, length($1)) = $1 AND a.pid <> pg_backend_pid()
+		  AND a.state IN ('idle', 'idle in transaction', 'idle in transaction (aborted)')
+		  AND now() - a.state_change >= $2 * interval '1 millisecond'`, queryTag, poisonIdleAfter.Milliseconds())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rounds++
+	for rows.Next() {
+		var pid int32
+		var state, keys string
+		var idle float64
+		if err := rows.Scan(&pid, &state, &idle, &keys); err != nil {
+			return err
+		}
+		class, detail := poisonOpenTx, state
+		if state == "idle" {
+			if keys == "" {
+				continue
+			}
+			class, detail = poisonAdvisory, ""
+		}
+		if keys != "" {
+			detail = fmt.Sprintf("%s, advisory keys %s", detail, keys)
+		}
+		k := poisonKey{pid, class}
+		p := a.poisoned[k]
+		if p == nil {
+			p = &poisonedConn{pid: pid, class: class, firstSeen: now}
+			a.poisoned[k] = p
+			fmt.Fprintf(os.Stderr, "WARNING: Pooled connection pid=%d poisoned [%s] idle %.1fs: %s\n", pid, class, idle, detail)
+			recordEvent("pooled connection pid %d poisoned (%s)", pid, class)
+		}
+		p.detail, p.lastSeen = detail, now
+		p.polls++
+	}
+	return rows.Err()
+}
+
+// print lists each poisoned backend under its class
+func (a *poisonAuditor) print() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Println()
+	fmt.Printf(">>> POOL POISONING: %d polls, connections idle %v or longer holding a transaction or advisory locks\n", a.rounds, poisonIdleAfter)
+	if len(a.poisoned) == 0 {
+		fmt.Println("No pooled connection was seen poisoned")
+		return
+	}
+	list := make([]*poisonedConn, 0, len(a.poisoned))
+	for _, p := range a.poisoned {
+		list = append(list, p)
+	}
+	order := map[string]int{poisonOpenTx: 0, poisonAdvisory: 1}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].class != list[j].class {
+			return order[list[i].class] < order[list[j].class]
+		}
+		return list[i].firstSeen.Before(list[j].firstSeen)
+	})
+	fmt.Printf("%-18s %8s %7s %10s   %s\n", "Class", "PID", "Polls", "Seen for", "Last seen as")
+	for _, p := range list {
+		fmt.Printf("%-18s %8d %7d %9.1fs   %s\n", p.class, p.pid, p.polls, p.lastSeen.Sub(p.firstSeen).Seconds(), p.detail)
+	}
+	fmt.Println("An advisory_session connection went back to the pool outside a transaction but still holds the lock, so")
+	fmt.Println("whoever checks it out next holds it too, and every other session waiting on the key is blocked until the")
+	fmt.Println("pool closes the connection; only -session-reset=discard_all (or pg_advisory_unlock_all) clears it on reuse.")
+}
@@ -0,0 +1,137 @@
+// Scenario: a poisoned pool and a slow resolver, each moderate alone,
+// together compounding into an outage.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// poisonDNSFaults are the fault phases, each followed by a recovery:
+//   - dns: every new connection waits -dns-latency for its host lookup
+//   - poison: a connection goes back to the pool holding the workload's row
+//     lock, so workers time out; every timeout breaks its connection and
+//     database/sql dials a replacement
+//   - poison+dns: both, so each of those replacements also waits for DNS
+var poisonDNSFaults = []string{"dns", "poison", "poison+dns"}
+
+const poisonDNSRecovery = 5 * time.Second
+
+func init() {
+	registerScenario("poisondns", scenario{
+		inject: func(h *harness) bool {
+			return runPoisonDNS(h, h.o.dnsLatency, h.o.hold/time.Duration(len(poisonDNSFaults)))
+		},
+		validate: func(o *options) error {
+			if o.dnsLatency <= 0 {
+				return fmt.Errorf("Invalid -dns-latency %v", o.dnsLatency)
+			}
+			// On a single row the poison alone stops every worker and
+			// leaves nothing for DNS to add
+			if o.workload == "counter" && o.wl.schema.rows < 2 {
+				return fmt.Errorf("poisondns needs a moderate poison, run it with -rows=20 or more")
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns++ }, // terminates the poisoned session
+	})
+}
+
+// poisonDNSPhase is what one phase cost, from the phase report and the lookups
+type poisonDNSPhase struct {
+	row     phaseRow
+	lookups int64
+	wait    time.Duration
+}
+
+func (p poisonDNSPhase) okRate() float64  { return float64(p.row.ok) / p.row.secs }
+func (p poisonDNSPhase) errRate() float64 { return float64(p.row.failed) / p.row.secs }
+
+// runPoisonDNS injects each fault for length, then decomposes the combined
+// phase's damage into each fault's share and their interaction
+func runPoisonDNS(h *harness, latency, length time.Duration) bool {
+	admin, err := sql.Open("pgx", h.connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return false
+	}
+	defer admin.Close()
+	ctx := context.Background()
+
+	baseline := currentPhase.Load().name
+	lookups := map[string]int64{}
+	waits := map[string]time.Duration{}
+	phase := func(name string, d time.Duration) {
+		startLookups, startWait := dnsLookups.Load(), dnsWait.Load()
+		startPhase(name)
+		time.Sleep(d)
+		lookups[name] = dnsLookups.Load() - startLookups
+		waits[name] = time.Duration(dnsWait.Load() - startWait)
+	}
+
+	for _, fault := range poisonDNSFaults {
+		fmt.Println()
+		pid := 0
+		if fault != "dns" {
+			conn, err := h.db.Conn(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return false
+			}
+			conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+			conn.ExecContext(ctx, "BEGIN")
+			conn.ExecContext(ctx, h.wl.poisonSQL())
+			conn.Close()
+		}
+		if fault != "poison" {
+			injectedDNSLatency.Store(int64(latency))
+		}
+		fmt.Printf(">>> POISON_DNS: %s for %v (dns latency %v, poisoned PID %d)\n", fault, length, latency, pid)
+		recordEvent("fault %s injected", fault)
+		phase(fault, length)
+
+		injectedDNSLatency.Store(0)
+		if pid != 0 {
+			admin.Exec("SELECT pg_terminate_backend($1)", pid)
+		}
+		recordEvent("fault %s removed", fault)
+		phase(fault+":recover", poisonDNSRecovery)
+	}
+	startPhase("poisondns:done")
+
+	phases := map[string]poisonDNSPhase{}
+	for _, row := range phaseRows() {
+		phases[row.name] = poisonDNSPhase{row: row, lookups: lookups[row.name], wait: waits[row.name]}
+	}
+	base := phases[baseline]
+
+	fmt.Println()
+	fmt.Printf(">>> COMPOUNDING REPORT (dns latency %v, baseline %s)\n", latency, baseline)
+	fmt.Printf("%-11s %8s %8s %10s %8s %10s\n", "Phase", "OK/s", "Err/s", "p95", "Lookups", "DNS wait")
+	for _, name := range append([]string{baseline}, poisonDNSFaults...) {
+		p := phases[name]
+		fmt.Printf("%-11s %8.1f %8.1f %10s %8d %9.1fs\n", name, p.okRate(), p.errRate(), ms(p.row.p95), p.lookups, p.wait.Seconds())
+	}
+
+	// Lost throughput over the baseline: additive if the faults were
+	// independent, more if they compound
+	lost := func(name string) float64 { return base.okRate() - phases[name].okRate() }
+	dns, poison, both := lost("dns"), lost("poison"), lost("poison+dns")
+	interaction := both - dns - poison
+	fmt.Println()
+	fmt.Println("Committed iterations/s lost against the baseline:")
+	fmt.Printf("  %-34s %8.1f\n", "dns alone", dns)
+	fmt.Printf("  %-34s %8.1f\n", "poison alone", poison)
+	fmt.Printf("  %-34s %8.1f\n", "poison+dns", both)
+	fmt.Printf("  %-34s %8.1f\n", "interaction (poison+dns - both alone)", interaction)
+	if interaction > 0 {
+		fmt.Println("The faults compound: timeouts under the poison break connections, and each replacement waits for DNS while")
+		fmt.Println("holding a pool slot, so fewer connections are left for the workers than either fault alone explains.")
+	} else {
+		fmt.Println("No compounding: the combined loss is at most the sum of the two faults alone.")
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+// CSV time series of the one-second pool samples, for spreadsheets and pandas.
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"os"
+	"strconv"
+	"time"
+)
+
+var poolCSVHeader = []string{"time", "elapsed_s", "phase", "open", "in_use", "idle", "waits_per_s", "avg_wait_ms",
+	"max_idle_closed_per_s", "max_lifetime_closed_per_s", "max_idle_time_closed_per_s"}
+
+// poolCSV is nil unless -csv was given; only monitorPoolStats writes to it
+var poolCSV *csv.Writer
+
+func openPoolCSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	poolCSV = csv.NewWriter(f)
+	poolCSV.Write(poolCSVHeader)
+	poolCSV.Flush()
+	return poolCSV.Error()
+}
+
+// writePoolSample appends one sample; the deltas are per second. Every row is
+// flushed so an interrupted run still leaves a usable file.
+func writePoolSample(stats sql.DBStats, waits, avgWaitMs, maxIdleClosed, maxLifetimeClosed, maxIdleTimeClosed float64) {
+	if poolCSV == nil {
+		return
+	}
+	phase := ""
+	if p := currentPhase.Load(); p != nil {
+		phase = p.name
+	}
+	now := time.Now()
+	poolCSV.Write([]string{
+		serverTime(now).Format(time.RFC3339Nano),
+		strconv.FormatFloat(now.Sub(startTime).Seconds(), 'f', 3, 64),
+		phase,
+		strconv.Itoa(stats.OpenConnections),
+		strconv.Itoa(stats.InUse),
+		strconv.Itoa(stats.Idle),
+		strconv.FormatFloat(waits, 'f', 2, 64),
+		strconv.FormatFloat(avgWaitMs, 'f', 2, 64),
+		strconv.FormatFloat(maxIdleClosed, 'f', 2, 64),
+		strconv.FormatFloat(maxLifetimeClosed, 'f', 2, 64),
+		strconv.FormatFloat(maxIdleTimeClosed, 'f', 2, 64),
+	})
+	poolCSV.Flush()
+}
@@ -0,0 +1,225 @@
+// Scenario: empirical capabilities of whatever sits between the client and
+// Postgres (nothing, PgBouncer, a cloud proxy, ...).
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// poolerProbeRounds is how often each session probe is repeated; a property
+// only counts as kept if it survives every round
+const poolerProbeRounds = 3
+
+type poolerProbe struct {
+	name    string
+	verdict string // yes, no or error
+	detail  string
+}
+
+func init() {
+	registerScenario("poolercheck", scenario{
+		standalone: func(o *options) bool { return runPoolerCheck(o.connStr) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 3 },
+	})
+}
+
+// runPoolerCheck asks the proxy behind DATABASE_URL what it keeps per client
+// session. Every session probe runs on client session A while client session
+// B holds a transaction open, so that a transaction pooler which would
+// otherwise hand A the server connection it just used has to pick another.
+func runPoolerCheck(connStr string) bool {
+	db, err := openDB(connStr, "pg-idle-test-poolercheck")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(3)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	probes := []poolerProbe{probePinned(ctx, db)}
+	for _, leak := range sessionLeaks {
+		probes = append(probes, probeSessionState(ctx, db, leak.name, leak.leave, leak.check))
+	}
+	probes = append(probes, probeProtocolPrepare(ctx, db), probeCancel(ctx, db))
+
+	fmt.Println()
+	fmt.Println(">>> POOLER CAPABILITY REPORT")
+	fmt.Printf("%-20s %-8s %s\n", "Probe", "Result", "Detail")
+	for _, p := range probes {
+		fmt.Printf("%-20s %-8s %s\n", p.name, p.verdict, p.detail)
+	}
+	fmt.Println()
+	if probes[0].verdict == "no" {
+		fmt.Println("Sessions are not pinned: session state needs a pooler which tracks it (e.g. PgBouncer max_prepared_statements),")
+		fmt.Println("and anything marked no above must not be relied on by the application.")
+	} else {
+		fmt.Println("Sessions are pinned to a server connection, as with direct connections or session pooling.")
+	}
+	return true
+}
+
+// withHeldTransaction runs fn while another client session has a transaction open
+func withHeldTransaction(ctx context.Context, db *sql.DB, fn func() error) error {
+	b, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if _, err := b.ExecContext(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	defer b.ExecContext(ctx, "ROLLBACK")
+	if _, err := b.ExecContext(ctx, "SELECT 1"); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func probePinned(ctx context.Context, db *sql.DB) poolerProbe {
+	p := poolerProbe{name: "session_pinned", verdict: "yes"}
+	a, err := db.Conn(ctx)
+	if err != nil {
+		return poolerProbe{p.name, "error", err.Error()}
+	}
+	defer a.Close()
+	pids := map[int32]bool{}
+	for i := 0; i < poolerProbeRounds; i++ {
+		var before, after int32
+		err := a.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&before)
+		if err == nil {
+			err = withHeldTransaction(ctx, db, func() error {
+				return a.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&after)
+			})
+		}
+		if err != nil {
+			return poolerProbe{p.name, "error", err.Error()}
+		}
+		pids[before], pids[after] = true, true
+	}
+	p.detail = fmt.Sprintf("one client session ran on %d server backends", len(pids))
+	if len(pids) > 1 {
+		p.verdict = "no"
+	}
+	return p
+}
+
+// probeSessionState leaves state on client session A and checks on A whether
+// it is still there once A has had to run on another server connection
+func probeSessionState(ctx context.Context, db *sql.DB, name, leave, check string) poolerProbe {
+	p := poolerProbe{name: name + "_persists", verdict: "yes"}
+	a, err := db.Conn(ctx)
+	if err != nil {
+		return poolerProbe{p.name, "error", err.Error()}
+	}
+	defer a.Close()
+	defer a.ExecContext(ctx, "DISCARD ALL")
+	kept := 0
+	for i := 0; i < poolerProbeRounds; i++ {
+		a.ExecContext(ctx, "DISCARD ALL")
+		// Behind a transaction pooler the statement can land on a server
+		// connection an earlier round already prepared it on
+		if _, err := a.ExecContext(ctx, leave); err != nil && !isSQLState(err, "42P05") {
+			return poolerProbe{p.name, "error", fmt.Sprintf("%s: %v", leave, err)}
+		}
+		var seen bool
+		if err := withHeldTransaction(ctx, db, func() error {
+			return a.QueryRowContext(ctx, check).Scan(&seen)
+		}); err != nil {
+			return poolerProbe{p.name, "error", err.Error()}
+		}
+		if seen {
+			kept++
+		}
+	}
+	p.detail = fmt.Sprintf("seen again in %d/%d rounds", kept, poolerProbeRounds)
+	if kept < poolerProbeRounds {
+		p.verdict = "no"
+	}
+	return p
+}
+
+// probeProtocolPrepare uses a named protocol-level prepared statement, as
+// pgx's default statement cache does, rather than SQL PREPARE
+func probeProtocolPrepare(ctx context.Context, db *sql.DB) poolerProbe {
+	p := poolerProbe{name: "protocol_prepare", verdict: "yes"}
+	a, err := db.Conn(ctx)
+	if err != nil {
+		return poolerProbe{p.name, "error", err.Error()}
+	}
+	defer a.Close()
+	ok := 0
+	var lastErr, noPgx error
+	for i := 0; i < poolerProbeRounds; i++ {
+		name := fmt.Sprintf("pg_idle_test_probe_%d", i)
+		err := a.Raw(func(driverConn any) error {
+			conn, err := pgxConnOf(driverConn)
+			if err != nil {
+				noPgx = err
+				return err
+			}
+			if _, err := conn.Prepare(ctx, name, "SELECT 1"); err != nil {
+				return err
+			}
+			defer conn.Deallocate(ctx, name)
+			return withHeldTransaction(ctx, db, func() error {
+				var one int
+				return conn.QueryRow(ctx, name).Scan(&one)
+			})
+		})
+		if noPgx != nil {
+			return poolerProbe{p.name, "error", noPgx.Error()}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ok++
+	}
+	p.detail = fmt.Sprintf("executed by name in %d/%d rounds", ok, poolerProbeRounds)
+	if ok < poolerProbeRounds {
+		p.verdict = "no"
+		if lastErr != nil {
+			p.detail += ": " + oneLine(lastErr.Error())
+		}
+	}
+	return p
+}
+
+// probeCancel lets a statement time out on the client and looks for it on
+// the server a second later. pgx sends a cancel request on timeout; if the
+// proxy does not forward it, pg_sleep keeps running.
+func probeCancel(ctx context.Context, db *sql.DB) poolerProbe {
+	p := poolerProbe{name: "cancel_propagates", verdict: "yes"}
+	tag := fmt.Sprintf("pg-idle-test cancel probe %d", time.Now().UnixNano())
+	timeout, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	_, err := db.ExecContext(timeout, fmt.Sprintf("/* %s */ SELECT pg_sleep(5)", tag))
+	if err == nil {
+		return poolerProbe{p.name, "error", "the statement was not canceled"}
+	}
+	time.Sleep(1 * time.Second)
+	var running bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_stat_activity WHERE state = 'active' AND query LIKE '%' || $1 || '%' AND pid <> pg_backend_pid())", tag).Scan(&running); err != nil {
+		return poolerProbe{p.name, "error", err.Error()}
+	}
+	p.detail = "the timed out statement stopped on the server"
+	if running {
+		p.verdict = "no"
+		p.detail = "the timed out statement was still running 1s later"
+	}
+	return p
+}
+
+func isSQLState(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
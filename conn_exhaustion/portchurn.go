@@ -0,0 +1,181 @@
+// Ephemeral port exhaustion through connection churn.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countTimeWait counts local TCP sockets in TIME_WAIT, or -1 if unknown (non-Linux)
+func countTimeWait() int {
+	n, found := 0, false
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		found = true
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) > 3 && fields[3] == "06" {
+				n++
+			}
+		}
+		f.Close()
+	}
+	if !found {
+		return -1
+	}
+	return n
+}
+
+// churnPhase counts churner outcomes for one pool configuration
+type churnPhase struct {
+	name         string
+	ok           atomic.Int64
+	mu           sync.Mutex
+	errors       map[string]int
+	peakTimeWait int
+}
+
+func (p *churnPhase) fail(err error) {
+	class := classifyStormError(err)
+	p.mu.Lock()
+	p.errors[class]++
+	p.mu.Unlock()
+}
+
+func init() {
+	registerScenario("portchurn", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runPortChurn(h.connStr, h.o.churnGoroutines, h.o.hold)
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns += o.churnGoroutines
+		},
+	})
+}
+
+// runPortChurn runs tight SELECT 1 loops on a separate pool, first with no
+// idle connections and a 1ms lifetime so every statement dials a new
+// connection (leaving a TIME_WAIT socket behind on close), then with
+// connection reuse. The regular workers keep running on their own pool.
+func runPortChurn(connStr string, goroutines int, hold time.Duration) bool {
+	churnDB, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer churnDB.Close()
+	churnDB.SetMaxOpenConns(goroutines)
+
+	phases := []*churnPhase{
+		{name: "churn", errors: map[string]int{}},
+		{name: "reuse", errors: map[string]int{}},
+	}
+	var current atomic.Pointer[churnPhase]
+	current.Store(phases[0])
+	churnDB.SetMaxIdleConns(0)
+	churnDB.SetConnMaxLifetime(time.Millisecond)
+
+	lo, hi := localPortRange()
+	fmt.Printf(">>> PORT_CHURN: %d goroutines without idle connections, ephemeral ports %d-%d\n", goroutines, lo, hi)
+	startPhase("portchurn:churn")
+
+	ctx, stop := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				qctx, cancel := context.WithTimeout(ctx, time.Second)
+				_, err := churnDB.ExecContext(qctx, "SELECT 1")
+				cancel()
+				if err != nil && ctx.Err() == nil {
+					current.Load().fail(err)
+					time.Sleep(10 * time.Millisecond) // avoid spinning on instant dial errors
+				} else if err == nil {
+					current.Load().ok.Add(1)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		var prevOK int64
+		var prevClosed int64
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			p := current.Load()
+			stats := churnDB.Stats()
+			closed := stats.MaxIdleClosed + stats.MaxLifetimeClosed
+			tw := countTimeWait()
+			p.mu.Lock()
+			if tw > p.peakTimeWait {
+				p.peakTimeWait = tw
+			}
+			failed := 0
+			for _, n := range p.errors {
+				failed += n
+			}
+			p.mu.Unlock()
+			ok := p.ok.Load()
+			if ok < prevOK {
+				prevOK = 0
+			}
+			fmt.Fprintf(os.Stderr, "[%s] PORT_CHURN: phase=%s ok/s=%d closed/s=%d failed=%d time_wait=%d\n",
+				time.Now().Format("04:05"), p.name, ok-prevOK, closed-prevClosed, failed, tw)
+			prevOK, prevClosed = ok, closed
+		}
+	}()
+
+	time.Sleep(hold / 2)
+	// Mitigation: keep connections idle in the pool instead of closing them
+	churnDB.SetMaxIdleConns(goroutines)
+	churnDB.SetConnMaxLifetime(0)
+	current.Store(phases[1])
+	fmt.Println(">>> PORT_CHURN: switched to connection reuse (MaxIdleConns=MaxOpenConns, no lifetime)")
+	startPhase("portchurn:reuse")
+	time.Sleep(hold / 2)
+	stop()
+	wg.Wait()
+
+	fmt.Println()
+	fmt.Println(">>> PORT_CHURN REPORT")
+	fmt.Printf("%-8s %10s %14s   %s\n", "Phase", "OK", "Peak TIME_WAIT", "Errors")
+	exhausted := false
+	for _, p := range phases {
+		var errs []string
+		for class, n := range p.errors {
+			errs = append(errs, fmt.Sprintf("%s=%d", class, n))
+		}
+		sort.Strings(errs)
+		fmt.Printf("%-8s %10d %14d   %s\n", p.name, p.ok.Load(), p.peakTimeWait, strings.Join(errs, " "))
+		if p.name == "churn" && p.errors["port_exhaustion"] > 0 {
+			exhausted = true
+		}
+	}
+	if exhausted {
+		fmt.Println(">>> PORT_CHURN: ephemeral ports exhausted while churning; connection reuse is the mitigation")
+	} else {
+		fmt.Println(">>> PORT_CHURN: ports not exhausted; raise -churn-goroutines or narrow net.ipv4.ip_local_port_range to reach the limit")
+	}
+	return phases[1].errors["port_exhaustion"] == 0
+}
@@ -0,0 +1,150 @@
+// Preflight checks for the privileges and headroom a scenario needs.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// preflightNeeds is what the selected scenario requires from the server
+type preflightNeeds struct {
+	mode        string
+	conns       int      // connections the run opens at its peak
+	superuser   string   // non-empty: why superuser is required
+	extensions  []string // extensions which must be available
+	minVersion  int      // server_version_num, 0 for any
+	alterSystem []string // GUCs changed with ALTER SYSTEM
+	plaintext   string   // non-empty: why the connection must not use TLS
+}
+
+type preflightCheck struct {
+	level  string // ok, WARN or FAIL
+	what   string
+	action string
+}
+
+// runPreflight checks needs against the server and prints the results. It
+// returns false if any check failed.
+func runPreflight(connStr string, needs preflightNeeds) bool {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var checks []preflightCheck
+	add := func(level, what, action string) { checks = append(checks, preflightCheck{level, what, action}) }
+
+	var version int
+	var versionStr string
+	var superuser bool
+	if err := db.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int, current_setting('server_version'), rolsuper FROM pg_roles WHERE rolname = current_user").Scan(&version, &versionStr, &superuser); err != nil {
+		add("FAIL", fmt.Sprintf("unable to query server: %v", err), "check DATABASE_URL")
+		return printPreflight(needs.mode, checks)
+	}
+	if needs.minVersion > 0 && version < needs.minVersion {
+		add("FAIL", fmt.Sprintf("server version %s, need %d or newer", versionStr, needs.minVersion/10000), "run against a newer Postgres")
+	} else {
+		add("ok", "server version "+versionStr, "")
+	}
+
+	var canCreate bool
+	if err := db.QueryRowContext(ctx, "SELECT has_schema_privilege(current_schema(), 'CREATE')").Scan(&canCreate); err != nil {
+		add("WARN", fmt.Sprintf("unable to check CREATE privilege on current schema: %v", err), "")
+	} else if canCreate {
+		add("ok", "CREATE on current schema", "")
+	} else {
+		add("FAIL", "no CREATE privilege on current schema, test tables cannot be created", "GRANT CREATE ON SCHEMA to the test user")
+	}
+
+	if needs.superuser != "" {
+		if superuser {
+			add("ok", "superuser ("+needs.superuser+")", "")
+		} else {
+			add("FAIL", "not superuser, needed for "+needs.superuser, "connect as a superuser or drop the option")
+		}
+	}
+	for _, name := range needs.alterSystem {
+		if superuser {
+			continue
+		}
+		var allowed bool
+		if version >= 150000 {
+			if err := db.QueryRowContext(ctx, "SELECT has_parameter_privilege($1, 'ALTER SYSTEM')", name).Scan(&allowed); err != nil {
+				add("WARN", fmt.Sprintf("unable to check ALTER SYSTEM privilege for %s: %v", name, err), "")
+				continue
+			}
+		}
+		if !allowed {
+			add("FAIL", "no ALTER SYSTEM privilege for "+name, "GRANT ALTER SYSTEM ON PARAMETER "+name+" (Postgres 15+) or connect as superuser")
+		}
+	}
+
+	for _, ext := range needs.extensions {
+		var available bool
+		if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = $1)", ext).Scan(&available); err != nil {
+			add("WARN", fmt.Sprintf("unable to check extension %s: %v", ext, err), "")
+		} else if available {
+			add("ok", "extension "+ext+" available", "")
+		} else {
+			add("FAIL", "extension "+ext+" not available", "install the Postgres contrib package")
+		}
+	}
+	var statStatements bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_stat_statements')").Scan(&statStatements); err != nil {
+		add("WARN", fmt.Sprintf("unable to check for pg_stat_statements: %v", err), "")
+	} else if !statStatements {
+		add("WARN", "pg_stat_statements not installed, server-side statement timings are unavailable for comparison", "add pg_stat_statements to shared_preload_libraries and CREATE EXTENSION")
+	}
+
+	if needs.plaintext != "" {
+		var ssl bool
+		if err := db.QueryRowContext(ctx, "SELECT COALESCE((SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()), false)").Scan(&ssl); err != nil {
+			add("WARN", fmt.Sprintf("unable to check for TLS, %s needs plaintext: %v", needs.plaintext, err), "")
+		} else if ssl {
+			add("FAIL", "connection uses TLS, "+needs.plaintext+" needs plaintext", "add sslmode=disable to DATABASE_URL")
+		}
+	}
+
+	// Connection headroom for roles without superuser privileges
+	var maxConns, reserved, inUse int
+	if err := db.QueryRowContext(ctx, `SELECT current_setting('max_connections')::int,
+		current_setting('superuser_reserved_connections')::int + COALESCE(current_setting('reserved_connections', true)::int, 0),
+		(SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend')`).Scan(&maxConns, &reserved, &inUse); err != nil {
+		add("WARN", fmt.Sprintf("unable to check connection headroom: %v", err), "")
+		return printPreflight(needs.mode, checks)
+	}
+	available := maxConns - reserved - inUse
+	what := fmt.Sprintf("connection headroom: need %d, available %d (max_connections=%d, reserved=%d, in use=%d)", needs.conns, available, maxConns, reserved, inUse)
+	switch {
+	case needs.conns > available:
+		add("FAIL", what, "raise max_connections, stop other clients or reduce pool sizes")
+	case needs.conns > available*8/10:
+		add("WARN", what, "little headroom left for reconnects and monitoring sessions")
+	default:
+		add("ok", what, "")
+	}
+
+	return printPreflight(needs.mode, checks)
+}
+
+func printPreflight(mode string, checks []preflightCheck) bool {
+	fmt.Printf(">>> PREFLIGHT: %s\n", mode)
+	ok := true
+	for _, c := range checks {
+		fmt.Printf("  %-5s %s\n", c.level, c.what)
+		if c.action != "" {
+			fmt.Printf("        -> %s\n", c.action)
+		}
+		ok = ok && c.level != "FAIL"
+	}
+	fmt.Println()
+	return ok
+}
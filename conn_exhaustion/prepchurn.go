@@ -0,0 +1,177 @@
+// Scenario: many distinct statements per connection, typically through a
+// transaction pooler, under each of pgx's query exec modes.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// queryExecModes are pgx's default_query_exec_mode values, from most to least
+// server-side state: cache_statement keeps a named prepared statement per
+// distinct SQL text (up to the statement cache capacity), cache_describe
+// caches only the description and uses the unnamed statement, describe_exec
+// describes every time, exec skips the describe, and simple_protocol sends
+// the text with parameters interpolated by the client.
+var queryExecModes = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
+}
+
+var prepChurnModes = []string{"cache_statement", "cache_describe", "describe_exec", "exec", "simple_protocol"}
+
+const prepChurnPool = 10
+
+type prepChurnResult struct {
+	ok        int64
+	errors    map[string]int // by SQLSTATE, or error text for non-server errors
+	p50       time.Duration
+	maxPrep   int   // most prepared statements seen on one server session
+	maxMemory int64 // most CachedPlanSource memory on one server session, -1 if unknown
+	sampled   int
+}
+
+func init() {
+	registerScenario("prepchurn", scenario{
+		standalone: func(o *options) bool { return runPrepChurn(o.connStr, o.prepStatements) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = prepChurnPool },
+	})
+}
+
+// runPrepChurn runs the given number of distinct statement texts on 4
+// workers for each exec mode, sampling prepared statements and plan cache
+// memory of the server sessions behind the pool along the way
+func runPrepChurn(connStr string, statements int) bool {
+	saved := queryExecMode
+	defer func() { queryExecMode = saved }()
+
+	results := map[string]*prepChurnResult{}
+	for _, mode := range prepChurnModes {
+		queryExecMode = mode
+		fmt.Fprintf(os.Stderr, "[%s] PREP_CHURN: %s\n", time.Now().Format("04:05"), mode)
+		db, err := openDB(connStr, "pg-idle-test-prepchurn")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+			return false
+		}
+		db.SetMaxOpenConns(prepChurnPool)
+		db.SetMaxIdleConns(prepChurnPool)
+
+		r := &prepChurnResult{errors: map[string]int{}, maxMemory: -1}
+		var mu sync.Mutex
+		var latencies []time.Duration
+		var next atomic.Int64
+		var wg sync.WaitGroup
+		sample := func() {
+			// Through a transaction pooler each sample lands on whichever
+			// server session is free, so sampling every pooled connection
+			// covers most of them
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			var sampling sync.WaitGroup
+			for i := 0; i < prepChurnPool/2; i++ {
+				sampling.Add(1)
+				go func() {
+					defer sampling.Done()
+					var prepared int
+					var memory int64
+					err := db.QueryRowContext(ctx, `SELECT (SELECT count(*) FROM pg_prepared_statements),
+						COALESCE((SELECT sum(total_bytes) FROM pg_backend_memory_contexts WHERE name = 'CachedPlanSource'), 0)`).Scan(&prepared, &memory)
+					if err != nil {
+						// pg_backend_memory_contexts is Postgres 14+
+						err = db.QueryRowContext(ctx, "SELECT count(*) FROM pg_prepared_statements").Scan(&prepared)
+						memory = -1
+					}
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					r.sampled++
+					r.maxPrep = max(r.maxPrep, prepared)
+					r.maxMemory = max(r.maxMemory, memory)
+					mu.Unlock()
+				}()
+			}
+			sampling.Wait()
+		}
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := next.Add(1); n <= int64(statements); n = next.Add(1) {
+					ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+					start := time.Now()
+					var v int64
+					// A distinct text per statement, as generated SQL or
+					// per-tenant table names produce
+					err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT $1::int8 + %d", n), n).Scan(&v)
+					elapsed := time.Since(start)
+					cancel()
+					mu.Lock()
+					if err != nil {
+						r.errors[prepChurnErrorKey(err)]++
+					} else {
+						r.ok++
+						latencies = append(latencies, elapsed)
+					}
+					mu.Unlock()
+					if n%500 == 0 {
+						sample()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		sample()
+		db.Close()
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		r.p50 = percentile(latencies, 0.50)
+		results[mode] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> PREPARED STATEMENT CHURN REPORT")
+	fmt.Printf("%d distinct statements per mode on a pool of %d\n\n", statements, prepChurnPool)
+	fmt.Printf("%-16s %8s %8s %10s %12s %14s  %s\n", "Mode", "OK", "Errors", "p50", "MaxPrepared", "MaxPlanMemKB", "Errors by code")
+	for _, mode := range prepChurnModes {
+		r := results[mode]
+		failed := 0
+		var codes []string
+		for code, n := range r.errors {
+			failed += n
+			codes = append(codes, fmt.Sprintf("%s=%d", code, n))
+		}
+		sort.Strings(codes)
+		memory := "n/a"
+		if r.maxMemory >= 0 {
+			memory = fmt.Sprint(r.maxMemory / 1024)
+		}
+		fmt.Printf("%-16s %8d %8d %10s %12d %14s  %s\n", mode, r.ok, failed, ms(r.p50), r.maxPrep, memory, strings.Join(codes, " "))
+	}
+	fmt.Println()
+	fmt.Println("MaxPrepared and MaxPlanMemKB are the most seen on one server session. Behind a transaction pooler without")
+	fmt.Println("prepared statement support, 26000 (prepared statement does not exist) and 42P05 (already exists) come from")
+	fmt.Println("a statement prepared on one server connection and executed on another.")
+	return true
+}
+
+func prepChurnErrorKey(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return classifyError(err)
+}
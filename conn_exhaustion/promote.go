@@ -0,0 +1,315 @@
+// Scenario: promoting a standby mid-run and flipping the application's
+// traffic to it, as seen by the client.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// promoteSecond is one second of the promotion timeline
+type promoteSecond struct {
+	phase     string
+	writes    int // committed writes
+	readOnly  int // writes refused with 25006 before promotion finished
+	reads     int // committed standby reads
+	conflicts int // reads canceled or terminated by recovery conflicts
+	resets    int // connections lost or refused
+	other     int
+	latencies []time.Duration // of committed writes
+}
+
+type promoteTimeline struct {
+	mu      sync.Mutex
+	start   time.Time
+	phase   string
+	seconds []*promoteSecond
+	example map[string]string // first error per column
+}
+
+func (t *promoteTimeline) setPhase(name string) {
+	t.mu.Lock()
+	t.phase = name
+	t.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "[%s] PROMOTE: %s\n", time.Now().Format("04:05"), name)
+}
+
+// record files the outcome of a write or read under the current second
+func (t *promoteTimeline) record(write bool, d time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	i := int(time.Since(t.start) / time.Second)
+	for len(t.seconds) <= i {
+		t.seconds = append(t.seconds, &promoteSecond{phase: t.phase})
+	}
+	s := t.seconds[i]
+	column := promoteColumn(err)
+	switch {
+	case column == "ok" && write:
+		s.writes++
+		s.latencies = append(s.latencies, d)
+	case column == "ok":
+		s.reads++
+	case column == "read_only":
+		s.readOnly++
+	case column == "conflict":
+		s.conflicts++
+	case column == "reset":
+		s.resets++
+	default:
+		s.other++
+	}
+	if err != nil && t.example[column] == "" {
+		t.example[column] = oneLine(err.Error())
+	}
+}
+
+// promoteColumn sorts a statement's outcome into the timeline's columns
+func promoteColumn(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "25006":
+			return "read_only"
+		case strings.Contains(pgErr.Message, "conflict with recovery"):
+			return "conflict"
+		case pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03":
+			return "reset"
+		}
+		return "other"
+	}
+	switch classifyError(err) {
+	case "broken_conn", "dial_failure", "server_fatal":
+		return "reset"
+	}
+	return "other"
+}
+
+// standbyConflicts reads pg_stat_database_conflicts on the standby
+func standbyConflicts(db *sql.DB) map[string]int64 {
+	var tablespace, lock, snapshot, bufferpin, deadlock int64
+	db.QueryRow(`SELECT confl_tablespace, confl_lock, confl_snapshot, confl_bufferpin, confl_deadlock
+		FROM pg_stat_database_conflicts WHERE datname = current_database()`).Scan(&tablespace, &lock, &snapshot, &bufferpin, &deadlock)
+	return map[string]int64{"tablespace": tablespace, "lock": lock, "snapshot": snapshot, "bufferpin": bufferpin, "deadlock": deadlock}
+}
+
+func init() {
+	registerScenario("promote", scenario{
+		standalone: func(o *options) bool { return runPromote(o.connStr, o.standbyURL, o.promoteCmd) },
+		validate: func(o *options) error {
+			if o.standbyURL == "" {
+				return errors.New("promote needs -standby-url, the connection string of a standby of DATABASE_URL")
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = 10 + 1 },
+	})
+}
+
+// runPromote writes to the primary while reading on the standby, flips the
+// writes to the standby, promotes it 5s later with pg_promote() or
+// promoteCmd and keeps writing for 20s. It reports every second of the
+// timeline and passes if the promoted standby took the writes.
+func runPromote(primaryURL, standbyURL, promoteCmd string) bool {
+	primary, err := openDB(primaryURL, "pg-idle-test-promote")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", primaryURL, err)
+		return false
+	}
+	defer primary.Close()
+	standby, err := openDB(standbyURL, "pg-idle-test-promote")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with -standby-url='%s': %v\n", standbyURL, err)
+		return false
+	}
+	defer standby.Close()
+	readers, _ := openDB(standbyURL, "pg-idle-test-promote-reader")
+	defer readers.Close()
+	control, _ := sql.Open("pgx", standbyURL)
+	defer control.Close()
+	primary.SetMaxOpenConns(10)
+	standby.SetMaxOpenConns(10)
+	readers.SetMaxOpenConns(5)
+	control.SetMaxOpenConns(1)
+
+	var inRecovery bool
+	if err := control.QueryRow("SELECT pg_is_in_recovery()").Scan(&inRecovery); err != nil || !inRecovery {
+		fmt.Fprintf(os.Stderr, "ERROR: -standby-url is not a standby (pg_is_in_recovery=%t): %v\n", inRecovery, err)
+		return false
+	}
+	primary.Exec("DROP TABLE IF EXISTS test_promote")
+	primary.Exec("CREATE TABLE test_promote (id INT PRIMARY KEY, val BIGINT)")
+	primary.Exec("INSERT INTO test_promote SELECT g, 0 FROM generate_series(1, 10) g")
+	replicated := false
+	for deadline := time.Now().Add(10 * time.Second); !replicated && time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		var rows int
+		replicated = control.QueryRow("SELECT count(*) FROM test_promote").Scan(&rows) == nil && rows == 10
+	}
+	if !replicated {
+		fmt.Fprintf(os.Stderr, "ERROR: test_promote did not reach the standby within 10s; is -standby-url a standby of DATABASE_URL?\n")
+		return false
+	}
+	conflictsBefore := standbyConflicts(control)
+
+	t := &promoteTimeline{start: time.Now(), phase: "primary", example: map[string]string{}}
+	var target atomic.Pointer[sql.DB]
+	target.Store(primary)
+	var stopping atomic.Bool
+	var firstWrite atomic.Int64 // unix nanos of the first write the standby committed
+	var workers sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		workers.Add(1)
+		go func(id int) {
+			defer workers.Done()
+			for !stopping.Load() {
+				db := target.Load()
+				ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+				start := time.Now()
+				_, err := db.ExecContext(ctx, "UPDATE test_promote SET val = val + 1 WHERE id = $1", id)
+				cancel()
+				t.record(true, time.Since(start), err)
+				if err == nil && db == standby {
+					firstWrite.CompareAndSwap(0, time.Now().UnixNano())
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}(1 + i)
+	}
+	// Readers hold a snapshot for 500ms, so replay of the primary's vacuum
+	// conflicts with them unless hot_standby_feedback is on
+	for i := 0; i < 5; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for !stopping.Load() {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				start := time.Now()
+				tx, err := readers.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+				if err == nil {
+					var sum int64
+					err = tx.QueryRowContext(ctx, "SELECT sum(val) FROM test_promote").Scan(&sum)
+					if err == nil {
+						_, err = tx.ExecContext(ctx, "SELECT pg_sleep(0.5)")
+					}
+					if err == nil {
+						err = tx.Commit()
+					} else {
+						tx.Rollback()
+					}
+				}
+				cancel()
+				t.record(false, time.Since(start), err)
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Second)
+	t.setPhase("flipped")
+	flipAt := time.Now()
+	target.Store(standby)
+	time.Sleep(5 * time.Second)
+	conflictsAtPromotion := standbyConflicts(control)
+
+	t.setPhase("promoting")
+	promoteAt := time.Now()
+	if promoteCmd != "" {
+		cmd := shellCommand(promoteCmd)
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		err = cmd.Run()
+	} else {
+		var promoted bool
+		err = control.QueryRow("SELECT pg_promote(true, 60)").Scan(&promoted)
+		if err == nil && !promoted {
+			err = errors.New("pg_promote() returned false")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to promote the standby: %v\n", err)
+	}
+	// A trigger file or helper returns before the promotion is done
+	var promotedAt time.Time
+	for deadline := time.Now().Add(60 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if control.QueryRow("SELECT pg_is_in_recovery()").Scan(&inRecovery) == nil && !inRecovery {
+			promotedAt = time.Now()
+			break
+		}
+	}
+	t.setPhase("promoted")
+	time.Sleep(20 * time.Second)
+	stopping.Store(true)
+	workers.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Println()
+	fmt.Println(">>> PROMOTION TIMELINE")
+	fmt.Printf("%4s %-10s %7s %9s %6s %10s %7s %6s %9s\n", "Sec", "Phase", "Writes", "ReadOnly", "Reads", "Conflicts", "Resets", "Other", "WriteP50")
+	var baseline []time.Duration
+	for i, s := range t.seconds {
+		sort.Slice(s.latencies, func(a, b int) bool { return s.latencies[a] < s.latencies[b] })
+		if s.phase == "primary" && i > 0 && len(s.latencies) > 0 {
+			baseline = append(baseline, s.latencies[len(s.latencies)/2])
+		}
+	}
+	sort.Slice(baseline, func(a, b int) bool { return baseline[a] < baseline[b] })
+	warmedUp := time.Duration(-1)
+	for i, s := range t.seconds {
+		p50 := "-"
+		if len(s.latencies) > 0 {
+			median := s.latencies[len(s.latencies)/2]
+			p50 = fmt.Sprintf("%.1fms", float64(median.Microseconds())/1000)
+			// Warmed up once the promoted standby is back within 1.5x of the
+			// primary's typical latency
+			if warmedUp < 0 && s.phase == "promoted" && len(baseline) > 0 && !promotedAt.IsZero() && median*2 <= baseline[len(baseline)/2]*3 {
+				warmedUp = max(t.start.Add(time.Duration(i+1)*time.Second).Sub(promotedAt), 0)
+			}
+		}
+		fmt.Printf("%4d %-10s %7d %9d %6d %10d %7d %6d %9s\n", i, s.phase, s.writes, s.readOnly, s.reads, s.conflicts, s.resets, s.other, p50)
+	}
+	fmt.Println()
+	var kinds []string
+	for _, kind := range []string{"snapshot", "lock", "bufferpin", "deadlock", "tablespace"} {
+		kinds = append(kinds, fmt.Sprintf("%s=%d", kind, conflictsAtPromotion[kind]-conflictsBefore[kind]))
+	}
+	fmt.Printf("recovery conflicts: %s (pg_stat_database_conflicts on the standby before promotion)\n", strings.Join(kinds, " "))
+	for _, column := range []string{"read_only", "conflict", "reset", "other"} {
+		if e := t.example[column]; e != "" {
+			fmt.Printf("first %-9s %s\n", column+":", e)
+		}
+	}
+	if promotedAt.IsZero() {
+		fmt.Println()
+		fmt.Println(">>> PROMOTE: FAIL the standby was still in recovery 60s after the promotion was requested")
+		return false
+	}
+	fmt.Printf("traffic flip to promotion request: %v, promotion took %v\n", promoteAt.Sub(flipAt).Round(time.Millisecond), promotedAt.Sub(promoteAt).Round(time.Millisecond))
+	if firstWrite.Load() == 0 {
+		fmt.Println()
+		fmt.Println(">>> PROMOTE: FAIL the promoted standby committed no writes")
+		return false
+	}
+	fmt.Printf("first write on the promoted standby: %v after the flip, %v after the promotion finished\n",
+		time.Unix(0, firstWrite.Load()).Sub(flipAt).Round(time.Millisecond), time.Unix(0, firstWrite.Load()).Sub(promotedAt).Round(time.Millisecond))
+	if warmedUp >= 0 {
+		fmt.Printf("write p50 back within 1.5x of the primary's %v after the promotion\n", warmedUp.Round(time.Second))
+	} else {
+		fmt.Println("write p50 did not get back within 1.5x of the primary's")
+	}
+	fmt.Println()
+	fmt.Println(">>> PROMOTE: PASS the promoted standby took the writes")
+	return true
+}
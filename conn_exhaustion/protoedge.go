@@ -0,0 +1,145 @@
+// Scenario: how the driver and database/sql handle a server which misbehaves
+// at the protocol level, against the in-process mock server, so the edge
+// cases need neither a real database nor root to provoke.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// protoEdgeProbe is one client call against a misbehaving server
+type protoEdgeProbe struct {
+	behavior, call string
+	elapsed        time.Duration
+	sessions       int32 // connections the client opened for the call
+	cancels        int32 // CancelRequests the client sent
+	err            error
+	note           string
+}
+
+func init() {
+	registerScenario("protoedge", scenario{
+		standalone: func(o *options) bool { return runProtoEdge() },
+		offline:    true,
+	})
+}
+
+func runProtoEdge() bool {
+	var probes []protoEdgeProbe
+	for _, run := range []func() ([]protoEdgeProbe, error){probeDropAfterAuth, probeLateReady, probeHeldTerminate} {
+		p, err := run()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to start mock server: %v\n", err)
+			return false
+		}
+		probes = append(probes, p...)
+	}
+
+	fmt.Println(">>> PROTOCOL EDGES (database/sql over pgx against an in-process mock server)")
+	fmt.Printf("%-26s %-22s %10s %9s %8s %-18s %s\n", "Server behavior", "Client call", "Elapsed", "Sessions", "Cancels", "Class", "Result")
+	for _, p := range probes {
+		class, result := "none", p.note
+		if p.err != nil {
+			class, result = classifyError(p.err), oneLine(p.err.Error())
+		}
+		fmt.Printf("%-26s %-22s %10s %9d %8d %-18s %s\n", p.behavior, p.call, ms(p.elapsed), p.sessions, p.cancels, class, result)
+	}
+	fmt.Println()
+	fmt.Println("Sessions counts the connections the call opened, so more than one means database/sql retried it on a fresh")
+	fmt.Println("connection after driver.ErrBadConn. A statement deadline which expires before ReadyForQuery must give up the")
+	fmt.Println("connection, since its protocol state is unknown, and the next statement pays for a new one.")
+	return true
+}
+
+// probeDropAfterAuth: the server accepts the password and closes before
+// ReadyForQuery, as one which runs out of slots or crashes mid-startup does
+func probeDropAfterAuth() ([]protoEdgeProbe, error) {
+	mock, err := startMockPostgres(mockBehavior{dropAfterAuth: true})
+	if err != nil {
+		return nil, err
+	}
+	defer mock.close()
+	db, err := sql.Open("pgx", mock.connStr())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	p := protoEdgeProbe{behavior: "drops after auth", call: "Ping"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	p.err = db.PingContext(ctx)
+	p.elapsed, p.sessions = time.Since(start), mock.sessions.Load()
+	return []protoEdgeProbe{p}, nil
+}
+
+// probeLateReady: the server sends a statement's results but holds
+// ReadyForQuery back past the statement deadline, then answers the next
+// statement within its deadline
+func probeLateReady() ([]protoEdgeProbe, error) {
+	delay := 2 * time.Second
+	mock, err := startMockPostgres(mockBehavior{readyDelay: delay})
+	if err != nil {
+		return nil, err
+	}
+	defer mock.close()
+	db, err := sql.Open("pgx", mock.connStr())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	behavior := fmt.Sprintf("ReadyForQuery %v late", delay)
+
+	var probes []protoEdgeProbe
+	for _, timeout := range []time.Duration{delay / 2, 2 * delay} {
+		p := protoEdgeProbe{behavior: behavior, call: fmt.Sprintf("Exec, %v deadline", timeout)}
+		before, cancelsBefore := mock.sessions.Load(), mock.cancels.Load()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+		_, p.err = db.ExecContext(ctx, "SELECT 1")
+		p.elapsed = time.Since(start)
+		cancel()
+		time.Sleep(100 * time.Millisecond) // the cancel request is sent asynchronously
+		p.sessions, p.cancels = mock.sessions.Load()-before, mock.cancels.Load()-cancelsBefore
+		p.note = "ok"
+		if len(probes) > 0 && p.sessions > 0 {
+			p.note = "ok on a new connection"
+		}
+		probes = append(probes, p)
+	}
+	return probes, nil
+}
+
+// probeHeldTerminate: the server never closes its side after Terminate, so
+// only the client closing the socket ends the session
+func probeHeldTerminate() ([]protoEdgeProbe, error) {
+	mock, err := startMockPostgres(mockBehavior{holdAfterTerminate: true})
+	if err != nil {
+		return nil, err
+	}
+	defer mock.close()
+	db, err := sql.Open("pgx", mock.connStr())
+	if err != nil {
+		return nil, err
+	}
+	p := protoEdgeProbe{behavior: "ignores Terminate", call: "DB.Close"}
+	if p.err = db.Ping(); p.err != nil {
+		db.Close()
+		return []protoEdgeProbe{p}, nil
+	}
+	start := time.Now()
+	p.err = db.Close()
+	p.elapsed, p.sessions = time.Since(start), mock.sessions.Load()
+	select {
+	case d := <-mock.terminated:
+		p.note = fmt.Sprintf("client closed the socket %s after Terminate", ms(d))
+	case <-time.After(5 * time.Second):
+		p.note = "socket still open 5s after Terminate"
+	}
+	return []protoEdgeProbe{p}, nil
+}
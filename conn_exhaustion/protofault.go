@@ -0,0 +1,216 @@
+// Scenario: a catalog of malformed and abusive server responses from the
+// mock server, and how pgx and database/sql come out of each.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// protocolFaults are the mock behaviors of the catalog, each hitting the
+// first statement the mock server runs
+var protocolFaults = []struct {
+	name     string
+	behavior mockBehavior
+}{
+	{"truncated DataRow", mockBehavior{truncateDataRow: true}},
+	{"duplicate ReadyForQuery", mockBehavior{duplicateReady: true}},
+	{"NOTICE flood (100000)", mockBehavior{noticeFlood: 100000}},
+	{"TLS close, no Terminate", mockBehavior{tls: true, closeAfterFirst: true}},
+}
+
+// protoFaultStep is one statement of a probe: SELECT n, which should return n
+type protoFaultStep struct {
+	elapsed time.Duration
+	got     int
+	want    int
+	err     error
+	panic   string // the driver panicked instead of returning
+}
+
+func (s protoFaultStep) String() string {
+	switch {
+	case s.panic != "":
+		return "panic"
+	case s.err != nil:
+		return classifyError(s.err)
+	case s.got != s.want:
+		return fmt.Sprintf("got %d, want %d", s.got, s.want)
+	}
+	return "ok " + ms(s.elapsed)
+}
+
+func (s protoFaultStep) hung() bool { return errors.Is(s.err, context.DeadlineExceeded) }
+
+// protoFaultProbe is what one client made of one fault: the faulty first
+// statement and the two after it on the same pgx connection or
+// database/sql pool, and whether the connection was closed or replaced
+type protoFaultProbe struct {
+	fault, client string
+	steps         [3]protoFaultStep
+	conn          string
+}
+
+// verdict classifies the driver's handling of the fault: robust when every
+// statement got its own answer or an error and the client ends up with a
+// usable connection or knows it has none
+func (p protoFaultProbe) verdict() string {
+	var panicked, hung, wrong bool
+	for _, s := range p.steps {
+		panicked = panicked || s.panic != ""
+		hung = hung || s.hung()
+		wrong = wrong || (s.err == nil && s.panic == "" && s.got != s.want)
+	}
+	next, then := p.steps[1], p.steps[2]
+	switch {
+	case panicked:
+		return "crash: driver panic"
+	case hung:
+		return "hang"
+	case wrong:
+		return "desync: wrong result"
+	case next.err == nil:
+		return "robust"
+	case p.conn == "closed":
+		return "robust, reconnect needed"
+	case then.err == nil:
+		return "recovers after a failed statement"
+	}
+	return "broken: connection unusable"
+}
+
+func init() {
+	registerScenario("protofault", scenario{
+		standalone: func(o *options) bool { return runProtoFaults() },
+		offline:    true,
+	})
+}
+
+func runProtoFaults() bool {
+	var probes []protoFaultProbe
+	for _, f := range protocolFaults {
+		for _, client := range []func(string, mockBehavior) (protoFaultProbe, error){probeFaultPgx, probeFaultSQL} {
+			p, err := client(f.name, f.behavior)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", f.name, err)
+				return false
+			}
+			probes = append(probes, p)
+		}
+	}
+
+	fmt.Println(">>> DRIVER ROBUSTNESS (protocol faults from an in-process mock server, 3s statement deadline)")
+	fmt.Printf("%-24s %-13s %-16s %-16s %-16s %-9s %s\n", "Fault", "Client", "Faulty statement", "Next", "Then", "Conn", "Verdict")
+	for _, p := range probes {
+		fmt.Printf("%-24s %-13s %-16s %-16s %-16s %-9s %s\n", p.fault, p.client, p.steps[0], p.steps[1], p.steps[2], p.conn, p.verdict())
+	}
+	fmt.Println()
+	for _, p := range probes {
+		reported := false
+		for _, step := range p.steps {
+			switch {
+			case step.panic != "":
+				fmt.Printf("  %s, %s: panic: %s\n", p.fault, p.client, step.panic)
+			case step.err != nil && !reported:
+				fmt.Printf("  %s, %s: %s\n", p.fault, p.client, oneLine(step.err.Error()))
+				reported = true
+			}
+		}
+	}
+	fmt.Println()
+	fmt.Println("Each fault hits the first statement, SELECT 1; SELECT 2 and SELECT 3 after it show whether the connection is")
+	fmt.Println("still in step with the server. Conn is whether pgx closed its connection or database/sql replaced it after the")
+	fmt.Println("fault. A desync returns another statement's result, the worst outcome for an application.")
+	return true
+}
+
+// faultStep runs one statement, recovering a driver panic so the catalog
+// goes on
+func faultStep(want int, run func(ctx context.Context) (int, error)) (s protoFaultStep) {
+	s.want = want
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			s.panic, s.elapsed = fmt.Sprint(r), time.Since(start)
+		}
+	}()
+	s.got, s.err = run(ctx)
+	s.elapsed = time.Since(start)
+	return s
+}
+
+// probeFaultPgx runs the two statements on one pgx connection
+func probeFaultPgx(fault string, behavior mockBehavior) (protoFaultProbe, error) {
+	p := protoFaultProbe{fault: fault, client: "pgx"}
+	mock, err := startMockPostgres(behavior)
+	if err != nil {
+		return p, err
+	}
+	defer mock.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := pgx.Connect(ctx, mock.connStr())
+	if err != nil {
+		return p, err
+	}
+	defer conn.Close(context.Background())
+	query := func(n int) func(ctx context.Context) (int, error) {
+		return func(ctx context.Context) (got int, err error) {
+			err = conn.QueryRow(ctx, fmt.Sprintf("SELECT %d", n)).Scan(&got)
+			return got, err
+		}
+	}
+	for i := range p.steps {
+		p.steps[i] = faultStep(i+1, query(i+1))
+		if i == 1 {
+			p.conn = "open"
+			if conn.IsClosed() {
+				p.conn = "closed"
+			}
+		}
+	}
+	return p, nil
+}
+
+// probeFaultSQL runs the two statements through a database/sql pool of one
+// connection, which discards a bad connection and dials another
+func probeFaultSQL(fault string, behavior mockBehavior) (protoFaultProbe, error) {
+	p := protoFaultProbe{fault: fault, client: "database/sql"}
+	mock, err := startMockPostgres(behavior)
+	if err != nil {
+		return p, err
+	}
+	defer mock.close()
+	db, err := sql.Open("pgx", mock.connStr())
+	if err != nil {
+		return p, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		return p, err
+	}
+	query := func(n int) func(ctx context.Context) (int, error) {
+		return func(ctx context.Context) (got int, err error) {
+			err = db.QueryRowContext(ctx, fmt.Sprintf("SELECT %d", n)).Scan(&got)
+			return got, err
+		}
+	}
+	before := mock.sessions.Load()
+	for i := range p.steps {
+		p.steps[i] = faultStep(i+1, query(i+1))
+	}
+	p.conn = "reused"
+	if mock.sessions.Load() > before {
+		p.conn = "replaced"
+	}
+	return p, nil
+}
@@ -0,0 +1,142 @@
+// Read-only workload for primaries and hot standbys.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// readOnlyWorkload reads a random test_row row in an explicit READ ONLY
+// transaction, optionally SERIALIZABLE READ ONLY DEFERRABLE. Pointed at a
+// standby (e.g. target_session_attrs=standby in DATABASE_URL) it shows what
+// differs from the primary: DEFERRABLE is refused since standbys do not
+// support SERIALIZABLE, and the blocking transaction, a read which holds its
+// snapshot, is canceled by replay conflicts unless hot_standby_feedback holds
+// back vacuum on the primary instead.
+type readOnlyWorkload struct {
+	schema     schemaSpec
+	deferrable bool
+
+	standby   bool
+	total     int64 // sum of test_row.val after setup
+	committed atomic.Int64
+	inherited atomic.Int64 // iterations whose connection was already inside a transaction
+	unaudited atomic.Int64 // iterations whose connection's transaction status could not be read
+
+	mu     sync.Mutex
+	errors map[string]int // by SQLSTATE
+}
+
+func (w *readOnlyWorkload) setup(db *sql.DB) {
+	db.QueryRow("SELECT pg_is_in_recovery()").Scan(&w.standby)
+	if w.standby {
+		// The tables come from the primary through replication
+		fmt.Println(">>> READ ONLY: connected to a standby, using test_row as replicated from the primary")
+	} else {
+		w.schema.create(db)
+	}
+	db.QueryRow("SELECT COALESCE(sum(val), 0) FROM test_row").Scan(&w.total)
+}
+
+func (w *readOnlyWorkload) begin() string {
+	if w.deferrable {
+		return "BEGIN ISOLATION LEVEL SERIALIZABLE READ ONLY DEFERRABLE"
+	}
+	return "BEGIN READ ONLY"
+}
+
+func (w *readOnlyWorkload) run(ctx context.Context, db *sql.DB, worker int, iteration int) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Raw(func(driverConn any) error {
+		c, err := pgxConnOf(driverConn)
+		if err != nil {
+			return err
+		}
+		if c.PgConn().TxStatus() != 'I' {
+			w.inherited.Add(1)
+		}
+		return nil
+	}); err != nil {
+		w.unaudited.Add(1)
+		return fmt.Errorf("unable to read the connection's transaction status: %w", err)
+	}
+
+	// Inside an inherited transaction BEGIN only warns, and the COMMIT below
+	// ends the blocking transaction
+	_, err = conn.ExecContext(ctx, w.begin())
+	if err == nil {
+		var val int
+		err = conn.QueryRowContext(ctx, "SELECT val FROM test_row WHERE id = $1", 1+rand.Intn(w.schema.rows)).Scan(&val)
+	}
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "SELECT pg_sleep(0.01)")
+	}
+	if err == nil {
+		_, err = conn.ExecContext(ctx, "COMMIT")
+	}
+	if err != nil {
+		conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK")
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			w.mu.Lock()
+			w.errors[pgErr.Code]++
+			w.mu.Unlock()
+		}
+		return err
+	}
+	w.committed.Add(1)
+	return nil
+}
+
+// verify checks that test_row is unchanged, and reports how the read-only
+// transactions fared on this server
+func (w *readOnlyWorkload) verify(ctx context.Context, conn *sql.Conn) (bool, string, error) {
+	var total int64
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(sum(val), 0) FROM test_row").Scan(&total); err != nil {
+		return false, "", err
+	}
+	role := "primary"
+	if w.standby {
+		role = "standby"
+	}
+	w.mu.Lock()
+	var codes []string
+	for code, n := range w.errors {
+		codes = append(codes, fmt.Sprintf("%s=%d", code, n))
+	}
+	w.mu.Unlock()
+	sort.Strings(codes)
+	if len(codes) == 0 {
+		codes = []string{"none"}
+	}
+	detail := fmt.Sprintf("%s: %d read-only transactions committed, %d started inside an inherited transaction, errors by SQLSTATE: %s",
+		role, w.committed.Load(), w.inherited.Load(), strings.Join(codes, " "))
+	if w.errors["0A000"] > 0 && w.standby && w.deferrable {
+		fmt.Fprintf(os.Stderr, "WARNING: Standbys refuse SERIALIZABLE, so -deferrable makes every transaction fail there\n")
+	}
+	if n := w.unaudited.Load(); n > 0 {
+		return false, detail + fmt.Sprintf(" (%d iterations could not check for an inherited transaction)", n), nil
+	}
+	if total != w.total {
+		return false, detail + fmt.Sprintf(" (test_row changed by %d)", total-w.total), nil
+	}
+	return true, detail, nil
+}
+
+func (*readOnlyWorkload) poisonSQL() string {
+	return "SELECT val FROM test_row WHERE id = 1 -- POISON"
+}
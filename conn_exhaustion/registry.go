@@ -0,0 +1,332 @@
+// Scenario registry and the worker harness shared by the fault scenarios.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scenario is what a scenario registers under its catalog name. Exactly one
+// of standalone and inject is set:
+//   - standalone scenarios run their own pools and print their own report
+//   - inject scenarios run under the worker harness, which does the shared
+//     setup (pool, workload tables, monitors, workers and warmup) and
+//     teardown (phase, checkout and error reports and the invariant check),
+//     and inject their fault once the warmup is over
+type scenario struct {
+	standalone func(o *options) bool
+	inject     func(h *harness) bool
+
+	// validate checks and parses the scenario's flags before preflight
+	validate func(o *options) error
+	// needs adjusts the preflight requirements, which start at the harness's
+	needs func(o *options, n *preflightNeeds)
+	// offline standalone scenarios never connect to DATABASE_URL, so they
+	// skip the preflight and the orphan detector
+	offline bool
+
+	// appName and latencyInjection configure the harness's pool
+	appName          string
+	latencyInjection bool
+}
+
+var scenarios = map[string]scenario{}
+
+// registerScenario is called from the init of the scenario's file
+func registerScenario(name string, s scenario) {
+	if _, dup := scenarios[name]; dup {
+		panic("scenario registered twice: " + name)
+	}
+	scenarios[name] = s
+}
+
+// unregisteredScenarios lists registered scenarios missing from the catalog and
+// catalog entries without a registration, which the describe output and the
+// usage text would otherwise get wrong
+func unregisteredScenarios() []string {
+	var missing []string
+	for _, name := range modes {
+		if _, ok := scenarios[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	for name := range scenarios {
+		if !slices.Contains(modes, name) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// harness is the worker pool an inject scenario runs against
+type harness struct {
+	o       *options
+	connStr string
+	db      *sql.DB
+	wl      workload
+
+	// hint is printed when the run fails, e.g. how to replay it
+	hint string
+}
+
+// runHarness starts the workers, waits for the warmup, runs the scenario's
+// fault and reports. It returns whether the scenario and the invariant check
+// passed.
+func runHarness(o *options, s scenario, wl workload) bool {
+	connStr := o.connStr
+	if o.calibrate {
+		// Before latencyInjection and the run's monitors, which would count it
+		if r, err := runCalibration(o, 2*time.Second); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Calibration failed: %v\n", err)
+		} else {
+			r.print()
+			fmt.Println()
+			calibrated = r
+		}
+	}
+	setNarrationDeadline(o.queryTimeout, o.adaptiveTimeout)
+	latencyInjection = s.latencyInjection
+	db, err := openDriverDB(connStr, s.appName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(o.maxOpen)
+	db.SetMaxIdleConns(o.maxIdle)
+
+	// Test connection
+	if err := db.Ping(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to database with DATABASE_URL='%s': %v\n", connStr, err)
+		os.Exit(1)
+	}
+
+	if o.gucAudit > 0 {
+		if gucAudit, err = newGUCAuditor(db, parseGUCList(o.gucAuditSettings)); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start session setting audit: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.activityStats {
+		if activity, err = newActivitySampler(connStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start pg_stat_activity sampler: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.blockingInterval > 0 {
+		if blocking, err = newBlockingReporter(connStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start blocking chain reporter: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.waitSample > 0 {
+		if waitEvents, err = newWaitEventSampler(connStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start wait event sampler: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if o.poisonAudit > 0 {
+		if poisonAudit, err = newPoisonAuditor(connStr); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start poison audit: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if skew, rtt, err := measureClockSkew(db); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Unable to measure clock skew: %v\n", err)
+	} else {
+		clockSkew = skew
+		fmt.Printf(">>> CLOCK: server clock is %v relative to the client (accurate to %v)\n", skew.Round(time.Microsecond), (rtt / 2).Round(time.Microsecond))
+		if skew > time.Second || skew < -time.Second {
+			fmt.Fprintf(os.Stderr, "WARNING: Client and server clocks differ by more than 1s; reports show server-clock timestamps for correlation\n")
+		}
+	}
+
+	if o.slowQuery > 0 {
+		if watchdog, err = newSlowQueryWatchdog(connStr, o.slowQuery, o.explainAnalyze); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start slow-query watchdog: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Setup tables
+	wl.setup(db)
+
+	statsDB, _ = sql.Open("pgx", connStr)
+	statsDB.SetMaxOpenConns(1)
+	if err := prepareCache(db, o.cacheMode); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to prepare %s cache: %v\n", o.cacheMode, err)
+	}
+
+	if o.controlTable != "" || o.controlChannel != "" {
+		phaseCtl = newPhaseControl()
+		if o.controlTable != "" {
+			if err := phaseCtl.followTable(context.Background(), connStr, o.controlTable); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to set up control table %s: %v\n", o.controlTable, err)
+				os.Exit(1)
+			}
+		}
+		if o.controlChannel != "" {
+			if err := phaseCtl.listen(context.Background(), connStr, o.controlChannel, o.agent, o.agents); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to listen on control channel %s: %v\n", o.controlChannel, err)
+				os.Exit(1)
+			}
+		}
+		defer phaseCtl.close()
+	}
+
+	fmt.Println(">>> Starting workers")
+	fmt.Println()
+
+	// Start pool stats monitor
+	go monitorPoolStats(db)
+	go dumpInflightOnSignal()
+	if o.latencyInterval > 0 {
+		go queryLatencies.logIntervals(o.latencyInterval)
+	}
+	if gucAudit != nil {
+		go gucAudit.run(o.gucAudit)
+	}
+	if activity != nil {
+		go activity.run()
+	}
+	if blocking != nil {
+		go blocking.run(o.blockingInterval)
+	}
+	if waitEvents != nil {
+		go waitEvents.run(o.waitSample)
+	}
+	if poisonAudit != nil {
+		go poisonAudit.run(o.poisonAudit)
+	}
+	if o.keepalive > 0 {
+		var pings atomic.Int64
+		go runKeepalivePinger(context.Background(), db, o.keepalive, &pings)
+	}
+	metricsPool.Store(db)
+	if o.httpAddr != "" {
+		go serveHTTP(o.httpAddr)
+	}
+
+	if o.admission > 0 {
+		admission = newAdmissionGate(int64(o.admission))
+	}
+
+	if o.deadlineAudit > 0 {
+		deadlines = newDeadlineAuditor(o.deadlineAudit)
+	}
+
+	if o.adaptiveTimeout {
+		queryDeadlines = newAdaptiveTimeout(o.queryTimeout)
+	}
+
+	if o.killBlockerAfter > 0 {
+		if killer, err = newBlockerKiller(connStr, db, o.killBlockerAfter); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start blocker killer: %v\n", err)
+			os.Exit(1)
+		}
+		go killer.run()
+	}
+
+	// Start workers
+	selfOverhead.begin()
+	var workers sync.WaitGroup
+	var stopping atomic.Bool
+	if o.cacheMode == "asis" {
+		startPhase("warmup")
+	} else {
+		startPhase("warmup:" + o.cacheMode)
+	}
+	for i := 0; i < o.workers; i++ {
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			for iteration := 0; !stopping.Load(); iteration++ {
+				ctx, tag := withWorker(context.Background(), worker)
+				tag.untracked = !instrumented(iteration)
+				selfOverhead.iteration(!tag.untracked)
+				ctx, cancel := context.WithTimeout(ctx, queryDeadlines.timeout(o.queryTimeout))
+				start := time.Now()
+				deadlines.audit(ctx, "admission", "")
+				release, err := admission.acquire(ctx, 1)
+				if err == nil {
+					err = wl.run(ctx, db, worker, iteration)
+					release()
+				}
+				recordIteration(time.Since(start), err)
+				queryDeadlines.observe(time.Since(start), err)
+				recordWorkerIteration(worker, err)
+				killer.iteration(err)
+				idleTx.iteration(tag.pid.Load(), err)
+				if err != nil {
+					class := workerErrors.add(err)
+					pid := int(tag.pid.Load())
+					switch {
+					case tag.untracked: // counted by class only
+					case jsonOutput():
+						emitJSON("worker_error", map[string]any{"worker": worker, "class": class, "pid": pid, "error": err.Error()})
+					default:
+						fmt.Fprintf(os.Stderr, "ERROR: Worker failed [%s] pid=%d: %v\n", class, pid, err)
+					}
+					narrateError(class)
+					recordError(err, pid)
+				}
+				cancel()
+				time.Sleep(100 * time.Millisecond)
+			}
+		}(i)
+	}
+
+	// Wait, then inject the fault. A cold start is split in two halves so the
+	// phase report compares cold and warm cache. With a control table the
+	// fault waits for its inject row instead.
+	if o.cacheMode == "cold" && phaseCtl == nil {
+		time.Sleep(o.warmup / 2)
+		startPhase("warmup:warm")
+		time.Sleep(o.warmup / 2)
+	} else {
+		phaseCtl.await("inject", o.warmup)
+	}
+
+	h := &harness{o: o, connStr: connStr, db: db, wl: wl}
+	passed := s.inject(h)
+
+	// Let in-flight statements finish, then close the pool so any transaction
+	// still open on a pooled connection is rolled back before verification
+	stopping.Store(true)
+	workers.Wait()
+	db.Close()
+	printPhaseReport()
+	printSLOReport()
+	printAdmissionReport(o.workers, o.maxOpen)
+	queryLatencies.print()
+	printCheckoutReport()
+	deadlines.print()
+	gucAudit.print()
+	activity.print()
+	blocking.print()
+	waitEvents.print()
+	poisonAudit.print()
+	killer.print()
+	selfOverhead.print()
+	printBadConnReport()
+	orphans.print()
+	workerErrors.print()
+	passed = checkExpectations(o, checkInvariants(connStr, wl)) && passed
+	if !passed && h.hint != "" {
+		fmt.Println(h.hint)
+	}
+	return passed
+}
@@ -0,0 +1,133 @@
+// Streaming replication protocol of the walsender scenarios. The functions
+// follow jackc/pglogrepl's StartReplication, ParseXLogData,
+// ParsePrimaryKeepaliveMessage, SendStandbyStatusUpdate and ParseLSN, which
+// they stand in for until the module can require it.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// Leading bytes of the CopyData messages of a replication stream
+const (
+	xLogDataByteID                = 'w'
+	primaryKeepaliveMessageByteID = 'k'
+	standbyStatusUpdateByteID     = 'r'
+)
+
+// µs between 1970-01-01 and 2000-01-01, the epoch of the replication protocol
+const pgEpochOffset = 946684800 * 1000000
+
+// lsn is a WAL position
+type lsn uint64
+
+func (l lsn) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
+
+// parseLSN parses "16/B374D848"
+func parseLSN(s string) (lsn, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	return lsn(h<<32 | l), nil
+}
+
+func pgTime(us uint64) time.Time {
+	return time.UnixMicro(int64(us) + pgEpochOffset)
+}
+
+// xLogData is a chunk of WAL, or of decoded changes on a logical stream
+type xLogData struct {
+	walStart     lsn
+	serverWALEnd lsn
+	serverTime   time.Time
+	walData      []byte
+}
+
+// parseXLogData parses the body of an XLogData message, after its byte ID
+func parseXLogData(buf []byte) (xLogData, error) {
+	if len(buf) < 24 {
+		return xLogData{}, fmt.Errorf("XLogData of %d bytes, want at least 24", len(buf))
+	}
+	return xLogData{
+		walStart:     lsn(binary.BigEndian.Uint64(buf)),
+		serverWALEnd: lsn(binary.BigEndian.Uint64(buf[8:])),
+		serverTime:   pgTime(binary.BigEndian.Uint64(buf[16:])),
+		walData:      buf[24:],
+	}, nil
+}
+
+// primaryKeepalive is the server's heartbeat; replyRequested asks for a
+// standby status update at once
+type primaryKeepalive struct {
+	serverWALEnd   lsn
+	serverTime     time.Time
+	replyRequested bool
+}
+
+// parsePrimaryKeepalive parses the body of a primary keepalive message,
+// after its byte ID
+func parsePrimaryKeepalive(buf []byte) (primaryKeepalive, error) {
+	if len(buf) != 17 {
+		return primaryKeepalive{}, fmt.Errorf("primary keepalive of %d bytes, want 17", len(buf))
+	}
+	return primaryKeepalive{
+		serverWALEnd:   lsn(binary.BigEndian.Uint64(buf)),
+		serverTime:     pgTime(binary.BigEndian.Uint64(buf[8:])),
+		replyRequested: buf[16] != 0,
+	}, nil
+}
+
+// sendStandbyStatusUpdate reports pos as written, flushed and applied
+func sendStandbyStatusUpdate(conn *pgconn.PgConn, pos lsn) error {
+	buf := make([]byte, 34)
+	buf[0] = standbyStatusUpdateByteID
+	binary.BigEndian.PutUint64(buf[1:], uint64(pos))
+	binary.BigEndian.PutUint64(buf[9:], uint64(pos))
+	binary.BigEndian.PutUint64(buf[17:], uint64(pos))
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Now().UnixMicro()-pgEpochOffset))
+	conn.Frontend().Send(&pgproto3.CopyData{Data: buf})
+	return conn.Frontend().Flush()
+}
+
+// startReplication sends a START_REPLICATION command and waits until the
+// server switches the connection to streaming
+func startReplication(ctx context.Context, conn *pgconn.PgConn, command string) error {
+	conn.Frontend().Send(&pgproto3.Query{String: command})
+	if err := conn.Frontend().Flush(); err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.ReadyForQuery:
+			return errors.New(command + " ended without streaming")
+		}
+	}
+}
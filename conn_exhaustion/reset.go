@@ -0,0 +1,181 @@
+// Session reset between checkouts and a scenario comparing its cost and the
+// state it clears.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// sessionResets are the statements run when database/sql hands out a used
+// connection again, after the acquire check:
+//   - none: the next checkout sees whatever the previous one left
+//   - reset_all: RESET ALL, session settings only
+//   - deallocate_all: DEALLOCATE ALL, SQL-level prepared statements only
+//   - discard_all: DISCARD ALL, also temp tables, advisory locks and LISTEN
+//     (PgBouncer's default server_reset_query)
+var sessionResets = map[string]string{
+	"none":           "",
+	"reset_all":      "RESET ALL",
+	"deallocate_all": "DEALLOCATE ALL",
+	"discard_all":    "DISCARD ALL",
+}
+
+var sessionResetOrder = []string{"none", "reset_all", "deallocate_all", "discard_all"}
+
+// sessionReset applies to pools opened with openDB
+var sessionReset = "none"
+
+// resetSession runs the configured reset on the raw connection. DEALLOCATE
+// ALL and DISCARD ALL also drop the named statements of pgx's statement
+// cache behind its back, so pools using them should not use cache_statement.
+// DISCARD ALL fails inside a transaction, which discards a poisoned
+// connection as a side effect.
+func resetSession(ctx context.Context, conn *pgx.Conn) error {
+	query := sessionResets[sessionReset]
+	if query == "" {
+		return nil
+	}
+	if err := conn.PgConn().Exec(ctx, query).Close(); err != nil {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// sessionLeaks are state left behind by one checkout, each with the query
+// which tells the next checkout whether it is still there. Leaving the state
+// twice must not block or fail, except for PREPARE.
+var sessionLeaks = []struct{ name, leave, check string }{
+	{"setting", "SET statement_timeout = '4321ms'", "SELECT current_setting('statement_timeout') = '4321ms'"},
+	{"prepared", "PREPARE leak_stmt AS SELECT 1", "SELECT EXISTS (SELECT 1 FROM pg_prepared_statements WHERE name = 'leak_stmt')"},
+	{"temptable", "CREATE TEMP TABLE IF NOT EXISTS leak_tmp (id INT)", "SELECT to_regclass('pg_temp.leak_tmp') IS NOT NULL"},
+	{"advisory", "SELECT pg_try_advisory_lock(4242)", "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND pid = pg_backend_pid())"},
+	{"listen", "LISTEN leak_channel", "SELECT EXISTS (SELECT 1 FROM pg_listening_channels() WHERE pg_listening_channels = 'leak_channel')"},
+}
+
+type resetResult struct {
+	p50, p95 time.Duration
+	leaked   []string
+}
+
+func init() {
+	registerScenario("resetcompare", scenario{
+		standalone: func(o *options) bool { return runResetCompare(o.connStr, o.acquireIterations) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 1 },
+	})
+}
+
+// runResetCompare measures, for each reset, the checkout+SELECT 1 latency on a
+// pool of one connection and which kinds of session state left by one
+// checkout the next checkout still sees
+func runResetCompare(connStr string, iterations int) bool {
+	savedReset, savedMode := sessionReset, queryExecMode
+	defer func() { sessionReset, queryExecMode = savedReset, savedMode }()
+	// Unnamed statements, so that DEALLOCATE ALL and DISCARD ALL leave pgx's
+	// own statement cache intact
+	queryExecMode = "cache_describe"
+
+	results := map[string]resetResult{}
+	for _, strategy := range sessionResetOrder {
+		sessionReset = strategy
+		fmt.Fprintf(os.Stderr, "[%s] RESET_COMPARE: %s\n", time.Now().Format("04:05"), strategy)
+		r, err := resetOnce(connStr, strategy, iterations)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", strategy, err)
+			return false
+		}
+		results[strategy] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> SESSION RESET REPORT")
+	fmt.Printf("%-15s %10s %10s %10s %7s  %s\n", "Reset", "p50", "p95", "Tax(p50)", "Leaked", "State seen by the next checkout")
+	base := results["none"].p50
+	for _, strategy := range sessionResetOrder {
+		r := results[strategy]
+		leaked := strings.Join(r.leaked, " ")
+		if leaked == "" {
+			leaked = "-"
+		}
+		fmt.Printf("%-15s %10s %10s %10s %4d/%d  %s\n", strategy, ms(r.p50), ms(r.p95), ms(r.p50-base),
+			len(r.leaked), len(sessionLeaks), leaked)
+	}
+	return true
+}
+
+func resetOnce(connStr string, strategy string, iterations int) (resetResult, error) {
+	var r resetResult
+	db, err := openDB(connStr, "pg-idle-test-reset-"+strategy)
+	if err != nil {
+		return r, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	ctx := context.Background()
+
+	// Latency tax: every checkout of the one connection runs the reset
+	var one int
+	latencies := make([]time.Duration, 0, iterations)
+	for i := 0; i < iterations; i++ {
+		start := time.Now()
+		if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+			return r, err
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.p50, r.p95 = percentile(latencies, 0.5), percentile(latencies, 0.95)
+
+	// Leakage: one checkout leaves the state behind, the next looks for it on
+	// the same server session
+	for _, leak := range sessionLeaks {
+		leftOn, err := checkoutPID(ctx, db, leak.leave)
+		if err != nil {
+			return r, fmt.Errorf("%s: %w", leak.name, err)
+		}
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return r, err
+		}
+		var pid int32
+		var seen bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_backend_pid(), ("+leak.check+")").Scan(&pid, &seen)
+		if err == nil && pid != leftOn {
+			err = fmt.Errorf("next checkout got server session %d instead of %d", pid, leftOn)
+		}
+		// Clean up whatever the reset left, so that the next leak starts clean
+		conn.ExecContext(ctx, "DISCARD ALL")
+		conn.Close()
+		if err != nil {
+			return r, fmt.Errorf("%s: %w", leak.name, err)
+		}
+		if seen {
+			r.leaked = append(r.leaked, leak.name)
+		}
+	}
+	return r, nil
+}
+
+// checkoutPID runs query on a checked out connection and returns its backend PID
+func checkoutPID(ctx context.Context, db *sql.DB, query string) (int32, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return 0, err
+	}
+	var pid int32
+	err = conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+	return pid, err
+}
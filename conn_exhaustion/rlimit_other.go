@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// fdLimit is not available on this platform
+func fdLimit() (soft, hard uint64, ok bool) {
+	return 0, 0, false
+}
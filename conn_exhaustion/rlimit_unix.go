@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// fdLimit returns the soft and hard RLIMIT_NOFILE of this process
+func fdLimit() (soft, hard uint64, ok bool) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, 0, false
+	}
+	return uint64(rlim.Cur), uint64(rlim.Max), true
+}
@@ -0,0 +1,298 @@
+// Rolling deploy: overlapping old and new application instances.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deploySecond aggregates one second of the rollout across all instances
+type deploySecond struct {
+	phase       string
+	ok, failed  int
+	worstP99us  int
+	serverConns int
+}
+
+type deployTimeline struct {
+	mu      sync.Mutex
+	start   time.Time
+	phase   string
+	seconds map[int]*deploySecond
+}
+
+func (t *deployTimeline) at(now time.Time) *deploySecond {
+	sec := int(now.Sub(t.start).Seconds())
+	s := t.seconds[sec]
+	if s == nil {
+		s = &deploySecond{phase: t.phase}
+		t.seconds[sec] = s
+	}
+	return s
+}
+
+// childInstance is one application instance running as a child process of
+// this binary. Closing its stdin tells it to drain and exit, which works the
+// same way on every platform.
+type childInstance struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{}
+}
+
+func startInstance(connStr, name string, poolSize int, t *deployTimeline) (*childInstance, error) {
+	cmd, err := childCommand(connStr, "-instance-name="+name, fmt.Sprintf("-instance-pool=%d", poolSize), "instance")
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &childInstance{name: name, cmd: cmd, stdin: stdin, done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			var ok, failed, p99 int
+			if n, _ := fmt.Sscanf(scanner.Text(), "INSTANCE_STATS ok=%d errors=%d p99_us=%d", &ok, &failed, &p99); n != 3 {
+				fmt.Println(scanner.Text())
+				continue
+			}
+			t.mu.Lock()
+			s := t.at(time.Now())
+			s.ok += ok
+			s.failed += failed
+			if p99 > s.worstP99us {
+				s.worstP99us = p99
+			}
+			t.mu.Unlock()
+		}
+		cmd.Wait()
+	}()
+	fmt.Printf(">>> DEPLOY: started %s (pid %d)\n", name, cmd.Process.Pid)
+	return c, nil
+}
+
+func (c *childInstance) drain() {
+	c.stdin.Close()
+	<-c.done
+	fmt.Printf(">>> DEPLOY: %s drained and exited\n", c.name)
+}
+
+func init() {
+	registerScenario("rollingdeploy", scenario{
+		standalone: func(o *options) bool {
+			return runRollingDeploy(o.connStr, o.deployInstances, o.poolSize, o.deployOverlap)
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = (o.deployInstances+1)*o.poolSize + 1 },
+	})
+}
+
+// runRollingDeploy replaces instances old instances one at a time, starting
+// each replacement overlap before draining the instance it replaces
+func runRollingDeploy(connStr string, instances, poolSize int, overlap time.Duration) bool {
+	monitor, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer monitor.Close()
+	monitor.SetMaxOpenConns(1)
+	var maxConns int
+	monitor.QueryRow("SELECT setting::int FROM pg_settings WHERE name = 'max_connections'").Scan(&maxConns)
+
+	t := &deployTimeline{start: time.Now(), phase: "steady-old", seconds: map[int]*deploySecond{}}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	var peak atomic.Int64
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			var conns int
+			monitor.QueryRow("SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend'").Scan(&conns)
+			if int64(conns) > peak.Load() {
+				peak.Store(int64(conns))
+			}
+			t.mu.Lock()
+			s := t.at(time.Now())
+			s.serverConns = conns
+			phase := s.phase
+			t.mu.Unlock()
+			fmt.Fprintf(os.Stderr, "[%s] DEPLOY: phase=%s server_conns=%d/%d\n", time.Now().Format("04:05"), phase, conns, maxConns)
+		}
+	}()
+	setPhase := func(phase string) {
+		t.mu.Lock()
+		t.phase = phase
+		t.mu.Unlock()
+	}
+
+	var old, replacements []*childInstance
+	for i := 0; i < instances; i++ {
+		c, err := startInstance(connStr, fmt.Sprintf("old-%d", i), poolSize, t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to start instance: %v\n", err)
+			return false
+		}
+		old = append(old, c)
+	}
+	time.Sleep(10 * time.Second)
+
+	setPhase("rollout")
+	for i, c := range old {
+		n, err := startInstance(connStr, fmt.Sprintf("new-%d", i), poolSize, t)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to start instance: %v\n", err)
+			return false
+		}
+		replacements = append(replacements, n)
+		time.Sleep(overlap)
+		c.drain()
+		time.Sleep(2 * time.Second)
+	}
+
+	setPhase("steady-new")
+	time.Sleep(10 * time.Second)
+	for _, c := range replacements {
+		c.drain()
+	}
+	stop()
+
+	return reportRollingDeploy(t, int(peak.Load()), maxConns, instances, poolSize)
+}
+
+func reportRollingDeploy(t *deployTimeline, peak, maxConns, instances, poolSize int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	type summary struct {
+		secs, ok, failed, worstP99us int
+	}
+	phases := map[string]*summary{}
+	secs := make([]int, 0, len(t.seconds))
+	for sec := range t.seconds {
+		secs = append(secs, sec)
+	}
+	sort.Ints(secs)
+	for _, sec := range secs {
+		s := t.seconds[sec]
+		p := phases[s.phase]
+		if p == nil {
+			p = &summary{}
+			phases[s.phase] = p
+		}
+		p.secs++
+		p.ok += s.ok
+		p.failed += s.failed
+		if s.worstP99us > p.worstP99us {
+			p.worstP99us = s.worstP99us
+		}
+	}
+
+	fmt.Println()
+	fmt.Println(">>> ROLLING DEPLOY REPORT")
+	fmt.Printf("%-12s %8s %8s %8s %12s\n", "Phase", "Secs", "OK/s", "Errors", "Worst p99")
+	for _, name := range []string{"steady-old", "rollout", "steady-new"} {
+		if p := phases[name]; p != nil {
+			fmt.Printf("%-12s %8d %8d %8d %10.1fms\n", name, p.secs, p.ok/max(p.secs, 1), p.failed, float64(p.worstP99us)/1000)
+		}
+	}
+	fmt.Println()
+	fmt.Printf("Peak server connections: %d of max_connections=%d (steady state needs %d, overlap adds %d per replaced instance)\n",
+		peak, maxConns, instances*poolSize, poolSize)
+	if maxConns > 0 && peak >= maxConns-5 {
+		fmt.Println(">>> DEPLOY: connection peak reached the max_connections headroom during overlap")
+		return false
+	}
+	return true
+}
+
+// runInstance is the child side of rollingdeploy: 20 workers on a pool of
+// poolSize connections, reporting per-second stats on stdout until stdin closes
+func runInstance(connStr, name string, poolSize int) {
+	db, err := openDB(connStr, "pg-idle-test-instance-"+name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		os.Exit(1)
+	}
+	db.SetMaxOpenConns(poolSize)
+	db.SetMaxIdleConns(poolSize)
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var failed int
+	var stopping atomic.Bool
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopping.Load() {
+				ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+				start := time.Now()
+				_, err := db.ExecContext(ctx, "SELECT pg_sleep(0.005)")
+				cancel()
+				mu.Lock()
+				if err != nil {
+					failed++
+				} else {
+					latencies = append(latencies, time.Since(start))
+				}
+				mu.Unlock()
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		stopping.Store(true)
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	report := func() {
+		mu.Lock()
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf("INSTANCE_STATS ok=%d errors=%d p99_us=%d\n", len(latencies), failed, percentile(latencies, 0.99).Microseconds())
+		latencies, failed = latencies[:0], 0
+		mu.Unlock()
+	}
+	for {
+		select {
+		case <-ticker.C:
+			report()
+		case <-done:
+			report()
+			db.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Checker: the user's statement mix run on one session and again with every
+// statement on a new session, to find statements which silently depend on
+// state an earlier one left in the session.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// sessionStateKinds are what a statement can leave in its session for a
+// later one, recognized in the statement's text
+var sessionStateKinds = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"temp table", regexp.MustCompile(`(?i)\bcreate\s+(local\s+|global\s+)?temp(orary)?\s+table\b`)},
+	{"setting", regexp.MustCompile(`(?i)^\s*(set|reset)\s|\bset_config\s*\(`)},
+	{"advisory lock", regexp.MustCompile(`(?i)\bpg_(try_)?advisory_(xact_)?(lock|unlock)(_shared)?\s*\(`)},
+	{"prepared statement", regexp.MustCompile(`(?i)^\s*prepare\s`)},
+	{"sequence value", regexp.MustCompile(`(?i)\b(nextval|setval)\s*\(`)},
+	{"LISTEN", regexp.MustCompile(`(?i)^\s*listen\s`)},
+}
+
+// rotateOutcome is what one statement returned in one run
+type rotateOutcome struct {
+	result string // rows as text
+	err    error
+}
+
+func (r rotateOutcome) String() string {
+	if r.err == nil {
+		return "ok"
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(r.err, &pgErr) {
+		return "error " + pgErr.Code
+	}
+	return "error " + classifyError(r.err)
+}
+
+func init() {
+	registerScenario("rotate", scenario{
+		standalone: func(o *options) bool { return runRotate(o.connStr, o.rotateStatements) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 2 }, // pinned session and the rotated one
+	})
+}
+
+// runRotate runs the statements of path in order on one session, then on a
+// new session each, and fails if any statement errs or returns other rows
+// only when rotated
+func runRotate(connStr, path string) bool {
+	b, err := readInput(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to read -rotate-statements: %v\n", err)
+		return false
+	}
+	stmts := splitStatements(string(b))
+	if len(stmts) == 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: %s has no statements\n", path)
+		return false
+	}
+
+	db, err := openDB(connStr, "pg-idle-test-rotate")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer db.Close()
+	// No idle connections: every checkout dials a new session
+	db.SetMaxIdleConns(0)
+
+	ctx := context.Background()
+	fmt.Printf(">>> ROTATE: %d statements from %s, pinned to one session and then each on a new session\n", len(stmts), path)
+	pinned := make([]rotateOutcome, len(stmts))
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to check out a connection: %v\n", err)
+		return false
+	}
+	for i, stmt := range stmts {
+		pinned[i] = runRotateStatement(ctx, conn, stmt)
+	}
+	conn.Close()
+	rotated := make([]rotateOutcome, len(stmts))
+	for i, stmt := range stmts {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to check out a connection: %v\n", err)
+			return false
+		}
+		rotated[i] = runRotateStatement(ctx, conn, stmt)
+		conn.Close()
+	}
+
+	fmt.Println()
+	fmt.Println(">>> SESSION STATE DEPENDENCE")
+	fmt.Printf("%3s  %-50s %-12s %-12s %s\n", "#", "Statement", "Pinned", "Rotated", "Verdict")
+	var dependent int
+	for i, stmt := range stmts {
+		verdict := "independent"
+		switch {
+		case pinned[i].err != nil && rotated[i].err != nil:
+			verdict = "fails either way"
+		case pinned[i].err == nil && rotated[i].err != nil:
+			verdict = "fails when rotated"
+		case pinned[i].err != nil:
+			verdict = "fails only pinned"
+		case pinned[i].result != rotated[i].result:
+			verdict = "other result when rotated"
+		}
+		dependsOnSession := verdict != "independent" && verdict != "fails either way"
+		if dependsOnSession {
+			dependent++
+			if kinds := sessionStateBefore(stmts[:i]); kinds != "" {
+				verdict += " (earlier statements set " + kinds + ")"
+			}
+		}
+		fmt.Printf("%3d  %-50s %-12s %-12s %s\n", i+1, truncate(oneLine(stmt), 50), pinned[i], rotated[i], verdict)
+		if dependsOnSession {
+			if pinned[i].result != rotated[i].result {
+				fmt.Printf("     pinned: %s\n     rotated: %s\n", truncate(pinned[i].result, 80), truncate(rotated[i].result, 80))
+			}
+			if rotated[i].err != nil {
+				fmt.Printf("     rotated error: %s\n", truncate(oneLine(rotated[i].err.Error()), 100))
+			}
+		}
+	}
+	fmt.Println()
+	fmt.Println("A statement which fails or returns other rows only when rotated depends on something an earlier")
+	fmt.Println("statement left in its session; behind a pool it works only while both land on the same connection,")
+	fmt.Println("and always breaks behind a transaction pooler. Statements whose result varies by itself, such as")
+	fmt.Println("now() or pg_backend_pid(), show up as other results too.")
+	if dependent > 0 {
+		fmt.Printf(">>> ROTATE: FAIL %d of %d statements depend on session state\n", dependent, len(stmts))
+		return false
+	}
+	fmt.Printf(">>> ROTATE: PASS all %d statements give the same outcome on any connection\n", len(stmts))
+	return true
+}
+
+// runRotateStatement runs stmt and renders every row it returns as text
+func runRotateStatement(ctx context.Context, conn *sql.Conn, stmt string) rotateOutcome {
+	rows, err := conn.QueryContext(ctx, stmt)
+	if err != nil {
+		return rotateOutcome{err: err}
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	var out []string
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return rotateOutcome{err: err}
+		}
+		out = append(out, fmt.Sprint(values...))
+	}
+	return rotateOutcome{result: "[" + strings.Join(out, "; ") + "]", err: rows.Err()}
+}
+
+// splitStatements splits on lines ending in ';', skipping blank lines and
+// -- comments
+func splitStatements(text string) []string {
+	var stmts []string
+	var cur []string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur = append(cur, trimmed)
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.Join(cur, " "), ";"))
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		stmts = append(stmts, strings.Join(cur, " "))
+	}
+	return stmts
+}
+
+// sessionStateBefore names the kinds of session state stmts set
+func sessionStateBefore(stmts []string) string {
+	var kinds []string
+	for _, k := range sessionStateKinds {
+		for _, stmt := range stmts {
+			if k.re.MatchString(stmt) {
+				kinds = append(kinds, k.kind)
+				break
+			}
+		}
+	}
+	return strings.Join(kinds, ", ")
+}
+
+// truncate keeps the first n characters of s
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n-3] + "..."
+	}
+	return s
+}
@@ -0,0 +1,13 @@
+-- Statement mix for the rotate mode: one statement per line ending in ';',
+-- run in order once on one connection and once on a new connection each.
+-- Each of the pairs below works only while both statements share a session.
+CREATE TEMP TABLE rotate_cart (item TEXT);
+INSERT INTO rotate_cart VALUES ('book');
+SELECT count(*) FROM rotate_cart;
+SET TimeZone = 'Asia/Tokyo';
+SELECT to_char(timestamptz '2024-01-01 00:00:00+00', 'YYYY-MM-DD HH24:MI');
+SELECT pg_advisory_lock(4245);
+SELECT pg_advisory_unlock(4245);
+CREATE SEQUENCE IF NOT EXISTS rotate_seq;
+SELECT nextval('rotate_seq') > 0;
+SELECT currval('rotate_seq') > 0;
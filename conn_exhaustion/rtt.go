@@ -0,0 +1,138 @@
+// RTT sweep scenario: the same workload under emulated network distances.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// latencyProfile is an emulated round trip added to every statement by
+// delaying the client's writes
+type latencyProfile struct {
+	name string
+	rtt  time.Duration
+}
+
+var latencyProfiles = []latencyProfile{
+	{"same-az", 500 * time.Microsecond},
+	{"cross-az", 2 * time.Millisecond},
+	{"cross-region", 70 * time.Millisecond},
+	{"satellite", 300 * time.Millisecond},
+}
+
+func latencyProfileNames() string {
+	var names []string
+	for _, p := range latencyProfiles {
+		names = append(names, p.name)
+	}
+	return strings.Join(names, ",")
+}
+
+// parseLatencyProfiles parses "same-az,cross-region"
+func parseLatencyProfiles(spec string) ([]latencyProfile, error) {
+	var profiles []latencyProfile
+next:
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		for _, p := range latencyProfiles {
+			if p.name == name {
+				profiles = append(profiles, p)
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("unknown latency profile %q, want one of %s", name, latencyProfileNames())
+	}
+	return profiles, nil
+}
+
+type rttResult struct {
+	profile  latencyProfile
+	rate     float64 // successful iterations per second
+	failed   int
+	p50      time.Duration
+	inUse    float64       // mean connections in use
+	hold     time.Duration // connection time per successful iteration
+	poolNeed int           // connections for the first profile's rate at this hold time
+}
+
+func init() {
+	registerScenario("rttsweep", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runRTTSweep(h.db, h.o.profiles, h.o.phaseDuration)
+		},
+		validate: func(o *options) (err error) {
+			if o.profiles, err = parseLatencyProfiles(o.latencyProfileSpec); err != nil {
+				return fmt.Errorf("Invalid -latency-profiles: %v", err)
+			}
+			return nil
+		},
+		latencyInjection: true,
+	})
+}
+
+// runRTTSweep runs one phase per profile on the running workload. The pool
+// needed at each RTT follows from Little's law: connections in use are the
+// iteration rate times the connection time per iteration, so the hold time
+// measured under each profile scales the first profile's rate.
+func runRTTSweep(db *sql.DB, profiles []latencyProfile, phaseDuration time.Duration) bool {
+	defer injectedLatency.Store(0)
+
+	var results []rttResult
+	for _, profile := range profiles {
+		injectedLatency.Store(int64(profile.rtt))
+		name := "rtt:" + profile.name
+		fmt.Printf(">>> PHASE: %s (+%v per round trip)\n", name, profile.rtt)
+		startPhase(name)
+		p := currentPhase.Load()
+
+		var inUse, samples int
+		for start := time.Now(); time.Since(start) < phaseDuration; samples++ {
+			time.Sleep(100 * time.Millisecond)
+			inUse += db.Stats().InUse
+		}
+
+		p.mu.Lock()
+		r := rttResult{profile: profile, rate: float64(p.ok) / time.Since(p.start).Seconds(), failed: p.failed}
+		sorted := append([]time.Duration(nil), p.latencies...)
+		p.mu.Unlock()
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		r.p50 = percentile(sorted, 0.5)
+		r.inUse = float64(inUse) / float64(max(samples, 1))
+		if r.rate > 0 {
+			r.hold = time.Duration(r.inUse / r.rate * float64(time.Second))
+		}
+		results = append(results, r)
+	}
+	injectedLatency.Store(0)
+
+	base := results[0].rate
+	maxOpen := db.Stats().MaxOpenConnections
+	fmt.Println()
+	fmt.Println(">>> RTT SWEEP REPORT")
+	fmt.Printf("%-14s %10s %8s %8s %10s %8s %12s %10s\n", "Profile", "RTT", "Iter/s", "Errors", "p50", "InUse", "Hold/iter", "PoolNeed")
+	ok := true
+	for i := range results {
+		r := &results[i]
+		need := "-"
+		if r.hold > 0 {
+			r.poolNeed = int(math.Ceil(base * r.hold.Seconds()))
+			need = fmt.Sprint(r.poolNeed)
+			ok = ok && r.poolNeed <= maxOpen
+		}
+		fmt.Printf("%-14s %10v %8.1f %8d %10s %8.1f %12s %10s\n", r.profile.name, r.profile.rtt, r.rate, r.failed,
+			ms(r.p50), r.inUse, ms(r.hold), need)
+	}
+	fmt.Println()
+	fmt.Printf("PoolNeed is the pool size which sustains %s's %.1f iter/s at each profile's hold time (the pool has %d).\n",
+		results[0].profile.name, base, maxOpen)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "WARNING: The pool is too small to keep the same throughput at the higher RTTs\n")
+	}
+	return true
+}
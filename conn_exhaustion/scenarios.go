@@ -0,0 +1,456 @@
+// Scenario catalog: machine-readable metadata for every mode.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type scenarioInfo struct {
+	Name            string   `json:"name"`
+	Demonstrates    string   `json:"demonstrates"`
+	Privileges      []string `json:"privileges"`
+	Destructive     []string `json:"destructive_actions"`
+	TypicalDuration string   `json:"typical_duration"`
+}
+
+var scenarioCatalog = []scenarioInfo{
+	{
+		Name:            "poison",
+		Demonstrates:    "A connection returned to the database/sql pool inside an open transaction keeps the row lock while other workers time out and cancel.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates the workload tables (test_row, test_doc or test_ledger)"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "sleep",
+		Demonstrates:    "The same row lock held by a session which stays idle in transaction without returning to the pool, so idle_in_transaction_session_timeout can release it.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates the workload tables"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "planflip",
+		Demonstrates:    "A latency change caused by a plan flip (index scans disabled mid-run), attributed by the slow-query watchdog rather than blamed on the pool.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates the workload tables", "sets enable_* planner GUCs on the client's own sessions"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "advisoryleak",
+		Demonstrates:    "A session-level advisory lock taken on a pooled connection and never released: no transaction is open, yet the lock travels with the connection from checkout to checkout, which the poison audit reports as its own class.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates the workload tables"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "templeak",
+		Demonstrates:    "Session temp tables created on pooled connections and never dropped: 42P07 collisions when the next checkout creates the same table, and temp schemas and the catalog growing when each uses a new name.",
+		Privileges:      []string{"CREATE on the current schema", "TEMPORARY on the database"},
+		Destructive:     []string{"drops and recreates the workload tables", "leaves temp tables on the pooled sessions until the pool closes"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "idletxtimeout",
+		Demonstrates:    "The poison case with idle_in_transaction_session_timeout set: whether the server ever finds the poisoned backend idle long enough to kill it, what error the pool surfaces on the connection's next use, and how long recovery takes.",
+		Privileges:      []string{"CREATE on the current schema", "ALTER SYSTEM (superuser or GRANT ALTER SYSTEM) with -guc-scope=server"},
+		Destructive:     []string{"drops and recreates the workload tables", "ALTER SYSTEM and pg_reload_conf() with -guc-scope=server (reset afterwards)"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "gucsweep",
+		Demonstrates:    "Workload metrics per phase while session or server GUCs change between phases, as a small configuration bench.",
+		Privileges:      []string{"CREATE on the current schema", "ALTER SYSTEM (superuser or GRANT ALTER SYSTEM) with -guc-scope=server"},
+		Destructive:     []string{"drops and recreates the workload tables", "ALTER SYSTEM and pg_reload_conf() with -guc-scope=server (reset afterwards)"},
+		TypicalDuration: "20s + phases x -phase-duration",
+	},
+	{
+		Name:            "rttsweep",
+		Demonstrates:    "The same workload at emulated same-AZ, cross-AZ, cross-region and satellite round trips, and the pool size each RTT needs for the same throughput.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates the workload tables"},
+		TypicalDuration: "20s + profiles x -phase-duration",
+	},
+	{
+		Name:            "walsenders",
+		Demonstrates:    "Physical replication streams opened up to and past max_wal_senders while the workload runs: the separate limit, its 53300 refusal, and an unaffected workload.",
+		Privileges:      []string{"CREATE on the current schema", "REPLICATION attribute", "a replication entry in pg_hba.conf"},
+		Destructive:     []string{"drops and recreates the workload tables", "occupies every free wal sender, so a standby reconnecting meanwhile is refused"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "logicalstall",
+		Demonstrates:    "A logical decoding consumer which stops sending feedback or stops reading while the workload writes: confirmed_flush_lsn lag, WAL retained by the slot and how the consumer catches up, the replication analogue of an idle poisoned connection.",
+		Privileges:      []string{"CREATE on the current schema", "REPLICATION attribute", "wal_level=logical", "pg_monitor to report the size of pg_wal"},
+		Destructive:     []string{"drops and recreates the workload tables", "creates and drops the replication slot pg_idle_test_logical, which retains WAL while the consumer stalls"},
+		TypicalDuration: "90s with defaults",
+	},
+	{
+		Name:            "walstall",
+		Demonstrates:    "A WAL write stall simulated with a synchronous standby that never acknowledges: new connections and reads still succeed while no commit completes, and the stall diagnosis naming a commit stall rather than the lock queue behind the waiting commits.",
+		Privileges:      []string{"CREATE on the current schema", "ALTER SYSTEM on synchronous_standby_names"},
+		Destructive:     []string{"drops and recreates the workload tables", "stalls every commit on the server for -hold-duration, other databases included, and leaves it stalled if the client dies before resetting synchronous_standby_names"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "cpuburn",
+		Demonstrates:    "CPU saturation of the database server by backends spinning in PL/pgSQL: a SELECT 1 outside the pool slowing down with everything else, the latency signature next to lock contention and pool exhaustion, and the stall diagnosis naming CPU saturation rather than the lock queue the slowed lock holders leave.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates the workload tables", "saturates the server's CPU for -hold-duration, other databases included"},
+		TypicalDuration: "95s",
+	},
+	{
+		Name:            "poisondns",
+		Demonstrates:    "Two moderate faults compounding: a poisoned pool whose timeouts break connections and a slow resolver delaying every replacement, injected alone and together, with the lost throughput split into each fault's share and their interaction.",
+		Privileges:      []string{"CREATE on the current schema", "pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"drops and recreates the workload tables", "terminates the poisoned session after each poison phase"},
+		TypicalDuration: "2 minutes",
+	},
+	{
+		Name:            "connstorm",
+		Demonstrates:    "Client-side limits of thousands of connections from one process: file descriptors, ephemeral ports and Go scheduler lag.",
+		Privileges:      []string{"enough max_connections headroom for -storm-conns"},
+		Destructive:     []string{"may consume every available connection slot, locking out other clients while it holds"},
+		TypicalDuration: "10-40s",
+	},
+	{
+		Name:            "serverless",
+		Demonstrates:    "Serverless-style clients, a process per invocation opening one or two connections for a couple of queries, against the same invocations sharing one pool as behind an external pooler: backends forked per second, peak sessions and connect cost.",
+		Privileges:      []string{"enough max_connections headroom for twice -serverless-concurrency"},
+		Destructive:     []string{"forks and tears down a server backend per invocation, which may lock out other clients at the connection limit"},
+		TypicalDuration: "30-90s",
+	},
+	{
+		Name:            "portchurn",
+		Demonstrates:    "Connection churn without idle connections filling the client's TIME_WAIT table until dials fail, and connection reuse as the mitigation.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates the workload tables", "can exhaust ephemeral ports for every process on the client host"},
+		TypicalDuration: "90s",
+	},
+	{
+		Name:            "idlescale",
+		Demonstrates:    "What idle sessions cost: their memory each and the latency they add to working sessions at 0 to -idle-conns, priced as a share of a managed instance to show the monthly cost of an over-provisioned pool.",
+		Privileges:      []string{"Postgres 14+ for per-session memory (pg_backend_memory_contexts)"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "25s",
+	},
+	{
+		Name:            "closecompare",
+		Demonstrates:    "Server-side cleanup time and log noise of graceful Terminate versus abrupt FIN and RST closes.",
+		Privileges:      []string{"plaintext connection (sslmode=disable) to drop Terminate"},
+		Destructive:     []string{"writes unexpected EOF and connection reset messages to the server log"},
+		TypicalDuration: "5s",
+	},
+	{
+		Name:            "acquirecompare",
+		Demonstrates:    "The latency tax of each acquire-time validation (none, ping, SELECT 1, transaction probe) against whether it catches connections terminated while idle and connections returned inside a transaction.",
+		Privileges:      []string{"CREATE on the current schema", "pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"drops and recreates test_acquire", "terminates its own pooled sessions"},
+		TypicalDuration: "10s",
+	},
+	{
+		Name:            "keepalivecompare",
+		Demonstrates:    "Connections silently dropped by a NAT idle timeout (simulated on the client) failing on first use, and how SetConnMaxIdleTime and a keepalive pinger compare as mitigations.",
+		Privileges:      []string{"none beyond connecting"},
+		Destructive:     []string{"leaves orphaned idle sessions on the server until TCP keepalive or idle_session_timeout removes them"},
+		TypicalDuration: "1-2 minutes",
+	},
+	{
+		Name:            "idleclose",
+		Demonstrates:    "The server closing idle pooled sessions (idle_session_timeout, like a pooler's client_idle_timeout) while the pool counts them as healthy, and how often the driver's retry hides that behind a reconnect instead of an error.",
+		Privileges:      []string{"Postgres 14+ for idle_session_timeout", "a direct connection or a pooler passing idle_session_timeout as a startup parameter"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "30s with defaults",
+	},
+	{
+		Name:            "withtx",
+		Demonstrates:    "Transactions abandoned when their context expires between statements leaving sessions idle in transaction, and txguard.WithTx rolling them back on a fresh context so the pool is never poisoned.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_withtx"},
+		TypicalDuration: "30s",
+	},
+	{
+		Name:            "misuse",
+		Demonstrates:    "Executable documentation of pool poisoning causes: manual BEGIN via db.Exec, rows not closed, connections not closed, context canceled before COMMIT and a Tx shared across goroutines, one at a time, each followed by what the pool audit, probe statements and stall diagnosis see.",
+		Privileges:      []string{"CREATE on the current schema", "pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"drops and recreates test_misuse"},
+		TypicalDuration: "15s",
+	},
+	{
+		Name:            "crashlock",
+		Demonstrates:    "A client process killed or frozen while its transaction holds the poison lock: how quickly the server notices with default and aggressive tcp_keepalives settings, and how long a writer queued on the row waits.",
+		Privileges:      []string{"CREATE on the current schema", "pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"drops and recreates test_crash", "kills and freezes child processes of this binary"},
+		TypicalDuration: "1 minute with defaults",
+	},
+	{
+		Name:            "conncheck",
+		Demonstrates:    "Queries which keep running on the server after their client process died, a long pg_sleep and a lock wait, and client_connection_check_interval aborting them; reports the server seconds spent on dead clients with and without it.",
+		Privileges:      []string{"Postgres 14+ on Linux for client_connection_check_interval", "CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_conncheck", "kills child processes of this binary"},
+		TypicalDuration: "1 minute with defaults",
+	},
+	{
+		Name:            "cancelstress",
+		Demonstrates:    "Cancel key mapping under a high rate of cancel requests, typically through PgBouncer: cancellers time out nearly every statement while victims run statements without deadlines, and any victim statement canceled was hit by a cancel meant for another client.",
+		Privileges:      []string{"none beyond connecting", "2 x -cancel-clients connections"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "30s with defaults",
+	},
+	{
+		Name:            "longsql",
+		Demonstrates:    "Statements with very large SQL text, a long IN list, the same ids as an array parameter and a giant comment: client latency, server log growth and which correlation tags survive truncation in pg_stat_activity.",
+		Privileges:      []string{"CREATE on the current schema", "superuser or pg_read_server_files for the log size"},
+		Destructive:     []string{"drops and recreates test_longsql", "adds to the server log when log_min_duration_statement is on"},
+		TypicalDuration: "15s",
+	},
+	{
+		Name:            "prepchurn",
+		Demonstrates:    "Thousands of distinct statement texts per connection, typically through a transaction-pooling PgBouncer, under each pgx query exec mode: prepared statements and plan cache memory per server session, latency, and the prepared-statement errors of mismatched server connections.",
+		Privileges:      []string{"none beyond connecting", "Postgres 14+ for the plan cache memory"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "30s with defaults",
+	},
+	{
+		Name:            "stmtcache",
+		Demonstrates:    "pgx's statement cache through a transaction pooler: prepared statement does not exist and already exists errors, client connections left failing, and the exec modes which avoid them.",
+		Privileges:      []string{"CREATE on the current schema", "a transaction-pooling PgBouncer in DATABASE_URL to reproduce the errors"},
+		Destructive:     []string{"drops and recreates test_stmtcache"},
+		TypicalDuration: "30s",
+	},
+	{
+		Name:            "forkshare",
+		Demonstrates:    "A pooled connection inherited across a fork by a worker process: crossed responses, wrong results and protocol errors when both use it, and a detector for client sockets open in two processes.",
+		Privileges:      []string{"plaintext connection (sslmode=disable)", "a Unix client; the detector needs Linux /proc"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "5s",
+	},
+	{
+		Name:            "gucleak",
+		Demonstrates:    "A SET statement_timeout = '50ms' left on a pooled connection without RESET: unrelated 100ms statements fail with 57014 whenever they land on it, while the txprobe acquire check passes it as idle; RESET ALL as the session reset prevents it.",
+		Privileges:      []string{"none"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "20s",
+	},
+	{
+		Name:            "resetcompare",
+		Demonstrates:    "The per-checkout latency of each session reset between checkouts (none, RESET ALL, DEALLOCATE ALL, DISCARD ALL) against which leftover session state the next checkout still sees: settings, prepared statements, temp tables, advisory locks and LISTEN.",
+		Privileges:      []string{"TEMP on the current database"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "10s",
+	},
+	{
+		Name:            "poolercheck",
+		Demonstrates:    "What the pooler or proxy behind DATABASE_URL keeps per client session: whether sessions are pinned, whether settings, SQL and protocol prepared statements, temp tables, advisory locks and LISTEN persist, and whether cancels reach the server.",
+		Privileges:      []string{"TEMP on the current database"},
+		Destructive:     []string{"may leave a temp table, advisory lock or LISTEN on server connections of a transaction pooler until it resets them"},
+		TypicalDuration: "5s",
+	},
+	{
+		Name:            "canceldriver",
+		Demonstrates:    "Whether the cancel request pgx sends when a context deadline expires stops a statement blocked behind a row lock on the server, rather than only the client giving up.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_cancel"},
+		TypicalDuration: "7s",
+	},
+	{
+		Name:            "cancelcompare",
+		Demonstrates:    "The same blocked UPDATE ended by a context deadline (pgx's CancelRequest) and by server-side statement_timeout: which one releases the lock wait sooner, which SQLSTATE each surfaces, and whether the connection survives.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_cancel"},
+		TypicalDuration: "12s",
+	},
+	{
+		Name:            "promote",
+		Demonstrates:    "Promoting a standby mid-run after flipping the writes to it: read-only errors before the promotion, recovery conflicts of standby reads, connection resets and the write latency warm-up after it, second by second.",
+		Privileges:      []string{"CREATE on the current schema of the primary", "a standby of DATABASE_URL at -standby-url", "pg_promote() on the standby (superuser or GRANT EXECUTE), or -promote-cmd"},
+		Destructive:     []string{"drops and recreates test_promote", "promotes the standby, which has to be rebuilt to follow the primary again"},
+		TypicalDuration: "35s",
+	},
+	{
+		Name:            "backpressure",
+		Demonstrates:    "The same request load served by a goroutine per request and by a fixed worker pool with a bounded queue while a lock exhausts the connection pool: goroutines, memory, shed requests and how long each takes to recover.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_backpressure"},
+		TypicalDuration: "1 minute",
+	},
+	{
+		Name:            "pgxpoison",
+		Demonstrates:    "The poison fault against pgxpool next to database/sql: whether a connection released inside a transaction keeps its row lock, pgxpool's Stat counters, and how each pool's ping of connections idle for over a second catches sessions terminated on the server.",
+		Privileges:      []string{"CREATE on the current schema", "pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"drops and recreates test_pgxpoison", "terminates its own pooled sessions"},
+		TypicalDuration: "1 minute",
+	},
+	{
+		Name:            "locktimeout",
+		Demonstrates:    "Workers bounded by lock_timeout instead of their context deadline against the same row lock held outside the pool: 55P03 errors against client cancels, and what each costs the pool in connection churn, checkout waits and recovery.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_row"},
+		TypicalDuration: "70s",
+	},
+	{
+		Name:            "deadlock",
+		Demonstrates:    "Two worker groups updating the same two rows in opposite order: the deadlock rate the server breaks with 40P01, which group's transactions it picks as victims and how long they waited, and whether the victims' connections go back to the pool outside a transaction.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_row"},
+		TypicalDuration: "20s",
+	},
+	{
+		Name:            "advisorylock",
+		Demonstrates:    "Workers serialized by a session-level advisory lock which a pooled connection holds instead of a row lock, taken with pg_try_advisory_lock polling and with a blocking pg_advisory_lock: reentrant acquisitions on the poisoned connection, and locks left in the pool by a deadline expiring before the unlock.",
+		Privileges:      []string{"pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"terminates its own poisoned session"},
+		TypicalDuration: "70s",
+	},
+	{
+		Name:            "execpatterns",
+		Demonstrates:    "One two-statement operation sharing a session setting, written as two calls on the *sql.DB, on a checked-out *sql.Conn and in a *sql.Tx: how long each holds a pooled connection and waits for one, and which sees another request's setting or leaves its own behind.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_patterns"},
+		TypicalDuration: "30s",
+	},
+	{
+		Name:            "listenidle",
+		Demonstrates:    "LISTEN issued on pooled connections which then sit idle in the database/sql pool: notifications that only reach code unwrapping the connection with Raw, and listeners silently ended with the sessions MaxIdleConns and ConnMaxIdleTime close.",
+		Privileges:      []string{"CONNECT"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "10s",
+	},
+	{
+		Name:            "copycancel",
+		Demonstrates:    "A COPY FROM STDIN canceled mid-stream by its context deadline, network-bound and paced by the client: how long pgx and the server take to stop, whether the rows already sent are rolled back, and whether the connection and the pool are usable afterwards.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_copy"},
+		TypicalDuration: "10s",
+	},
+	{
+		Name:            "rotate",
+		Demonstrates:    "Hidden dependence on session state in the user's statement mix: each statement run on one session and again on a new session of its own, with the statements that fail or return other rows only when rotated and the temp tables, settings, advisory locks or sequence values earlier statements set.",
+		Privileges:      []string{"whatever the statement mix needs"},
+		Destructive:     []string{"runs the statements of -rotate-statements twice; the built-in example creates the sequence rotate_seq"},
+		TypicalDuration: "1s",
+	},
+	{
+		Name:            "bigresult",
+		Demonstrates:    "A query returning millions of rows abandoned mid-fetch, by canceling its context and by closing the rows early: how long the driver takes to give the connection back, whether it drains the result or abandons the connection, and when the server stops sending.",
+		Privileges:      []string{"CONNECT"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "20s",
+	},
+	{
+		Name:            "timeoutcompare",
+		Demonstrates:    "A fixed per-query deadline against one derived from the rolling p99 of committed queries times three, under normal, degraded and hung load: queries canceled although they would have finished, the server time they wasted and how long hung queries held a connection.",
+		Privileges:      []string{"CONNECT"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "1 minute",
+	},
+	{
+		Name:            "platform",
+		Demonstrates:    "Client platform differences in fault handling: how child processes are killed, whether freeze and the in-flight dump signal exist, which keepalive schedule the OS accepts, and how fast and with which system error a terminated backend is detected, idle and mid-statement.",
+		Privileges:      []string{"pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"terminates its own probe sessions"},
+		TypicalDuration: "5s",
+	},
+	{
+		Name:            "calibrate",
+		Demonstrates:    "The harness's own cost: the counter workload's statements against an in-process mock server, through the bare driver and through the instrumented worker path, and the latency and CPU the instrumentation adds per iteration.",
+		Privileges:      []string{"none"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "10s",
+	},
+	{
+		Name:            "protoedge",
+		Demonstrates:    "Driver edge cases against an in-process mock server that misbehaves at the protocol level: a connection dropped after authentication, ReadyForQuery held back past the statement deadline, and Terminate never answered by a close.",
+		Privileges:      []string{"none"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "5s",
+	},
+	{
+		Name:            "protofault",
+		Demonstrates:    "Driver robustness against malformed and abusive server responses from an in-process mock server: a truncated DataRow, a duplicate ReadyForQuery, a NOTICE flood and a TLS connection closed without Terminate, each classified for pgx and database/sql.",
+		Privileges:      []string{"none"},
+		Destructive:     []string{"none"},
+		TypicalDuration: "10s",
+	},
+	{
+		Name:            "shutdown",
+		Demonstrates:    "Application deploy drills: how many in-flight transactions each drain strategy cuts off and whether sessions are left behind.",
+		Privileges:      []string{"CREATE on the current schema"},
+		Destructive:     []string{"drops and recreates test_drain"},
+		TypicalDuration: "20s",
+	},
+	{
+		Name:            "rollingdeploy",
+		Demonstrates:    "Combined connection peak against max_connections and the latency dip while old and new application instances overlap.",
+		Privileges:      []string{"enough max_connections headroom for (instances + 1) x pool size"},
+		Destructive:     []string{"runs child processes of this binary"},
+		TypicalDuration: "45s with defaults",
+	},
+	{
+		Name:            "fuzz",
+		Demonstrates:    "Unexpected pool states from randomly composed lock holders, poisoned connections, killed sessions and latency, checked for permanent stalls and lost or unacknowledged writes; -seed replays a schedule.",
+		Privileges:      []string{"CREATE on the current schema", "pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"drops and recreates the workload tables", "terminates worker sessions"},
+		TypicalDuration: "20s + -fuzz-window + 10s",
+	},
+	{
+		Name:            "compose",
+		Demonstrates:    "A combination of faults given on the command line or in a config file (lock, poison, kill-backend, latency, dns, each with its own start and end), with a phase per set of active faults and a recovery check after the last one ends.",
+		Privileges:      []string{"CREATE on the current schema", "pg_terminate_backend on the client's own sessions"},
+		Destructive:     []string{"drops and recreates the workload tables", "terminates worker sessions for poison and kill-backend"},
+		TypicalDuration: "20s + the composition + 10s",
+	},
+}
+
+// modes are the scenarios selected by the first positional argument
+var modes = func() []string {
+	names := make([]string, 0, len(scenarioCatalog))
+	for _, s := range scenarioCatalog {
+		names = append(names, s.Name)
+	}
+	return names
+}()
+
+// describeScenarios prints the catalog, or the named scenarios, as text or JSON
+func describeScenarios(args []string) bool {
+	asJSON := len(args) > 0 && args[0] == "-json"
+	if asJSON {
+		args = args[1:]
+	}
+	selected := scenarioCatalog
+	if len(args) > 0 {
+		selected = nil
+		for _, name := range args {
+			found := false
+			for _, s := range scenarioCatalog {
+				if s.Name == name {
+					selected = append(selected, s)
+					found = true
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "describe: unknown scenario %q (known: %s)\n", name, strings.Join(modes, ", "))
+				return false
+			}
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(selected)
+		return true
+	}
+	for i, s := range selected {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s (typically %s)\n", s.Name, s.TypicalDuration)
+		fmt.Printf("  %s\n", s.Demonstrates)
+		fmt.Printf("  Requires:    %s\n", strings.Join(s.Privileges, "; "))
+		fmt.Printf("  Destructive: %s\n", strings.Join(s.Destructive, "; "))
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+// Configurable schema generator for the counter workload.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// schemaSpec describes the generated test_row table. The zero-extra-columns,
+// single-row spec is the original tiny counter table.
+type schemaSpec struct {
+	rows       int // number of rows seeded; workers update a random row, the blocker locks id=1
+	columns    int // extra TEXT payload columns c1..cN
+	indexes    int // secondary indexes, on val first (defeats HOT updates) then c1..cN
+	fillfactor int // table fillfactor, 10-100
+}
+
+func (s schemaSpec) validate() error {
+	if s.rows < 1 {
+		return fmt.Errorf("rows must be at least 1")
+	}
+	if s.columns < 0 || s.indexes < 0 {
+		return fmt.Errorf("columns and indexes must not be negative")
+	}
+	if s.indexes > s.columns+1 {
+		return fmt.Errorf("at most %d indexes with %d columns", s.columns+1, s.columns)
+	}
+	if s.fillfactor < 10 || s.fillfactor > 100 {
+		return fmt.Errorf("fillfactor must be between 10 and 100")
+	}
+	return nil
+}
+
+// ddl returns the statements which (re)create and populate test_row
+func (s schemaSpec) ddl() []string {
+	cols := []string{"id INT PRIMARY KEY", "val INT"}
+	sel := []string{"g", "0"}
+	for i := 1; i <= s.columns; i++ {
+		cols = append(cols, fmt.Sprintf("c%d TEXT", i))
+		sel = append(sel, fmt.Sprintf("md5((g * %d)::text)", i))
+	}
+
+	stmts := []string{
+		"DROP TABLE IF EXISTS test_row",
+		fmt.Sprintf("CREATE TABLE test_row (%s) WITH (fillfactor = %d)", strings.Join(cols, ", "), s.fillfactor),
+		fmt.Sprintf("INSERT INTO test_row SELECT %s FROM generate_series(1, %d) g", strings.Join(sel, ", "), s.rows),
+	}
+	for i := 0; i < s.indexes; i++ {
+		col := "val"
+		if i > 0 {
+			col = fmt.Sprintf("c%d", i)
+		}
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX test_row_%s_idx ON test_row (%s)", col, col))
+	}
+	return append(stmts, "ANALYZE test_row")
+}
+
+func (s schemaSpec) create(db *sql.DB) {
+	for _, stmt := range s.ddl() {
+		if _, err := db.Exec(stmt); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Schema setup failed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// SERIALIZABLE workload with an optional retry wrapper for serialization
+// failures.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// serializableWorkload reads the sum of test_row and increments a random row
+// in one SERIALIZABLE transaction, so concurrent iterations conflict and the
+// server fails some of them with 40001. With retries an iteration runs again
+// after a serialization failure (or a 40P01 deadlock), each attempt on a fresh
+// checkout with a fresh timeout as a typical retry wrapper does, after a full
+// jitter backoff if one is set.
+type serializableWorkload struct {
+	schema  schemaSpec
+	retries int
+	backoff time.Duration
+
+	acked atomic.Int64 // increments reported as successful to the worker
+
+	mu     sync.Mutex
+	phases []*serializablePhase
+}
+
+// serializablePhase counts attempts during one phase of the phase report
+type serializablePhase struct {
+	name       string
+	iterations int64
+	attempts   int64
+	conflicts  int64 // attempts failed with 40001 or 40P01
+	exhausted  int64 // iterations which still failed on a conflict after every retry
+}
+
+func (w *serializableWorkload) setup(db *sql.DB) {
+	w.schema.create(db)
+}
+
+// phase returns the counters of the current phase; w.mu must be held
+func (w *serializableWorkload) phase() *serializablePhase {
+	name := ""
+	if p := currentPhase.Load(); p != nil {
+		name = p.name
+	}
+	if len(w.phases) == 0 || w.phases[len(w.phases)-1].name != name {
+		w.phases = append(w.phases, &serializablePhase{name: name})
+	}
+	return w.phases[len(w.phases)-1]
+}
+
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+func (w *serializableWorkload) run(ctx context.Context, db *sql.DB, worker int, iteration int) error {
+	timeout := 500 * time.Millisecond
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	w.mu.Lock()
+	w.phase().iterations++
+	w.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if attempt > 0 {
+			attemptCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		}
+		err := w.attempt(attemptCtx, db)
+		cancel()
+		conflict := isSerializationFailure(err)
+		w.mu.Lock()
+		p := w.phase()
+		p.attempts++
+		if conflict {
+			p.conflicts++
+			if attempt == w.retries {
+				p.exhausted++
+			}
+		}
+		w.mu.Unlock()
+		if err == nil {
+			w.acked.Add(1)
+			return nil
+		}
+		if !conflict || attempt == w.retries {
+			return err
+		}
+		if w.backoff > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(w.backoff) << min(attempt, 10))))
+		}
+	}
+}
+
+// attempt runs the transaction once; database/sql rolls it back on error
+func (w *serializableWorkload) attempt(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var sum int64
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(sum(val), 0) FROM test_row").Scan(&sum); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE test_row SET val = val + 1 WHERE id = $1", 1+rand.Intn(w.schema.rows)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_sleep(0.01)"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// verify checks that the committed counter total equals the acknowledged
+// increments, and prints the attempts per phase
+func (w *serializableWorkload) verify(ctx context.Context, conn *sql.Conn) (bool, string, error) {
+	var total int64
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(sum(val), 0) FROM test_row").Scan(&total); err != nil {
+		return false, "", err
+	}
+	w.mu.Lock()
+	fmt.Printf(">>> SERIALIZATION RETRIES (%d retries, backoff %v)\n", w.retries, w.backoff)
+	fmt.Printf("%-24s %10s %9s %10s %8s %10s %14s\n", "Phase", "Iterations", "Attempts", "Conflicts", "Retries", "Exhausted", "Attempts/iter")
+	var conflicts, retried int64
+	for _, p := range w.phases {
+		name := p.name
+		if name == "" {
+			name = "(start)"
+		}
+		amplification := 0.0
+		if p.iterations > 0 {
+			amplification = float64(p.attempts) / float64(p.iterations)
+		}
+		fmt.Printf("%-24s %10d %9d %10d %8d %10d %14.2f\n", name, p.iterations, p.attempts, p.conflicts, p.attempts-p.iterations, p.exhausted, amplification)
+		conflicts += p.conflicts
+		retried += p.attempts - p.iterations
+	}
+	w.mu.Unlock()
+	fmt.Println("Every attempt checks out a connection, so Attempts/iter is the extra pool demand of the retries.")
+	fmt.Println()
+
+	acked := w.acked.Load()
+	detail := fmt.Sprintf("counter=%d acknowledged=%d conflicts=%d retries=%d", total, acked, conflicts, retried)
+	switch {
+	case total < acked:
+		detail += fmt.Sprintf(" (%d acknowledged updates lost)", acked-total)
+	case total > acked:
+		detail += fmt.Sprintf(" (%d unacknowledged updates applied)", total-acked)
+	}
+	return total == acked, detail, nil
+}
+
+func (*serializableWorkload) poisonSQL() string {
+	return "UPDATE test_row SET val = val + 1 WHERE id = 1 -- POISON"
+}
@@ -0,0 +1,277 @@
+// Scenario: serverless-style clients, many short-lived processes each opening
+// one or two connections for a couple of queries and exiting, next to the
+// same invocations sharing one long-lived pool as an external pooler would.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverlessApp is the application_name of every invocation's sessions
+const serverlessApp = "pg-idle-test-serverless"
+
+type serverlessResult struct {
+	failures map[string]int
+	backends map[int32]bool
+	connects []time.Duration // per process invocation, dial to first statement
+	wall     []time.Duration // per invocation, including process start
+	elapsed  time.Duration
+	peak     int64 // server sessions of serverlessApp at once
+}
+
+// invocationError is the failure a child invocation reported, classified on
+// its side where the error's type is still known
+type invocationError struct{ class, msg string }
+
+func (e *invocationError) Error() string { return e.msg }
+
+func init() {
+	registerScenario("serverless", scenario{
+		standalone: func(o *options) bool {
+			return runServerless(o.connStr, o.serverlessInvocations, o.serverlessConcurrency)
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = 2*o.serverlessConcurrency + 1 }, // two per invocation and sampler
+	})
+}
+
+// runServerless runs invocations at most concurrency at a time, first each in
+// a new process of this binary with its own connections, then each as a
+// goroutine on one pool of concurrency connections. Every other invocation
+// runs its two queries concurrently and so opens two connections. It passes
+// if no invocation failed in either.
+func runServerless(connStr string, invocations, concurrency int) bool {
+	sampler, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer sampler.Close()
+	sampler.SetMaxOpenConns(1)
+
+	modes := []string{"process", "pooled"}
+	results := map[string]*serverlessResult{}
+	for _, mode := range modes {
+		fmt.Printf(">>> SERVERLESS: %s, %d invocations, %d at a time\n", mode, invocations, concurrency)
+		var invoke func(i int) ([]int32, time.Duration, error)
+		if mode == "process" {
+			invoke = func(i int) ([]int32, time.Duration, error) { return serverlessProcess(connStr, 1+i%2) }
+		} else {
+			db, err := openDB(connStr, serverlessApp)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+				return false
+			}
+			defer db.Close()
+			db.SetMaxOpenConns(concurrency)
+			db.SetMaxIdleConns(concurrency)
+			invoke = func(i int) ([]int32, time.Duration, error) {
+				pids, err := serverlessInvoke(context.Background(), db, 1+i%2)
+				return pids, -1, err
+			}
+		}
+		results[mode] = serverlessRun(sampler, invoke, invocations, concurrency)
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> SERVERLESS REPORT (%d invocations, %d at a time)\n", invocations, concurrency)
+	fmt.Printf("%-8s %8s %8s %9s %10s %11s %12s %12s %12s %12s\n", "Mode", "Elapsed", "Failed", "Backends", "Backends/s", "Peak conns",
+		"Connect p50", "Connect p95", "Invoke p50", "Invoke p95")
+	pass := true
+	for _, mode := range modes {
+		r := results[mode]
+		failed := 0
+		for _, n := range r.failures {
+			failed += n
+		}
+		pass = pass && failed == 0
+		connect50, connect95 := "-", "-"
+		if len(r.connects) > 0 {
+			connect50, connect95 = ms(percentile(r.connects, 0.50)), ms(percentile(r.connects, 0.95))
+		}
+		fmt.Printf("%-8s %7.1fs %8d %9d %10.1f %11d %12s %12s %12s %12s\n", mode, r.elapsed.Seconds(), failed, len(r.backends),
+			float64(len(r.backends))/r.elapsed.Seconds(), r.peak, connect50, connect95,
+			ms(percentile(r.wall, 0.50)), ms(percentile(r.wall, 0.95)))
+		for class, n := range r.failures {
+			fmt.Printf("  %s: %d failed with %s\n", mode, n, class)
+		}
+	}
+	fmt.Println()
+	fmt.Println("Backends counts the server sessions the invocations ran on: every process dials its own, so the server")
+	fmt.Println("forks, authenticates and warms a catalog cache for each invocation and tears it down a few queries")
+	fmt.Println("later, and Peak conns follows concurrency times connections per invocation rather than the work done.")
+	fmt.Println("The pooled mode stands in for an external pooler such as PgBouncer or RDS Proxy in front of the same")
+	fmt.Println("invocations: the server keeps a fixed set of sessions and a new client pays for a pooler connection")
+	fmt.Println("only. Point DATABASE_URL at a pooler to measure the process mode through it.")
+	if !pass {
+		fmt.Println(">>> SERVERLESS: FAIL invocations failed, likely on the server's connection limit (see the classes above)")
+		return false
+	}
+	fmt.Println(">>> SERVERLESS: PASS every invocation succeeded")
+	return true
+}
+
+// serverlessRun calls invoke invocations times, at most concurrency at once,
+// while sampling the server sessions of serverlessApp every 100ms
+func serverlessRun(sampler *sql.DB, invoke func(i int) ([]int32, time.Duration, error), invocations, concurrency int) *serverlessResult {
+	r := &serverlessResult{failures: map[string]int{}, backends: map[int32]bool{}}
+	var peak atomic.Int64
+	sampling, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		for sampling.Err() == nil {
+			var n int64
+			if sampler.QueryRowContext(sampling, "SELECT count(*) FROM pg_stat_activity WHERE application_name = $1", serverlessApp).Scan(&n) == nil && n > peak.Load() {
+				peak.Store(n)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	var done atomic.Int64
+	start := time.Now()
+	for i := 0; i < invocations; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			t0 := time.Now()
+			pids, connect, err := invoke(i)
+			wall := time.Since(t0)
+			mu.Lock()
+			defer mu.Unlock()
+			r.wall = append(r.wall, wall)
+			if connect >= 0 && err == nil {
+				r.connects = append(r.connects, connect)
+			}
+			for _, pid := range pids {
+				if pid != 0 {
+					r.backends[pid] = true
+				}
+			}
+			if ie, ok := err.(*invocationError); ok {
+				r.failures[ie.class]++
+			} else if err != nil {
+				r.failures[classifyStormError(err)]++
+			}
+			if n := done.Add(1); n%100 == 0 {
+				fmt.Fprintf(os.Stderr, "[%s] SERVERLESS: %d/%d invocations, %d backends\n", time.Now().Format("04:05"), n, invocations, len(r.backends))
+			}
+		}(i)
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+	stop()
+	r.peak = peak.Load()
+	sort.Slice(r.wall, func(i, j int) bool { return r.wall[i] < r.wall[j] })
+	sort.Slice(r.connects, func(i, j int) bool { return r.connects[i] < r.connects[j] })
+	return r
+}
+
+// serverlessProcess runs one invocation in a new process of this binary and
+// parses the backends and connect time it reports
+func serverlessProcess(connStr string, conns int) ([]int32, time.Duration, error) {
+	cmd, err := childCommand(connStr, "invocation", strconv.Itoa(conns))
+	if err != nil {
+		return nil, 0, err
+	}
+	out, err := cmd.Output()
+	line := strings.TrimSpace(string(out))
+	if reason, failed := strings.CutPrefix(line, "FAILED "); failed {
+		class, msg, _ := strings.Cut(reason, " ")
+		return nil, 0, &invocationError{class: class, msg: msg}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var connectUs int64
+	var pidList string
+	if _, err := fmt.Sscanf(line, "INVOKED connect_us=%d pids=%s", &connectUs, &pidList); err != nil {
+		return nil, 0, fmt.Errorf("unexpected invocation output %q", line)
+	}
+	var pids []int32
+	for _, p := range strings.Split(pidList, ",") {
+		if pid, err := strconv.Atoi(p); err == nil {
+			pids = append(pids, int32(pid))
+		}
+	}
+	return pids, time.Duration(connectUs) * time.Microsecond, nil
+}
+
+// runInvocation is the child side of serverless: one invocation on its own
+// connections, reported on stdout, then exit
+func runInvocation(connStr, conns string) {
+	n, _ := strconv.Atoi(conns)
+	fail := func(err error) {
+		fmt.Printf("FAILED %s %s\n", classifyStormError(err), oneLine(err.Error()))
+		os.Exit(1)
+	}
+	db, err := openDB(connStr, serverlessApp)
+	if err != nil {
+		fail(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		fail(err)
+	}
+	connect := time.Since(start)
+	pids, err := serverlessInvoke(ctx, db, n)
+	if err != nil {
+		fail(err)
+	}
+	var list []string
+	for _, pid := range pids {
+		list = append(list, strconv.Itoa(int(pid)))
+	}
+	fmt.Printf("INVOKED connect_us=%d pids=%s\n", connect.Microseconds(), strings.Join(list, ","))
+}
+
+// serverlessInvoke is the work of one invocation: a catalog lookup and a read
+// of the server's activity, one after the other on one connection or at once
+// on two
+func serverlessInvoke(ctx context.Context, db *sql.DB, conns int) ([]int32, error) {
+	queries := []string{
+		"SELECT pg_backend_pid() FROM pg_class WHERE relname = 'pg_class'",
+		"SELECT pg_backend_pid() FROM (SELECT count(*) FROM pg_stat_activity) a",
+	}
+	pids := make([]int32, len(queries))
+	errs := make([]error, len(queries))
+	run := func(i int) { errs[i] = db.QueryRowContext(ctx, queries[i]).Scan(&pids[i]) }
+	if conns < 2 {
+		for i := range queries {
+			run(i)
+		}
+	} else {
+		// Both checkouts at once make the pool open a second connection
+		var wg sync.WaitGroup
+		for i := range queries {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				run(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return pids, err
+		}
+	}
+	return pids, nil
+}
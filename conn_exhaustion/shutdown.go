@@ -0,0 +1,162 @@
+// Graceful shutdown drill comparing pool drain strategies.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainStrategies are the ways the drill shuts the application down:
+//   - immediate: cancel everything in flight and close the pool
+//   - deadline: stop taking work, wait up to -drain-timeout, then cancel the rest
+//   - wait: stop taking work and wait for every in-flight transaction, up to
+//     drainWaitCap after which the rest is canceled
+var drainStrategies = []string{"immediate", "deadline", "wait"}
+
+// drainWaitCap bounds the wait strategy, as an orchestrator's termination
+// grace period would
+const drainWaitCap = time.Minute
+
+type drillResult struct {
+	inFlight     int64 // transactions begun on a connection when shutdown began
+	drained      int64 // in-flight transactions which committed after shutdown began
+	cutOff       int64 // in-flight transactions canceled by the shutdown
+	drainTime    time.Duration
+	backendsLeft int // sessions still on the server right after the pool closed
+	openTxLeft   int // of which inside a transaction
+}
+
+func init() {
+	registerScenario("shutdown", scenario{
+		standalone: func(o *options) bool { return runShutdownDrill(o.connStr, o.workers, o.maxOpen, o.drainTimeout) },
+	})
+}
+
+// runShutdownDrill runs one simulated deploy per drain strategy on a pool of
+// maxOpen. Each worker runs short transactions on its own row, sleeping up to
+// 300ms inside the transaction, so there is always work in flight when the
+// deploy starts.
+func runShutdownDrill(connStr string, workers, maxOpen int, drainTimeout time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_drain")
+	setup.Exec("CREATE TABLE test_drain (id INT PRIMARY KEY, val INT)")
+	setup.Exec("INSERT INTO test_drain SELECT g, 0 FROM generate_series(0, $1) g", workers-1)
+
+	results := map[string]drillResult{}
+	for _, strategy := range drainStrategies {
+		fmt.Printf(">>> SHUTDOWN: drill with %s drain\n", strategy)
+		results[strategy] = drillOnce(connStr, setup, strategy, workers, maxOpen, drainTimeout)
+	}
+
+	fmt.Println()
+	fmt.Println(">>> SHUTDOWN REPORT")
+	fmt.Printf("%-10s %9s %8s %7s %10s %13s %11s\n", "Strategy", "InFlight", "Drained", "CutOff", "DrainTime", "BackendsLeft", "OpenTxLeft")
+	clean := true
+	for _, strategy := range drainStrategies {
+		r := results[strategy]
+		fmt.Printf("%-10s %9d %8d %7d %10s %13d %11d\n", strategy, r.inFlight, r.drained, r.cutOff,
+			r.drainTime.Round(time.Millisecond), r.backendsLeft, r.openTxLeft)
+		clean = clean && r.openTxLeft == 0
+	}
+	return clean
+}
+
+func drillOnce(connStr string, monitor *sql.DB, strategy string, workers, maxOpen int, drainTimeout time.Duration) drillResult {
+	appName := "pg-idle-test-drain-" + strategy
+	db, err := openDB(connStr, appName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return drillResult{}
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxOpen)
+
+	hardCtx, hardStop := context.WithCancel(context.Background())
+	defer hardStop()
+	var accepting atomic.Bool
+	var shuttingDown atomic.Bool
+	var inFlight, drained, cutOff atomic.Int64
+	accepting.Store(true)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for accepting.Load() {
+				began, err := drillTransaction(hardCtx, db, worker, &inFlight)
+				// Workers still queued for a connection had nothing in flight
+				if !began || !shuttingDown.Load() {
+					continue
+				}
+				if err == nil {
+					drained.Add(1)
+				} else if hardCtx.Err() != nil {
+					cutOff.Add(1)
+				}
+			}
+		}(i)
+	}
+	time.Sleep(5 * time.Second)
+
+	// Deploy: stop taking new work and drain according to the strategy
+	start := time.Now()
+	accepting.Store(false)
+	shuttingDown.Store(true)
+	r := drillResult{inFlight: inFlight.Load()}
+	switch strategy {
+	case "immediate":
+		hardStop()
+	case "deadline":
+		for inFlight.Load() > 0 && time.Since(start) < drainTimeout {
+			time.Sleep(time.Millisecond)
+		}
+		hardStop()
+	case "wait":
+		for inFlight.Load() > 0 && time.Since(start) < drainWaitCap {
+			time.Sleep(time.Millisecond)
+		}
+		hardStop()
+	}
+	wg.Wait()
+	db.Close()
+	r.drainTime = time.Since(start)
+	r.drained, r.cutOff = drained.Load(), cutOff.Load()
+
+	// Give the server a moment to process the disconnects
+	time.Sleep(100 * time.Millisecond)
+	monitor.QueryRow(`SELECT count(*), count(*) FILTER (WHERE state LIKE 'idle in transaction%' OR xact_start IS NOT NULL)
+		FROM pg_stat_activity WHERE application_name = $1`, appName).Scan(&r.backendsLeft, &r.openTxLeft)
+	return r
+}
+
+// drillTransaction runs one transaction, counting it in inFlight from BEGIN
+// until it ends, and reports whether it got as far as BEGIN
+func drillTransaction(ctx context.Context, db *sql.DB, worker int, inFlight *atomic.Int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	inFlight.Add(1)
+	defer inFlight.Add(-1)
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "UPDATE test_drain SET val = val + 1 WHERE id = $1", worker); err != nil {
+		return true, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_sleep(random() * 0.3)"); err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// freezeSignal is nil since processes cannot be stopped with a signal here
+var freezeSignal os.Signal
+
+// notifyDumpSignal is not available on this platform; use -http-addr instead
+func notifyDumpSignal(c chan<- os.Signal) bool {
+	return false
+}
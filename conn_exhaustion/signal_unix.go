@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// freezeSignal stops a process without closing its sockets
+var freezeSignal os.Signal = syscall.SIGSTOP
+
+// notifyDumpSignal delivers SIGUSR1 to c
+func notifyDumpSignal(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1)
+	return true
+}
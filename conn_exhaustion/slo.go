@@ -0,0 +1,124 @@
+// SLO evaluation of a run: the error budget of a latency objective such as
+// 99.9% of iterations under 200ms, and how much of it each phase consumed.
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sloTarget is an objective on worker iterations: at least objective of them
+// commit within latency. A failed iteration is always bad.
+type sloTarget struct {
+	objective float64 // e.g. 0.999
+	latency   time.Duration
+}
+
+// slo is nil unless -slo was given
+var slo *sloTarget
+
+// parseSLO parses "99.9%<200ms"
+func parseSLO(spec string) (*sloTarget, error) {
+	pct, latency, ok := strings.Cut(strings.ReplaceAll(spec, " ", ""), "<")
+	if !ok {
+		return nil, fmt.Errorf("want PERCENT%%<LATENCY, e.g. 99.9%%<200ms")
+	}
+	objective, err := strconv.ParseFloat(strings.TrimSuffix(pct, "%"), 64)
+	if err != nil || objective <= 0 || objective >= 100 {
+		return nil, fmt.Errorf("percentage %q is not between 0 and 100", pct)
+	}
+	d, err := time.ParseDuration(latency)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("latency %q is not a positive duration", latency)
+	}
+	return &sloTarget{objective: objective / 100, latency: d}, nil
+}
+
+func (s *sloTarget) String() string {
+	return fmt.Sprintf("%s%% of iterations under %v", strconv.FormatFloat(100*s.objective, 'f', -1, 64), s.latency)
+}
+
+// sloRow is one phase in SLO terms
+type sloRow struct {
+	name       string
+	iterations int
+	bad        int
+	good       float64 // percentage of good iterations
+	burnRate   float64 // bad fraction over the budgeted fraction, 1 spends it exactly
+	budgetUsed float64 // percentage of the whole run's budget spent in the phase
+}
+
+// sloRows evaluates every phase against slo; the budget is 1-objective of
+// the iterations of the whole run. It must be called after printPhaseReport.
+func sloRows() (rows []sloRow, total sloRow) {
+	phases := phaseRows()
+	total.name = "total"
+	for _, p := range phases {
+		total.iterations += p.ok + p.failed
+		total.bad += p.sloBad
+	}
+	budget := (1 - slo.objective) * float64(total.iterations)
+	eval := func(r *sloRow) {
+		if r.iterations == 0 {
+			return
+		}
+		r.good = 100 * float64(r.iterations-r.bad) / float64(r.iterations)
+		r.burnRate = float64(r.bad) / float64(r.iterations) / (1 - slo.objective)
+		if budget > 0 {
+			r.budgetUsed = 100 * float64(r.bad) / budget
+		}
+	}
+	for _, p := range phases {
+		r := sloRow{name: p.name, iterations: p.ok + p.failed, bad: p.sloBad}
+		eval(&r)
+		rows = append(rows, r)
+	}
+	eval(&total)
+	return rows, total
+}
+
+// printSLOReport prints the error budget per phase, if -slo was given
+func printSLOReport() {
+	if slo == nil {
+		return
+	}
+	rows, total := sloRows()
+	fmt.Println()
+	fmt.Printf(">>> SLO REPORT (%v, failed iterations count as bad)\n", slo)
+	fmt.Printf("%-40s %10s %8s %8s %10s %12s\n", "Phase", "Iterations", "Bad", "Good%", "Burn rate", "Budget used")
+	for _, r := range append(rows, total) {
+		fmt.Printf("%-40s %10d %8d %8.3f %9.1fx %11.1f%%\n", r.name, r.iterations, r.bad, r.good, r.burnRate, r.budgetUsed)
+	}
+	fmt.Println("The error budget is the bad iterations the objective allows over the whole run; Budget used is each")
+	fmt.Println("phase's share of it, so a fault phase above 100% alone broke the objective for the run. A burn rate of")
+	fmt.Println("1x spends the budget exactly as fast as the objective allows; multi-window burn rate alerts page at")
+	fmt.Println("about 14x over an hour.")
+	worst := sloRow{}
+	for _, r := range rows {
+		if r.budgetUsed > worst.budgetUsed {
+			worst = r
+		}
+	}
+	switch {
+	case total.budgetUsed <= 100:
+		fmt.Printf(">>> SLO: met, %.1f%% of the error budget used\n", total.budgetUsed)
+	default:
+		fmt.Printf(">>> SLO: missed, %.1f%% of the error budget used, %.1f%% in phase %s\n", total.budgetUsed, worst.budgetUsed, worst.name)
+	}
+}
+
+// writeSLOSummary adds the SLO table to the Markdown summary
+func writeSLOSummary(w io.Writer) {
+	if slo == nil {
+		return
+	}
+	rows, total := sloRows()
+	fmt.Fprintf(w, "\n### SLO: %v\n\n", slo)
+	fmt.Fprintf(w, "| Phase | Iterations | Bad | Good%% | Burn rate | Budget used |\n|---|---:|---:|---:|---:|---:|\n")
+	for _, r := range append(rows, total) {
+		fmt.Fprintf(w, "| %s | %d | %d | %.3f | %.1fx | %.1f%% |\n", r.name, r.iterations, r.bad, r.good, r.burnRate, r.budgetUsed)
+	}
+}
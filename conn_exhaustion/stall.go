@@ -0,0 +1,202 @@
+// Stall detection and root-cause diagnosis from pool and server evidence.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// stallSeconds of a full pool with waiting checkouts count as a stall
+const stallSeconds = 3
+
+// commitWaitEvents are the wait events of a backend whose commit is waiting
+// for WAL to be written or flushed (IO and LWLock) or for a synchronous
+// standby (IPC), as a SQL list
+const commitWaitEvents = "'SyncRep', 'WALWrite', 'WALSync', 'WALInsert', 'WALBufMapping'"
+
+// openTxSeen is when the monitor last checked out a pooled connection with an
+// open transaction (unix nanoseconds, 0 if never)
+var openTxSeen atomic.Int64
+
+// stallDetector diagnoses each stall once, when it has lasted stallSeconds
+type stallDetector struct {
+	fullFor   int
+	diagnosed bool
+}
+
+func (d *stallDetector) observe(stats sql.DBStats, waitsDelta float64) {
+	if stats.MaxOpenConnections == 0 || stats.InUse < stats.MaxOpenConnections || waitsDelta == 0 {
+		d.fullFor, d.diagnosed = 0, false
+		return
+	}
+	d.fullFor += int(monitorTick() / time.Second)
+	if d.fullFor < stallSeconds || d.diagnosed {
+		return
+	}
+	d.diagnosed = true
+	ev := gatherEvidence(stats, waitsDelta)
+	diagnosis := diagnoseStall(ev)
+	recordDiagnosis(diagnosis)
+	go notify.send("stall", diagnosis)
+	fmt.Println()
+	fmt.Printf(">>> DIAGNOSIS: %s\n", diagnosis)
+	for _, line := range ev.lines() {
+		fmt.Printf("    evidence: %s\n", line)
+	}
+	printInflight(os.Stdout)
+}
+
+// stallEvidence is what the decision tree looks at
+type stallEvidence struct {
+	inUse, maxOpen int
+	waitsPerSec    float64
+	openTxAudit    bool // a pooled connection was seen inside a transaction recently
+
+	serverErr error
+
+	// The oldest session blocking others, if any
+	blockerPID   int
+	blockerState string
+	blockerXact  float64 // seconds since its transaction started
+	blockerQuery string
+	blockerWait  string // its wait event, if it is waiting itself
+	blockerRels  string // tables it holds row locks on
+	blocked      int    // sessions waiting on its locks
+
+	// The oldest session queued for an ACCESS EXCLUSIVE table lock, if any
+	ddlPID   int
+	ddlQuery string
+
+	commitWaits int    // active sessions waiting for their commit record to be written, flushed or replicated
+	commitWait  string // most common wait event among them
+
+	active   int    // non-idle sessions in this database, other than the sampler
+	onCPU    int    // active sessions without a wait event
+	topWait  string // most common wait_event_type among them
+	idleInTx int
+}
+
+func gatherEvidence(stats sql.DBStats, waitsDelta float64) stallEvidence {
+	ev := stallEvidence{
+		inUse:       stats.InUse,
+		maxOpen:     stats.MaxOpenConnections,
+		waitsPerSec: waitsDelta,
+		openTxAudit: time.Since(time.Unix(0, openTxSeen.Load())) < 10*time.Second,
+	}
+	if statsDB == nil {
+		ev.serverErr = fmt.Errorf("no stats connection")
+		return ev
+	}
+	ev.serverErr = statsDB.QueryRow(`
+		SELECT count(*) FILTER (WHERE state <> 'idle'),
+		       count(*) FILTER (WHERE state = 'active' AND wait_event IS NULL),
+		       count(*) FILTER (WHERE state LIKE 'idle in transaction%'),
+		       COALESCE(mode() WITHIN GROUP (ORDER BY wait_event_type) FILTER (WHERE state = 'active'), ''),
+		       count(*) FILTER (WHERE state = 'active' AND wait_event IN (`+commitWaitEvents+`)),
+		       COALESCE(mode() WITHIN GROUP (ORDER BY wait_event) FILTER (WHERE state = 'active' AND wait_event IN (`+commitWaitEvents+`)), '')
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND backend_type = 'client backend' AND pid <> pg_backend_pid()`).
+		Scan(&ev.active, &ev.onCPU, &ev.idleInTx, &ev.topWait, &ev.commitWaits, &ev.commitWait)
+	if ev.serverErr != nil {
+		return ev
+	}
+	statsDB.QueryRow(`
+		WITH blockers AS (
+			SELECT unnest(pg_blocking_pids(pid)) AS pid, count(*) OVER () AS blocked
+			FROM pg_stat_activity WHERE datname = current_database())
+		SELECT a.pid, COALESCE(a.state, ''), COALESCE(EXTRACT(epoch FROM now() - a.xact_start), 0), COALESCE(a.query, ''),
+		       COALESCE(a.wait_event, ''),
+		       (SELECT COALESCE(string_agg(DISTINCT c.relname, ','), '')
+		        FROM pg_locks l JOIN pg_class c ON c.oid = l.relation
+		        WHERE l.pid = a.pid AND l.mode = 'RowExclusiveLock' AND c.relkind = 'r'),
+		       (SELECT max(blocked) FROM blockers)
+		FROM pg_stat_activity a
+		WHERE a.pid IN (SELECT pid FROM blockers)
+		ORDER BY a.xact_start
+		LIMIT 1`).Scan(&ev.blockerPID, &ev.blockerState, &ev.blockerXact, &ev.blockerQuery, &ev.blockerWait, &ev.blockerRels, &ev.blocked)
+	statsDB.QueryRow(`
+		SELECT a.pid, COALESCE(a.query, '')
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE NOT l.granted AND l.locktype = 'relation' AND l.mode = 'AccessExclusiveLock' AND a.datname = current_database()
+		ORDER BY a.query_start
+		LIMIT 1`).Scan(&ev.ddlPID, &ev.ddlQuery)
+	return ev
+}
+
+// diagnoseStall walks the decision tree from the most to the least specific cause
+func diagnoseStall(ev stallEvidence) string {
+	if ev.serverErr != nil {
+		return fmt.Sprintf("server unreachable from the stats connection (%v); the pool is likely stuck dialing or on dead connections", ev.serverErr)
+	}
+	// Sessions waiting to commit keep their row locks, so a commit stall also
+	// shows blockers; it is one when the blocker is itself waiting to commit
+	if ev.commitWaits > 0 && (strings.Contains(commitWaitEvents, "'"+ev.blockerWait+"'") || ev.commitWaits*2 >= ev.active) {
+		return fmt.Sprintf("commit stall: %d sessions waiting to make their commit durable (wait event %s) while the server still accepts connections and reads; WAL storage full, frozen or slow, or a synchronous standby not acknowledging",
+			ev.commitWaits, ev.commitWait)
+	}
+	// A CPU-bound server slows the statements holding row locks as much as
+	// any other, so their waiters show up as a lock queue behind a blocker
+	// which is itself on CPU; more sessions on CPU than the pool has
+	// connections means the load does not come from this pool
+	if ev.onCPU > ev.maxOpen && (ev.blockerPID == 0 || ev.blockerState == "active" && ev.blockerWait == "") {
+		return fmt.Sprintf("CPU saturation: %d sessions on CPU without a wait event, more than the pool's %d connections; the server is CPU-bound by work outside this pool and every statement runs slower, lock holders included",
+			ev.onCPU, ev.maxOpen)
+	}
+	// A queued ACCESS EXCLUSIVE request blocks every later statement on the
+	// table, so the oldest blocker is whichever session the DDL waits for
+	if ev.ddlPID != 0 && ev.blockerPID != 0 {
+		return fmt.Sprintf("lock queue behind DDL: PID %d waits for ACCESS EXCLUSIVE behind PID %d (%s) and every statement on the table queues behind it: %s; run migrations with lock_timeout",
+			ev.ddlPID, ev.blockerPID, ev.blockerState, oneLine(ev.ddlQuery))
+	}
+	rels := ev.blockerRels
+	if rels == "" {
+		rels = "a row"
+	}
+	if ev.blockerPID != 0 {
+		switch {
+		case strings.HasPrefix(ev.blockerState, "idle in transaction (aborted)"):
+			return fmt.Sprintf("failed transaction never rolled back: PID %d is idle in an aborted transaction holding locks on %s", ev.blockerPID, rels)
+		case strings.HasPrefix(ev.blockerState, "idle in transaction") && ev.openTxAudit:
+			return fmt.Sprintf("connection returned to pool inside open transaction holding lock on %s (PID %d)", rels, ev.blockerPID)
+		case strings.HasPrefix(ev.blockerState, "idle in transaction"):
+			return fmt.Sprintf("session PID %d is idle in transaction holding lock on %s; the client holds it outside the pool between statements", ev.blockerPID, rels)
+		case ev.blockerState == "active":
+			return fmt.Sprintf("long-running statement in PID %d holds locks on %s: %s", ev.blockerPID, rels, oneLine(ev.blockerQuery))
+		}
+		return fmt.Sprintf("PID %d (%s) blocks %d sessions", ev.blockerPID, ev.blockerState, ev.blocked)
+	}
+	if ev.active >= ev.maxOpen/2 {
+		wait := ev.topWait
+		if wait == "" {
+			wait = "none (on CPU)"
+		}
+		return fmt.Sprintf("pool saturated by slow statements: %d sessions active without lock waits, top wait event type %s; check plans (-slow-query)", ev.active, wait)
+	}
+	return fmt.Sprintf("pool exhausted on the client: %d connections checked out but only %d active on the server; connections are held without running queries (leak or slow code between checkout and return)", ev.inUse, ev.active)
+}
+
+func (ev stallEvidence) lines() []string {
+	lines := []string{fmt.Sprintf("pool InUse=%d/%d Waits/s=%.1f", ev.inUse, ev.maxOpen, ev.waitsPerSec)}
+	if ev.openTxAudit {
+		lines = append(lines, "TxStatus audit: a pooled connection was checked out inside an open transaction")
+	}
+	if ev.serverErr != nil {
+		return append(lines, fmt.Sprintf("server: %v", ev.serverErr))
+	}
+	lines = append(lines, fmt.Sprintf("server: %d active (%d on CPU), %d idle in transaction, top wait event type %q", ev.active, ev.onCPU, ev.idleInTx, ev.topWait))
+	if ev.commitWaits > 0 {
+		lines = append(lines, fmt.Sprintf("commit: %d sessions waiting, top wait event %q", ev.commitWaits, ev.commitWait))
+	}
+	if ev.ddlPID != 0 {
+		lines = append(lines, fmt.Sprintf("ddl: PID %d queued for ACCESS EXCLUSIVE: %s", ev.ddlPID, oneLine(ev.ddlQuery)))
+	}
+	if ev.blockerPID != 0 {
+		lines = append(lines, fmt.Sprintf("blocker: PID %d %s, transaction open %.1fs, %d sessions waiting, locks on %q, last query: %s",
+			ev.blockerPID, ev.blockerState, ev.blockerXact, ev.blocked, ev.blockerRels, oneLine(ev.blockerQuery)))
+	}
+	return lines
+}
@@ -0,0 +1,229 @@
+// Scenario: pgx's statement cache through a transaction pooler, where a
+// statement prepared on one server connection is executed on another, and
+// the client connections it leaves failing until they are closed.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	stmtCachePool = 10
+	stmtCacheRun  = 10 * time.Second
+	// stmtCacheStuck failures in a row, until the end of the run, make a
+	// client connection poisoned
+	stmtCacheStuck = 5
+)
+
+// stmtCacheConn is what one client connection did during a run
+type stmtCacheConn struct {
+	ok, failed int
+	streak     int // failures since its last success
+}
+
+type stmtCacheResult struct {
+	ok, failed int64
+	errors     map[string]int // by SQLSTATE, or error class for non-server errors
+	conns      map[any]*stmtCacheConn
+}
+
+func init() {
+	registerScenario("stmtcache", scenario{
+		standalone: func(o *options) bool { return runStmtCache(o.connStr, o.stmtCacheModes) },
+		validate: func(o *options) error {
+			for _, mode := range strings.Split(o.stmtCacheModes, ",") {
+				if _, ok := queryExecModes[mode]; !ok {
+					return fmt.Errorf("Invalid -stmtcache-modes: unknown exec mode %q", mode)
+				}
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) { n.conns = stmtCachePool + 1 }, // pool and setup
+	})
+}
+
+// runStmtCache runs 20 workers on a pool of stmtCachePool connections for
+// stmtCacheRun per exec mode of modes, each iteration a query and an update
+// on one checked-out connection. It passes if every mode other than
+// cache_statement ran without errors, which is the mitigation it shows.
+func runStmtCache(connStr, modes string) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_stmtcache")
+	if _, err := setup.Exec("CREATE TABLE test_stmtcache AS SELECT g AS id, 0 AS val FROM generate_series(1, 10) g"); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to create test_stmtcache: %v\n", err)
+		return false
+	}
+
+	saved := queryExecMode
+	defer func() { queryExecMode = saved }()
+	queryExecMode = "simple_protocol"
+	pinned := func() poolerProbe {
+		db, err := openDB(connStr, "pg-idle-test-stmtcache")
+		if err != nil {
+			return poolerProbe{"session_pinned", "error", err.Error()}
+		}
+		defer db.Close()
+		db.SetMaxOpenConns(2)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return probePinned(ctx, db)
+	}()
+	fmt.Printf(">>> STMT CACHE: session pinned to one server connection: %s (%s)\n", pinned.verdict, pinned.detail)
+	if pinned.verdict == "yes" {
+		fmt.Println(">>> STMT CACHE: DATABASE_URL does not look like a transaction pooler; expect no errors in any mode")
+	}
+
+	order := strings.Split(modes, ",")
+	results := map[string]*stmtCacheResult{}
+	for _, mode := range order {
+		queryExecMode = mode
+		fmt.Printf(">>> STMT CACHE: %s, 20 workers on %d connections for %v\n", mode, stmtCachePool, stmtCacheRun)
+		r, err := stmtCacheOnce(connStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", mode, err)
+			return false
+		}
+		results[mode] = r
+	}
+
+	fmt.Println()
+	fmt.Printf(">>> STMT CACHE REPORT (%d client connections, session pinned: %s)\n", stmtCachePool, pinned.verdict)
+	fmt.Printf("%-16s %8s %8s %10s %9s  %s\n", "Exec mode", "OK", "Failed", "Conns used", "Poisoned", "Errors")
+	pass := true
+	for _, mode := range order {
+		r := results[mode]
+		poisoned := 0
+		for _, c := range r.conns {
+			if c.streak >= stmtCacheStuck {
+				poisoned++
+			}
+		}
+		var classes []string
+		for class, n := range r.errors {
+			classes = append(classes, fmt.Sprintf("%s=%d", class, n))
+		}
+		sort.Strings(classes)
+		fmt.Printf("%-16s %8d %8d %10d %9d  %s\n", mode, r.ok, r.failed, len(r.conns), poisoned, strings.Join(classes, " "))
+		if mode != "cache_statement" && r.failed > 0 {
+			pass = false
+		}
+	}
+	fmt.Println()
+	fmt.Println("cache_statement, pgx's default, prepares a named statement per SQL text on the session it runs on and")
+	fmt.Println("remembers it in the client connection. Behind a transaction pooler the next transaction of that client")
+	fmt.Println("connection may run on another server connection, where the name is unknown (26000 prepared statement")
+	fmt.Println("does not exist) or was prepared by another client (42P05 already exists). A failed query drops its")
+	fmt.Println("entry and its DEALLOCATE can fail the same way; a failed Exec keeps it, and neither error marks the")
+	fmt.Println("connection bad, so it keeps failing for as long as the pool keeps it. Poisoned counts client")
+	fmt.Println("connections whose last 5 or more statements all failed. cache_describe, describe_exec and exec use")
+	fmt.Println("the unnamed statement within one round trip and simple_protocol none at all; set one with")
+	fmt.Println("default_query_exec_mode in the connection string, or enable max_prepared_statements on PgBouncer")
+	fmt.Println("1.21+ to keep cache_statement.")
+	if !pass {
+		fmt.Println(">>> STMT CACHE: FAIL statements failed in an exec mode which keeps no named statements")
+		return false
+	}
+	fmt.Println(">>> STMT CACHE: PASS the exec modes without named statements ran without errors")
+	return true
+}
+
+func stmtCacheOnce(connStr string) (*stmtCacheResult, error) {
+	r := &stmtCacheResult{errors: map[string]int{}, conns: map[any]*stmtCacheConn{}}
+	db, err := openDB(connStr, "pg-idle-test-stmtcache")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(stmtCachePool)
+	db.SetMaxIdleConns(stmtCachePool)
+
+	var mu sync.Mutex
+	var stopping atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < 20; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; !stopping.Load(); i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				key, err := stmtCacheIteration(ctx, db, w, i)
+				cancel()
+				mu.Lock()
+				c := r.conns[key]
+				if c == nil && key != nil {
+					c = &stmtCacheConn{}
+					r.conns[key] = c
+				}
+				if err == nil {
+					r.ok++
+					c.ok++
+					c.streak = 0
+				} else {
+					r.failed++
+					r.errors[stmtCacheErrorClass(err)]++
+					if c != nil {
+						c.failed++
+						c.streak++
+					}
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(w)
+	}
+	time.Sleep(stmtCacheRun)
+	stopping.Store(true)
+	wg.Wait()
+	return r, nil
+}
+
+// stmtCacheIteration runs a query and an update in autocommit on one
+// checked-out connection, the update through Exec, and returns the driver
+// connection it used
+func stmtCacheIteration(ctx context.Context, db *sql.DB, worker, iteration int) (any, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var key any
+	conn.Raw(func(driverConn any) error {
+		key = driverConn
+		return nil
+	})
+	var v int
+	if err := conn.QueryRowContext(ctx, "SELECT val FROM test_stmtcache WHERE id = $1", 1+worker%10).Scan(&v); err != nil {
+		return key, err
+	}
+	_, err = conn.ExecContext(ctx, "UPDATE test_stmtcache SET val = val + 1 WHERE id = $1", 1+iteration%10)
+	return key, err
+}
+
+// stmtCacheErrorClass names a server error by its SQLSTATE, keeping a failed
+// DEALLOCATE of dropped cache entries apart
+func stmtCacheErrorClass(err error) string {
+	var pgErr *pgconn.PgError
+	switch {
+	case strings.Contains(err.Error(), "failed to deallocate cached statement"):
+		return "deallocate_failed"
+	case errors.As(err, &pgErr):
+		return pgErr.Code
+	}
+	return classifyError(err)
+}
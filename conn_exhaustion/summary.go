@@ -0,0 +1,125 @@
+// Markdown summary of a run for pasting into issues and postmortems.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runSummary collects what the Markdown summary reports besides the phase
+// and error tables
+type runSummary struct {
+	mu        sync.Mutex
+	timeline  []summaryEvent
+	diagnoses []string
+	invariant string
+}
+
+type summaryEvent struct {
+	at   time.Duration // since startTime
+	wall time.Time     // on the server's clock
+	text string
+}
+
+var summary runSummary
+
+// recordEvent adds an injected fault or other notable event to the timeline
+func recordEvent(format string, args ...any) {
+	text := fmt.Sprintf(format, args...)
+	if jsonOutput() {
+		emitJSON("scenario_event", map[string]any{"elapsed_s": time.Since(startTime).Seconds(), "text": text})
+	}
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.timeline = append(summary.timeline, summaryEvent{at: time.Since(startTime), wall: serverTime(time.Now()), text: text})
+}
+
+func recordDiagnosis(text string) {
+	recordEvent("stall diagnosed: %s", text)
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.diagnoses = append(summary.diagnoses, text)
+}
+
+func recordInvariant(text string) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.invariant = text
+}
+
+// writeSummary writes the summary to path, or to stdout for "-"
+func writeSummary(path, mode, workloadName string, passed bool) error {
+	text := summaryMarkdown(mode, workloadName, passed)
+	if path == "-" {
+		_, err := io.WriteString(os.Stdout, text)
+		return err
+	}
+	return os.WriteFile(path, []byte(text), 0o644)
+}
+
+// summaryMarkdown renders the summary. It must be called after printPhaseReport.
+func summaryMarkdown(mode, workloadName string, passed bool) string {
+	w := &strings.Builder{}
+	result := "PASS"
+	if !passed {
+		result = "FAIL"
+	}
+	fmt.Fprintf(w, "## pg-idle-test: %s (%s)\n\n", mode, result)
+	for _, s := range scenarioCatalog {
+		if s.Name == mode {
+			fmt.Fprintf(w, "- **Scenario:** `%s`, %s\n", mode, s.Demonstrates)
+		}
+	}
+	fmt.Fprintf(w, "- **Workload:** `%s`\n", workloadName)
+	if args := os.Args[1:]; len(args) > 0 {
+		fmt.Fprintf(w, "- **Command:** `%s`\n", strings.Join(args, " "))
+	}
+	fmt.Fprintf(w, "- **Driver:** %s\n", driverVersion())
+	fmt.Fprintf(w, "- **Started:** %s (server clock), ran %.0fs\n", serverTime(startTime).UTC().Format(time.RFC3339), time.Since(startTime).Seconds())
+	fmt.Fprintf(w, "- **Clock skew:** server %v relative to client, timestamps below are on the server clock\n", clockSkew.Round(time.Microsecond))
+	if n, seconds := orphans.totals(); n > 0 {
+		fmt.Fprintf(w, "- **Orphaned queries:** %d backends kept running statements for %.1fs after the client closed their connection\n", n, seconds.Seconds())
+	}
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	if summary.invariant != "" {
+		fmt.Fprintf(w, "- **Invariant:** %s\n", summary.invariant)
+	}
+
+	fmt.Fprintf(w, "\n### Key metrics\n\n")
+	fmt.Fprintf(w, "| Phase | Secs | Iter/s | Errors | p50 | p95 | max |\n|---|---:|---:|---:|---:|---:|---:|\n")
+	for _, row := range phaseRows() {
+		fmt.Fprintf(w, "| %s | %.0f | %.1f | %d | %s | %s | %s |\n", row.name, row.secs, float64(row.ok)/row.secs, row.failed,
+			ms(row.p50), ms(row.p95), ms(row.max))
+	}
+
+	writeSLOSummary(w)
+
+	workerErrors.mu.Lock()
+	if len(workerErrors.counts) > 0 {
+		fmt.Fprintf(w, "\n### Errors\n\n| Class | Count | First example |\n|---|---:|---|\n")
+		for _, class := range errorClasses {
+			if n := workerErrors.counts[class]; n > 0 {
+				fmt.Fprintf(w, "| %s | %d | `%s` |\n", class, n, strings.ReplaceAll(workerErrors.examples[class], "|", "\\|"))
+			}
+		}
+	}
+	workerErrors.mu.Unlock()
+
+	fmt.Fprintf(w, "\n### Timeline\n\n")
+	for _, e := range summary.timeline {
+		fmt.Fprintf(w, "- `+%.1fs` `%s` %s\n", e.at.Seconds(), e.wall.UTC().Format("15:04:05.000"), e.text)
+	}
+
+	if len(summary.diagnoses) > 0 {
+		fmt.Fprintf(w, "\n### Diagnosis\n\n")
+		for _, d := range summary.diagnoses {
+			fmt.Fprintf(w, "- %s\n", d)
+		}
+	}
+	return w.String()
+}
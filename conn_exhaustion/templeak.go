@@ -0,0 +1,163 @@
+// Scenario: session temp tables created on pooled connections and never
+// dropped, which travel with the connection to whichever code checks it out
+// next and pile up in the catalog.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// tempLeakJobs run the leaky code path next to the workload
+const tempLeakJobs = 4
+
+// tempLeakSample is the temp tables of the database at one point
+type tempLeakSample struct {
+	tables, schemas int
+	catalog         int64 // bytes of pg_class and pg_attribute
+}
+
+func sampleTempTables() (tempLeakSample, error) {
+	var s tempLeakSample
+	err := statsDB.QueryRow(`
+		SELECT count(*), count(DISTINCT relnamespace),
+		       (SELECT pg_relation_size('pg_class') + pg_relation_size('pg_attribute'))
+		FROM pg_class WHERE relpersistence = 't' AND relkind = 'r'`).Scan(&s.tables, &s.schemas, &s.catalog)
+	return s, err
+}
+
+type tempLeakPhase struct {
+	name                              string
+	runs, created, collisions, failed atomic.Int64
+	end                               tempLeakSample
+}
+
+func init() {
+	registerScenario("templeak", scenario{inject: runTempLeak})
+}
+
+// runTempLeak runs tempLeakJobs jobs which check out a pooled connection,
+// create a temp table, fill and read it and put the connection back without
+// dropping it: for the first half of the hold always under the same name,
+// which collides on a connection that already has it, and for the second
+// half under a new name each time, which only grows. A detector samples the
+// database's temp tables every second from outside the pool.
+func runTempLeak(h *harness) bool {
+	fmt.Println()
+	base, err := sampleTempTables()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to count temp tables: %v\n", err)
+		return false
+	}
+	fmt.Printf(">>> TEMP LEAK: %d jobs creating temp tables on pooled connections without dropping them (session reset %s)\n", tempLeakJobs, sessionReset)
+	recordEvent("temp table jobs started without DROP")
+
+	detecting, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		last := base
+		for {
+			select {
+			case <-detecting.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			s, err := sampleTempTables()
+			if err != nil || s == last {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "[%s] TEMP LEAK: %d temp tables in %d schemas (+%d since the fault), catalog +%d kB\n",
+				time.Now().Format("04:05"), s.tables, s.schemas, s.tables-base.tables, (s.catalog-base.catalog)/1024)
+			last = s
+		}
+	}()
+
+	var seq atomic.Int64
+	var phases []*tempLeakPhase
+	for _, name := range []string{"fixed", "unique"} {
+		p := &tempLeakPhase{name: name}
+		startPhase("templeak:" + name)
+		var stopping atomic.Bool
+		var wg sync.WaitGroup
+		for j := 0; j < tempLeakJobs; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for !stopping.Load() {
+					table := "pg_idle_test_scratch"
+					if name == "unique" {
+						table = fmt.Sprintf("pg_idle_test_scratch_%d", seq.Add(1))
+					}
+					err := tempLeakJob(h, table)
+					var pgErr *pgconn.PgError
+					p.runs.Add(1)
+					switch {
+					case err == nil:
+						p.created.Add(1)
+					case errors.As(err, &pgErr) && pgErr.Code == "42P07":
+						p.collisions.Add(1)
+					default:
+						p.failed.Add(1)
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+			}()
+		}
+		time.Sleep(h.o.hold / 2)
+		stopping.Store(true)
+		wg.Wait()
+		p.end, _ = sampleTempTables()
+		phases = append(phases, p)
+	}
+	stop()
+
+	fmt.Println()
+	fmt.Println(">>> TEMP TABLE LEAK REPORT")
+	fmt.Printf("%-8s %8s %8s %11s %7s %12s %13s %15s\n", "Names", "Jobs", "Created", "Collisions", "Failed", "Temp tables", "Temp schemas", "Catalog growth")
+	for _, p := range phases {
+		fmt.Printf("%-8s %8d %8d %11d %7d %12d %13d %12d kB\n", p.name, p.runs.Load(), p.created.Load(), p.collisions.Load(), p.failed.Load(),
+			p.end.tables-base.tables, p.end.schemas-base.schemas, (p.end.catalog-base.catalog)/1024)
+	}
+	fmt.Println()
+	fmt.Println("Temp tables and schemas are counted at the end of each phase, over the database and above the count")
+	fmt.Println("before the fault. A temp table lives as long as its session, and a pooled session lives as long as the")
+	fmt.Println("pool keeps it, so the next job on the connection fails with 42P07 relation already exists (Collisions)")
+	fmt.Println("or, under IF NOT EXISTS, silently reads the previous job's rows. New names instead leave one table per")
+	fmt.Println("job in the connection's pg_temp schema, growing pg_class and pg_attribute until the connection closes.")
+	fmt.Println("Drop temp tables before returning the connection, create them ON COMMIT DROP inside a transaction, or")
+	fmt.Println("reset with -session-reset=discard_all (DISCARD ALL includes DISCARD TEMP).")
+	last := phases[len(phases)-1]
+	if last.end.tables <= base.tables && phases[0].collisions.Load() == 0 {
+		fmt.Println(">>> TEMP LEAK: no temp table outlived its checkout")
+	} else {
+		fmt.Printf(">>> TEMP LEAK: %d temp tables left on pooled connections, %d collisions\n", last.end.tables-base.tables, phases[0].collisions.Load())
+	}
+	return true
+}
+
+// tempLeakJob is the leaky code path: create, fill and read a temp table on
+// a pooled connection, and return the connection without DROP
+func tempLeakJob(h *harness, table string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.o.queryTimeout)
+	defer cancel()
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "CREATE TEMP TABLE "+table+" (id INT, note TEXT)"); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "INSERT INTO "+table+" SELECT g, 'row ' || g FROM generate_series(1, 100) g"); err != nil {
+		return err
+	}
+	var n int
+	return conn.QueryRowContext(ctx, "SELECT count(*) FROM "+table).Scan(&n)
+}
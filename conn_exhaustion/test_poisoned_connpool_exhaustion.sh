@@ -5,6 +5,10 @@ set -e
 NUM_PGBOUNCERS=$1
 MODE="$2"
 PEERS_MODE="$3"
+# Extra flags passed to the Go client, e.g. CLIENT_ARGS="-workload=jsonb -doc-size=65536"
+CLIENT_ARGS="${CLIENT_ARGS:-}"
+# COLD_CACHE=1 restarts Postgres (and drops the OS page cache where permitted) before the client starts
+COLD_CACHE="${COLD_CACHE:-0}"
 
 POSTGRES_USER="testuser"
 POSTGRES_PASSWORD="test"
@@ -79,7 +83,7 @@ DCCFG
 done
 
 # Build and start services
-CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o poison_connpool_linux poison_connpool.go
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o poison_connpool_linux .
 docker compose -f docker-compose.yml -f docker-compose.pgbouncers.yml down 2>/dev/null || true
 docker rm -f conn_exhaustion_client 2>/dev/null || true
 docker compose -f docker-compose.yml -f docker-compose.pgbouncers.yml up -d
@@ -100,6 +104,17 @@ docker compose exec -T postgres psql -U postgres -d testdb -c "
     GRANT ALL ON SCHEMA public TO testuser;
 " > /dev/null 2>&1 || true
 
+if [ "$COLD_CACHE" = "1" ]; then
+    echo "Restarting PostgreSQL for a cold cache..."
+    docker compose restart postgres > /dev/null 2>&1
+    sync; (echo 3 | sudo -n tee /proc/sys/vm/drop_caches > /dev/null 2>&1) || echo "Unable to drop OS page cache (needs passwordless sudo), continuing"
+    for i in {1..30}; do
+        docker compose exec -T postgres pg_isready -U postgres > /dev/null 2>&1 && break
+        sleep 1
+    done
+    CLIENT_ARGS="-cache=cold $CLIENT_ARGS"
+fi
+
 POSTGRES_CONTAINER=$(docker compose ps -q postgres)
 HAPROXY_IP=$(docker inspect -f '{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}' $(docker compose ps -q haproxy))
 
@@ -110,7 +125,7 @@ docker run -d --name conn_exhaustion_client \
     alpine:latest sleep infinity
 
 docker exec -e "DATABASE_URL=postgres://$POSTGRES_USER:$POSTGRES_PASSWORD@$HAPROXY_IP:6432/$POSTGRES_DB" \
-    conn_exhaustion_client sh -c '/usr/local/bin/poison_connpool '"$MODE"' 2> /tmp/client_stderr.log' &
+    conn_exhaustion_client sh -c '/usr/local/bin/poison_connpool '"$CLIENT_ARGS $MODE"' 2> /tmp/client_stderr.log' &
 
 # Monitor
 echo ""
@@ -191,6 +206,8 @@ client_deadline=$(grep -c 'context deadline exceeded' "$CLIENT_LOG" | tr -d '\n'
 client_superuser=$(grep -c 'reserved for roles with the SUPERUSER' "$CLIENT_LOG" | tr -d '\n' || echo 0)
 client_max_conn=$(grep -c 'no more connections allowed (max_client_conn)' "$CLIENT_LOG" | tr -d '\n' || echo 0)
 client_open_txn=$(grep -c 'Connection returned to pool with open transaction' "$CLIENT_LOG" | tr -d '\n' || echo 0)
+unexpected_eof=$(grep -c 'unexpected EOF on client connection' "$POSTGRES_LOG" | tr -d '\n' || echo 0)
+conn_reset=$(grep -c 'Connection reset by peer' "$POSTGRES_LOG" | tr -d '\n' || echo 0)
 
 failed_cancel=0
 not_ready=0
@@ -211,6 +228,8 @@ printf "%-45s %6s   %s\n" "─────────────────
 printf "%-45s %6s   %s\n" "PostgreSQL canceling statement" "$canceling" "$POSTGRES_LOG"
 printf "%-45s %6s   %s\n" "Idle-in-transaction timeouts" "$idle_timeout" "$POSTGRES_LOG"
 printf "%-45s %6s   %s\n" "Transaction timeouts" "$transaction_timeout" "$POSTGRES_LOG"
+printf "%-45s %6s   %s\n" "PostgreSQL unexpected EOF from client" "$unexpected_eof" "$POSTGRES_LOG"
+printf "%-45s %6s   %s\n" "PostgreSQL connection reset by peer" "$conn_reset" "$POSTGRES_LOG"
 printf "%-45s %6s   %s\n" "PgBouncer failed cancel requests" "$failed_cancel" "$pgb_logs"
 printf "%-45s %6s   %s\n" "PgBouncer disconnect while not ready" "$not_ready" "$pgb_logs"
 printf "%-45s %6s   %s\n" "Client context deadline exceeded" "$client_deadline" "$CLIENT_LOG"
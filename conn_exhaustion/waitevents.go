@@ -0,0 +1,156 @@
+// High-frequency sampling of the backends' wait events, aggregated per phase.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// waitEventTop is how many wait events a phase lists before "other"
+const waitEventTop = 5
+
+// waitEventPhase counts backend samples by wait event during one phase
+type waitEventPhase struct {
+	phase   string
+	polls   int
+	samples int
+	events  map[string]int
+}
+
+type waitEventSampler struct {
+	db *sql.DB
+
+	mu     sync.Mutex
+	phases []*waitEventPhase
+	failed int
+}
+
+// waitEvents is nil unless -wait-sample was given
+var waitEvents *waitEventSampler
+
+// newWaitEventSampler opens the sampler's own connection, so it keeps
+// sampling while the worker pool is exhausted
+func newWaitEventSampler(connStr string) (*waitEventSampler, error) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &waitEventSampler{db: db}, nil
+}
+
+// run samples every interval until the process exits
+func (w *waitEventSampler) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		start := time.Now()
+		events, err := w.sample()
+		selfOverhead.since("wait event sampler", start, 1)
+		if err != nil {
+			w.mu.Lock()
+			w.failed++
+			w.mu.Unlock()
+			continue
+		}
+		w.observe(events)
+	}
+}
+
+// sample counts the client backends of the database which are not idle by
+// wait event; an active backend without one is on CPU
+func (w *waitEventSampler) sample() (map[string]int, error) {
+	rows, err := w.db.Query(`
+		SELECT coalesce(wait_event_type || ':' || wait_event, 'CPU'), count(*)
+		FROM pg_stat_activity
+		WHERE datname = current_database() AND backend_type = 'client backend' AND state <> 'idle' AND pid <> pg_backend_pid()
+		  AND application_name <> $1
+		GROUP BY 1`, controlAppName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := map[string]int{}
+	for rows.Next() {
+		var event string
+		var n int
+		if err := rows.Scan(&event, &n); err != nil {
+			return nil, err
+		}
+		events[event] = n
+	}
+	return events, rows.Err()
+}
+
+func (w *waitEventSampler) observe(events map[string]int) {
+	p := currentPhase.Load()
+	if p == nil || p.name == "" {
+		return // before the warmup or after the phase report
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.phases) == 0 || w.phases[len(w.phases)-1].phase != p.name {
+		w.phases = append(w.phases, &waitEventPhase{phase: p.name, events: map[string]int{}})
+	}
+	phase := w.phases[len(w.phases)-1]
+	phase.polls++
+	for event, n := range events {
+		phase.events[event] += n
+		phase.samples += n
+	}
+}
+
+// breakdown lists the most frequent wait events of a phase with their share
+// of its backend samples
+func (p *waitEventPhase) breakdown() string {
+	if p.samples == 0 {
+		return "no backend outside idle"
+	}
+	events := make([]string, 0, len(p.events))
+	for event := range p.events {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if p.events[events[i]] != p.events[events[j]] {
+			return p.events[events[i]] > p.events[events[j]]
+		}
+		return events[i] < events[j]
+	})
+	var parts []string
+	other := p.samples
+	for _, event := range events[:min(len(events), waitEventTop)] {
+		parts = append(parts, fmt.Sprintf("%s %.1f%%", event, 100*float64(p.events[event])/float64(p.samples)))
+		other -= p.events[event]
+	}
+	if other > 0 {
+		parts = append(parts, fmt.Sprintf("other %.1f%%", 100*float64(other)/float64(p.samples)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// print reports the wait events of each phase, to read against the phase report
+func (w *waitEventSampler) print() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fmt.Println()
+	fmt.Println(">>> WAIT EVENTS (share of non-idle backend samples per phase, CPU = active without a wait event)")
+	fmt.Printf("%-24s %7s %9s   %s\n", "Phase", "Polls", "Backends", "Wait events")
+	for _, p := range w.phases {
+		fmt.Printf("%-24s %7d %9.1f   %s\n", p.phase, p.polls, float64(p.samples)/float64(max(p.polls, 1)), p.breakdown())
+	}
+	if w.failed > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d wait event samples failed\n", w.failed)
+	}
+}
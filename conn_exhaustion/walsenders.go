@@ -0,0 +1,192 @@
+// WAL sender slot pressure: physical replication streams up to and past
+// max_wal_senders while the workload runs.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// walStream is one pg_receivewal-style physical replication connection
+// without a slot, streaming from the current WAL position and acknowledging
+// what it received whenever the server asks
+type walStream struct {
+	conn     *pgconn.PgConn
+	received atomic.Int64 // WAL bytes
+}
+
+func openWALStream(ctx context.Context, connStr string) (*walStream, error) {
+	cfg, err := pgconn.ParseConfig(connStr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RuntimeParams["replication"] = "true"
+	cfg.RuntimeParams["application_name"] = "pg-idle-test-walsender"
+	conn, err := pgconn.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	results, err := conn.Exec(ctx, "IDENTIFY_SYSTEM").ReadAll()
+	if err != nil || len(results) != 1 || len(results[0].Rows) != 1 || len(results[0].Rows[0]) < 3 {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("IDENTIFY_SYSTEM: %v", err)
+	}
+	xlogpos, err := parseLSN(string(results[0].Rows[0][2]))
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("IDENTIFY_SYSTEM: %w", err)
+	}
+	if err := startReplication(ctx, conn, "START_REPLICATION PHYSICAL "+xlogpos.String()); err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	s := &walStream{conn: conn}
+	go s.stream(xlogpos)
+	return s, nil
+}
+
+// stream reads WAL until the connection is closed. It is the only reader and
+// writer of the connection once streaming has started.
+func (s *walStream) stream(pos lsn) {
+	for {
+		msg, err := s.conn.ReceiveMessage(context.Background())
+		if err != nil {
+			return
+		}
+		data, ok := msg.(*pgproto3.CopyData)
+		if !ok || len(data.Data) == 0 {
+			continue
+		}
+		switch data.Data[0] {
+		case xLogDataByteID:
+			if xld, err := parseXLogData(data.Data[1:]); err == nil {
+				pos = xld.walStart + lsn(len(xld.walData))
+				s.received.Add(int64(len(xld.walData)))
+			}
+		case primaryKeepaliveMessageByteID:
+			if ka, err := parsePrimaryKeepalive(data.Data[1:]); err == nil && ka.replyRequested {
+				sendStandbyStatusUpdate(s.conn, pos)
+			}
+		}
+	}
+}
+
+func (s *walStream) close() {
+	// The streaming goroutine holds the connection lock in ReceiveMessage, so
+	// close the socket underneath it
+	s.conn.Conn().Close()
+}
+
+func init() {
+	registerScenario("walsenders", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runWALSenders(h.connStr, h.o.walStreams, h.o.hold)
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns++ // the streams count against max_wal_senders instead
+		},
+	})
+}
+
+// runWALSenders opens replication streams one per second, up to streams or
+// max_wal_senders+2 if streams is 0, holds them for the rest of the phase and
+// checks that the workers, which use ordinary connection slots, did not notice
+func runWALSenders(connStr string, streams int, duration time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	var maxWalSenders, maxConnections, busy int
+	setup.QueryRow("SELECT current_setting('max_wal_senders')::int, current_setting('max_connections')::int").Scan(&maxWalSenders, &maxConnections)
+	setup.QueryRow("SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'walsender'").Scan(&busy)
+	if streams == 0 {
+		streams = maxWalSenders + 2
+	}
+	fmt.Printf(">>> WAL_SENDERS: max_wal_senders=%d (%d in use), opening %d replication streams alongside max_connections=%d\n",
+		maxWalSenders, busy, streams, maxConnections)
+	startPhase("walsenders")
+	p := currentPhase.Load()
+
+	var open []*walStream
+	refused := map[string]int{}
+	var firstRefusal string
+	attempted := 0
+	start := time.Now()
+	for i := 0; i < streams && time.Since(start) < duration; i++ {
+		attempted++
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s, err := openWALStream(ctx, connStr)
+		cancel()
+		if err != nil {
+			code := "other"
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				code = pgErr.Code
+			}
+			refused[code]++
+			if firstRefusal == "" {
+				firstRefusal = oneLine(err.Error())
+			}
+			fmt.Fprintf(os.Stderr, "[%s] WAL_SENDERS: stream %d refused: %v\n", time.Now().Format("04:05"), i+1, err)
+		} else {
+			open = append(open, s)
+			fmt.Fprintf(os.Stderr, "[%s] WAL_SENDERS: stream %d streaming\n", time.Now().Format("04:05"), i+1)
+		}
+		time.Sleep(1 * time.Second)
+	}
+	var walsenders int
+	setup.QueryRow("SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'walsender'").Scan(&walsenders)
+	time.Sleep(max(duration-time.Since(start), 0))
+
+	var received int64
+	for _, s := range open {
+		received += s.received.Load()
+		s.close()
+	}
+	p.mu.Lock()
+	failed, ok := p.failed, p.ok
+	p.mu.Unlock()
+
+	fmt.Println()
+	fmt.Println(">>> WAL SENDER REPORT")
+	fmt.Printf("streams opened:   %d of %d attempted (%d wal senders on the server at the peak, max_wal_senders=%d)\n", len(open), attempted, walsenders, maxWalSenders)
+	var codes []string
+	for code, n := range refused {
+		codes = append(codes, fmt.Sprintf("%s=%d", code, n))
+	}
+	sort.Strings(codes)
+	fmt.Printf("streams refused:  %d %s\n", attempted-len(open), strings.Join(codes, " "))
+	if firstRefusal != "" {
+		fmt.Printf("first refusal:    %s\n", firstRefusal)
+	}
+	fmt.Printf("WAL streamed:     %d bytes\n", received)
+	fmt.Printf("workload:         %d iterations ok, %d failed while the streams were held\n", ok, failed)
+	fmt.Println()
+	if refused["53300"] > 0 && failed == 0 {
+		fmt.Println(">>> WAL SENDERS: PASS wal senders ran out (53300) while the workload's connections were unaffected")
+		return true
+	}
+	if refused["42501"] > 0 || refused["28000"] > 0 {
+		fmt.Println(">>> WAL SENDERS: FAIL replication connections need the REPLICATION attribute and a pg_hba.conf replication entry")
+		return false
+	}
+	if refused["53300"] == 0 {
+		fmt.Println(">>> WAL SENDERS: FAIL max_wal_senders was not reached; raise -wal-streams")
+		return false
+	}
+	fmt.Println(">>> WAL SENDERS: FAIL the workload failed while the wal senders were exhausted")
+	return false
+}
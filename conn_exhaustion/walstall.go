@@ -0,0 +1,174 @@
+// Scenario: a WAL write stall, where every commit hangs while connections
+// and reads keep working, as when the WAL volume is frozen or a synchronous
+// standby stops acknowledging.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// walStallStandby is the synchronous standby the stall waits for, which
+// never connects
+const walStallStandby = "pg_idle_test_walstall"
+
+func init() {
+	registerScenario("walstall", scenario{
+		inject: func(h *harness) bool {
+			fmt.Println()
+			return runWALStall(h)
+		},
+		validate: func(o *options) error {
+			if o.controlTable != "" || o.controlChannel != "" {
+				return errors.New("walstall stalls the commits of the control table and channel too; time the stall with -hold-duration")
+			}
+			return nil
+		},
+		needs: func(o *options, n *preflightNeeds) {
+			n.conns += 2 // admin and connect probe
+			n.alterSystem = append(n.alterSystem, "synchronous_standby_names")
+		},
+	})
+}
+
+// runWALStall makes every commit wait for a synchronous standby which does
+// not exist for -hold-duration, probing meanwhile whether new connections and
+// reads still succeed, and checks that the stall diagnosis names a commit
+// stall rather than a lock
+func runWALStall(h *harness) bool {
+	admin, err := sql.Open("pgx", h.connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to open admin connection: %v\n", err)
+		return false
+	}
+	defer admin.Close()
+	admin.SetMaxOpenConns(1)
+	var standbys, syncCommit string
+	admin.QueryRow("SHOW synchronous_standby_names").Scan(&standbys)
+	h.db.QueryRow("SHOW synchronous_commit").Scan(&syncCommit)
+	if standbys != "" {
+		fmt.Fprintf(os.Stderr, "ERROR: synchronous_standby_names is already set (%q), not replacing it\n", standbys)
+		return false
+	}
+	if syncCommit == "off" || syncCommit == "local" {
+		fmt.Fprintf(os.Stderr, "ERROR: synchronous_commit=%s for the workers, so their commits do not wait for a standby\n", syncCommit)
+		return false
+	}
+	// ALTER SYSTEM writes no WAL, so the reset goes through during the stall
+	stall := []gucSetting{{name: "synchronous_standby_names", value: walStallStandby}}
+	if err := setServerGUCs(admin, stall); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Unable to set synchronous_standby_names: %v\n", err)
+		return false
+	}
+	released := false
+	release := func() {
+		if released {
+			return
+		}
+		released = true
+		if err := setServerGUCs(admin, []gucSetting{{name: stall[0].name}}); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Unable to reset synchronous_standby_names, commits stay stalled: %v\n", err)
+		}
+	}
+	defer release()
+	fmt.Printf(">>> WAL STALL: synchronous_standby_names=%s, commits wait for a standby which never acknowledges, for %v\n", walStallStandby, h.o.hold)
+	recordEvent("commits stalled on synchronous standby %s", walStallStandby)
+	startPhase("wal stall")
+	p := currentPhase.Load()
+
+	// Once a second: a new connection and a read on it, then the sessions
+	// waiting to commit by wait event
+	var connects, connectFailed, reads int
+	var slowestConnect time.Duration
+	var firstFailure string
+	peakWaiting := 0
+	waitEvents := map[string]int{}
+	start := time.Now()
+	for time.Since(start) < h.o.hold {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t := time.Now()
+		conn, err := pgx.Connect(ctx, h.connStr)
+		if err == nil {
+			connects++
+			slowestConnect = max(slowestConnect, time.Since(t))
+			var one int
+			if err = conn.QueryRow(ctx, "SELECT 1").Scan(&one); err == nil {
+				reads++
+			}
+			conn.Close(ctx)
+		}
+		cancel()
+		if err != nil {
+			connectFailed++
+			if firstFailure == "" {
+				firstFailure = oneLine(err.Error())
+			}
+		}
+		rows, err := admin.Query(`
+			SELECT wait_event, count(*) FROM pg_stat_activity
+			WHERE datname = current_database() AND state = 'active' AND wait_event IN (` + commitWaitEvents + `)
+			GROUP BY 1`)
+		if err == nil {
+			waiting := 0
+			for rows.Next() {
+				var event string
+				var n int
+				if rows.Scan(&event, &n) == nil {
+					waitEvents[event] = max(waitEvents[event], n)
+					waiting += n
+				}
+			}
+			rows.Close()
+			peakWaiting = max(peakWaiting, waiting)
+			fmt.Fprintf(os.Stderr, "[%s] WAL_STALL: %d sessions waiting to commit\n", time.Now().Format("04:05"), waiting)
+		}
+		time.Sleep(max(time.Second-time.Since(t), 0))
+	}
+	diagnosis := diagnoseStall(gatherEvidence(h.db.Stats(), 0))
+	p.mu.Lock()
+	ok, failed := p.ok, p.failed
+	p.mu.Unlock()
+	release()
+	startPhase("after wal stall")
+	recordEvent("synchronous_standby_names reset, commits released")
+
+	fmt.Println()
+	fmt.Println(">>> WAL STALL SIGNATURE")
+	fmt.Printf("new connections:  %d ok, %d failed, slowest %s\n", connects, connectFailed, ms(slowestConnect))
+	if firstFailure != "" {
+		fmt.Printf("first failure:    %s\n", firstFailure)
+	}
+	fmt.Printf("reads:            %d ok on the new connections\n", reads)
+	var events []string
+	for event, n := range waitEvents {
+		events = append(events, fmt.Sprintf("%s=%d", event, n))
+	}
+	sort.Strings(events)
+	fmt.Printf("waiting to commit: %d sessions at the peak %s\n", peakWaiting, strings.Join(events, " "))
+	fmt.Printf("workload:         %d iterations ok, %d failed during the stall\n", ok, failed)
+	fmt.Printf("diagnosis:        %s\n", diagnosis)
+	fmt.Println()
+	fmt.Println("Everything connects and nothing commits: sessions wait in SyncRep (or IO:WALWrite/WALSync on a frozen")
+	fmt.Println("WAL volume) with their row locks held, so workers updating the same rows queue on locks behind them like")
+	fmt.Println("in a lock-based exhaustion. A commit the client gives up on is already committed locally, and becomes")
+	fmt.Println("visible once the stall ends: the client sees an error for a transaction which happened.")
+	fmt.Println()
+	switch {
+	case connectFailed > 0:
+		fmt.Println(">>> WAL STALL: FAIL new connections failed during the stall")
+		return false
+	case !strings.HasPrefix(diagnosis, "commit stall"):
+		fmt.Println(">>> WAL STALL: FAIL the stall diagnosis did not name a commit stall")
+		return false
+	}
+	fmt.Println(">>> WAL STALL: PASS connections and reads succeeded, commits stalled, diagnosed as a commit stall")
+	return true
+}
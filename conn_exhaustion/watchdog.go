@@ -0,0 +1,203 @@
+// Slow-query watchdog which captures EXPLAIN output from a side connection.
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowQueryWatchdog captures the plan of any worker statement still running
+// after threshold. Plans are captured at most once per statement text per
+// planCacheTTL on a separate pool, so the watchdog neither starves the worker
+// pool nor floods the server while every worker is stuck on the same lock. A
+// baseline plan is captured on the first execution of each statement so that
+// the first slow execution can already be compared against it.
+type slowQueryWatchdog struct {
+	threshold time.Duration
+	analyze   bool
+	db        *sql.DB
+
+	mu    sync.Mutex
+	plans map[string]*capturedPlan // by statement text
+
+	planChanges atomic.Int64
+}
+
+type capturedPlan struct {
+	at          time.Time
+	fingerprint string
+	plan        string
+}
+
+const planCacheTTL = 5 * time.Second
+
+// watchdog is nil unless -slow-query was given
+var watchdog *slowQueryWatchdog
+
+func newSlowQueryWatchdog(connStr string, threshold time.Duration, analyze bool) (*slowQueryWatchdog, error) {
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	return &slowQueryWatchdog{threshold: threshold, analyze: analyze, db: db, plans: map[string]*capturedPlan{}}, nil
+}
+
+// execContext is db.ExecContext under the watchdog and in-flight tracker
+func execContext(ctx context.Context, db *sql.DB, query string, args ...any) (sql.Result, error) {
+	if untracked(ctx) {
+		return db.ExecContext(ctx, query, args...)
+	}
+	ctx, q, done := trackQuery(ctx, query)
+	defer done()
+	defer watchdog.watch(query, args, q)()
+	res, err := db.ExecContext(ctx, query, args...)
+	queryLatencies.record(ctx, query, time.Since(q.start), err)
+	return res, err
+}
+
+// queryRowContext is db.QueryRowContext under the watchdog and in-flight tracker
+func queryRowContext(ctx context.Context, db *sql.DB, query string, args ...any) *sql.Row {
+	if untracked(ctx) {
+		return db.QueryRowContext(ctx, query, args...)
+	}
+	ctx, q, done := trackQuery(ctx, query)
+	defer done()
+	defer watchdog.watch(query, args, q)()
+	row := db.QueryRowContext(ctx, query, args...)
+	queryLatencies.record(ctx, query, time.Since(q.start), row.Err())
+	return row
+}
+
+// watch starts timing a statement; the returned func must be called when it completes
+func (w *slowQueryWatchdog) watch(query string, args []any, q *inflightQuery) func() {
+	if w == nil {
+		return func() {}
+	}
+	w.mu.Lock()
+	_, seen := w.plans[query]
+	w.mu.Unlock()
+	if !seen {
+		go w.capture(query, args)
+	}
+
+	start := time.Now()
+	timer := time.AfterFunc(w.threshold, func() { w.capture(query, args) })
+	return func() {
+		if !timer.Stop() {
+			elapsed := time.Since(start)
+			w.mu.Lock()
+			fingerprint := ""
+			if p := w.plans[query]; p != nil {
+				fingerprint = p.fingerprint
+			}
+			w.mu.Unlock()
+			fmt.Fprintf(os.Stderr, "[%s] SLOW_QUERY: %dms plan=%s %s\n",
+				time.Now().Format("04:05"), elapsed.Milliseconds(), fingerprint, oneLine(query))
+		}
+	}
+}
+
+func (w *slowQueryWatchdog) capture(query string, args []any) {
+	w.mu.Lock()
+	prev := w.plans[query]
+	if prev != nil && time.Since(prev.at) < planCacheTTL {
+		w.mu.Unlock()
+		return
+	}
+	// Claim the slot so concurrent slow executions do not capture too
+	w.plans[query] = &capturedPlan{at: time.Now()}
+	if prev != nil {
+		w.plans[query].fingerprint = prev.fingerprint
+		w.plans[query].plan = prev.plan
+	}
+	w.mu.Unlock()
+
+	plan, err := w.explain(query, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[%s] SLOW_QUERY: EXPLAIN failed for %s: %v\n", time.Now().Format("04:05"), oneLine(query), err)
+		return
+	}
+	fingerprint := planFingerprint(plan)
+
+	w.mu.Lock()
+	w.plans[query].fingerprint = fingerprint
+	w.plans[query].plan = plan
+	w.mu.Unlock()
+
+	if prev != nil && prev.fingerprint == fingerprint {
+		return
+	}
+	event := "baseline"
+	if prev != nil && prev.fingerprint != "" {
+		event = "changed from " + prev.fingerprint
+		w.planChanges.Add(1)
+	}
+	fmt.Fprintf(os.Stderr, "[%s] SLOW_QUERY: plan %s %s: %s\n",
+		time.Now().Format("04:05"), fingerprint, event, oneLine(query))
+	for _, line := range strings.Split(plan, "\n") {
+		fmt.Fprintf(os.Stderr, "    PLAN: %s\n", line)
+	}
+}
+
+// explain runs EXPLAIN for the statement. With analyze, the statement is
+// executed inside a transaction which is always rolled back, under a
+// lock_timeout so that a statement stuck behind a row lock reports
+// "lock timeout" instead of joining the queue.
+func (w *slowQueryWatchdog) explain(query string, args []any) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	explain := "EXPLAIN "
+	var tx *sql.Tx
+	var rows *sql.Rows
+	var err error
+	if w.analyze {
+		explain = "EXPLAIN (ANALYZE, BUFFERS) "
+		if tx, err = w.db.BeginTx(ctx, nil); err != nil {
+			return "", err
+		}
+		defer tx.Rollback()
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL lock_timeout = '%dms'", w.threshold.Milliseconds())); err != nil {
+			return "", err
+		}
+		rows, err = tx.QueryContext(ctx, explain+query, args...)
+	} else {
+		rows, err = w.db.QueryContext(ctx, explain+query, args...)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
+
+var planNoise = regexp.MustCompile(`\((cost|actual)[^)]*\)|(?m)^\s*(Planning|Execution|Buffers|Planning Time|Execution Time).*$`)
+
+// planFingerprint identifies a plan shape, ignoring costs and timings
+func planFingerprint(plan string) string {
+	sum := sha1.Sum([]byte(planNoise.ReplaceAllString(plan, "")))
+	return hex.EncodeToString(sum[:4])
+}
+
+func oneLine(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
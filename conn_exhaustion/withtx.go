@@ -0,0 +1,142 @@
+// Scenario: the poison condition from a transaction abandoned on context
+// cancellation, with and without txguard.WithTx.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ardentperf/pg-idle-test/conn_exhaustion/pkg/txguard"
+)
+
+type withTxResult struct {
+	ok, failed      int64
+	maxIdleInTx     int // most sessions seen idle in transaction at once
+	idleInTxSamples int // samples (every 200ms) with any session idle in transaction
+}
+
+// withTxBody updates a row, then does client-side work which sometimes
+// outlasts the 300ms deadline, so that COMMIT fails with the context error
+// before it ever reaches the server
+func withTxBody(ctx context.Context, conn *sql.Conn) error {
+	if _, err := conn.ExecContext(ctx, "UPDATE test_withtx SET val = val + 1 WHERE id = $1", 1+rand.Intn(5)); err != nil {
+		return err
+	}
+	time.Sleep(time.Duration(rand.Intn(400)) * time.Millisecond)
+	return nil
+}
+
+// naiveTx is the hand-rolled pattern the poison mode reproduces: any error
+// returns early and Close puts the connection back with the transaction open
+func naiveTx(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	if err := withTxBody(ctx, conn); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+func init() {
+	registerScenario("withtx", scenario{
+		standalone: func(o *options) bool { return runWithTxCompare(o.connStr, 20, 15*time.Second) },
+		needs:      func(o *options, n *preflightNeeds) { n.conns = 10 + 1 },
+	})
+}
+
+// runWithTxCompare runs the same transactions hand-rolled and through
+// txguard.WithTx, and passes if WithTx never left a session idle in transaction
+func runWithTxCompare(connStr string, workers int, hold time.Duration) bool {
+	setup, err := sql.Open("pgx", connStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect with DATABASE_URL='%s': %v\n", connStr, err)
+		return false
+	}
+	defer setup.Close()
+	setup.Exec("DROP TABLE IF EXISTS test_withtx")
+	setup.Exec("CREATE TABLE test_withtx (id INT PRIMARY KEY, val INT)")
+	setup.Exec("INSERT INTO test_withtx SELECT g, 0 FROM generate_series(1, 5) g")
+
+	variants := []struct {
+		name string
+		run  func(ctx context.Context, db *sql.DB) error
+	}{
+		{"naive", naiveTx},
+		{"withtx", func(ctx context.Context, db *sql.DB) error { return txguard.WithTx(ctx, db, withTxBody) }},
+	}
+	results := map[string]withTxResult{}
+	for _, v := range variants {
+		fmt.Fprintf(os.Stderr, "[%s] WITHTX: %s\n", time.Now().Format("04:05"), v.name)
+		appName := "pg-idle-test-withtx-" + v.name
+		db, err := openDB(connStr, appName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s: %v\n", v.name, err)
+			return false
+		}
+		db.SetMaxOpenConns(10)
+		db.SetMaxIdleConns(10)
+
+		var r withTxResult
+		var ok, failed atomic.Int64
+		var stopping atomic.Bool
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for !stopping.Load() {
+					ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+					if err := v.run(ctx, db); err != nil {
+						failed.Add(1)
+					} else {
+						ok.Add(1)
+					}
+					cancel()
+					time.Sleep(50 * time.Millisecond)
+				}
+			}()
+		}
+		for start := time.Now(); time.Since(start) < hold; time.Sleep(200 * time.Millisecond) {
+			var idleInTx int
+			setup.QueryRow("SELECT count(*) FROM pg_stat_activity WHERE application_name = $1 AND state LIKE 'idle in transaction%'", appName).Scan(&idleInTx)
+			if idleInTx > 0 {
+				r.idleInTxSamples++
+			}
+			r.maxIdleInTx = max(r.maxIdleInTx, idleInTx)
+		}
+		stopping.Store(true)
+		wg.Wait()
+		db.Close()
+		r.ok, r.failed = ok.Load(), failed.Load()
+		results[v.name] = r
+	}
+
+	fmt.Println()
+	fmt.Println(">>> WITHTX REPORT")
+	fmt.Printf("%-8s %8s %8s %13s %18s\n", "Variant", "OK", "Failed", "MaxIdleInTx", "SamplesIdleInTx")
+	for _, v := range variants {
+		r := results[v.name]
+		fmt.Printf("%-8s %8d %8d %13d %18d\n", v.name, r.ok, r.failed, r.maxIdleInTx, r.idleInTxSamples)
+	}
+	guarded := results["withtx"]
+	fmt.Println()
+	if guarded.maxIdleInTx > 0 {
+		fmt.Printf(">>> WITHTX: FAIL %d sessions left idle in transaction with WithTx\n", guarded.maxIdleInTx)
+		return false
+	}
+	fmt.Printf(">>> WITHTX: PASS no session left idle in transaction with WithTx (naive: up to %d)\n", results["naive"].maxIdleInTx)
+	return true
+}
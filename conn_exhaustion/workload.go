@@ -0,0 +1,181 @@
+// Workload presets executed by the worker goroutines and the blocking connection.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workload is the statement mix issued by each worker iteration. Every workload
+// has one contended row which the blocking connection locks during the test.
+type workload interface {
+	// setup (re)creates the tables and seed rows used by the workload
+	setup(db *sql.DB)
+	// run executes one worker iteration; the returned error is reported as a worker failure
+	run(ctx context.Context, db *sql.DB, worker int, iteration int) error
+	// poisonSQL takes the row lock inside the blocking transaction
+	poisonSQL() string
+}
+
+// workloadOptions holds the flag values used to construct a workload
+type workloadOptions struct {
+	docSize int
+	schema  schemaSpec
+	retries int
+	// deferrable makes the readonly workload use SERIALIZABLE READ ONLY DEFERRABLE
+	deferrable bool
+	// serialRetries and serialBackoff wrap the serializable workload's transactions
+	serialRetries int
+	serialBackoff time.Duration
+}
+
+var workloads = map[string]func(opts workloadOptions) workload{
+	"counter": func(opts workloadOptions) workload { return &counterWorkload{schema: opts.schema} },
+	"jsonb":   func(opts workloadOptions) workload { return &jsonbWorkload{docSize: opts.docSize} },
+	"naive-retry": func(opts workloadOptions) workload {
+		return &ledgerWorkload{retries: opts.retries}
+	},
+	"idempotent": func(opts workloadOptions) workload {
+		return &ledgerWorkload{retries: opts.retries, idempotent: true}
+	},
+	"readonly": func(opts workloadOptions) workload {
+		return &readOnlyWorkload{schema: opts.schema, deferrable: opts.deferrable, errors: map[string]int{}}
+	},
+	"serializable": func(opts workloadOptions) workload {
+		return &serializableWorkload{schema: opts.schema, retries: opts.serialRetries, backoff: opts.serialBackoff}
+	},
+}
+
+func workloadNames() string {
+	names := make([]string, 0, len(workloads))
+	for name := range workloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// counterWorkload increments a counter in test_row; with the default schema this
+// is the original tiny single-row table
+type counterWorkload struct {
+	schema schemaSpec
+	acked  atomic.Int64 // increments reported as successful to the worker
+}
+
+func (w *counterWorkload) setup(db *sql.DB) {
+	w.schema.create(db)
+}
+
+func (w *counterWorkload) run(ctx context.Context, db *sql.DB, worker int, iteration int) error {
+	res, err := execContext(ctx, db, "UPDATE test_row SET val = val + 1 WHERE id = $1", 1+rand.Intn(w.schema.rows))
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 1 {
+			w.acked.Add(1)
+		}
+	}
+	execContext(ctx, db, "SELECT pg_sleep(0.01)")
+	return err
+}
+
+// verify checks that the committed counter total equals the acknowledged increments
+func (w *counterWorkload) verify(ctx context.Context, conn *sql.Conn) (bool, string, error) {
+	var total int64
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(sum(val), 0) FROM test_row").Scan(&total); err != nil {
+		return false, "", err
+	}
+	acked := w.acked.Load()
+	detail := fmt.Sprintf("counter=%d acknowledged=%d", total, acked)
+	switch {
+	case total < acked:
+		detail += fmt.Sprintf(" (%d acknowledged updates lost)", acked-total)
+	case total > acked:
+		detail += fmt.Sprintf(" (%d unacknowledged updates applied)", total-acked)
+	}
+	return total == acked, detail, nil
+}
+
+func (*counterWorkload) poisonSQL() string {
+	return "UPDATE test_row SET val = val + 1 WHERE id = 1 -- POISON"
+}
+
+// jsonbWorkload rewrites, reads and inserts large JSONB documents. Document 1 is
+// the contended row; inserted documents are spread over a fixed number of slots
+// per worker so the table does not grow without bound during long runs.
+type jsonbWorkload struct {
+	docSize int
+	acked   sync.Map // "worker:iteration" of acknowledged rewrites of document 1
+}
+
+const jsonbSlotsPerWorker = 100
+
+func (w *jsonbWorkload) setup(db *sql.DB) {
+	db.Exec("DROP TABLE IF EXISTS test_doc")
+	db.Exec("CREATE TABLE test_doc (id INT PRIMARY KEY, doc JSONB NOT NULL)")
+	db.Exec("INSERT INTO test_doc (id, doc) VALUES (1, $1)", makeDoc(w.docSize, -1, 0))
+}
+
+func (w *jsonbWorkload) run(ctx context.Context, db *sql.DB, worker int, iteration int) error {
+	if _, err := execContext(ctx, db, "UPDATE test_doc SET doc = $1 WHERE id = 1", makeDoc(w.docSize, worker, iteration)); err != nil {
+		return err
+	}
+	w.acked.Store(fmt.Sprintf("%d:%d", worker, iteration), true)
+	if iteration%2 == 0 {
+		var doc []byte
+		return queryRowContext(ctx, db, "SELECT doc FROM test_doc WHERE id = 1").Scan(&doc)
+	}
+	// Slots start at 1000 to stay clear of the contended document
+	id := 1000 + worker*jsonbSlotsPerWorker + iteration%jsonbSlotsPerWorker
+	_, err := execContext(ctx, db, "INSERT INTO test_doc (id, doc) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET doc = EXCLUDED.doc",
+		id, makeDoc(w.docSize, worker, iteration))
+	return err
+}
+
+// verify checks that the committed version of document 1 was written by an
+// acknowledged rewrite (or is still the seed). Last-writer-wins documents cannot
+// reveal lost writes, only unacknowledged ones.
+func (w *jsonbWorkload) verify(ctx context.Context, conn *sql.Conn) (bool, string, error) {
+	var worker, iteration int
+	if err := conn.QueryRowContext(ctx, "SELECT (doc->>'worker')::int, (doc->>'iteration')::int FROM test_doc WHERE id = 1").Scan(&worker, &iteration); err != nil {
+		return false, "", err
+	}
+	detail := fmt.Sprintf("document 1 written by worker=%d iteration=%d", worker, iteration)
+	if worker == -1 {
+		return true, detail + " (seed)", nil
+	}
+	if _, ok := w.acked.Load(fmt.Sprintf("%d:%d", worker, iteration)); !ok {
+		return false, detail + " (unacknowledged rewrite applied)", nil
+	}
+	return true, detail, nil
+}
+
+func (w *jsonbWorkload) poisonSQL() string {
+	return "UPDATE test_doc SET doc = jsonb_set(doc, '{poisoned}', 'true') WHERE id = 1 -- POISON"
+}
+
+// makeDoc builds a JSON document of roughly size bytes. Values are random hex so
+// that TOAST compression cannot shrink the payload below the requested size.
+func makeDoc(size int, worker int, iteration int) string {
+	doc := map[string]any{
+		"worker":     worker,
+		"iteration":  iteration,
+		"updated_at": time.Now().Format(time.RFC3339Nano),
+	}
+	var items []map[string]string
+	buf := make([]byte, 32)
+	for n := 0; n < size; n += 2*len(buf) + 24 {
+		rand.Read(buf)
+		items = append(items, map[string]string{"k": fmt.Sprintf("item%d", len(items)), "v": hex.EncodeToString(buf)})
+	}
+	doc["items"] = items
+	b, _ := json.Marshal(doc)
+	return string(b)
+}
@@ -0,0 +1,184 @@
+#!/bin/bash
+
+# Test script to measure how long Postgres keeps the locks of a client which
+# vanished without closing its connection (packets dropped, as after a host
+# crash or network partition), for several server-side tcp_keepalives_*
+# settings.
+
+set -e
+
+NETWORK_NAME="pg_test_network"
+SERVER_CONTAINER="pg_server"
+CLIENT_CONTAINER="pg_client"
+POSTGRES_DB="testdb"
+POSTGRES_USER="postgres"
+POSTGRES_PASSWORD="test"
+MAX_WAIT=45  # seconds to wait for the server to release the lock
+
+# idle interval count; 0 keeps the OS default (Linux: 7200s, 75s, 9)
+CONFIGS=(
+    "0 0 0"
+    "10 5 3"
+    "5 2 3"
+    "2 1 2"
+)
+
+echo "======================================"
+echo "Postgres tcp_keepalives Sweep"
+echo "Time until a vanished client's lock is released"
+echo "======================================"
+
+# Cleanup function
+cleanup() {
+    echo ""
+    echo "Cleaning up..."
+    docker stop $CLIENT_CONTAINER $SERVER_CONTAINER 2>/dev/null || true
+    docker rm $CLIENT_CONTAINER $SERVER_CONTAINER 2>/dev/null || true
+    docker network rm $NETWORK_NAME 2>/dev/null || true
+}
+
+trap cleanup EXIT
+
+psql_server() {
+    docker exec $SERVER_CONTAINER psql -U $POSTGRES_USER -d $POSTGRES_DB "$@"
+}
+
+# Create network
+echo "Creating Docker network..."
+docker network create $NETWORK_NAME > /dev/null
+
+# Start Postgres server (with NET_ADMIN capability for iptables)
+echo "Starting Postgres server..."
+docker run -d --name $SERVER_CONTAINER \
+    --network $NETWORK_NAME \
+    --cap-add=NET_ADMIN \
+    -e POSTGRES_PASSWORD=$POSTGRES_PASSWORD \
+    -e POSTGRES_DB=$POSTGRES_DB \
+    postgres:latest > /dev/null
+
+# Wait for Postgres
+echo "Waiting for Postgres..."
+for i in {1..30}; do
+    if docker exec $SERVER_CONTAINER pg_isready -U $POSTGRES_USER -d $POSTGRES_DB > /dev/null 2>&1; then
+        echo "Postgres ready!"
+        break
+    fi
+    [ $i -eq 30 ] && echo "ERROR: Postgres failed to start" && exit 1
+    sleep 1
+done
+
+sleep 3
+
+echo "Installing iptables and iproute2 in server container..."
+docker exec $SERVER_CONTAINER bash -c "
+    apt-get update -qq > /dev/null 2>&1
+    apt-get install -y iptables iproute2 -qq > /dev/null 2>&1
+"
+
+echo "Creating test table..."
+psql_server -c "
+    CREATE TABLE test_table (id INT PRIMARY KEY, value TEXT);
+    INSERT INTO test_table VALUES (1, 'initial value');
+" > /dev/null
+
+echo "Starting client container..."
+docker run -d --name $CLIENT_CONTAINER --network $NETWORK_NAME postgres:latest sleep infinity > /dev/null
+sleep 2
+
+SERVER_IP=$(docker inspect -f '{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}' $SERVER_CONTAINER)
+CLIENT_IP=$(docker inspect -f '{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}' $CLIENT_CONTAINER)
+echo "Server IP: $SERVER_IP"
+echo "Client IP: $CLIENT_IP"
+
+RESULTS=()
+for config in "${CONFIGS[@]}"; do
+    read -r IDLE INTERVAL COUNT <<< "$config"
+    echo ""
+    echo "=== tcp_keepalives idle=$IDLE interval=$INTERVAL count=$COUNT ==="
+    psql_server -c "ALTER SYSTEM SET tcp_keepalives_idle = $IDLE;" > /dev/null
+    psql_server -c "ALTER SYSTEM SET tcp_keepalives_interval = $INTERVAL;" > /dev/null
+    psql_server -c "ALTER SYSTEM SET tcp_keepalives_count = $COUNT;" > /dev/null
+    psql_server -c "SELECT pg_reload_conf();" > /dev/null
+
+    # Take the row lock and stay idle in transaction
+    docker exec -d $CLIENT_CONTAINER bash -c "
+export PGPASSWORD='$POSTGRES_PASSWORD'
+(
+    echo 'BEGIN;'
+    echo \"UPDATE test_table SET value = 'locked by client' WHERE id = 1;\"
+    sleep 600
+) | psql -h $SERVER_IP -U $POSTGRES_USER -d $POSTGRES_DB > /dev/null 2>&1
+"
+
+    BACKEND_PID=""
+    for i in {1..20}; do
+        BACKEND_PID=$(psql_server -t -c "
+            SELECT pid FROM pg_stat_activity
+            WHERE client_addr = '$CLIENT_IP' AND state = 'idle in transaction'
+            LIMIT 1;
+        " | tr -d ' ')
+        [ -n "$BACKEND_PID" ] && break
+        sleep 0.5
+    done
+    if [ -z "$BACKEND_PID" ]; then
+        echo "ERROR: client transaction not found"
+        exit 1
+    fi
+    echo "Client's backend PID on server: $BACKEND_PID"
+    echo "Server socket: $(docker exec $SERVER_CONTAINER ss -tno dst $CLIENT_IP | tail -n +2 | tr -s ' ')"
+
+    echo "Dropping all packets between client and server..."
+    docker exec $SERVER_CONTAINER bash -c "
+        iptables -A INPUT -s $CLIENT_IP -j DROP
+        iptables -A OUTPUT -d $CLIENT_IP -j DROP
+    "
+    START_TIME=$(date +%s)
+
+    RELEASED=""
+    while [ $(( $(date +%s) - START_TIME )) -lt $MAX_WAIT ]; do
+        EXISTS=$(psql_server -t -c "SELECT count(*) FROM pg_stat_activity WHERE pid = $BACKEND_PID;" | tr -d ' ')
+        if [ "$EXISTS" -eq 0 ]; then
+            RELEASED=$(( $(date +%s) - START_TIME ))
+            break
+        fi
+        sleep 1
+    done
+
+    if [ -n "$RELEASED" ]; then
+        echo "✓ Backend exited and released the lock after ~${RELEASED}s"
+    else
+        echo "✗ Backend still holds the lock after ${MAX_WAIT}s"
+        echo "   Server socket: $(docker exec $SERVER_CONTAINER ss -tno dst $CLIENT_IP | tail -n +2 | tr -s ' ')"
+        psql_server -c "SELECT pg_terminate_backend($BACKEND_PID);" > /dev/null
+        RELEASED=">${MAX_WAIT}"
+    fi
+
+    if [ "$IDLE" -eq 0 ]; then
+        EXPECTED="7875 (OS default)"
+    else
+        EXPECTED=$(( IDLE + INTERVAL * COUNT ))
+    fi
+    RESULTS+=("$(printf '%-6s %-10s %-7s %-18s %s' "$IDLE" "$INTERVAL" "$COUNT" "$EXPECTED" "$RELEASED")")
+
+    # Restore connectivity; the abandoned psql learns of the closed session
+    # from the server's retransmitted FIN
+    docker exec $SERVER_CONTAINER bash -c "
+        iptables -D INPUT -s $CLIENT_IP -j DROP
+        iptables -D OUTPUT -d $CLIENT_IP -j DROP
+    "
+    sleep 1
+done
+
+echo ""
+echo "======================================"
+echo "Summary (seconds):"
+printf '%-6s %-10s %-7s %-18s %s\n' "idle" "interval" "count" "expected" "lock released"
+for row in "${RESULTS[@]}"; do
+    echo "$row"
+done
+echo ""
+echo "Key finding: a client which vanishes without a FIN or RST keeps its"
+echo "locks until the server's keepalive probes give up, after roughly"
+echo "idle + interval * count seconds. With the OS defaults that is over"
+echo "two hours; idle_in_transaction_session_timeout bounds it regardless."
+echo "======================================"